@@ -1,11 +1,15 @@
 package main
 
 import (
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/Althaf66/cryptoXchange/internal/rediscfg"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
 	"github.com/Althaf66/cryptoXchange/internal/ws"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 )
 
@@ -13,14 +17,20 @@ func main() {
 	r := mux.NewRouter()
 
 	v1 := r.PathPrefix("/v1").Subrouter()
-	v1.HandleFunc("/ws", handleWebSocket)
+	v1.HandleFunc("/ws", ws.HandleWebSocket)
+	// Slow-consumer counters, among the rest of expvar.
+	r.Handle("/debug/vars", expvar.Handler())
 
 	addr := os.Getenv("WS_PORT")
 	if addr == "" {
 		addr = ":3001"
 	}
 
-	ws.SubscriptionManager.Init()
+	bus := transport.NewRedis(redis.NewClient(rediscfg.Options()), "", "")
+	if err := ws.SubscriptionManager.Init(bus); err != nil {
+		log.Fatal("Failed to subscribe to Redis:", err)
+	}
+	ws.SubscriptionManager.WarmCaches()
 	log.Printf("WebSocket endpoint listening on %s/v1/ws", addr)
 	if err := http.ListenAndServe(addr, r); err != nil {
 		log.Fatal("ListenAndServe:", err)
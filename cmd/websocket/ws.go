@@ -1,26 +0,0 @@
-package main
-
-import (
-	"log"
-	"net/http"
-
-	"github.com/Althaf66/cryptoXchange/internal/ws"
-	"github.com/gorilla/websocket"
-)
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow connections from any origin
-	},
-}
-
-// WebSocket handler
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
-		return
-	}
-
-	ws.UserManager.AddUser(conn, r)
-}
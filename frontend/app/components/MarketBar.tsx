@@ -2,21 +2,25 @@
 import { useEffect, useState } from "react";
 import type { Ticker as TickerData } from "../utils/types";
 import { getTicker } from "../utils/httpClient";
+import { SignalingManager } from "../utils/SignalingManager";
 
 export const MarketBar = ({market}: {market: string}) => {
     const [ticker, setTicker] = useState<TickerData | null>(null);
 
-    // Polled, not streamed: nothing publishes a ticker@ channel, and a 24h
-    // rollup does not need sub-second freshness.
+    // Loaded once, then kept current by the engine's ticker.<market> stream,
+    // which it publishes after every trade.
     useEffect(() => {
-        const refresh = () => {
-            getTicker(market)
-                .then(setTicker)
-                .catch((err) => console.error(`Failed to fetch ticker for ${market}:`, err));
+        let cancelled = false;
+        const stream = `ticker.${market}`;
+        const callbackId = `TICKER-${market}`;
+        getTicker(market)
+            .then((t) => { if (!cancelled) setTicker(t); })
+            .catch((err) => console.error(`Failed to fetch ticker for ${market}:`, err));
+        SignalingManager.getInstance().registerCallback(stream, (t: TickerData) => setTicker(t), callbackId);
+        return () => {
+            cancelled = true;
+            SignalingManager.getInstance().deRegisterCallback(stream, callbackId);
         };
-        refresh();
-        const interval = setInterval(refresh, 5000);
-        return () => clearInterval(interval);
     }, [market])
 
     return <div>
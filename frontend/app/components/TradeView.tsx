@@ -6,28 +6,31 @@ import { getKlines } from "../utils/httpClient";
 import { SignalingManager } from "../utils/SignalingManager";
 import { KLine } from "../utils/types";
 
-// The intervals backed by materialized views (klines_1m/1h). Adding another one
-// here without adding its view returns an "invalid interval" error.
-//
-// 1w was removed: sol_prices only retains two days, so that view could never
-// hold a complete bucket and the chart drew it as one candle.
-const INTERVALS = ["1m", "1h"] as const;
+// The intervals the API serves (KlineIntervals in internal/dbase/klines.go).
+// Adding one here without adding its series there returns an "invalid
+// interval" error.
+const INTERVALS = ["1m", "5m", "15m", "1h", "4h", "1d", "1w", "1M"] as const;
 type Interval = (typeof INTERVALS)[number];
 
 // Tooltip text - "1m" alone is ambiguous between minute and month.
 const INTERVAL_LABELS: Record<Interval, string> = {
   "1m": "1 minute",
+  "5m": "5 minutes",
+  "15m": "15 minutes",
   "1h": "1 hour",
+  "4h": "4 hours",
+  "1d": "1 day",
+  "1w": "1 week",
+  "1M": "1 month",
 };
 
-// The materialized views only refresh on a 10s cron, so REST is the slow,
-// authoritative source. Live trades drive the chart between reconciles; this
-// just heals anything missed while the socket was down.
+// REST is the authoritative source: the live candle stream drives the chart
+// between reconciles, and this heals anything missed while the socket was down.
 const RECONCILE_MS = 30_000;
 
 interface Candle {
   timestamp: number; // bucket END, matching the API's `end` field
-  start: number; // bucket START, so the live path can derive the width
+  start: number; // bucket START
   open: number;
   high: number;
   low: number;
@@ -58,7 +61,7 @@ export function TradeView({ market }: { market: string }) {
 
   useEffect(() => {
     let cancelled = false;
-    const stream = `trade@${market}`;
+    const stream = `kline@${chartInterval}.${market}`;
     const callbackId = `KLINE-${market}`;
 
     const reconcile = async () => {
@@ -96,55 +99,33 @@ export function TradeView({ market }: { market: string }) {
       });
     };
 
-    // Fold each executed trade into the candle currently forming.
-    //
-    // Boundaries come from the server's own start/end rather than epoch maths.
-    // time_bucket('1 week') originates on a Monday while Math.floor(ms / WEEK)
-    // originates on a Thursday, so computing weekly buckets here would draw a
-    // live candle beside the real one instead of on top of it.
-    const onTrade = (data: any) => {
-      const price = Number(data?.price);
-      const ts = Number(data?.timestamp);
-      if (!Number.isFinite(price) || !Number.isFinite(ts)) return;
+    // The engine keeps the candle currently forming and streams it after every
+    // trade in it (kline@<interval>.<market>), with its bucket's own start and
+    // end, so nothing here has to work out where a week or a month begins.
+    const onKline = (data: any) => {
+      const candle: Candle = {
+        start: Number(data?.start),
+        timestamp: Number(data?.end),
+        open: Number(data?.open),
+        high: Number(data?.high),
+        low: Number(data?.low),
+        close: Number(data?.close),
+      };
+      if (!Object.values(candle).every(Number.isFinite)) return;
 
       // Nothing to anchor to until the first reconcile lands; it runs on mount,
-      // so this only skips trades arriving during that initial fetch.
+      // so this only skips updates arriving during that initial fetch.
       const prev = lastCandleRef.current;
       if (!prev) return;
 
       // Older than the bar already drawn. The series is append-only.
-      if (ts < prev.start) return;
-
-      let candle: Candle;
-      if (ts < prev.timestamp) {
-        candle = {
-          ...prev,
-          high: Math.max(prev.high, price),
-          low: Math.min(prev.low, price),
-          close: price,
-        };
-      } else {
-        // The bucket rolled over. Advance by whole widths so a gap with no
-        // trades still lands on the server's phase.
-        const width = prev.timestamp - prev.start;
-        if (width <= 0) return;
-        const steps = Math.ceil((ts - prev.timestamp + 1) / width);
-        const start = prev.timestamp + (steps - 1) * width;
-        candle = {
-          start,
-          timestamp: start + width,
-          open: price,
-          high: price,
-          low: price,
-          close: price,
-        };
-      }
+      if (candle.timestamp < prev.timestamp) return;
 
       lastCandleRef.current = candle;
       chartManagerRef.current?.updateCandle(candle);
     };
 
-    SignalingManager.getInstance().registerCallback(stream, onTrade, callbackId);
+    SignalingManager.getInstance().registerCallback(stream, onKline, callbackId);
 
     reconcile();
     const interval = setInterval(reconcile, RECONCILE_MS);
@@ -163,7 +144,7 @@ export function TradeView({ market }: { market: string }) {
     <div className="flex flex-col">
       <div className="flex items-center gap-3 px-3 py-2">
         <span className="text-xs text-slate-500">Interval</span>
-        {/* Segmented control: the three options are always visible and their
+        {/* Segmented control: the options are always visible and their
             widths are equalised, so the group doesn't reflow when the active
             one changes. */}
         <div
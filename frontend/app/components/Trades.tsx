@@ -16,6 +16,19 @@ interface TradeRow {
 // 15-per-side order book. Change both together.
 const MAX_ROWS = 23;
 
+// The REST history and the stream overlap: a new subscriber is sent the last
+// trades the server has seen (internal/ws/cache.go), and the fetch returns
+// many of the same ones. REST ids carry a "<market>-" prefix the stream's do
+// not, so ids are compared without it.
+function merge(market: string, rows: TradeRow[]): TradeRow[] {
+    const byId = new Map<string, TradeRow>();
+    for (const row of rows) {
+        const id = row.id.startsWith(`${market}-`) ? row.id.slice(market.length + 1) : row.id;
+        if (!byId.has(id)) byId.set(id, { ...row, id });
+    }
+    return [...byId.values()].sort((x, y) => y.timestamp - x.timestamp).slice(0, MAX_ROWS);
+}
+
 export function Trades({ market }: { market: string }) {
     const [trades, setTrades] = useState<TradeRow[]>([]);
 
@@ -27,7 +40,7 @@ export function Trades({ market }: { market: string }) {
             stream,
             (data: any) => {
                 setTrades((prev) =>
-                    [
+                    merge(market, [
                         {
                             id: String(data.id),
                             price: data.price,
@@ -36,7 +49,7 @@ export function Trades({ market }: { market: string }) {
                             timestamp: data.timestamp,
                         },
                         ...prev,
-                    ].slice(0, MAX_ROWS)
+                    ])
                 );
             },
             callbackId
@@ -44,15 +57,18 @@ export function Trades({ market }: { market: string }) {
 
         getTrades(market)
             .then((history) =>
-                setTrades(
-                    history.slice(0, MAX_ROWS).map((t: any) => ({
-                        id: String(t.id),
-                        price: String(t.price),
-                        quantity: String(t.volume ?? t.quantity),
-                        isBuyerMaker: t.is_buyer_maker ?? t.isBuyerMaker,
-                        // REST returns an RFC3339 string, the WS stream sends epoch ms.
-                        timestamp: new Date(t.timestamp).getTime(),
-                    }))
+                setTrades((prev) =>
+                    merge(market, [
+                        ...prev,
+                        ...history.map((t: any) => ({
+                            id: String(t.id),
+                            price: String(t.price),
+                            quantity: String(t.volume ?? t.quantity),
+                            isBuyerMaker: t.is_buyer_maker ?? t.isBuyerMaker,
+                            // REST returns an RFC3339 string, the WS stream sends epoch ms.
+                            timestamp: new Date(t.timestamp).getTime(),
+                        })),
+                    ])
                 )
             )
             .catch((err) => console.error(`Failed to fetch trades for ${market}:`, err));
@@ -1,23 +1,33 @@
 "use client";
 
 import { useEffect, useRef, useState } from "react";
-import { getDepth, getTicker, getTrades } from "../../utils/httpClient";
+import { getDepth, getTrades } from "../../utils/httpClient";
 import { SignalingManager } from "../../utils/SignalingManager";
 import { AskTable } from "./AskTable";
 import { BidTable } from "./BidTable";
 
-// Define interfaces for type safety
-interface DepthData {
+// One depth@ message: the levels a command changed, "0" for one that emptied,
+// numbered firstUpdateId..lastUpdateId (internal/engine/depth.go). Or, first
+// thing after subscribing, the whole book as of lastUpdateId, flagged
+// snapshot (internal/ws/cache.go).
+interface DepthDiff {
   bids: [string, string][];
   asks: [string, string][];
+  firstUpdateId: number;
+  lastUpdateId: number;
+  snapshot?: boolean;
 }
 
-interface Ticker {
-  price: string;
-}
+// As many levels a side as the REST snapshot carries. Diffs reach deeper
+// levels too; showing them would make the book grow for as long as the page
+// stays open.
+const LEVELS = 20;
 
-interface Trade {
-  price: string;
+function applyLevels(side: Map<string, string>, levels: [string, string][]) {
+  for (const [price, quantity] of levels) {
+    if (Number(quantity) === 0) side.delete(price);
+    else side.set(price, quantity);
+  }
 }
 
 export function Depth({ market, onPriceClick, refreshKey }: { market: string; onPriceClick?: (price: string) => void; refreshKey?: number }) {
@@ -25,6 +35,7 @@ export function Depth({ market, onPriceClick, refreshKey }: { market: string; on
   const [asks, setAsks] = useState<[string, string][] | undefined>();
   const [price, setPrice] = useState<string | undefined>();
   const asksRef = useRef<HTMLDivElement>(null);
+  const resyncRef = useRef<() => void>();
 
   // Keep the best ask (last row) in view as levels come and go.
   useEffect(() => {
@@ -32,71 +43,95 @@ export function Depth({ market, onPriceClick, refreshKey }: { market: string; on
     if (el) el.scrollTop = el.scrollHeight;
   }, [asks]);
 
+  // The book is a snapshot - the one the server sends on subscribing, or
+  // failing that a REST fetch - plus every diff after it. Diffs that arrive
+  // before the snapshot are buffered; the ones it already includes are
+  // dropped; and a diff that does not follow on from the last one applied
+  // means one went missing - over a reconnect, say - so the book is fetched
+  // again rather than left quietly wrong.
   useEffect(() => {
-    console.log(`Depth component mounted for market: ${market}`);
+    let cancelled = false;
+    let fetching = false;
+    const book = {
+      bids: new Map<string, string>(),
+      asks: new Map<string, string>(),
+      lastUpdateId: -1, // not synced yet
+    };
+    let buffer: DepthDiff[] = [];
+
+    const render = () => {
+      setBids(
+        [...book.bids.entries()].sort((x, y) => Number(y[0]) - Number(x[0])).slice(0, LEVELS)
+      );
+      // Ascending, best (lowest) ask first, the same order as the REST fetch.
+      setAsks(
+        [...book.asks.entries()].sort((x, y) => Number(x[0]) - Number(y[0])).slice(0, LEVELS)
+      );
+    };
+
+    const load = (bids: [string, string][], asks: [string, string][], lastUpdateId: number) => {
+      book.bids = new Map(bids);
+      book.asks = new Map(asks);
+      book.lastUpdateId = lastUpdateId;
+      const pending = buffer;
+      buffer = [];
+      pending.forEach(apply);
+      render();
+    };
+
+    const apply = (diff: DepthDiff) => {
+      if (diff.snapshot) {
+        load(diff.bids ?? [], diff.asks ?? [], Number(diff.lastUpdateId));
+        return;
+      }
+      if (book.lastUpdateId < 0) {
+        buffer.push(diff);
+        return;
+      }
+      if (diff.lastUpdateId <= book.lastUpdateId) return;
+      if (diff.firstUpdateId > book.lastUpdateId + 1) {
+        buffer = [diff];
+        resync();
+        return;
+      }
+      applyLevels(book.bids, diff.bids);
+      applyLevels(book.asks, diff.asks);
+      book.lastUpdateId = diff.lastUpdateId;
+    };
+
+    const resync = () => {
+      book.lastUpdateId = -1;
+      if (fetching) return;
+      fetching = true;
+      getDepth(market)
+        .then((d) => {
+          fetching = false;
+          if (cancelled) return;
+          // The server's snapshot got here first, and the diffs since.
+          if (book.lastUpdateId >= Number(d.lastUpdateId)) return;
+          load(d.bids, d.asks, Number(d.lastUpdateId));
+        })
+        .catch((err) => {
+          fetching = false;
+          console.error(`Failed to fetch depth for ${market}:`, err);
+          if (!cancelled) setTimeout(resync, 2000);
+        });
+    };
+    resyncRef.current = resync;
 
     const stream = `depth@${market}`;
     const callbackId = `DEPTH-${market}`;
-
-    // Register callback for depth updates
+    // Registered before the fetch, so nothing between the snapshot and the
+    // first diff can fall in the gap.
     SignalingManager.getInstance().registerCallback(
       stream,
-      (data: DepthData) => {
-
-        // Update bids
-        setBids((originalBids = []) => {
-          // Keep only bids that are in the new data or have non-zero quantity
-          const bidsAfterUpdate = originalBids.filter((bid) =>
-            data.bids.some((newBid) => newBid[0] === bid[0] && Number(newBid[1]) !== 0)
-          );
-
-          // Update quantities and add new bids
-          for (const newBid of data.bids) {
-            if (Number(newBid[1]) !== 0) {
-              const existingIndex = bidsAfterUpdate.findIndex((bid) => bid[0] === newBid[0]);
-              if (existingIndex >= 0) {
-                bidsAfterUpdate[existingIndex][1] = newBid[1];
-              } else {
-                bidsAfterUpdate.push(newBid);
-              }
-            }
-          }
-
-            // Descending, best (highest) bid first.
-          const sortedBids = bidsAfterUpdate.sort((x, y) => Number(y[0]) - Number(x[0]));
-          return sortedBids;
-        });
-
-        // Update asks
-        setAsks((originalAsks = []) => {
-          // Keep only asks that are in the new data or have non-zero quantity
-          const asksAfterUpdate = originalAsks.filter((ask) =>
-            data.asks.some((newAsk) => newAsk[0] === ask[0] && Number(newAsk[1]) !== 0)
-          );
-
-          // Update quantities and add new asks
-          for (const newAsk of data.asks) {
-            if (Number(newAsk[1]) !== 0) {
-              const existingIndex = asksAfterUpdate.findIndex((ask) => ask[0] === newAsk[0]);
-              if (existingIndex >= 0) {
-                asksAfterUpdate[existingIndex][1] = newAsk[1];
-              } else {
-                asksAfterUpdate.push(newAsk);
-              }
-            }
-          }
-
-            // Ascending, best (lowest) ask first - same order the REST fetch
-            // returns, so the book doesn't reorder itself on the first trade.
-            asksAfterUpdate.sort((x, y) => Number(x[0]) - Number(y[0]));
-            return asksAfterUpdate;
-        });
+      (diff: DepthDiff) => {
+        apply(diff);
+        if (book.lastUpdateId >= 0) render();
       },
       callbackId
     );
-
-    // SignalingManager subscribes on the first registered callback and replays
-    // subscriptions on reconnect. This used to re-send SUBSCRIBE 20x a second.
+    resync();
 
     // The last traded price only moves when a trade happens, and depth@ never
     // carries it. Without this the number between the two sides of the book
@@ -117,28 +152,20 @@ export function Depth({ market, onPriceClick, refreshKey }: { market: string; on
       })
       .catch((err) => console.error(`Failed to fetch trades for ${market}:`, err));
 
-    // Cleanup on unmount
     return () => {
+      cancelled = true;
+      resyncRef.current = undefined;
       SignalingManager.getInstance().deRegisterCallback(stream, callbackId);
       SignalingManager.getInstance().deRegisterCallback(tradeStream, tradeCallbackId);
     };
   }, [market]);
 
-  // The book, straight from the engine. Runs on mount and again whenever the
-  // parent bumps refreshKey (a cancel) - the depth stream's incremental updates
-  // can't express a removed level, so the REST snapshot is what repairs it.
-  // Kept out of the effect above so a refresh doesn't re-register the
-  // WebSocket callbacks.
+  // The parent bumps refreshKey after a cancel. The diffs carry the removed
+  // level now, so this is belt and braces: a fresh snapshot, fed through the
+  // same sync as a gap.
   useEffect(() => {
-    getDepth(market)
-      .then((d: DepthData) => {
-        // The API already returns bids descending and asks ascending, both
-        // best-first. Keep them that way; the tables handle display order.
-        setBids(d.bids);
-        setAsks(d.asks);
-      })
-      .catch((err) => console.error(`Failed to fetch depth for ${market}:`, err));
-  }, [market, refreshKey]);
+    if (refreshKey) resyncRef.current?.();
+  }, [refreshKey]);
 
 return <div className="flex flex-col flex-1 min-h-0 px-2">
         <TableHeader />
@@ -14,7 +14,8 @@ export default function Page() {
     const { market } = useParams();
     // Lifted so clicking a level in the order book fills the price in SwapUI.
     const [prefillPrice, setPrefillPrice] = useState<string>();
-    // Bumped on cancel so Depth re-fetches the book from the engine.
+    // Bumped on cancel so Depth resyncs from a fresh snapshot; the diffs
+    // already carry the removed level, so this only guards against a missed one.
     const [depthNonce, setDepthNonce] = useState(0);
 
     return <div className="flex flex-col lg:flex-row flex-1 text-white">
@@ -11,6 +11,8 @@ interface DepthData {
   a: [string, string][];
   id: number;
   e: string;
+  firstUpdateId: number;
+  lastUpdateId: number;
 }
 
 interface TradeData {
@@ -23,11 +25,35 @@ interface TradeData {
   market: string;
 }
 
+interface KlineData {
+  e: string;
+  market: string;
+  interval: string;
+  start: number;
+  end: number;
+  open: string;
+  high: string;
+  low: string;
+  close: string;
+  volume: string;
+  trades: number;
+  isClosed: boolean;
+}
+
+// The answer to a SUBSCRIBE, UNSUBSCRIBE or LIST_SUBSCRIPTIONS frame, carrying
+// its id: the streams now held, or why nothing changed.
+interface ResultFrame {
+  id?: number;
+  result: string[] | null;
+  error?: { code: string; msg: string };
+}
+
 interface OutgoingMessage {
   stream: string;
   data?: DepthData | null;
   tickerdata?: Partial<Ticker>;
   tradeData?: TradeData | null;
+  klineData?: KlineData | null;
 }
 
 export class SignalingManager {
@@ -79,14 +105,34 @@ export class SignalingManager {
       }
       console.log("WebSocket message received:", message);
 
+      // Replies to our own requests carry no stream. A refused SUBSCRIBE
+      // would otherwise leave a component waiting on data that never comes
+      // with nothing in the console to say why.
+      if (!("stream" in message)) {
+        const reply = message as unknown as ResultFrame;
+        if (reply.error) {
+          console.error(`WebSocket request ${reply.id} refused: ${reply.error.code} ${reply.error.msg}`);
+        }
+        return;
+      }
+
       const stream = message.stream;
 
       // Trades arrive under `tradeData` with `data` null, so they can't be
-      // routed by data.e like depth and ticker are.
+      // routed by data.e like depth is.
       if (message.tradeData && this.callbacks[stream]) {
         this.callbacks[stream].forEach(({ callback }) => callback(message.tradeData));
         return;
       }
+      // Candles likewise, under `klineData`, and tickers under `tickerdata`.
+      if (message.klineData && this.callbacks[stream]) {
+        this.callbacks[stream].forEach(({ callback }) => callback(message.klineData));
+        return;
+      }
+      if (message.tickerdata && this.callbacks[stream]) {
+        this.callbacks[stream].forEach(({ callback }) => callback(message.tickerdata));
+        return;
+      }
 
       const type = message.data?.e || "";
       console.log("Message type:", type);
@@ -94,19 +140,14 @@ export class SignalingManager {
       if (type === "depth" && this.callbacks[stream]) {
         console.log("Depth update received for stream:", stream);
         this.callbacks[stream].forEach(({ callback }) => {
-          callback({ bids: message.data?.b, asks: message.data?.a });
+          callback({
+            bids: message.data?.b,
+            asks: message.data?.a,
+            firstUpdateId: message.data?.firstUpdateId,
+            lastUpdateId: message.data?.lastUpdateId,
+            snapshot: message.data?.snapshot === true,
+          });
         });
-      } else if (type === "ticker" && this.callbacks[stream]) {
-        console.log("Ticker update received for stream:", stream);
-        const newTicker: Partial<Ticker> = {
-          lastPrice: message.tickerdata?.lastPrice,
-          high: message.tickerdata?.high,
-          low: message.tickerdata?.low,
-          volume: message.tickerdata?.volume,
-          quoteVolume: message.tickerdata?.quoteVolume,
-          symbol: message.tickerdata?.symbol,
-        };
-        this.callbacks[stream].forEach(({ callback }) => callback(newTicker));
       }
     };
 
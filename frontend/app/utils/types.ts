@@ -22,7 +22,7 @@ export interface Trade {
 export interface Depth {
     bids: [string, string][],
     asks: [string, string][],
-    lastUpdateId: string
+    lastUpdateId: number
 }
 
 export interface UserBalance {
@@ -2,12 +2,17 @@ module github.com/Althaf66/cryptoXchange
 
 go 1.24.0
 
-require github.com/go-playground/validator/v10 v10.26.0
+require (
+	github.com/go-playground/validator/v10 v10.26.0
+	github.com/klauspost/compress v1.18.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/felixge/httpsnoop v1.0.3 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 )
 
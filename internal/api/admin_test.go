@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+var adminRoutes = []struct{ method, path string }{
+	{"GET", "/v1/admin/reconcile"},
+	{"GET", "/v1/admin/engine"},
+	{"GET", "/v1/admin/deadletters"},
+	{"GET", "/v1/admin/deadletters/db_processor"},
+	{"POST", "/v1/admin/deadletters/db_processor/1-0/replay"},
+	{"DELETE", "/v1/admin/deadletters/db_processor/1-0"},
+}
+
+func adminTestApp() *application {
+	app := &application{
+		logger:        zap.NewNop().Sugar(),
+		authenticator: auth.NewJWTAuthenticator("secret", "cryptoXchange", "cryptoXchange"),
+	}
+	app.config.auth.adminToken = "admin-secret"
+	return app
+}
+
+// Replaying a dead letter re-runs a trade or a deposit. None of the admin
+// routes may be reachable without the admin token, and a user's JWT - which
+// anyone can sign up for - is not it.
+func TestAdminRoutesNeedTheAdminToken(t *testing.T) {
+	app := adminTestApp()
+	userToken, err := app.authenticator.GenerateToken(jwt.MapClaims{
+		"sub": 1, "aud": "cryptoXchange", "iss": "cryptoXchange",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.authenticator.ValidateToken(userToken); err != nil {
+		t.Fatalf("test JWT does not validate: %v", err)
+	}
+
+	mux := app.mount()
+	for _, route := range adminRoutes {
+		for header, want := range map[string]int{
+			"":                    http.StatusUnauthorized,
+			"Bearer " + userToken: http.StatusForbidden,
+		} {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("%s %s with %q = %d, want %d", route.method, route.path, header, rec.Code, want)
+			}
+		}
+	}
+}
+
+func TestAdminTokenMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for _, tc := range []struct {
+		configured, header string
+		want               int
+	}{
+		{"admin-secret", "Bearer admin-secret", http.StatusNoContent},
+		{"admin-secret", "Bearer admin-secreT", http.StatusForbidden},
+		{"admin-secret", "admin-secret", http.StatusUnauthorized},
+		// Unset, not an empty password.
+		{"", "Bearer ", http.StatusUnauthorized},
+		{"", "Bearer anything", http.StatusForbidden},
+	} {
+		app := adminTestApp()
+		app.config.auth.adminToken = tc.configured
+		req := httptest.NewRequest("GET", "/v1/admin/engine", nil)
+		req.Header.Set("Authorization", tc.header)
+		rec := httptest.NewRecorder()
+		app.AdminTokenMiddleware(ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("ADMIN_TOKEN %q, header %q = %d, want %d", tc.configured, tc.header, rec.Code, tc.want)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package api
 
 import (
 	"context"
@@ -33,12 +33,14 @@ type config struct {
 }
 
 type dbConfig struct {
-	addr     string
-	RedisURL string
+	addr string
 }
 
 type authConfig struct {
 	token tokenConfig
+	// adminToken is what the /admin routes take instead of a user's JWT
+	// (AdminTokenMiddleware). Empty closes them.
+	adminToken string
 }
 
 type tokenConfig struct {
@@ -78,13 +80,24 @@ func (app *application) mount() http.Handler {
 
 	// Demo mode: balances are readable without a token so the UI can show them
 	// for the selected demo user. Signup/login still work and /users stays authed.
-	// Order and deposit history follow the same rule for the same reason.
+	// Order, fill and deposit history follow the same rule for the same reason.
 	v1.HandleFunc("/balance/{userId}", app.balanceHandler).Methods("GET")
+	v1.HandleFunc("/fills", app.fillsHandler).Methods("GET")
 	v1.HandleFunc("/transfers", app.transferHistoryHandler).Methods("GET")
 
-	// Operational check, not a user-facing route: compares the ledger against
-	// what the engine holds in memory.
-	v1.HandleFunc("/admin/reconcile", app.reconcileHandler).Methods("GET")
+	// Operational checks, not user-facing routes: the ledger against what the
+	// engine holds in memory, how far behind the engine is, and the messages
+	// the engine and the db processor gave up on. Replaying or discarding a
+	// dead letter moves money, and the listings show other users' orders, so
+	// all of it needs the admin token.
+	adminSubrouter := v1.PathPrefix("/admin").Subrouter()
+	adminSubrouter.Use(app.AdminTokenMiddleware)
+	adminSubrouter.HandleFunc("/reconcile", app.reconcileHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/engine", app.engineStatsHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/deadletters", app.deadLetterCountsHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/deadletters/{queue}", app.deadLettersHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/deadletters/{queue}/{id}/replay", app.replayDeadLetterHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/deadletters/{queue}/{id}", app.discardDeadLetterHandler).Methods("DELETE")
 
 	// Demo accounts, created and funded from the home page. Registered before
 	// the /users/{userID} subrouter below so "virtual" is never taken for a id.
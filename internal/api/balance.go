@@ -1,4 +1,4 @@
-package main
+package api
 
 import (
 	"math"
@@ -56,7 +56,7 @@ func (app *application) balanceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: GET_BALANCE,
 		Data: GetBalanceData{UserID: userId},
 	})
@@ -122,7 +122,7 @@ func (app *application) onRampHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: ON_RAMP,
 		Data: req,
 	})
@@ -147,7 +147,7 @@ func (app *application) onRampHandler(w http.ResponseWriter, r *http.Request) {
 // writeCurrentBalance answers a replayed deposit with the balance as it stands,
 // so a retrying client sees the same shape of response as the original call.
 func (app *application) writeCurrentBalance(w http.ResponseWriter, r *http.Request, userID string) {
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: GET_BALANCE,
 		Data: GetBalanceData{UserID: userID},
 	})
@@ -234,7 +234,7 @@ func (app *application) reconcileHandler(w http.ResponseWriter, r *http.Request)
 // engineBalanceTotals asks the engine for a user's balances and folds each
 // asset down to Available+Locked, which is what a ledger sum represents.
 func (app *application) engineBalanceTotals(r *http.Request, userID string) (map[string]float64, error) {
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: GET_BALANCE,
 		Data: GetBalanceData{UserID: userID},
 	})
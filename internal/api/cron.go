@@ -1,52 +1,96 @@
-package main
+package api
 
 import (
 	"database/sql"
 	"fmt"
 	"log"
 	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
 )
 
 // retention is how much history the demo keeps. The market maker prints ~20
 // trades a minute, so without this the tables grow forever.
 const retention = "2 days"
 
+// startCronJob copies closed candles into the durable history and prunes old
+// rows, hourly. The candle views used to be refreshed here as well; they are
+// continuous aggregates now, which Timescale refreshes itself (see
+// dbase.initKlineViews).
 func startCronJob(db *sql.DB) {
-	// These refresh without CONCURRENTLY (which would need a unique index on
-	// each view), so each one takes an ACCESS EXCLUSIVE lock and blocks every
-	// concurrent /klines read. At 10s that was three stalls per 10s window.
-	views := time.NewTicker(60 * time.Second)
-	defer views.Stop()
-	// Hourly is plenty for a two-day window, and keeps the delete off the 10s path.
+	// Hourly is plenty for a two-day window.
 	prune := time.NewTicker(time.Hour)
 	defer prune.Stop()
 
-	pruneOldData(db)
-
 	for {
-		select {
-		case <-views.C:
-			refreshMaterializedViews(db)
-		case <-prune.C:
-			pruneOldData(db)
+		if err := rollupKlines(db); err != nil {
+			log.Printf("Error rolling up candles: %v", err)
+		}
+		pruneOldData(db)
+		<-prune.C
+	}
+}
+
+// rollupKlines copies every closed bucket of the hourly and daily views into
+// their history tables (dbase.KlineHistories), which nothing prunes.
+//
+// Buckets starting inside the retention window are copied again each run and
+// overwrite what is there: a trade the db processor wrote late still reaches
+// the candle. Their trades are all still in sol_prices, so the view's figures
+// are whole. Older buckets are only copied if they are past the table's last
+// one, which fills the table from the views on the first run, and catches up
+// after the cron was down longer than the window; the view's materialized
+// copy is all there is of those, so they are never overwritten.
+func rollupKlines(db *sql.DB) error {
+	for _, h := range dbase.KlineHistories {
+		_, err := db.Exec(fmt.Sprintf(`
+			INSERT INTO %[1]s (bucket, market, open, high, low, close, volume)
+			SELECT v.bucket, v.market, v.open, v.high, v.low, v.close, v.volume
+			FROM %[2]s v
+			WHERE v.bucket + INTERVAL '%[3]d seconds' <= now()
+				AND (v.bucket >= now() - $1::interval
+					OR v.bucket > COALESCE(
+						(SELECT max(h.bucket) FROM %[1]s h WHERE h.market = v.market), '-infinity'))
+			ON CONFLICT (market, bucket) DO UPDATE SET
+				open = EXCLUDED.open,
+				high = EXCLUDED.high,
+				low = EXCLUDED.low,
+				close = EXCLUDED.close,
+				volume = EXCLUDED.volume`, h.Table, h.View, int(h.Bucket.Seconds())), retention)
+		if err != nil {
+			return fmt.Errorf("%s: %v", h.Table, err)
 		}
 	}
+	return nil
 }
 
 // pruneOldData drops demo history older than the retention window.
 //
 // sol_prices is not handled here: it is a hypertable with a native retention
 // policy (see dbase.InitializeKlineDB), which Timescale's own background worker
-// enforces by dropping whole chunks.
+// enforces by dropping whole chunks. Nor are the candle history tables, which
+// are kept for good (see rollupKlines).
 func pruneOldData(db *sql.DB) {
 	if _, err := db.Exec(
 		`DELETE FROM orders WHERE created_at < now() - $1::interval`, retention); err != nil {
 		log.Printf("Error pruning orders: %v", err)
 	}
 
+	if _, err := db.Exec(
+		`DELETE FROM trades WHERE executed_at < now() - $1::interval`, retention); err != nil {
+		log.Printf("Error pruning trades: %v", err)
+	}
+
 	if err := compactLedger(db); err != nil {
 		log.Printf("Error compacting ledger: %v", err)
 	}
+
+	// An event only comes back while its message is still on the queue or
+	// in a leader's unfinished command, which is minutes, not days.
+	if _, err := db.Exec(
+		`DELETE FROM processed_events WHERE processed_at < now() - $1::interval`, retention); err != nil {
+		log.Printf("Error pruning processed events: %v", err)
+	}
 }
 
 // compactLedger folds expiring ledger rows into one carry-forward row per
@@ -98,22 +142,3 @@ func compactLedger(db *sql.DB) error {
 
 	return tx.Commit()
 }
-
-func refreshMaterializedViews(db *sql.DB) {
-	// klines_1w is deliberately absent: sol_prices keeps two days (see the
-	// retention policy in dbase.InitializeKlineDB), so a one-week bucket can
-	// never be complete. Refreshing it only bought a lock and a wrong candle.
-	views := []string{
-		"klines_1m",
-		"klines_1h",
-	}
-
-	for _, view := range views {
-		query := fmt.Sprintf("REFRESH MATERIALIZED VIEW %s", view)
-		if _, err := db.Exec(query); err != nil {
-			log.Printf("Error refreshing view %s: %v", view, err)
-		}
-	}
-
-	// log.Println("Materialized views refreshed successfully")
-}
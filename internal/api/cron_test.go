@@ -1,4 +1,4 @@
-package main
+package api
 
 import (
 	"database/sql"
@@ -175,6 +175,50 @@ func TestCompactLedgerNeverFoldsSeedRows(t *testing.T) {
 	}
 }
 
+// Closed candles land in the history table; the open one does not, and a
+// second run rewrites rather than duplicates. Needs a real TimescaleDB.
+func TestRollupKlinesCopiesClosedBuckets(t *testing.T) {
+	db := testDB(t)
+	if err := dbase.InitializeKlineDB(db); err != nil {
+		t.Fatalf("init kline tables: %v", err)
+	}
+
+	const market = "TEST_ROLLUP"
+	cleanup := func() {
+		db.Exec(`DELETE FROM sol_prices WHERE market = $1`, market)
+		for _, h := range dbase.KlineHistories {
+			db.Exec(`DELETE FROM `+h.Table+` WHERE market = $1`, market)
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	// One statement, so both old trades share a now() and an hour.
+	if _, err := db.Exec(`
+		INSERT INTO sol_prices (id, time, price, volume, market) VALUES
+			('rollup-0', now() - INTERVAL '3 hours', 100, 1, $1),
+			('rollup-1', now() - INTERVAL '3 hours', 101, 1, $1),
+			('rollup-2', now(), 102, 1, $1)`, market); err != nil {
+		t.Fatalf("insert trades: %v", err)
+	}
+
+	for round := 1; round <= 2; round++ {
+		if err := rollupKlines(db); err != nil {
+			t.Fatalf("round %d rollup: %v", round, err)
+		}
+	}
+
+	var hours int
+	var volume float64
+	if err := db.QueryRow(`SELECT count(*), COALESCE(sum(volume), 0) FROM kline_history_1h WHERE market = $1`,
+		market).Scan(&hours, &volume); err != nil {
+		t.Fatalf("count history: %v", err)
+	}
+	if hours != 1 || volume != 2 {
+		t.Errorf("history has %d hours with volume %v, want the closed hour alone with 2", hours, volume)
+	}
+}
+
 func sameBalances(got, want map[string]float64) bool {
 	if len(got) != len(want) {
 		return false
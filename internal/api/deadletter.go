@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/gorilla/mux"
+)
+
+// deadLetterQueues are the queues whose consumers dead-letter: the db
+// processor's, and the engine's command queues.
+func deadLetterQueues() []string {
+	queues := append(transport.DbPartitions(), markets.AccountQueue)
+	for _, ticker := range markets.Symbols() {
+		queues = append(queues, markets.CommandQueue(ticker))
+	}
+	return queues
+}
+
+// deadLetterQueue reads {queue} from the path. Only the known queues are
+// accepted, so these routes cannot be pointed at arbitrary keys.
+func deadLetterQueue(r *http.Request) (string, bool) {
+	queue := mux.Vars(r)["queue"]
+	for _, known := range deadLetterQueues() {
+		if queue == known {
+			return queue, true
+		}
+	}
+	return "", false
+}
+
+// deadLetterCountsHandler counts the dead letters on every queue, which is
+// the number to watch: anything above zero is a message nobody has written.
+func (app *application) deadLetterCountsHandler(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{}
+	for _, queue := range deadLetterQueues() {
+		letters, err := engineClient.bus.DeadLetters(r.Context(), queue)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+		counts[queue] = len(letters)
+	}
+	WriteJSON(w, http.StatusOK, counts)
+}
+
+func (app *application) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	queue, ok := deadLetterQueue(r)
+	if !ok {
+		app.notFoundResponse(w, r, errors.New("unknown queue"))
+		return
+	}
+	letters, err := engineClient.bus.DeadLetters(r.Context(), queue)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, letters)
+}
+
+// replayDeadLetterHandler pushes a dead letter back onto the end of its
+// queue. Taking it first means two replays of the same letter push it once.
+//
+// ponytail: if the push fails the letter is gone from both places. It is in
+// the response and the log, to be pushed back by hand.
+func (app *application) replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	letter, ok := app.takeDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	if err := engineClient.bus.Push(r.Context(), letter.Queue, []byte(letter.Payload)); err != nil {
+		app.logger.Errorw("replaying dead letter failed, letter dropped", "letter", letter, "error", err)
+		app.internalServerError(w, r, err)
+		return
+	}
+	app.logger.Infow("replayed dead letter", "queue", letter.Queue, "id", letter.ID)
+	WriteJSON(w, http.StatusOK, letter)
+}
+
+func (app *application) discardDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	letter, ok := app.takeDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	app.logger.Infow("discarded dead letter", "letter", letter)
+	WriteJSON(w, http.StatusOK, letter)
+}
+
+// takeDeadLetter removes the letter the path names, or writes the error and
+// reports false.
+func (app *application) takeDeadLetter(w http.ResponseWriter, r *http.Request) (transport.DeadLetter, bool) {
+	queue, ok := deadLetterQueue(r)
+	if !ok {
+		app.notFoundResponse(w, r, errors.New("unknown queue"))
+		return transport.DeadLetter{}, false
+	}
+	letter, ok, err := engineClient.bus.TakeDeadLetter(r.Context(), queue, mux.Vars(r)["id"])
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return transport.DeadLetter{}, false
+	}
+	if !ok {
+		app.notFoundResponse(w, r, errors.New("dead letter not found"))
+		return transport.DeadLetter{}, false
+	}
+	return letter, true
+}
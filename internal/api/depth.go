@@ -1,4 +1,4 @@
-package main
+package api
 
 import (
 	"net/http"
@@ -28,7 +28,7 @@ func (app *application) getDepthHandler(w http.ResponseWriter, r *http.Request)
 		Data: data,
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), message)
+	response, err := engineClient.SendAndAwait(r.Context(), message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const GET_ENGINE_STATS = "GET_ENGINE_STATS"
+
+// engineHeartbeatChannel is where the leading engine publishes its stats
+// every 5s (internal/engine/stats.go). Three beats missed and /health calls
+// the engine down.
+const (
+	engineHeartbeatChannel = "engine:heartbeat"
+	engineHeartbeatTimeout = 15 * time.Second
+)
+
+// engineStatsTimeout is short on purpose: the stats command queues behind
+// every other account command, so when the engine is badly behind - which is
+// when someone looks - waiting the full SendAndAwait timeout would hide the
+// answer behind the problem.
+const engineStatsTimeout = 5 * time.Second
+
+// engineStatsHandler asks the engine for its live stats. If it does not answer
+// in time, it serves the last heartbeat instead, marked stale, with a 503.
+func (app *application) engineStatsHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := engineClient.SendAndAwaitWithTimeout(r.Context(), MessageToEngine{
+		Type: GET_ENGINE_STATS,
+	}, engineStatsTimeout, 1)
+	if err == nil {
+		WriteJSON(w, http.StatusOK, response.Payload)
+		return
+	}
+
+	heartbeat, _ := engineClient.lastHeartbeat()
+	if heartbeat == nil {
+		http.Error(w, "engine did not answer: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"stale":     true,
+		"error":     err.Error(),
+		"heartbeat": heartbeat,
+	})
+}
+
+// engineHeartbeat is the part of the engine's stats /health reports.
+type engineHeartbeat struct {
+	At       time.Time        `json:"at"`
+	Sequence uint64           `json:"sequence"`
+	Queues   map[string]int64 `json:"queues"`
+}
+
+// watchHeartbeat keeps the engine's latest heartbeat until ctx ends.
+func (ec *EngineClient) watchHeartbeat(ctx context.Context) error {
+	sub, err := ec.bus.Subscribe(ctx, engineHeartbeatChannel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					return
+				}
+				ec.mu.Lock()
+				ec.heartbeat, ec.heartbeatSeen = json.RawMessage(msg.Payload), time.Now()
+				ec.mu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// lastHeartbeat returns the engine's latest heartbeat and when it arrived, or
+// nil if none has since this API started.
+func (ec *EngineClient) lastHeartbeat() (json.RawMessage, time.Time) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.heartbeat, ec.heartbeatSeen
+}
+
+// engineHealth summarises the heartbeat for /health.
+func engineHealth() map[string]interface{} {
+	raw, seen := engineClient.lastHeartbeat()
+	if raw == nil || time.Since(seen) > engineHeartbeatTimeout {
+		return map[string]interface{}{"status": "down"}
+	}
+	var beat engineHeartbeat
+	if err := json.Unmarshal(raw, &beat); err != nil {
+		return map[string]interface{}{"status": "unknown", "error": err.Error()}
+	}
+	backlog := int64(0)
+	for _, n := range beat.Queues {
+		backlog += n
+	}
+	return map[string]interface{}{
+		"status":           "up",
+		"lastHeartbeat":    beat.At,
+		"heartbeatAgeSecs": time.Since(seen).Seconds(),
+		"sequence":         beat.Sequence,
+		"queued":           backlog,
+	}
+}
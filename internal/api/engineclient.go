@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/google/uuid"
+)
+
+type MessageToEngine struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type MessageFromOrderbook struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+type QueuedCommand struct {
+	ClientID string          `json:"clientId"`
+	Message  MessageToEngine `json:"message"`
+}
+
+// EngineClient sends commands to the engine and waits for its replies, and
+// keeps the engine's latest heartbeat for /health and each market's latest
+// ticker for /v1/tickers (tickers.go).
+type EngineClient struct {
+	bus transport.Transport
+
+	mu            sync.Mutex
+	heartbeat     json.RawMessage
+	heartbeatSeen time.Time
+	tickers       map[string]json.RawMessage
+}
+
+var engineClient *EngineClient
+
+func NewEngineClient(bus transport.Transport) *EngineClient {
+	return &EngineClient{bus: bus}
+}
+
+// commandQueue picks the engine queue a command goes to. Commands about one
+// market go to that market's queue, where its own engine worker takes them;
+// the rest - and anything naming a market the engine does not list, which it
+// will reject - go to the account queue.
+func commandQueue(message MessageToEngine) string {
+	switch message.Type {
+	case CREATE_ORDER, CANCEL_ORDER, GET_OPEN_ORDERS, GET_DEPTH, GET_TICKER:
+	default:
+		return markets.AccountQueue
+	}
+	dataBytes, _ := json.Marshal(message.Data)
+	var routed struct {
+		Market string `json:"market"`
+	}
+	json.Unmarshal(dataBytes, &routed)
+	if !markets.Listed(routed.Market) {
+		return markets.AccountQueue
+	}
+	return markets.CommandQueue(routed.Market)
+}
+
+// isMutating reports whether re-sending a command could change state twice.
+// The engine works through its queues in order, so a command that timed out
+// has not necessarily been skipped — it may simply be queued.
+// Retrying those places the same order, or credits the same deposit, again.
+func isMutating(msgType string) bool {
+	switch msgType {
+	case CREATE_ORDER, CANCEL_ORDER, ON_RAMP, CREATE_USER:
+		return true
+	}
+	return false
+}
+
+// SendAndAwait sends a message and waits for a response.
+//
+// Reads are retried; writes are not. The engine now replies on every path
+// (including "order not found"), so a missing reply means the engine is gone or
+// wedged — in which case a retry only queues a second copy of the command.
+func (ec *EngineClient) SendAndAwait(ctx context.Context, message MessageToEngine) (*MessageFromOrderbook, error) {
+	retries := 3
+	if isMutating(message.Type) {
+		retries = 1
+	}
+	return ec.SendAndAwaitWithTimeout(ctx, message, 30*time.Second, retries)
+}
+
+// SendAndAwaitWithTimeout provides configurable timeout and retry options
+func (ec *EngineClient) SendAndAwaitWithTimeout(ctx context.Context, message MessageToEngine, timeout time.Duration, maxRetries int) (*MessageFromOrderbook, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying SendAndAwait, attempt %d/%d", attempt+1, maxRetries)
+			// Exponential backoff
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		response, err := ec.sendAndAwaitSingle(ctx, message, timeout)
+		if err == nil {
+			return response, nil
+		}
+
+		lastErr = err
+		log.Printf("SendAndAwait attempt %d failed: %v", attempt+1, err)
+
+		// Don't retry on context cancellation
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// sendAndAwaitSingle performs a single attempt to send and receive
+func (ec *EngineClient) sendAndAwaitSingle(ctx context.Context, message MessageToEngine, timeout time.Duration) (*MessageFromOrderbook, error) {
+	clientID := ec.getRandomClientID()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Subscribe before publishing, so a fast engine cannot answer into the void.
+	sub, err := ec.bus.Subscribe(timeoutCtx, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe for the reply: %w", err)
+	}
+	defer sub.Close()
+
+	msgBytes, err := json.Marshal(QueuedCommand{ClientID: clientID, Message: message})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if err := ec.bus.Push(timeoutCtx, commandQueue(message), msgBytes); err != nil {
+		return nil, fmt.Errorf("failed to send message to the engine: %w", err)
+	}
+
+	// The deadline comes from the context, not from a channel of its own. The
+	// version before that closed a response channel and an error channel in
+	// the same defer, leaving the select with two ready cases: half the time it
+	// read nil from the closed response channel, fell through, and returned a
+	// generic error that defeated the caller's don't-retry-on-cancel check.
+	for {
+		select {
+		case <-timeoutCtx.Done():
+			return nil, fmt.Errorf("awaiting engine reply on %s: %w", clientID, timeoutCtx.Err())
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return nil, fmt.Errorf("awaiting engine reply on %s: subscription closed", clientID)
+			}
+			var response MessageFromOrderbook
+			if err := json.Unmarshal(msg.Payload, &response); err != nil {
+				log.Printf("Discarding unparseable engine reply on %s: %v", clientID, err)
+				continue
+			}
+			return &response, nil
+		}
+	}
+}
+
+// getRandomClientID names the pub/sub channel a single request listens on.
+// It used to keep only the first UUID segment — 32 bits, which collides often
+// enough at load that two concurrent requests would share a channel and each
+// receive the other's reply. Nothing downstream checks that a response matches
+// the command that was sent, so the full UUID is the whole defence.
+func (ec *EngineClient) getRandomClientID() string {
+	return uuid.New().String()
+}
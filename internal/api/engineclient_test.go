@@ -0,0 +1,28 @@
+package api
+
+import "testing"
+
+// A market command on the wrong queue still works - the engine locks by what a
+// command touches - but it waits behind every other market again, which is
+// the whole point of the split.
+func TestCommandQueue(t *testing.T) {
+	cases := []struct {
+		message MessageToEngine
+		want    string
+	}{
+		{MessageToEngine{Type: CREATE_ORDER, Data: CreateOrderData{Market: "BTC_USD"}}, "messages:BTC_USD"},
+		{MessageToEngine{Type: CANCEL_ORDER, Data: CancelOrderData{Market: "SOL_USD"}}, "messages:SOL_USD"},
+		{MessageToEngine{Type: GET_DEPTH, Data: GetDepthData{Market: "ETH_USD"}}, "messages:ETH_USD"},
+		{MessageToEngine{Type: GET_OPEN_ORDERS, Data: GetOpenOrdersData{Market: "DOGE_USD"}}, "messages:DOGE_USD"},
+		{MessageToEngine{Type: GET_TICKER, Data: GetTickerData{Market: "SOL_USD"}}, "messages:SOL_USD"},
+		// Not a listed market: the account queue's worker answers NO_ORDERBOOK
+		// instead of the command sitting on a queue nobody reads.
+		{MessageToEngine{Type: CREATE_ORDER, Data: CreateOrderData{Market: "XRP_USD"}}, "messages"},
+		{MessageToEngine{Type: GET_BALANCE, Data: GetBalanceData{UserID: "1"}}, "messages"},
+	}
+	for _, c := range cases {
+		if got := commandQueue(c.message); got != c.want {
+			t.Errorf("commandQueue(%s %+v) = %q, want %q", c.message.Type, c.message.Data, got, c.want)
+		}
+	}
+}
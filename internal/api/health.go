@@ -0,0 +1,19 @@
+package api
+
+import "net/http"
+
+// healthcheckHandler reports the engine alongside the API but stays 200 while
+// the engine is down: this is the platform's readiness probe for the API, and
+// restarting API containers does nothing for a dead engine.
+func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"env":     app.config.env,
+		"status":  "healthy",
+		"version": "0.0.1",
+		"engine":  engineHealth(),
+	}
+	err := JsonResponse(w, http.StatusOK, data)
+	if err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
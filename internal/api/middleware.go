@@ -1,7 +1,8 @@
-package main
+package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"strings"
@@ -50,6 +51,25 @@ func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// AdminTokenMiddleware lets a request through only if it bears ADMIN_TOKEN.
+// A user's JWT is not enough: anyone can sign up for one. Without an
+// ADMIN_TOKEN configured nothing gets through.
+func (app *application) AdminTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			app.unauthorizedErrorResponse(w, r, fmt.Errorf("authorization header is missing or malformed"))
+			return
+		}
+		admin := app.config.auth.adminToken
+		if admin == "" || subtle.ConstantTimeCompare([]byte(token), []byte(admin)) != 1 {
+			app.forbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) getUser(ctx context.Context, userID string) (*store.User, error) {
 	user, err := app.store.Users.GetByID(ctx, userID)
 	if err != nil {
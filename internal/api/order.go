@@ -1,8 +1,11 @@
-package main
+package api
 
 import (
+	"errors"
 	"log"
 	"net/http"
+
+	"github.com/Althaf66/cryptoXchange/internal/store"
 )
 
 const (
@@ -78,7 +81,7 @@ func (app *application) createOrderHandler(w http.ResponseWriter, r *http.Reques
 		Data: orderData,
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), message)
+	response, err := engineClient.SendAndAwait(r.Context(), message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -99,7 +102,7 @@ func (app *application) cancelOrderHandler(w http.ResponseWriter, r *http.Reques
 		Data: cancelData,
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), message)
+	response, err := engineClient.SendAndAwait(r.Context(), message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -127,6 +130,45 @@ func (app *application) orderHistoryHandler(w http.ResponseWriter, r *http.Reque
 	WriteJSON(w, http.StatusOK, orders)
 }
 
+// fillsHandler lists a user's executions, newest first, from the trades the
+// db processor wrote rather than from the engine, which keeps no history.
+// A page ends with the cursor to pass as before for the next one; next is
+// empty on the last page.
+func (app *application) fillsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID := query.Get("userId")
+	if userID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := parseLimit(r, 50)
+	fills, err := app.store.Fills.ListByUser(store.FillFilter{
+		UserID:  userID,
+		Market:  query.Get("market"),
+		OrderID: query.Get("orderId"),
+		Before:  query.Get("before"),
+		Limit:   limit,
+	})
+	if errors.Is(err, store.ErrBadCursor) {
+		http.Error(w, "before is not a cursor this endpoint returned", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	next := ""
+	if len(fills) == limit {
+		next = fills[len(fills)-1].Cursor()
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"fills": fills,
+		"next":  next,
+	})
+}
+
 func (app *application) getOpenOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("userId")
 	market := r.URL.Query().Get("market")
@@ -144,7 +186,7 @@ func (app *application) getOpenOrdersHandler(w http.ResponseWriter, r *http.Requ
 		Data: data,
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), message)
+	response, err := engineClient.SendAndAwait(r.Context(), message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
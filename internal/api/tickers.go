@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+)
+
+// /v1/tickers used to ask the engine for every market's ticker on each page
+// load. Each ask is a command on that market's shard: journaled, marked
+// applied, and queued behind the market's orders, for what is a public read.
+// The engine publishes a market's ticker on ticker.<market> whenever it
+// trades, so the API keeps the latest of each instead, as the websocket
+// service does (ws/cache.go), and only asks the engine once per market when
+// it starts, for the markets that have not traded since.
+
+// tickerSeedTimeout bounds one startup GET_TICKER; it is retried until one
+// comes back or the market trades.
+const tickerSeedTimeout = 5 * time.Second
+
+func tickerChannel(market string) string { return "ticker." + market }
+
+// watchTickers keeps each listed market's latest published ticker until ctx
+// ends.
+func (ec *EngineClient) watchTickers(ctx context.Context) error {
+	channels := []string{}
+	for _, symbol := range markets.Symbols() {
+		channels = append(channels, tickerChannel(symbol))
+	}
+	sub, err := ec.bus.Subscribe(ctx, channels...)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					return
+				}
+				var message struct {
+					Ticker json.RawMessage `json:"tickerdata"`
+				}
+				if err := json.Unmarshal(msg.Payload, &message); err != nil || message.Ticker == nil {
+					log.Printf("Ignoring unreadable ticker on %s: %v", msg.Channel, err)
+					continue
+				}
+				ec.setTicker(strings.TrimPrefix(msg.Channel, "ticker."), message.Ticker, true)
+			}
+		}
+	}()
+	return nil
+}
+
+// seedTickers asks the engine for the ticker of every market none has been
+// published for yet, all at once, retrying each until it has one.
+func (ec *EngineClient) seedTickers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, symbol := range markets.Symbols() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := 0; ctx.Err() == nil; attempt++ {
+				if attempt > 0 {
+					time.Sleep(min(time.Duration(attempt)*time.Second, 30*time.Second))
+				}
+				if ec.ticker(symbol) != nil {
+					return
+				}
+				response, err := ec.SendAndAwaitWithTimeout(ctx, MessageToEngine{
+					Type: GET_TICKER,
+					Data: GetTickerData{Market: symbol},
+				}, tickerSeedTimeout, 1)
+				if err != nil || response.Type != GET_TICKER {
+					log.Printf("Fetching the %s ticker: %v", symbol, err)
+					continue
+				}
+				payload, err := json.Marshal(response.Payload)
+				if err != nil {
+					continue
+				}
+				// Published while this was out, the newer one stays.
+				ec.setTicker(symbol, payload, false)
+				return
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (ec *EngineClient) setTicker(market string, ticker json.RawMessage, replace bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.tickers == nil {
+		ec.tickers = map[string]json.RawMessage{}
+	}
+	if _, ok := ec.tickers[market]; ok && !replace {
+		return
+	}
+	ec.tickers[market] = ticker
+}
+
+func (ec *EngineClient) ticker(market string) json.RawMessage {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.tickers[market]
+}
+
+// latestTickers is one ticker per listed market, in listing order. A market
+// the API has none for yet gets a zeroed one, as the engine answers for a
+// market that never traded, so it still renders a row.
+func (ec *EngineClient) latestTickers() []json.RawMessage {
+	tickers := []json.RawMessage{}
+	for _, symbol := range markets.Symbols() {
+		ticker := ec.ticker(symbol)
+		if ticker == nil {
+			ticker, _ = json.Marshal(map[string]string{
+				"symbol": symbol, "lastPrice": "0", "high": "0", "low": "0",
+				"volume": "0", "quoteVolume": "0", "priceChange": "0",
+				"priceChangePercent": "0", "trades": "0", "firstPrice": "0",
+			})
+		}
+		tickers = append(tickers, ticker)
+	}
+	return tickers
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// /v1/tickers is a public read: it serves what the engine published and
+// leaves nothing on any command queue for the engine to journal.
+func TestTickersComeFromWhatTheEnginePublished(t *testing.T) {
+	bus := transport.NewMemory()
+	original := engineClient
+	engineClient = NewEngineClient(bus)
+	t.Cleanup(func() { engineClient = original })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := engineClient.watchTickers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	published := `{"symbol":"SOL_USD","lastPrice":"101","trades":"3"}`
+	if err := bus.Publish(ctx, "ticker.SOL_USD", []byte(`{"stream":"ticker.SOL_USD","tickerdata":`+published+`}`)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for engineClient.ticker("SOL_USD") == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	(&application{}).tickersHandler(rec, httptest.NewRequest("GET", "/v1/tickers", nil))
+	var got []map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if len(got) != len(markets.Symbols()) {
+		t.Fatalf("got %d tickers, want one per market", len(got))
+	}
+	for _, ticker := range got {
+		want := "0"
+		if ticker["symbol"] == "SOL_USD" {
+			want = "101"
+		}
+		if ticker["lastPrice"] != want {
+			t.Errorf("%s last price = %q, want %q", ticker["symbol"], ticker["lastPrice"], want)
+		}
+	}
+
+	for _, queue := range append([]string{markets.AccountQueue}, commandQueues()...) {
+		if n, _ := bus.Len(ctx, queue); n != 0 {
+			t.Errorf("%d commands left on %s", n, queue)
+		}
+	}
+}
+
+func commandQueues() []string {
+	queues := []string{}
+	for _, symbol := range markets.Symbols() {
+		queues = append(queues, markets.CommandQueue(symbol))
+	}
+	return queues
+}
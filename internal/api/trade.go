@@ -1,25 +1,53 @@
-package main
+package api
 
 import (
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/Althaf66/cryptoXchange/internal/markets"
-	"github.com/Althaf66/cryptoXchange/internal/store"
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
 	"github.com/gorilla/mux"
 )
 
+// klinesHandler serves /klines/{interval}, one of dbase.KlineIntervals.
+// startTime and endTime are Unix milliseconds, as the trades carry them;
+// limit defaults to 100 and caps at 1000.
 func (app *application) klinesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	interval := vars["interval"]
+	if _, ok := dbase.KlineIntervalByName(interval); !ok {
+		http.Error(w, "invalid interval: "+interval, http.StatusBadRequest)
+		return
+	}
 
-	market := r.URL.Query().Get("market")
+	query := r.URL.Query()
+	market := query.Get("market")
 	if market == "" {
 		market = defaultMarket
 	}
 
-	klines, err := app.store.Trades.GetKlines(interval, market)
+	var bounds [2]time.Time
+	for i, name := range []string{"startTime", "endTime"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms < 0 {
+			http.Error(w, name+" must be Unix milliseconds", http.StatusBadRequest)
+			return
+		}
+		bounds[i] = time.UnixMilli(ms)
+	}
+
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		if parsedLimit, err := strconv.Atoi(l); err == nil && parsedLimit > 0 && parsedLimit <= 1000 {
+			limit = parsedLimit
+		}
+	}
+
+	klines, err := app.store.Trades.GetKlines(interval, market, bounds[0], bounds[1], limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -43,21 +71,17 @@ func (app *application) latestPriceHandler(w http.ResponseWriter, r *http.Reques
 	WriteJSON(w, http.StatusOK, response)
 }
 
-// tickersHandler returns one entry per demo market for the markets page.
-// GetTicker returns a zeroed ticker rather than an error when a market has no
-// trades yet, so an unseeded market still renders a row.
-func (app *application) tickersHandler(w http.ResponseWriter, r *http.Request) {
-	tickers := []*store.Ticker{}
-	for _, symbol := range markets.Symbols() {
-		ticker, err := app.store.Trades.GetTicker(symbol)
-		if err != nil {
-			app.internalServerError(w, r, err)
-			return
-		}
-		tickers = append(tickers, ticker)
-	}
+const GET_TICKER = "GET_TICKER"
 
-	WriteJSON(w, http.StatusOK, tickers)
+type GetTickerData struct {
+	Market string `json:"market"`
+}
+
+// tickersHandler returns one entry per demo market for the markets page: the
+// rolling 24h figures the engine keeps as it trades, as it last streamed them
+// on ticker.<market> (tickers.go). It does not ask the engine anything.
+func (app *application) tickersHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, engineClient.latestTickers())
 }
 
 func (app *application) recentTradesHandler(w http.ResponseWriter, r *http.Request) {
@@ -1,4 +1,4 @@
-package main
+package api
 
 import (
 	"net/http"
@@ -34,7 +34,7 @@ func (app *application) createVirtualUserHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: CREATE_USER,
 		Data: CreateUserData{Name: req.Name, Amount: req.Amount, TxnID: uuid.NewString()},
 	})
@@ -47,7 +47,7 @@ func (app *application) createVirtualUserHandler(w http.ResponseWriter, r *http.
 }
 
 func (app *application) getVirtualUsersHandler(w http.ResponseWriter, r *http.Request) {
-	response, err := redisManager.SendAndAwait(r.Context(), MessageToEngine{
+	response, err := engineClient.SendAndAwait(r.Context(), MessageToEngine{
 		Type: GET_USERS,
 		Data: struct{}{},
 	})
@@ -43,13 +43,19 @@ func InitializeKlineDB(db *sql.DB) error {
 			volume          DOUBLE PRECISION,
 			currency_code   VARCHAR (10),
 			market          VARCHAR (20),
-			is_buyer_maker  BOOLEAN DEFAULT FALSE,
 			PRIMARY KEY (id, time)
 		);`
 	if _, err := db.Exec(createTableQuery); err != nil {
 		return fmt.Errorf("failed to create table: %v", err)
 	}
 
+	// sol_prices is the price series the candles are built from, and nothing
+	// else: who traded and which side took is in the trades table
+	// (InitializeExchangeTables). is_buyer_maker predates it.
+	if _, err := db.Exec(`ALTER TABLE sol_prices DROP COLUMN IF EXISTS is_buyer_maker;`); err != nil {
+		return fmt.Errorf("failed to drop sol_prices.is_buyer_maker: %v", err)
+	}
+
 	// Check if hypertable exists
 	var exists bool
 	checkHypertableQuery := `
@@ -70,60 +76,15 @@ func InitializeKlineDB(db *sql.DB) error {
 
 	// The market maker prints ~20 trades a minute forever, so old chunks have to
 	// go. This is Timescale's own background job - the plain tables are pruned by
-	// the cron in cmd/api/cron.go instead. Consequence worth knowing: the 1w
-	// candle view can never show more than two days.
+	// the cron in internal/api/cron.go instead. The candles outlive it (see
+	// initKlineViews).
 	retentionQuery := `SELECT add_retention_policy('sol_prices', INTERVAL '2 days', if_not_exists => TRUE);`
 	if _, err := db.Exec(retentionQuery); err != nil {
 		return fmt.Errorf("failed to add retention policy: %v", err)
 	}
 
-	// Create materialized views, bucketed per market.
-	//
-	// These are dropped first, not created IF NOT EXISTS: an earlier version
-	// grouped by currency_code, a column the insert path never writes, so every
-	// market collapsed into one NULL-keyed candle series. IF NOT EXISTS would
-	// silently keep that definition on an existing database. Dropping is free -
-	// they are pure aggregates over sol_prices and the cron in cmd/api/cron.go
-	// rebuilds them within 10 seconds.
-	materializedViews := []string{
-		`DROP MATERIALIZED VIEW IF EXISTS klines_1m;
-		CREATE MATERIALIZED VIEW klines_1m AS
-		SELECT
-			time_bucket('1 minute', time) AS bucket,
-			first(price, time) AS open,
-			max(price) AS high,
-			min(price) AS low,
-			last(price, time) AS close,
-			sum(volume) AS volume,
-			market
-		FROM sol_prices
-		GROUP BY bucket, market;`,
-
-		`DROP MATERIALIZED VIEW IF EXISTS klines_1h;
-		CREATE MATERIALIZED VIEW klines_1h AS
-		SELECT
-			time_bucket('1 hour', time) AS bucket,
-			first(price, time) AS open,
-			max(price) AS high,
-			min(price) AS low,
-			last(price, time) AS close,
-			sum(volume) AS volume,
-			market
-		FROM sol_prices
-		GROUP BY bucket, market;`,
-
-		// No klines_1w. sol_prices keeps two days (see the retention policy
-		// above), so a one-week bucket could never be more than a fragment —
-		// the chart rendered it as a single candle covering everything, which
-		// reads as a broken chart rather than a week view. Dropped here so an
-		// existing database loses the stale view too.
-		`DROP MATERIALIZED VIEW IF EXISTS klines_1w;`,
-	}
-
-	for _, query := range materializedViews {
-		if _, err := db.Exec(query); err != nil {
-			return fmt.Errorf("failed to create materialized view: %v", err)
-		}
+	if err := initKlineViews(db); err != nil {
+		return err
 	}
 
 	log.Println("TimescaleDB initialized successfully")
@@ -134,7 +95,7 @@ func InitializeKlineDB(db *sql.DB) error {
 // keep in memory: every order, every movement of value, and every deposit.
 //
 // None of these carry a foreign key to users. Engine user IDs are demo strings
-// ("1", "2", "5") seeded by ensureMarkets in cmd/engine/engine.go and were never
+// ("1", "2", "5") seeded by ensureMarkets in internal/engine/engine.go and were never
 // rows in the users table - adding the FK would reject every seeded order.
 //
 // Money is NUMERIC(38,18) even though the engine works in float64: the durable
@@ -182,6 +143,37 @@ func InitializeExchangeTables(db *sql.DB) error {
 		`CREATE UNIQUE INDEX IF NOT EXISTS ledger_seed_uniq
 			ON ledger (ref_id) WHERE reason = 'seed';`,
 
+		// One row per trade, naming both orders and both users. The key is
+		// sol_prices' - trade ids start again at 1 when the engine is seeded
+		// afresh, so the id alone would silently drop the new engine's trades.
+		// There are no fees yet; the columns are zero until the engine charges
+		// some, so adding them then needs no migration. Pruned with orders
+		// (internal/api/cron.go).
+		`CREATE TABLE IF NOT EXISTS trades (
+			trade_id       TEXT NOT NULL,
+			market         TEXT NOT NULL,
+			price          NUMERIC(38,18) NOT NULL,
+			quantity       NUMERIC(38,18) NOT NULL,
+			quote_quantity NUMERIC(38,18) NOT NULL,
+			maker_order_id TEXT NOT NULL,
+			taker_order_id TEXT NOT NULL,
+			maker_user_id  TEXT NOT NULL,
+			taker_user_id  TEXT NOT NULL,
+			maker_side     TEXT NOT NULL,
+			taker_side     TEXT NOT NULL,
+			maker_fee      NUMERIC(38,18) NOT NULL DEFAULT 0,
+			taker_fee      NUMERIC(38,18) NOT NULL DEFAULT 0,
+			executed_at    TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (trade_id, executed_at)
+		);`,
+		`CREATE INDEX IF NOT EXISTS trades_market_idx ON trades (market, executed_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS trades_maker_user_idx ON trades (maker_user_id, executed_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS trades_taker_user_idx ON trades (taker_user_id, executed_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS trades_maker_order_idx ON trades (maker_order_id);`,
+		`CREATE INDEX IF NOT EXISTS trades_taker_order_idx ON trades (taker_order_id);`,
+		// The prune filters on executed_at alone.
+		`CREATE INDEX IF NOT EXISTS trades_executed_at_idx ON trades (executed_at);`,
+
 		// id is the idempotency key, so a replayed deposit collides instead of
 		// crediting twice.
 		`CREATE TABLE IF NOT EXISTS transfers (
@@ -195,6 +187,17 @@ func InitializeExchangeTables(db *sql.DB) error {
 			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 		);`,
 		`CREATE INDEX IF NOT EXISTS transfers_user_idx ON transfers (user_id, created_at DESC);`,
+
+		// Every engine event the db processor has written, recorded in the
+		// same transaction as the write, so one delivered twice is skipped
+		// instead of counting a fill or a ledger movement twice. Pruned with
+		// the rest of the history (internal/api/cron.go).
+		`CREATE TABLE IF NOT EXISTS processed_events (
+			event_id     TEXT PRIMARY KEY,
+			processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`,
+		`CREATE INDEX IF NOT EXISTS processed_events_processed_at_idx
+			ON processed_events (processed_at);`,
 	}
 
 	for _, stmt := range statements {
@@ -206,3 +209,20 @@ func InitializeExchangeTables(db *sql.DB) error {
 	log.Println("exchange tables initialized successfully")
 	return nil
 }
+
+// InitializeSnapshotTable creates the table the engine's postgres snapshot
+// store writes to (SNAPSHOT_STORE=postgres). data is the whole encoded
+// envelope; sequence and created_at duplicate its metadata so a snapshot can be
+// identified from psql without decoding it.
+func InitializeSnapshotTable(db *sql.DB) error {
+	const stmt = `CREATE TABLE IF NOT EXISTS engine_snapshots (
+		id         BIGSERIAL PRIMARY KEY,
+		sequence   BIGINT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		data       BYTEA NOT NULL
+	);`
+	if _, err := db.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to create engine_snapshots: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package dbase
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// klineView is a continuous aggregate over sol_prices.
+type klineView struct {
+	name   string
+	bucket time.Duration
+
+	// The refresh policy materializes buckets between start and end before
+	// now, every schedule. Buckets after the window - the open one, and the
+	// one or two before it - are aggregated from sol_prices at query time
+	// (real-time aggregation), so a read never waits on a refresh.
+	//
+	// start stays within sol_prices' two-day retention: refreshing a range
+	// whose chunks were dropped would empty the candles already materialized
+	// there. A window also has to span two buckets, which is why 1d has no
+	// end.
+	start, end, schedule string
+}
+
+var klineViews = []klineView{
+	{name: "klines_1m", bucket: time.Minute, start: "1 hour", end: "1 minute", schedule: "1 minute"},
+	{name: "klines_5m", bucket: 5 * time.Minute, start: "2 hours", end: "5 minutes", schedule: "5 minutes"},
+	{name: "klines_15m", bucket: 15 * time.Minute, start: "6 hours", end: "15 minutes", schedule: "15 minutes"},
+	{name: "klines_1h", bucket: time.Hour, start: "1 day", end: "1 hour", schedule: "1 hour"},
+	{name: "klines_1d", bucket: 24 * time.Hour, start: "2 days", end: "", schedule: "1 hour"},
+}
+
+// KlineHistory is a durable candle table: closed buckets copied out of View
+// by the API's hourly cron, and never pruned.
+//
+// The continuous aggregate already outlives the trades it was built from, but
+// only as a cache Timescale is free to recompute. Refreshing a range whose
+// sol_prices chunks are gone empties it, and so does recreating the view to
+// change its definition. A plain table is out of reach of both.
+type KlineHistory struct {
+	Table  string
+	View   string
+	Bucket time.Duration
+}
+
+// KlineHistories are the durable series, hourly and daily. A year is 8,760
+// hourly rows a market, so nothing finer is kept.
+var KlineHistories = []KlineHistory{
+	{Table: "kline_history_1h", View: "klines_1h", Bucket: time.Hour},
+	{Table: "kline_history_1d", View: "klines_1d", Bucket: 24 * time.Hour},
+}
+
+// KlineInterval is one candle series /v1/klines/{Name} serves. The short ones
+// read their continuous aggregate as it is. The rest are rolled up from a
+// KlineHistory and, past the last bucket copied there, its view; Width is
+// the time_bucket they are grouped into.
+type KlineInterval struct {
+	Name    string
+	View    string
+	History *KlineHistory
+	Width   string
+
+	bucket time.Duration
+	months int
+}
+
+// KlineIntervals lists every candle series, shortest first.
+var KlineIntervals = []KlineInterval{
+	{Name: "1m", View: "klines_1m", bucket: time.Minute},
+	{Name: "5m", View: "klines_5m", bucket: 5 * time.Minute},
+	{Name: "15m", View: "klines_15m", bucket: 15 * time.Minute},
+	{Name: "1h", History: &KlineHistories[0], Width: "1 hour", bucket: time.Hour},
+	{Name: "4h", History: &KlineHistories[0], Width: "4 hours", bucket: 4 * time.Hour},
+	{Name: "1d", History: &KlineHistories[1], Width: "1 day", bucket: 24 * time.Hour},
+	// time_bucket starts weeks on a Monday.
+	{Name: "1w", History: &KlineHistories[1], Width: "1 week", bucket: 7 * 24 * time.Hour},
+	{Name: "1M", History: &KlineHistories[1], Width: "1 month", months: 1},
+}
+
+// KlineIntervalByName finds the series /v1/klines/{name} asks for.
+func KlineIntervalByName(name string) (KlineInterval, bool) {
+	for _, k := range KlineIntervals {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return KlineInterval{}, false
+}
+
+// End is where the candle starting at start closes. A month is no fixed
+// duration.
+func (k KlineInterval) End(start time.Time) time.Time {
+	if k.months > 0 {
+		return start.AddDate(0, k.months, 0)
+	}
+	return start.Add(k.bucket)
+}
+
+// initKlineViews creates a continuous aggregate per view and its refresh
+// policy, and the durable tables the long series are kept in. Timescale
+// refreshes the views in the background, a bucket range at a time, where
+// REFRESH MATERIALIZED VIEW rebuilt the whole view under an ACCESS EXCLUSIVE
+// lock that stalled every /klines read while it ran.
+//
+// The views under an hour keep a week; minute candles for months are no chart
+// anyone reads. The hourly and daily ones are not pruned, but the history
+// tables are what the long series trust (see KlineHistory).
+func initKlineViews(db *sql.DB) error {
+	for _, v := range klineViews {
+		// klines_1m and klines_1h used to be plain materialized views, and
+		// CREATE ... IF NOT EXISTS would keep them.
+		var plain bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_matviews WHERE matviewname = $1)`, v.name).Scan(&plain); err != nil {
+			return fmt.Errorf("failed to check %s: %v", v.name, err)
+		}
+		if plain {
+			if _, err := db.Exec(fmt.Sprintf(`DROP MATERIALIZED VIEW %s`, v.name)); err != nil {
+				return fmt.Errorf("failed to drop the old %s: %v", v.name, err)
+			}
+		}
+
+		statements := []string{
+			fmt.Sprintf(`CREATE MATERIALIZED VIEW IF NOT EXISTS %s
+				WITH (timescaledb.continuous) AS
+				SELECT
+					time_bucket(INTERVAL '%d seconds', time) AS bucket,
+					market,
+					first(price, time) AS open,
+					max(price) AS high,
+					min(price) AS low,
+					last(price, time) AS close,
+					sum(volume) AS volume
+				FROM sol_prices
+				GROUP BY bucket, market
+				WITH NO DATA`, v.name, int(v.bucket.Seconds())),
+			// Set on every boot rather than only at creation, so a view made
+			// materialized-only by hand - or by a Timescale default that
+			// changed - still serves the open bucket.
+			fmt.Sprintf(`ALTER MATERIALIZED VIEW %s SET (timescaledb.materialized_only = false)`, v.name),
+			fmt.Sprintf(`SELECT add_continuous_aggregate_policy('%s',
+				start_offset => INTERVAL '%s',
+				end_offset => %s,
+				schedule_interval => INTERVAL '%s',
+				if_not_exists => TRUE)`, v.name, v.start, intervalOrNull(v.end), v.schedule),
+		}
+		if v.bucket < time.Hour {
+			statements = append(statements, fmt.Sprintf(
+				`SELECT add_retention_policy('%s', INTERVAL '7 days', if_not_exists => TRUE)`, v.name))
+		}
+		for _, stmt := range statements {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to set up %s: %v", v.name, err)
+			}
+		}
+	}
+
+	for _, h := range KlineHistories {
+		if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			bucket TIMESTAMPTZ NOT NULL,
+			market TEXT NOT NULL,
+			open   DOUBLE PRECISION NOT NULL,
+			high   DOUBLE PRECISION NOT NULL,
+			low    DOUBLE PRECISION NOT NULL,
+			close  DOUBLE PRECISION NOT NULL,
+			volume DOUBLE PRECISION NOT NULL,
+			PRIMARY KEY (market, bucket)
+		)`, h.Table)); err != nil {
+			return fmt.Errorf("failed to create %s: %v", h.Table, err)
+		}
+	}
+
+	// No 1w view: the week view the plain materialized views once had showed a
+	// fragment of a week as one candle, and weeks are rolled up from the daily
+	// history now. 4h is rolled up from the hourly one the same way. Dropped
+	// here so an existing database loses them too.
+	for _, view := range []string{"klines_1w", "klines_4h"} {
+		if _, err := db.Exec(fmt.Sprintf(`DROP MATERIALIZED VIEW IF EXISTS %s`, view)); err != nil {
+			return fmt.Errorf("failed to drop %s: %v", view, err)
+		}
+	}
+	return nil
+}
+
+func intervalOrNull(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return "INTERVAL '" + s + "'"
+}
@@ -0,0 +1,90 @@
+package dbprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// Handler serves:
+//
+//   - GET /health: 200 while Postgres and the transport both answer, 503
+//     with the error otherwise. It is the platform's liveness probe, and a
+//     processor that cannot reach either writes nothing.
+//   - GET /metrics: per db queue, its backlog, whether this instance holds
+//     it and what this instance has written from it since it started.
+func (p *Processor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", p.health)
+	mux.HandleFunc("GET /metrics", p.metricsHandler)
+	return mux
+}
+
+func (p *Processor) health(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	status := map[string]string{"status": "healthy"}
+	code := http.StatusOK
+	if err := p.db.PingContext(ctx); err != nil {
+		status["status"], status["postgres"] = "unhealthy", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	if _, err := p.t.Len(ctx, transport.DbQueue); err != nil {
+		status["status"], status["transport"] = "unhealthy", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// QueueMetrics is one db queue's entry in /metrics.
+type QueueMetrics struct {
+	// Backlog is the queue's length, or -1 if the transport did not answer.
+	Backlog      int64      `json:"backlog"`
+	Working      bool       `json:"working"`
+	Batches      int64      `json:"batches"`
+	Messages     int64      `json:"messages"`
+	DeadLettered int64      `json:"deadLettered"`
+	Retries      int64      `json:"retries"`
+	LastBatch    *time.Time `json:"lastBatch,omitempty"`
+}
+
+func (p *Processor) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	working := map[string]bool{}
+	for _, queue := range p.Working() {
+		working[queue] = true
+	}
+	queues := map[string]QueueMetrics{}
+	for _, queue := range transport.DbPartitions() {
+		m := p.metrics[queue]
+		backlog, err := p.t.Len(r.Context(), queue)
+		if err != nil {
+			backlog = -1
+		}
+		q := QueueMetrics{
+			Backlog:      backlog,
+			Working:      working[queue],
+			Batches:      m.Batches.Load(),
+			Messages:     m.Messages.Load(),
+			DeadLettered: m.DeadLettered.Load(),
+			Retries:      m.Retries.Load(),
+		}
+		if ms := m.LastBatch.Load(); ms != 0 {
+			last := time.UnixMilli(ms).UTC()
+			q.LastBatch = &last
+		}
+		queues[queue] = q
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"concurrency": p.concurrency,
+		"queues":      queues,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
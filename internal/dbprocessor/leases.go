@@ -0,0 +1,109 @@
+package dbprocessor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Leases hand each db queue to one worker at a time, across every instance of
+// the db processor. Two workers on one queue would interleave an order's
+// create, fills and cancel in whatever order their batches commit.
+type Leases interface {
+	// Acquire tries once to take queue's lease, and reports whether it did.
+	Acquire(ctx context.Context, queue string) (bool, error)
+	// Renew extends a lease Acquire granted. It reports false when the lease
+	// has expired and may belong to someone else.
+	Renew(ctx context.Context, queue string) (bool, error)
+	// Release gives the lease up so another instance can take the queue at
+	// once rather than after the TTL.
+	Release(ctx context.Context, queue string) error
+	// TTL is how long a lease outlives a holder that stops renewing it.
+	TTL() time.Duration
+}
+
+// RedisLeases keeps the leases as keys holding their owner's id, each set
+// with NX and a TTL, as the engine's leader lock is.
+type RedisLeases struct {
+	client *redis.Client
+	owner  string
+	ttl    time.Duration
+}
+
+// NewRedisLeases names this process with a fresh id, so a restart never
+// renews what its previous run held.
+func NewRedisLeases(client *redis.Client, ttl time.Duration) *RedisLeases {
+	return &RedisLeases{client: client, owner: uuid.New().String(), ttl: ttl}
+}
+
+func leaseKey(queue string) string { return "lease:" + queue }
+
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (l *RedisLeases) Acquire(ctx context.Context, queue string) (bool, error) {
+	return l.client.SetNX(ctx, leaseKey(queue), l.owner, l.ttl).Result()
+}
+
+func (l *RedisLeases) Renew(ctx context.Context, queue string) (bool, error) {
+	held, err := renewScript.Run(ctx, l.client, []string{leaseKey(queue)}, l.owner, l.ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+func (l *RedisLeases) Release(ctx context.Context, queue string) error {
+	return releaseScript.Run(ctx, l.client, []string{leaseKey(queue)}, l.owner).Err()
+}
+
+func (l *RedisLeases) TTL() time.Duration { return l.ttl }
+
+// MemoryLeases are for a single process, cmd/allinone's, where they only keep
+// its own workers apart.
+type MemoryLeases struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func NewMemoryLeases() *MemoryLeases {
+	return &MemoryLeases{held: make(map[string]bool)}
+}
+
+func (l *MemoryLeases) Acquire(ctx context.Context, queue string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[queue] {
+		return false, nil
+	}
+	l.held[queue] = true
+	return true, nil
+}
+
+func (l *MemoryLeases) Renew(ctx context.Context, queue string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held[queue], nil
+}
+
+func (l *MemoryLeases) Release(ctx context.Context, queue string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, queue)
+	return nil
+}
+
+// TTL is only how often a holder renews; nothing here expires.
+func (l *MemoryLeases) TTL() time.Duration { return 5 * time.Second }
@@ -0,0 +1,201 @@
+// Package dbprocessor runs kline.StartDataProcessor over the db queues as a
+// service of its own, so persistence neither stops with the API nor doubles
+// up when the API scales out.
+//
+// There is one db queue per market and one for everything else (see
+// transport.DbPartitions). Each is worked by one worker at a time, holding the
+// queue's lease; a worker is a goroutine, and an instance runs as many as its
+// concurrency allows. Within a queue messages are written strictly in order,
+// which is what keeps an order's fills behind its create; across queues
+// nothing is ordered, and nothing needs to be.
+//
+// An instance with idle workers takes any queue whose lease is free, so a
+// queue whose instance died is picked up once its lease expires. Instances
+// never hand queues to one another while they are healthy: to spread the
+// queues over N instances, give each a concurrency of about queues/N, and the
+// rest wait as standbys.
+//
+// ponytail: a worker that stalls past its lease - a long GC pause, a
+// partitioned network - finishes the batch in hand after another has taken
+// the queue. Event ids keep that from writing anything twice, but the new
+// holder may commit a fill of that queue ahead of the stalled create.
+package dbprocessor
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/kline"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// claimEvery is how often an idle worker looks for a queue nobody holds.
+const claimEvery = 2 * time.Second
+
+// Processor works the db queues with up to concurrency workers.
+type Processor struct {
+	db          *sql.DB
+	t           transport.Transport
+	leases      Leases
+	concurrency int
+
+	// metrics has an entry for every db queue, for the life of the process,
+	// so counts survive a queue moving away and back.
+	metrics map[string]*kline.Metrics
+
+	mu      sync.Mutex
+	working map[string]bool
+}
+
+// New makes a Processor. A concurrency below one, or above the number of db
+// queues, works every queue.
+func New(db *sql.DB, t transport.Transport, leases Leases, concurrency int) *Processor {
+	queues := transport.DbPartitions()
+	if concurrency < 1 || concurrency > len(queues) {
+		concurrency = len(queues)
+	}
+	metrics := make(map[string]*kline.Metrics, len(queues))
+	for _, queue := range queues {
+		metrics[queue] = &kline.Metrics{}
+	}
+	return &Processor{
+		db:          db,
+		t:           t,
+		leases:      leases,
+		concurrency: concurrency,
+		metrics:     metrics,
+		working:     make(map[string]bool),
+	}
+}
+
+// Run works the queues until ctx is cancelled, then waits for every worker to
+// write and acknowledge what it took and release its lease.
+func (p *Processor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range p.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.worker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Processor) worker(ctx context.Context) {
+	for ctx.Err() == nil {
+		queue, ok := p.claim(ctx)
+		if !ok {
+			sleep(ctx, claimEvery)
+			continue
+		}
+		p.work(ctx, queue)
+	}
+}
+
+// claim takes the lease of the first queue no worker holds, DbQueue first: it
+// drains whatever an older engine left there, ahead of the markets' own.
+func (p *Processor) claim(ctx context.Context) (string, bool) {
+	for _, queue := range transport.DbPartitions() {
+		p.mu.Lock()
+		busy := p.working[queue]
+		if !busy {
+			p.working[queue] = true
+		}
+		p.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		ok, err := p.leases.Acquire(ctx, queue)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error acquiring the lease on %s: %v", queue, err)
+		}
+		if ok {
+			return queue, true
+		}
+		p.done(queue)
+	}
+	return "", false
+}
+
+func (p *Processor) done(queue string) {
+	p.mu.Lock()
+	delete(p.working, queue)
+	p.mu.Unlock()
+}
+
+// work runs the queue's processor until ctx is cancelled or the lease is
+// lost, then releases it.
+func (p *Processor) work(ctx context.Context, queue string) {
+	defer p.done(queue)
+	log.Printf("Writing %s", queue)
+
+	leased, lost := context.WithCancel(ctx)
+	defer lost()
+	go p.hold(leased, queue, lost)
+	kline.StartDataProcessor(leased, p.db, p.t, queue, p.metrics[queue])
+
+	if err := p.leases.Release(context.WithoutCancel(ctx), queue); err != nil {
+		log.Printf("Error releasing the lease on %s: %v", queue, err)
+	}
+	log.Printf("Stopped writing %s", queue)
+}
+
+// hold renews queue's lease at a third of its TTL, and calls lost once it is
+// gone or could not be renewed for a whole TTL.
+func (p *Processor) hold(ctx context.Context, queue string, lost func()) {
+	ttl := p.leases.TTL()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		held, err := p.leases.Renew(ctx, queue)
+		switch {
+		case err == nil && held:
+			renewed = time.Now()
+		case err == nil:
+			log.Printf("Lost the lease on %s", queue)
+			lost()
+			return
+		case ctx.Err() != nil:
+			return
+		default:
+			log.Printf("Error renewing the lease on %s: %v", queue, err)
+			if time.Since(renewed) > ttl {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// Working lists the queues this instance holds.
+func (p *Processor) Working() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queues := []string{}
+	for _, queue := range transport.DbPartitions() {
+		if p.working[queue] {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,82 @@
+package dbprocessor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// eventually polls cond until it holds or a few seconds pass.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func run(t *testing.T, p *Processor) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { p.Run(ctx); close(done) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Run did not return after cancel")
+		}
+	})
+}
+
+// Every db queue is worked, the default one included. Malformed messages are
+// dead-lettered before reaching Postgres, so this needs none.
+func TestEveryQueueIsWorked(t *testing.T) {
+	ctx := context.Background()
+	bus := transport.NewMemory()
+	for _, queue := range transport.DbPartitions() {
+		bus.Push(ctx, queue, []byte("{not json"))
+	}
+	run(t, New(nil, bus, NewMemoryLeases(), 0))
+
+	for _, queue := range transport.DbPartitions() {
+		eventually(t, queue+" to be worked", func() bool {
+			n, _ := bus.Len(ctx, queue)
+			letters, _ := bus.DeadLetters(ctx, queue)
+			return n == 0 && len(letters) == 1
+		})
+	}
+}
+
+// Two instances sharing the leases split the queues between them: one takes
+// only as many as its concurrency allows, the other the rest, and no queue is
+// worked by both.
+func TestInstancesSplitTheQueues(t *testing.T) {
+	bus := transport.NewMemory()
+	leases := NewMemoryLeases()
+	first := New(nil, bus, leases, 2)
+	run(t, first)
+	eventually(t, "the first instance to take two queues", func() bool { return len(first.Working()) == 2 })
+
+	second := New(nil, bus, leases, 0)
+	run(t, second)
+	all := len(transport.DbPartitions())
+	eventually(t, "the second instance to take the rest", func() bool { return len(second.Working()) == all-2 })
+
+	if got := len(first.Working()); got != 2 {
+		t.Errorf("first instance works %d queues, want 2", got)
+	}
+	for _, queue := range first.Working() {
+		for _, other := range second.Working() {
+			if queue == other {
+				t.Errorf("%s is worked by both instances", queue)
+			}
+		}
+	}
+}
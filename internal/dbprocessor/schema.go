@@ -0,0 +1,48 @@
+package dbprocessor
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// tables are the ones the processor writes. The API creates them at boot
+// (dbase.InitializeKlineDB and InitializeExchangeTables), and only the API:
+// two services creating the same hypertable and candle views at once race on
+// them.
+var tables = []string{"sol_prices", "trades", "orders", "ledger", "processed_events"}
+
+// WaitForSchema returns once every table the processor writes exists, or ctx
+// is done. Writing before then would fail every message with "relation does
+// not exist", which is not transient, and dead-letter the lot.
+func WaitForSchema(ctx context.Context, db *sql.DB) error {
+	for {
+		missing, err := missingTable(ctx, db)
+		if err == nil && missing == "" {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error checking the schema: %v", err)
+		} else {
+			log.Printf("Waiting for the API to create %s", missing)
+		}
+		sleep(ctx, 2*time.Second)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func missingTable(ctx context.Context, db *sql.DB) (string, error) {
+	for _, table := range tables {
+		var exists bool
+		if err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return table, nil
+		}
+	}
+	return "", nil
+}
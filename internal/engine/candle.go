@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// candleIntervals are the live candle streams, kline@<name>.<market>. They are
+// the series /v1/klines serves (dbase.KlineIntervals), so a chart can load
+// history over REST and carry on from the stream without the two disagreeing
+// about where a bucket starts.
+var candleIntervals = []struct {
+	name   string
+	width  time.Duration
+	months int
+}{
+	{name: "1m", width: time.Minute},
+	{name: "5m", width: 5 * time.Minute},
+	{name: "15m", width: 15 * time.Minute},
+	{name: "1h", width: time.Hour},
+	{name: "4h", width: 4 * time.Hour},
+	{name: "1d", width: 24 * time.Hour},
+	{name: "1w", width: 7 * 24 * time.Hour},
+	{name: "1M", months: 1},
+}
+
+// clock is what the leader stamps commands with, and so what candles and the
+// rolling ticker are bucketed by. A variable so tests can cross a bucket
+// boundary without waiting for one.
+var clock = time.Now
+
+// now is when the command running on book ran: the leader's stamp, on a
+// replay too (see outcome). Called under book.mu.
+func (book *Orderbook) now() time.Time {
+	if book.decided.At.IsZero() {
+		// Not through process: a handler a test calls directly.
+		return clock()
+	}
+	return book.decided.At
+}
+
+// Candle is a bucket still open, built from the trades the engine made in it.
+// It travels with its book in the snapshot, so a restart mid-minute carries on
+// the same candle rather than opening a second one at the next trade's price.
+type Candle struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume float64   `json:"volume"`
+	Trades int       `json:"trades"`
+}
+
+// candleBucket is where the bucket holding at starts and ends. Truncate counts
+// from January 1st of year 1, a Monday at midnight, so weeks start on a Monday
+// as time_bucket's do.
+func candleBucket(width time.Duration, months int, at time.Time) (time.Time, time.Time) {
+	at = at.UTC()
+	if months > 0 {
+		start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, months, 0)
+	}
+	start := at.Truncate(width)
+	return start, start.Add(width)
+}
+
+func candleStream(interval, market string) string {
+	return fmt.Sprintf("kline@%s.%s", interval, market)
+}
+
+// updateCandles folds one command's fills into book's open candles and
+// publishes each candle once. The fills are bucketed by when the command ran,
+// so a standby replaying them later puts them where the leader did. A fill in
+// a later bucket than a candle's first closes that candle, in case
+// closeCandles has not got to it yet. Called under book.mu.
+func (e *Engine) updateCandles(book *Orderbook, market string, fills []Fill) {
+	if len(fills) == 0 {
+		return
+	}
+	at := book.now()
+	prices := make([]float64, len(fills))
+	for i, fill := range fills {
+		prices[i], _ = strconv.ParseFloat(fill.Price, 64)
+	}
+	if book.Candles == nil {
+		book.Candles = make(map[string]*Candle)
+	}
+	for _, interval := range candleIntervals {
+		c := book.Candles[interval.name]
+		if c != nil && !at.Before(c.End) {
+			e.publishCandle(market, interval.name, c, true)
+			c = nil
+		}
+		if c == nil {
+			start, end := candleBucket(interval.width, interval.months, at)
+			c = &Candle{Start: start, End: end, Open: prices[0], High: prices[0], Low: prices[0]}
+			book.Candles[interval.name] = c
+		}
+		for i, fill := range fills {
+			c.High = max(c.High, prices[i])
+			c.Low = min(c.Low, prices[i])
+			c.Close = prices[i]
+			c.Volume += fill.Qty
+			c.Trades++
+		}
+		e.publishCandle(market, interval.name, c, false)
+	}
+}
+
+// closeCandles publishes every candle whose bucket has ended as closed, and
+// drops it. Without it a bucket with no trade after it would never be marked
+// closed - the last minute before a quiet spell would look open until the
+// next trade.
+//
+// Only a leader runs it, by the clock. That is safe against the stamps a
+// standby replays by: each is taken under the same book lock, so no command
+// stamped before a bucket's end runs after it closed.
+func (e *Engine) closeCandles() {
+	for market, book := range e.Orderbooks {
+		book.mu.Lock()
+		at := clock()
+		for name, c := range book.Candles {
+			if !at.Before(c.End) {
+				e.publishCandle(market, name, c, true)
+				delete(book.Candles, name)
+			}
+		}
+		book.mu.Unlock()
+	}
+}
+
+func (e *Engine) publishCandle(market, interval string, c *Candle, closed bool) {
+	stream := candleStream(interval, market)
+	e.publish(stream, WsMessage{
+		Stream: stream,
+		KlineData: &KlineData{
+			E:        "kline",
+			Market:   market,
+			Interval: interval,
+			Start:    c.Start.UnixMilli(),
+			End:      c.End.UnixMilli(),
+			Open:     formatNum(c.Open),
+			High:     formatNum(c.High),
+			Low:      formatNum(c.Low),
+			Close:    formatNum(c.Close),
+			Volume:   formatNum(c.Volume),
+			Trades:   c.Trades,
+			IsClosed: closed,
+		},
+	})
+}
+
+// candleLoop closes candles as their buckets end, until ctx is cancelled. A
+// second is as late as a closed flag can arrive.
+func candleLoop(ctx context.Context, engine *Engine) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			engine.closeCandles()
+		}
+	}
+}
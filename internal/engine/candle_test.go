@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// captureCandles records every kline@1m message the engine publishes.
+func captureCandles(t *testing.T) *[]KlineData {
+	t.Helper()
+	original := publishToWS
+	got := []KlineData{}
+	publishToWS = func(channel string, m WsMessage) error {
+		if channel == candleStream("1m", testMarket) {
+			got = append(got, *m.KlineData)
+		}
+		return nil
+	}
+	t.Cleanup(func() { publishToWS = original })
+	return &got
+}
+
+func setClock(t *testing.T, at *time.Time) {
+	t.Helper()
+	original := clock
+	clock = func() time.Time { return *at }
+	t.Cleanup(func() { clock = original })
+}
+
+func TestCandlesFollowTradesAndCloseWithTheirBucket(t *testing.T) {
+	countOutputs(t)
+	candles := captureCandles(t)
+	now := time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC)
+	setClock(t, &now)
+
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	e.Process(order("sell", "100", "1", "maker"), "c")
+	e.Process(order("sell", "102", "1", "maker"), "c")
+	e.Process(order("buy", "102", "2", "taker"), "c")
+
+	if len(*candles) != 1 {
+		t.Fatalf("got %d candle updates for one command, want 1", len(*candles))
+	}
+	c := (*candles)[0]
+	start := time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+	if c.Start != start.UnixMilli() || c.End != start.Add(time.Minute).UnixMilli() {
+		t.Errorf("bucket = %d-%d, want the 10:30 minute", c.Start, c.End)
+	}
+	if c.Open != "100" || c.High != "102" || c.Low != "100" || c.Close != "102" ||
+		c.Volume != "2" || c.Trades != 2 || c.IsClosed {
+		t.Errorf("candle = %+v", c)
+	}
+
+	// Nothing has ended yet.
+	e.closeCandles()
+	if len(*candles) != 1 {
+		t.Fatalf("closeCandles published %d updates inside the bucket", len(*candles)-1)
+	}
+
+	now = now.Add(time.Minute)
+	e.closeCandles()
+	if len(*candles) != 2 || !(*candles)[1].IsClosed || (*candles)[1].Close != "102" {
+		t.Fatalf("after the minute ended: %+v", *candles)
+	}
+
+	e.Process(order("sell", "99", "1", "maker"), "c")
+	e.Process(order("buy", "99", "1", "taker"), "c")
+	next := (*candles)[len(*candles)-1]
+	if next.Start != start.Add(time.Minute).UnixMilli() || next.Open != "99" || next.Trades != 1 || next.IsClosed {
+		t.Errorf("next minute's candle = %+v", next)
+	}
+}
+
+// The stream and /v1/klines have to agree on where a bucket starts, or the
+// chart draws the live candle beside the stored one.
+func TestCandleBucketsMatchTimeBucket(t *testing.T) {
+	at := time.Date(2024, 3, 7, 13, 45, 0, 0, time.UTC) // a Thursday
+	for _, tc := range []struct {
+		width      time.Duration
+		months     int
+		start, end time.Time
+	}{
+		{4 * time.Hour, 0, time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 7, 16, 0, 0, 0, time.UTC)},
+		{7 * 24 * time.Hour, 0, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{0, 1, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		start, end := candleBucket(tc.width, tc.months, at)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("bucket(%v, %d months) = %v-%v, want %v-%v", tc.width, tc.months, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+// A standby catching up a quarter of an hour late still puts the leader's
+// trades in the minute they were made, not the one it replays them in.
+func TestReplayedCandlesUseTheLeadersTime(t *testing.T) {
+	countOutputs(t)
+	now := time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC)
+	setClock(t, &now)
+
+	leader, standby := standbyPair(t)
+	entries := journalOf(t, leader,
+		order("sell", "100", "1", "maker"),
+		order("buy", "100", "1", "taker"),
+	)
+	if !entries[1].Outcome.At.Equal(now) {
+		t.Fatalf("journaled time = %v, want %v", entries[1].Outcome.At, now)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if !standby.catchUp(entries, allMuted, nil) {
+		t.Fatal("catchUp reported a gap")
+	}
+	want := time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+	if c := standby.Orderbooks[testMarket].Candles["1m"]; c == nil || !c.Start.Equal(want) {
+		t.Errorf("standby's 1m candle = %+v, want the 10:30 minute", c)
+	}
+}
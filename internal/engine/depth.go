@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The depth stream carries changes, not the book. Each message on
+// depth@<market> lists only the levels one command changed, with the
+// quantity now resting there - "0" for a level that emptied - and numbers
+// them: every changed level takes the next DepthUpdateID, and the message
+// names its first and last. GET_DEPTH answers with the id the book is at, so
+// a client syncs the usual way:
+//
+//  1. subscribe, and buffer what arrives;
+//  2. fetch the depth snapshot;
+//  3. drop buffered messages whose lastUpdateId is at or below the
+//     snapshot's, and apply the rest in order;
+//  4. from then on, a message whose firstUpdateId is not the previous
+//     lastUpdateId + 1 means one was missed: fetch the snapshot again.
+//
+// Diffs cover every level; the snapshot only the top of the book. A level
+// below the snapshot's cut-off arrives as a change like any other.
+
+// depthLevels is the resting quantity at each price, per side, formatted as
+// the stream sends it. Compared as strings, so float noise in a sum that did
+// not change is not a change. It walks the whole book, so only restore uses
+// it; a command's diff looks at the levels it touched (levelQty).
+func (o *Orderbook) depthLevels() (bids, asks map[string]string) {
+	bids, asks = map[string]string{}, map[string]string{}
+	for _, side := range []struct {
+		orders []Order
+		levels map[string]string
+	}{{o.Bids, bids}, {o.Asks, asks}} {
+		sums := map[string]float64{}
+		for _, order := range side.orders {
+			if remaining := order.Quantity - order.Filled; remaining > 0 {
+				sums[formatNum(order.Price)] += remaining
+			}
+		}
+		for price, qty := range sums {
+			side.levels[price] = formatNum(qty)
+		}
+	}
+	return bids, asks
+}
+
+// touch notes that the level at price on side may have changed, for the
+// next depth diff to look at. Called under book.mu by whatever adds, fills or
+// removes a resting order.
+func (o *Orderbook) touch(side string, price float64) {
+	touched := &o.touchedAsks
+	if side == "buy" {
+		touched = &o.touchedBids
+	}
+	if *touched == nil {
+		*touched = map[string]bool{}
+	}
+	(*touched)[formatNum(price)] = true
+}
+
+// levelQty is the resting quantity at level on one side, as depthLevels
+// formats it, or "" if nothing rests there. orders is sorted best first, and
+// so by level too: the level's orders are one run, found by binary search.
+func levelQty(orders []Order, level string, descending bool) string {
+	price, _ := strconv.ParseFloat(level, 64)
+	levelOf := func(i int) float64 {
+		p, _ := strconv.ParseFloat(formatNum(orders[i].Price), 64)
+		return p
+	}
+	start := sort.Search(len(orders), func(i int) bool {
+		if descending {
+			return levelOf(i) <= price
+		}
+		return levelOf(i) >= price
+	})
+	sum := 0.0
+	for i := start; i < len(orders) && formatNum(orders[i].Price) == level; i++ {
+		if remaining := orders[i].Quantity - orders[i].Filled; remaining > 0 {
+			sum += remaining
+		}
+	}
+	if sum == 0 {
+		return ""
+	}
+	return formatNum(sum)
+}
+
+// depthChanges brings published up to date for the touched levels and lists
+// the ones that changed, "0" for one that is gone, ordered best first for the
+// side.
+func depthChanges(orders []Order, published map[string]string, touched map[string]bool, descending bool) [][2]string {
+	changes := [][2]string{}
+	for level := range touched {
+		qty := levelQty(orders, level, descending)
+		if published[level] == qty {
+			continue
+		}
+		if qty == "" {
+			delete(published, level)
+			changes = append(changes, [2]string{level, "0"})
+		} else {
+			published[level] = qty
+			changes = append(changes, [2]string{level, qty})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(changes[i][0], 64)
+		b, _ := strconv.ParseFloat(changes[j][0], 64)
+		if descending {
+			return a > b
+		}
+		return a < b
+	})
+	return changes
+}
+
+// publishDepthDiff publishes what the command just run changed in book's
+// depth, if anything. Only the levels it touched are looked at, so the cost
+// is the command's, not the book's. The ids advance whether or not the
+// message goes out: a standby replaying muted has to arrive at the leader's
+// numbering. Called under book.mu.
+func (e *Engine) publishDepthDiff(book *Orderbook, market string) {
+	if book.publishedBids == nil {
+		book.publishedBids = map[string]string{}
+	}
+	if book.publishedAsks == nil {
+		book.publishedAsks = map[string]string{}
+	}
+	bidChanges := depthChanges(book.Bids, book.publishedBids, book.touchedBids, true)
+	askChanges := depthChanges(book.Asks, book.publishedAsks, book.touchedAsks, false)
+	book.touchedBids, book.touchedAsks = nil, nil
+
+	n := uint64(len(bidChanges) + len(askChanges))
+	if n == 0 {
+		return
+	}
+	first := book.DepthUpdateID + 1
+	book.DepthUpdateID += n
+
+	stream := fmt.Sprintf("depth@%s", market)
+	e.publish(stream, WsMessage{
+		Stream: stream,
+		Data: &DepthData{
+			B:             bidChanges,
+			A:             askChanges,
+			E:             "depth",
+			FirstUpdateID: first,
+			LastUpdateID:  book.DepthUpdateID,
+		},
+	})
+}
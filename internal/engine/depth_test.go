@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// captureDepth records every depth@ message the engine publishes.
+func captureDepth(t *testing.T) *[]DepthData {
+	t.Helper()
+	original := publishToWS
+	got := []DepthData{}
+	publishToWS = func(channel string, m WsMessage) error {
+		if channel == "depth@"+testMarket {
+			got = append(got, *m.Data)
+		}
+		return nil
+	}
+	t.Cleanup(func() { publishToWS = original })
+	return &got
+}
+
+// A client that applies the diffs from a snapshot's lastUpdateId on has to
+// end up with the book, and has to be able to tell when it missed one.
+func TestDepthDiffsNumberEveryChangedLevel(t *testing.T) {
+	countOutputs(t)
+	diffs := captureDepth(t)
+	replies := captureReplies(t)
+
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	e.Process(order("sell", "100", "1", "maker"), "c")
+	e.Process(order("sell", "101", "2", "maker"), "c")
+
+	*replies = nil
+	e.Process(MessageFromAPI{Type: GET_DEPTH, Data: GetDepthData{Market: testMarket}}, "c")
+	snapshot := onlyReply(t, replies).Payload.(DepthPayload)
+	if snapshot.LastUpdateID != 2 {
+		t.Fatalf("snapshot lastUpdateId = %d, want 2", snapshot.LastUpdateID)
+	}
+
+	// Takes all of 100 and half of 101, and rests nothing.
+	e.Process(order("buy", "101", "2", "taker"), "c")
+	_, _, orderID, err := e.CreateOrder(testMarket, "90", "1", "buy", "taker", "limit")
+	if err != nil {
+		t.Fatalf("resting bid: %v", err)
+	}
+	e.Process(MessageFromAPI{Type: CANCEL_ORDER, Data: CancelOrderData{OrderID: orderID, Market: testMarket}}, "c")
+
+	want := []DepthData{
+		{A: [][2]string{{"100", "1"}}, B: [][2]string{}, FirstUpdateID: 1, LastUpdateID: 1},
+		{A: [][2]string{{"101", "2"}}, B: [][2]string{}, FirstUpdateID: 2, LastUpdateID: 2},
+		{A: [][2]string{{"100", "0"}, {"101", "1"}}, B: [][2]string{}, FirstUpdateID: 3, LastUpdateID: 4},
+		{A: [][2]string{}, B: [][2]string{{"90", "1"}}, FirstUpdateID: 5, LastUpdateID: 5},
+		{A: [][2]string{}, B: [][2]string{{"90", "0"}}, FirstUpdateID: 6, LastUpdateID: 6},
+	}
+	if len(*diffs) != len(want) {
+		t.Fatalf("got %d depth messages, want %d: %+v", len(*diffs), len(want), *diffs)
+	}
+	for i, w := range want {
+		got := (*diffs)[i]
+		if !reflect.DeepEqual(got.A, w.A) || !reflect.DeepEqual(got.B, w.B) ||
+			got.FirstUpdateID != w.FirstUpdateID || got.LastUpdateID != w.LastUpdateID {
+			t.Errorf("message %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+// A restored book rebuilds what the stream last described from its orders,
+// so the first command after a restart sends only what it changed.
+func TestDepthDiffsCarryOnAfterRestore(t *testing.T) {
+	countOutputs(t)
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	e.Process(order("sell", "100", "1", "maker"), "c")
+
+	data, err := json.Marshal(e.state())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var state engineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	e.restore(&state)
+	diffs := captureDepth(t)
+	e.Process(order("sell", "101", "1", "maker"), "c")
+
+	if len(*diffs) != 1 || len((*diffs)[0].A) != 1 || (*diffs)[0].FirstUpdateID != 2 {
+		t.Errorf("after restore: %+v", *diffs)
+	}
+}
+
+// Diffs are built from the levels each command touched rather than the whole
+// book, so after any mix of resting, matching and cancelling what the stream
+// has described must still be exactly the book.
+func TestTouchedLevelsKeepTheStreamEqualToTheBook(t *testing.T) {
+	countOutputs(t)
+	e := newTestEngine(t)
+	fund(e, "maker", 1_000_000, 1_000)
+	fund(e, "taker", 1_000_000, 1_000)
+	r := rand.New(rand.NewSource(1))
+	book := e.Orderbooks[testMarket]
+	for i := 0; i < 500; i++ {
+		side := []string{"buy", "sell"}[r.Intn(2)]
+		user := []string{"maker", "taker"}[r.Intn(2)]
+		price := fmt.Sprintf("%d.%d", 95+r.Intn(10), r.Intn(2)*5)
+		qty := fmt.Sprintf("%d", 1+r.Intn(3))
+		if r.Intn(4) == 0 && len(book.Bids)+len(book.Asks) > 0 {
+			var victim Order
+			if len(book.Bids) > 0 && (len(book.Asks) == 0 || r.Intn(2) == 0) {
+				victim = book.Bids[r.Intn(len(book.Bids))]
+			} else {
+				victim = book.Asks[r.Intn(len(book.Asks))]
+			}
+			e.Process(MessageFromAPI{Type: CANCEL_ORDER, Data: CancelOrderData{OrderID: victim.OrderID, Market: testMarket}}, "c")
+		} else {
+			e.Process(order(side, price, qty, user), "c")
+		}
+		bids, asks := book.depthLevels()
+		if !reflect.DeepEqual(bids, book.publishedBids) || !reflect.DeepEqual(asks, book.publishedAsks) {
+			t.Fatalf("after command %d the stream describes bids %v asks %v, the book is bids %v asks %v",
+				i, book.publishedBids, book.publishedAsks, bids, asks)
+		}
+	}
+}
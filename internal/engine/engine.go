@@ -1,17 +1,20 @@
-package main
+package engine
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/google/uuid"
 )
 
 const BASE_CURRENCY = "USD"
@@ -36,11 +39,36 @@ type Engine struct {
 	// Users maps an engine user id to its display name. Names are presentation
 	// only - the engine has always keyed everything off the bare id.
 	Users map[string]string `json:"users"`
-
-	// ponytail: one lock for the whole engine. The message loop is single
-	// threaded; this only guards it against the snapshot goroutine. Split per
-	// orderbook if a second market ever needs real concurrency.
+	// Sequence counts every command Process has handled. It is saved with the
+	// snapshot so a restored engine knows how far along it was.
+	Sequence uint64 `json:"sequence"`
+	// Positions is how many commands each shard's queue has delivered, which is
+	// also where each shard's journal resumes (see journal.go).
+	Positions map[string]uint64 `json:"positions"`
+	// Epoch names every order this engine mints (see nextOrderID). It is fixed
+	// when an engine first seeds and then travels with its snapshots, so a
+	// standby restored from them continues the same series.
+	Epoch string `json:"epoch"`
+
+	snapshots snapshotStore
+	// replaying mutes every output while a standby applies journaled commands;
+	// see persist and friends in output.go.
+	replaying bool
+	// lastSnapshot describes the newest snapshot this engine wrote or restored.
+	lastSnapshot SnapshotMeta
+	// seeded is set while the state is a fresh seed rather than a restored
+	// snapshot. A standby in that state has nothing the journal applies to.
+	seeded bool
+	stats  commandStats
+
+	// Each market's commands run under that Orderbook's mu, on the market's
+	// own worker. mu is the coordination layer between them: it guards Balances
+	// and Users, which every market shares, and is only held for the balance
+	// arithmetic itself, never across matching. Lock order is always book, then
+	// mu - commands without a market take mu alone.
 	mu sync.Mutex
+	// seqMu guards Sequence and Positions, which commands on every shard bump.
+	seqMu sync.Mutex
 }
 
 func snapshotPath() string {
@@ -57,20 +85,28 @@ func NewEngine() *Engine {
 		Users:      make(map[string]string),
 	}
 
-	if !engine.loadSnapshot() {
+	store, err := newSnapshotStore()
+	if err != nil {
+		log.Fatalf("snapshot store: %v", err)
+	}
+	if _, err := snapshotCompression(); err != nil {
+		log.Fatalf("snapshot compression: %v", err)
+	}
+	engine.snapshots = store
+
+	// A snapshot that exists but cannot be read is fatal. Seeding instead would
+	// hand every user a fresh balance while Postgres still holds their trades.
+	restored, err := engine.loadSnapshot()
+	if err != nil {
+		log.Fatalf("refusing to start: %v (move the snapshot files aside to reseed deliberately)", err)
+	}
+	if !restored {
 		log.Println("no snapshot found, starting from seeded state")
+		engine.Epoch = uuid.New().String()
+		engine.seeded = true
 	}
 	engine.ensureMarkets()
 
-	// Start snapshot saving goroutine
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			engine.SaveSnapshot()
-		}
-	}()
-
 	return engine
 }
 
@@ -78,104 +114,265 @@ func NewEngine() *Engine {
 // it every engine restart wipes the demo back to three hardcoded users, and the
 // per-orderbook LastTradeID resets to 0 and collides with the trade rows already
 // in Postgres.
-func (e *Engine) loadSnapshot() bool {
-	data, err := os.ReadFile(snapshotPath())
+//
+// It reports false with no error only when there is no snapshot at all. A
+// corrupt latest falls back to the previous generation; if every generation is
+// bad the error is returned rather than treated as a fresh start.
+func (e *Engine) loadSnapshot() (bool, error) {
+	state, name, err := readSnapshot(e.snapshotStore())
+	if errors.Is(err, errNoSnapshot) {
+		return false, nil
+	}
 	if err != nil {
-		return false
+		return false, err
 	}
 
-	var snapshot struct {
-		Orderbooks map[string]*Orderbook              `json:"orderbooks"`
-		Balances   map[string]map[string]*UserBalance `json:"balances"`
-		Users      map[string]string                  `json:"users"`
+	e.restore(state)
+	log.Printf("restored snapshot %s at sequence %d: %d orderbook(s), %d user balance(s)",
+		name, e.Sequence, len(e.Orderbooks), len(e.Balances))
+	return true, nil
+}
+
+// restore replaces the engine's state with a decoded snapshot.
+func (e *Engine) restore(state *engineState) {
+	e.Orderbooks = state.Orderbooks
+	for _, book := range e.Orderbooks {
+		book.publishedBids, book.publishedAsks = book.depthLevels()
 	}
-	if err := json.Unmarshal(data, &snapshot); err != nil {
-		log.Printf("snapshot is corrupt, ignoring it: %v", err)
-		return false
+	if state.Balances != nil {
+		e.Balances = state.Balances
 	}
-	if len(snapshot.Orderbooks) == 0 {
-		return false
+	if state.Users != nil {
+		e.Users = state.Users
 	}
+	e.Sequence = state.Sequence
+	e.Positions = state.Positions
+	e.Epoch = state.Epoch
+	e.lastSnapshot = SnapshotMeta{Sequence: state.Sequence, Positions: state.Positions}
+}
 
-	e.Orderbooks = snapshot.Orderbooks
-	if snapshot.Balances != nil {
-		e.Balances = snapshot.Balances
+// snapshotStore falls back to the file store for engines built without
+// NewEngine, which is every test.
+func (e *Engine) snapshotStore() snapshotStore {
+	if e.snapshots != nil {
+		return e.snapshots
 	}
-	if snapshot.Users != nil {
-		e.Users = snapshot.Users
+	return &fileSnapshotStore{path: snapshotPath(), retain: snapshotRetain()}
+}
+
+// state is what SaveSnapshot writes. Callers hold every lock (see lockAll).
+func (e *Engine) state() engineState {
+	return engineState{
+		Orderbooks: e.Orderbooks,
+		Balances:   e.Balances,
+		Users:      e.Users,
+		Sequence:   e.Sequence,
+		Positions:  e.Positions,
+		Epoch:      e.Epoch,
 	}
-	log.Printf("restored snapshot: %d orderbook(s), %d user balance(s)",
-		len(e.Orderbooks), len(e.Balances))
-	return true
 }
 
-func (e *Engine) SaveSnapshot() {
+// lockAll stops every shard between commands, so a snapshot sees no command
+// half applied and the Positions it records match the state exactly. Books
+// are taken in ticker order, then mu, keeping the book-then-mu lock order.
+func (e *Engine) lockAll() func() {
+	tickers := make([]string, 0, len(e.Orderbooks))
+	for ticker := range e.Orderbooks {
+		tickers = append(tickers, ticker)
+	}
+	sort.Strings(tickers)
+	// Held by pointer, not looked up again on unlock: a standby's restore
+	// replaces the books while it holds their locks.
+	books := make([]*Orderbook, len(tickers))
+	for i, ticker := range tickers {
+		books[i] = e.Orderbooks[ticker]
+		books[i].mu.Lock()
+	}
 	e.mu.Lock()
-	data, err := json.Marshal(struct {
-		Orderbooks map[string]*Orderbook              `json:"orderbooks"`
-		Balances   map[string]map[string]*UserBalance `json:"balances"`
-		Users      map[string]string                  `json:"users"`
-	}{e.Orderbooks, e.Balances, e.Users})
-	e.mu.Unlock()
+	return func() {
+		e.mu.Unlock()
+		for _, book := range books {
+			book.mu.Unlock()
+		}
+	}
+}
+
+// SaveSnapshot writes the current state and reports what it stored, if anything.
+func (e *Engine) SaveSnapshot() (SnapshotMeta, bool) {
+	unlock := e.lockAll()
+	meta := SnapshotMeta{Sequence: e.Sequence, Positions: map[string]uint64{}, CreatedAt: time.Now().UTC()}
+	for shard, position := range e.Positions {
+		meta.Positions[shard] = position
+	}
+	state, err := json.Marshal(e.state())
+	unlock()
 
 	if err != nil {
 		log.Printf("Error marshaling snapshot: %v", err)
-		return
+		return meta, false
 	}
-	// Write-then-rename, not WriteFile: WriteFile truncates first, so a crash
-	// mid-write leaves valid-length garbage that loadSnapshot discards — which
-	// silently re-seeds every balance while Postgres still holds the trades.
-	// Rename is atomic, so the file is either the old snapshot or the new one.
-	// This matters most on shutdown: main.go saves once more on SIGTERM, racing
+	compression, err := snapshotCompression()
+	if err != nil {
+		log.Printf("Error encoding snapshot: %v", err)
+		return meta, false
+	}
+	data, err := encodeSnapshot(state, meta, compression)
+	if err != nil {
+		log.Printf("Error encoding snapshot: %v", err)
+		return meta, false
+	}
+	// This matters most on shutdown: lead saves once more on SIGTERM, racing
 	// the platform's grace period before SIGKILL.
-	path := snapshotPath()
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
+	if err := e.snapshotStore().Save(data, meta); err != nil {
 		log.Printf("Error writing snapshot: %v", err)
-		return
-	}
-	if err := os.Rename(tmp, path); err != nil {
-		log.Printf("Error replacing snapshot: %v", err)
+		return meta, false
 	}
+	e.mu.Lock()
+	e.lastSnapshot = meta
+	e.mu.Unlock()
+	return meta, true
 }
 
+// accountShard is the shard for commands that arrive on markets.AccountQueue.
+// Every other shard is named after its market.
+const accountShard = "account"
+
+// Process runs one command as if it had arrived on the account queue.
 func (e *Engine) Process(message MessageFromAPI, clientID string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	e.process(accountShard, message, clientID, outcome{})
+}
 
+// process runs one command delivered by shard's queue. The lock it holds is
+// chosen by what the command touches, not by where it arrived: an API from
+// before the engine was sharded sends every command to the account queue.
+//
+// follow is the command's outcome as the leader journaled it, for a replay
+// to follow; process returns the outcome this run came to, for the leader to
+// journal (see outcome).
+func (e *Engine) process(shard string, message MessageFromAPI, clientID string, follow outcome) outcome {
+	unlock := e.lockFor(message)
+	defer unlock()
+
+	// Handed to the handlers on the book, which the lock above covers.
+	book := e.Orderbooks[commandMarket(message)]
+	if book != nil {
+		book.follow, book.decided = follow, outcome{At: follow.At}
+		if book.decided.At.IsZero() {
+			book.decided.At = stamp()
+		}
+		defer func() { book.follow, book.decided = outcome{}, outcome{} }()
+	}
+
+	// Timed from when the command holds its lock, so this is the engine's own
+	// cost. Time spent queued shows up in GET_ENGINE_STATS as queue length.
+	defer func(start time.Time) { e.stats.record(message.Type, time.Since(start)) }(time.Now())
+
+	e.advance(shard)
 	switch message.Type {
 	case CREATE_ORDER:
 		e.handleCreateOrder(message, clientID)
 	case CANCEL_ORDER:
 		e.handleCancelOrder(message, clientID)
+	case CANCEL_ALL:
+		e.handleCancelAll(message, clientID)
 	case GET_OPEN_ORDERS:
 		e.handleGetOpenOrders(message, clientID)
 	case ON_RAMP:
 		e.handleOnRamp(message, clientID)
 	case GET_DEPTH:
 		e.handleGetDepth(message, clientID)
+	case GET_TICKER:
+		e.handleGetTicker(message, clientID)
 	case GET_BALANCE:
 		e.handleGetBalance(message, clientID)
 	case CREATE_USER:
 		e.handleCreateUser(message, clientID)
 	case GET_USERS:
 		e.handleGetUsers(clientID)
+	case GET_ENGINE_STATS:
+		e.handleGetEngineStats(clientID)
 	default:
 		// Every path through Process must answer. The API blocks on a pub/sub
 		// reply, so a message we silently drop costs the caller its full
 		// timeout rather than returning an error.
-		sendRejection(clientID, &OrderError{
+		e.reject(clientID, &OrderError{
 			Code:   "UNKNOWN_COMMAND",
 			Reason: "unsupported message type: " + message.Type,
 		})
 	}
+	if book != nil {
+		return book.decided
+	}
+	return outcome{}
+}
+
+// lockFor takes the book lock for a command about one listed market, and mu
+// for anything else. GET_ENGINE_STATS takes none: it reads every book and the
+// balances, which under mu would break the book-then-mu order, so Stats takes
+// each lock in turn itself. Changing no state, it needs no place in a
+// snapshot's cut either.
+func (e *Engine) lockFor(message MessageFromAPI) func() {
+	if message.Type == GET_ENGINE_STATS {
+		return func() {}
+	}
+	if book, ok := e.Orderbooks[commandMarket(message)]; ok {
+		book.mu.Lock()
+		return book.mu.Unlock
+	}
+	e.mu.Lock()
+	return e.mu.Unlock
+}
+
+// commandMarket is the market a command is about, or "" for one that is about
+// balances or users instead.
+func commandMarket(message MessageFromAPI) string {
+	switch message.Type {
+	case CREATE_ORDER, CANCEL_ORDER, CANCEL_ALL, GET_OPEN_ORDERS, GET_DEPTH, GET_TICKER:
+	default:
+		return ""
+	}
+	dataBytes, _ := json.Marshal(message.Data)
+	var routed struct {
+		Market string `json:"market"`
+	}
+	json.Unmarshal(dataBytes, &routed)
+	return routed.Market
+}
+
+// advance counts one command delivered by shard.
+func (e *Engine) advance(shard string) {
+	e.seqMu.Lock()
+	defer e.seqMu.Unlock()
+	e.Sequence++
+	if e.Positions == nil {
+		e.Positions = make(map[string]uint64)
+	}
+	e.Positions[shard]++
+}
+
+// positions copies Positions.
+func (e *Engine) positions() map[string]uint64 {
+	e.seqMu.Lock()
+	defer e.seqMu.Unlock()
+	positions := make(map[string]uint64, len(e.Positions))
+	for shard, position := range e.Positions {
+		positions[shard] = position
+	}
+	return positions
+}
+
+// position is how many commands shard has delivered.
+func (e *Engine) position(shard string) uint64 {
+	e.seqMu.Lock()
+	defer e.seqMu.Unlock()
+	return e.Positions[shard]
 }
 
 func (e *Engine) handleCreateOrder(message MessageFromAPI, clientID string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panic creating order: %v", r)
-			sendRejection(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
+			e.reject(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
 		}
 	}()
 
@@ -187,11 +384,12 @@ func (e *Engine) handleCreateOrder(message MessageFromAPI, clientID string) {
 		data.Market, data.Price, data.Quantity, data.Side, data.UserID, data.Type)
 	if err != nil {
 		log.Printf("Order rejected: %v", err)
-		sendRejection(clientID, err)
+		e.reject(clientID, err)
+		e.publishOrderEvent(data.UserID, rejectedOrder(data, err))
 		return
 	}
 
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type: "ORDER_PLACED",
 		Payload: OrderPlacedPayload{
 			OrderID:     orderID,
@@ -201,17 +399,21 @@ func (e *Engine) handleCreateOrder(message MessageFromAPI, clientID string) {
 	})
 }
 
-func sendRejection(clientID string, err error) {
-	code := "INTERNAL"
-	if oe, ok := err.(*OrderError); ok {
-		code = oe.Code
-	}
-	sendToAPI(clientID, MessageToAPI{
+func (e *Engine) reject(clientID string, err error) {
+	e.reply(clientID, MessageToAPI{
 		Type:    "ORDER_REJECTED",
-		Payload: OrderRejectedPayload{Reason: err.Error(), Code: code},
+		Payload: OrderRejectedPayload{Reason: err.Error(), Code: errorCode(err)},
 	})
 }
 
+// errorCode is the OrderError code behind err, INTERNAL for anything else.
+func errorCode(err error) string {
+	if oe, ok := err.(*OrderError); ok {
+		return oe.Code
+	}
+	return "INTERNAL"
+}
+
 func (e *Engine) handleGetBalance(message MessageFromAPI, clientID string) {
 	dataBytes, _ := json.Marshal(message.Data)
 	var data GetBalanceData
@@ -222,7 +424,7 @@ func (e *Engine) handleGetBalance(message MessageFromAPI, clientID string) {
 		balances = map[string]*UserBalance{}
 	}
 
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type:    GET_BALANCE,
 		Payload: balances,
 	})
@@ -232,7 +434,7 @@ func (e *Engine) handleCancelOrder(message MessageFromAPI, clientID string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Error cancelling order: %v", r)
-			sendRejection(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
+			e.reject(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
 		}
 	}()
 
@@ -242,15 +444,13 @@ func (e *Engine) handleCancelOrder(message MessageFromAPI, clientID string) {
 
 	orderbook, exists := e.Orderbooks[data.Market]
 	if !exists {
-		sendRejection(clientID, &OrderError{
+		e.reject(clientID, &OrderError{
 			Code:   "NO_ORDERBOOK",
 			Reason: "no orderbook for market " + data.Market,
 		})
 		return
 	}
 
-	baseAsset := strings.Split(data.Market, "_")[0]
-
 	// Find order in asks or bids
 	var order *Order
 	for _, ask := range orderbook.Asks {
@@ -268,66 +468,126 @@ func (e *Engine) handleCancelOrder(message MessageFromAPI, clientID string) {
 		}
 	}
 
-	if order == nil {
+	// Someone else's order is reported as missing rather than as forbidden,
+	// so a guessed id says nothing about whether it exists. The HTTP API
+	// sends no user and is not checked.
+	if order == nil || (data.UserID != "" && order.UserID != data.UserID) {
 		// Routine, not exceptional: an order that filled between the client
 		// reading the book and sending the cancel is already gone. The market
 		// maker does this every tick by design.
-		sendRejection(clientID, &OrderError{
+		e.reject(clientID, &OrderError{
 			Code:   "ORDER_NOT_FOUND",
 			Reason: "no resting order " + data.OrderID + " on " + data.Market,
 		})
 		return
 	}
 
+	cancelled := e.cancelResting(orderbook, data.Market, *order)
+	e.publishBalances(order.UserID)
+
+	e.reply(clientID, MessageToAPI{
+		Type:    "ORDER_CANCELLED",
+		Payload: cancelled,
+	})
+}
+
+// handleCancelAll cancels every order userId has resting on market. None is
+// not an error: the reply is simply empty.
+func (e *Engine) handleCancelAll(message MessageFromAPI, clientID string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error cancelling orders: %v", r)
+			e.reject(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
+		}
+	}()
+
+	dataBytes, _ := json.Marshal(message.Data)
+	var data CancelAllData
+	json.Unmarshal(dataBytes, &data)
+
+	orderbook, exists := e.Orderbooks[data.Market]
+	if !exists {
+		e.reject(clientID, &OrderError{
+			Code:   "NO_ORDERBOOK",
+			Reason: "no orderbook for market " + data.Market,
+		})
+		return
+	}
+
+	cancelled := []OrderCancelledPayload{}
+	for _, order := range orderbook.GetOpenOrders(data.UserID) {
+		cancelled = append(cancelled, e.cancelResting(orderbook, data.Market, order))
+	}
+	if len(cancelled) > 0 {
+		e.publishBalances(data.UserID)
+	}
+
+	e.reply(clientID, MessageToAPI{
+		Type:    "ORDERS_CANCELLED",
+		Payload: cancelled,
+	})
+}
+
+// cancelResting takes order off book, frees what it had locked and records
+// the cancellation. Publishing the owner's balances is left to the caller, so
+// cancelling many orders sends them once. Called under book.mu.
+func (e *Engine) cancelResting(orderbook *Orderbook, market string, order Order) OrderCancelledPayload {
+	baseAsset := strings.Split(market, "_")[0]
+
 	if order.Side == "buy" {
-		price := orderbook.CancelBid(*order)
+		price := orderbook.CancelBid(order)
 		leftQuantity := (order.Quantity - order.Filled) * order.Price
 
 		// ponytail: refunds BASE_CURRENCY rather than the market's quote asset.
 		// Correct while every market is USD-quoted; derive the quote from
-		// data.Market if a non-USD pair is ever added.
-		if userBalance, exists := e.Balances[order.UserID]; exists {
-			if baseCurrency, exists := userBalance[BASE_CURRENCY]; exists {
+		// market if a non-USD pair is ever added.
+		e.withBalances(func() {
+			if baseCurrency, exists := e.Balances[order.UserID][BASE_CURRENCY]; exists {
 				releaseFunds(baseCurrency, leftQuantity)
 			}
-		}
+		})
 
 		if price != nil {
-			e.publishWSDepthUpdates(nil, "", "", data.Market)
+			e.publishDepthDiff(orderbook, market)
 		}
 	} else {
-		price := orderbook.CancelAsk(*order)
+		price := orderbook.CancelAsk(order)
 		leftQuantity := order.Quantity - order.Filled
 
 		// A sell locks the base asset, not the quote asset.
-		if userBalance, exists := e.Balances[order.UserID]; exists {
-			if baseBalance, exists := userBalance[baseAsset]; exists {
+		e.withBalances(func() {
+			if baseBalance, exists := e.Balances[order.UserID][baseAsset]; exists {
 				releaseFunds(baseBalance, leftQuantity)
 			}
-		}
+		})
 
 		if price != nil {
-			e.publishWSDepthUpdates(nil, "", "", data.Market)
+			e.publishDepthDiff(orderbook, market)
 		}
 	}
 
-	e.markOrderCancelled(data.OrderID)
-
-	sendToAPI(clientID, MessageToAPI{
-		Type: "ORDER_CANCELLED",
-		Payload: OrderCancelledPayload{
-			OrderID:      data.OrderID,
-			ExecutedQty:  order.Filled,
-			RemainingQty: order.Quantity - order.Filled,
-		},
+	e.markOrderCancelled(market, order.OrderID)
+	e.publishOrderEvent(order.UserID, OrderEvent{
+		Event:        ORDER_CANCELLED,
+		OrderID:      order.OrderID,
+		Market:       market,
+		Side:         order.Side,
+		Price:        formatNum(order.Price),
+		RemainingQty: formatNum(order.Quantity - order.Filled),
 	})
+
+	return OrderCancelledPayload{
+		OrderID:      order.OrderID,
+		ExecutedQty:  order.Filled,
+		RemainingQty: order.Quantity - order.Filled,
+	}
 }
 
 func (e *Engine) handleGetOpenOrders(message MessageFromAPI, clientID string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Error getting open orders: %v", r)
-			sendRejection(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
+			e.reject(clientID, &OrderError{Code: "INTERNAL", Reason: fmt.Sprintf("%v", r)})
 		}
 	}()
 
@@ -337,7 +597,7 @@ func (e *Engine) handleGetOpenOrders(message MessageFromAPI, clientID string) {
 
 	orderbook, exists := e.Orderbooks[data.Market]
 	if !exists {
-		sendRejection(clientID, &OrderError{
+		e.reject(clientID, &OrderError{
 			Code:   "NO_ORDERBOOK",
 			Reason: "no orderbook for market " + data.Market,
 		})
@@ -346,7 +606,7 @@ func (e *Engine) handleGetOpenOrders(message MessageFromAPI, clientID string) {
 
 	openOrders := orderbook.GetOpenOrders(data.UserID)
 
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type:    "OPEN_ORDERS",
 		Payload: openOrders,
 	})
@@ -363,14 +623,14 @@ func (e *Engine) handleOnRamp(message MessageFromAPI, clientID string) {
 	// reaches a balance also makes json.Marshal fail, which kills SaveSnapshot
 	// permanently, so it has to be rejected at the parse.
 	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 {
-		sendRejection(clientID, &OrderError{
+		e.reject(clientID, &OrderError{
 			Code:   "INVALID_AMOUNT",
 			Reason: "amount must be a positive, finite number: " + data.Amount,
 		})
 		return
 	}
 	userid, asset, balance := e.onRamp(data.UserID, data.Asset, amount, data.TxnID)
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type: "ON_RAMP",
 		Payload: OnRampPayload{
 			UserID:  userid,
@@ -384,7 +644,7 @@ func (e *Engine) handleGetDepth(message MessageFromAPI, clientID string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Error getting depth: %v", r)
-			sendToAPI(clientID, MessageToAPI{
+			e.reply(clientID, MessageToAPI{
 				Type: GET_DEPTH,
 				Payload: DepthPayload{
 					Bids: [][2]string{},
@@ -404,9 +664,16 @@ func (e *Engine) handleGetDepth(message MessageFromAPI, clientID string) {
 		panic("No orderbook found")
 	}
 
-	sendToAPI(clientID, MessageToAPI{
+	depth := orderbook.GetDepth()
+	switch {
+	case data.Limit < 0:
+		depth = orderbook.GetDepthWithLimit(math.MaxInt)
+	case data.Limit > 0:
+		depth = orderbook.GetDepthWithLimit(data.Limit)
+	}
+	e.reply(clientID, MessageToAPI{
 		Type:    GET_DEPTH,
-		Payload: orderbook.GetDepth(),
+		Payload: depth,
 	})
 	log.Printf("Depth for market %s sent to client %s", data.Market, clientID)
 }
@@ -471,14 +738,20 @@ func (e *Engine) CreateOrder(market, priceStr, quantityStr, side, userID, orderT
 		}
 	}
 
-	if err := e.CheckAndLockFunds(baseAsset, quoteAsset, side, userID, price, quantity); err != nil {
-		return 0, nil, "", err
+	var lockErr error
+	e.withBalances(func() {
+		lockErr = e.lockFunds(baseAsset, quoteAsset, side, userID, price, quantity, orderbook.follow.Funds)
+	})
+	orderbook.decided.Funds = fundsLocked
+	if lockErr != nil {
+		orderbook.decided.Funds = fundsShort
+		return 0, nil, "", lockErr
 	}
 
 	order := Order{
 		Price:    price,
 		Quantity: quantity,
-		OrderID:  generateOrderID(),
+		OrderID:  e.nextOrderID(orderbook),
 		Filled:   0,
 		Side:     side,
 		UserID:   userID,
@@ -488,22 +761,54 @@ func (e *Engine) CreateOrder(market, priceStr, quantityStr, side, userID, orderT
 	executedQty, fills, err := orderbook.AddOrder(order, restRemainder)
 	if err != nil {
 		// Validation failed after we locked funds - give them straight back.
-		e.releaseLock(userID, baseAsset, quoteAsset, side, quantity, price)
+		e.withBalances(func() { e.releaseLock(userID, baseAsset, quoteAsset, side, quantity, price) })
 		return 0, nil, "", &OrderError{Code: "INVALID_ORDER", Reason: err.Error()}
 	}
 
-	e.UpdateBalance(userID, baseAsset, quoteAsset, side, market, fills, executedQty)
-	e.releaseOverLock(userID, baseAsset, quoteAsset, side, fills, executedQty, quantity, price, restRemainder)
+	// The ledger rows are persisted after mu is released, like the trades
+	// and orders below: a push is network I/O, and under mu every other
+	// market's fills would queue behind it.
+	var ledger []DbMessage
+	e.withBalances(func() {
+		ledger = e.UpdateBalance(userID, baseAsset, quoteAsset, side, market, fills, executedQty)
+		e.releaseOverLock(userID, baseAsset, quoteAsset, side, fills, executedQty, quantity, price, restRemainder)
+	})
 
-	e.CreateDbTrades(fills, market, userID)
+	for _, message := range ledger {
+		if err := e.persist(message); err != nil {
+			log.Printf("Error pushing ledger entries for %s: %v", message.EventID, err)
+		}
+	}
+	e.CreateDbTrades(order, fills, market, orderbook.now())
 	e.UpdateDbOrders(order, executedQty, fills, market, restRemainder)
-	e.publishWSDepthUpdates(fills, priceStr, side, market)
-	e.publishWSTrades(fills, userID, market)
+	e.publishDepthDiff(orderbook, market)
+	e.publishWSTrades(fills, userID, market, orderbook.now())
+	e.publishOrderFills(orderbook, market, order, fills, restRemainder)
+	e.publishBalances(fillUsers(userID, fills)...)
+	e.updateCandles(orderbook, market, fills)
+	e.recordTicker(orderbook, market, fills)
 
 	return executedQty, fills, order.OrderID, nil
 }
 
+// withBalances runs fn under mu, for a market command that has to touch
+// balances while holding its book. Deferred, so a panic in fn - which the
+// handlers recover from - cannot leave every other market locked out.
+func (e *Engine) withBalances(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn()
+}
+
 func (e *Engine) CheckAndLockFunds(baseAsset, quoteAsset, side, userID string, price, quantity float64) error {
+	return e.lockFunds(baseAsset, quoteAsset, side, userID, price, quantity, fundsUnchecked)
+}
+
+// lockFunds locks what an order needs, if the user has it. Replaying, follow
+// is what the leader found instead, and wins: fundsLocked locks even when
+// this engine's balance falls short for now, because the leader ran another
+// market's command in between that this engine has yet to replay.
+func (e *Engine) lockFunds(baseAsset, quoteAsset, side, userID string, price, quantity float64, follow fundsCheck) error {
 	if _, exists := e.Balances[userID]; !exists {
 		e.Balances[userID] = make(map[string]*UserBalance)
 	}
@@ -518,7 +823,11 @@ func (e *Engine) CheckAndLockFunds(baseAsset, quoteAsset, side, userID string, p
 	}
 
 	bal := e.Balances[userID][asset]
-	if bal.Available < needed {
+	short := bal.Available < needed
+	if follow != fundsUnchecked {
+		short = follow == fundsShort
+	}
+	if short {
 		return &OrderError{
 			Code: "INSUFFICIENT_FUNDS",
 			Reason: fmt.Sprintf("insufficient %s: need %.4f, have %.4f",
@@ -600,8 +909,9 @@ func (e *Engine) pushLedger(userID, asset string, delta float64, reason, refID s
 	if delta == 0 {
 		return
 	}
-	err := pushDbMessage(DbMessage{
-		Type: LEDGER_ENTRY,
+	err := e.persist(DbMessage{
+		EventID: e.eventID("ledger", reason, refID, userID, asset),
+		Type:    LEDGER_ENTRY,
 		Data: LedgerEntryData{
 			UserID: userID,
 			Asset:  asset,
@@ -615,13 +925,40 @@ func (e *Engine) pushLedger(userID, asset string, delta float64, reason, refID s
 	}
 }
 
+// tradeLedger appends the four legs of one fill on market to ledger, as a
+// single message. Sent as four, a batch boundary or a crash between them
+// could leave the ledger holding half a trade, which reconcile reports as
+// drift that is not there.
+func (e *Engine) tradeLedger(ledger []DbMessage, market, ref string, legs ...LedgerEntryData) []DbMessage {
+	entries := make([]LedgerEntryData, 0, len(legs))
+	for _, leg := range legs {
+		if leg.Delta != 0 {
+			leg.Reason, leg.RefID = LEDGER_TRADE, ref
+			entries = append(entries, leg)
+		}
+	}
+	if len(entries) == 0 {
+		return ledger
+	}
+	return append(ledger, DbMessage{
+		EventID: e.eventID("ledger", LEDGER_TRADE, ref),
+		Type:    LEDGER_ENTRIES,
+		Data:    LedgerEntriesData{Entries: entries},
+		Market:  market,
+	})
+}
+
 // tradeRefID matches the id CreateDbTrades writes into sol_prices, so a ledger
 // row can be traced back to the trade that caused it.
 func tradeRefID(market string, tradeID int) string {
 	return market + "-" + strconv.Itoa(tradeID)
 }
 
-func (e *Engine) UpdateBalance(userID, baseAsset, quoteAsset, side, market string, fills []Fill, executedQty float64) {
+// UpdateBalance settles fills between the taker and their makers, under mu.
+// It returns the ledger messages for them rather than persisting them, so
+// the caller can push them once mu is released.
+func (e *Engine) UpdateBalance(userID, baseAsset, quoteAsset, side, market string, fills []Fill, executedQty float64) []DbMessage {
+	var ledger []DbMessage
 	if side == "buy" {
 		for _, fill := range fills {
 			fillPrice, _ := strconv.ParseFloat(fill.Price, 64)
@@ -651,11 +988,12 @@ func (e *Engine) UpdateBalance(userID, baseAsset, quoteAsset, side, market strin
 
 			// Four legs, netting to zero per asset: a trade moves value between
 			// two users, it never creates any.
-			ref := tradeRefID(market, fill.TradeID)
-			e.pushLedger(fill.OtherUserID, quoteAsset, fillQty*fillPrice, LEDGER_TRADE, ref)
-			e.pushLedger(userID, quoteAsset, -fillQty*fillPrice, LEDGER_TRADE, ref)
-			e.pushLedger(fill.OtherUserID, baseAsset, -fillQty, LEDGER_TRADE, ref)
-			e.pushLedger(userID, baseAsset, fillQty, LEDGER_TRADE, ref)
+			ledger = e.tradeLedger(ledger, market, tradeRefID(market, fill.TradeID),
+				LedgerEntryData{UserID: fill.OtherUserID, Asset: quoteAsset, Delta: fillQty * fillPrice},
+				LedgerEntryData{UserID: userID, Asset: quoteAsset, Delta: -fillQty * fillPrice},
+				LedgerEntryData{UserID: fill.OtherUserID, Asset: baseAsset, Delta: -fillQty},
+				LedgerEntryData{UserID: userID, Asset: baseAsset, Delta: fillQty},
+			)
 		}
 	} else {
 		for _, fill := range fills {
@@ -685,13 +1023,15 @@ func (e *Engine) UpdateBalance(userID, baseAsset, quoteAsset, side, market strin
 			e.Balances[userID][baseAsset].Locked -= fillQty
 
 			// Mirror image of the buy branch.
-			ref := tradeRefID(market, fill.TradeID)
-			e.pushLedger(fill.OtherUserID, quoteAsset, -fillQty*fillPrice, LEDGER_TRADE, ref)
-			e.pushLedger(userID, quoteAsset, fillQty*fillPrice, LEDGER_TRADE, ref)
-			e.pushLedger(fill.OtherUserID, baseAsset, fillQty, LEDGER_TRADE, ref)
-			e.pushLedger(userID, baseAsset, -fillQty, LEDGER_TRADE, ref)
+			ledger = e.tradeLedger(ledger, market, tradeRefID(market, fill.TradeID),
+				LedgerEntryData{UserID: fill.OtherUserID, Asset: quoteAsset, Delta: -fillQty * fillPrice},
+				LedgerEntryData{UserID: userID, Asset: quoteAsset, Delta: fillQty * fillPrice},
+				LedgerEntryData{UserID: fill.OtherUserID, Asset: baseAsset, Delta: fillQty},
+				LedgerEntryData{UserID: userID, Asset: baseAsset, Delta: -fillQty},
+			)
 		}
 	}
+	return ledger
 }
 
 // formatNum renders a price or quantity for the UI and the trade log. Fixed 2
@@ -709,24 +1049,40 @@ func formatNum(v float64) string {
 	return s
 }
 
-func (e *Engine) CreateDbTrades(fills []Fill, market, userID string) {
+// CreateDbTrades records each of taker's fills as a trade, naming both orders
+// and both users so the trades table needs no join against the ledger to say
+// who traded with whom. at is when the command ran, which the candles and
+// ticker were bucketed by too, so a replay writes the row the leader did.
+func (e *Engine) CreateDbTrades(taker Order, fills []Fill, market string, at time.Time) {
+	makerSide := "sell"
+	if taker.Side == "sell" {
+		makerSide = "buy"
+	}
 	for _, fill := range fills {
 		fillPrice, _ := strconv.ParseFloat(fill.Price, 64)
 
-		pushDbMessage(DbMessage{
-			Type: TRADE_ADDED,
+		e.persist(DbMessage{
+			EventID: e.eventID("trade", tradeRefID(market, fill.TradeID)),
+			Type:    TRADE_ADDED,
 			Data: TradeAddedData{
 				Market: market,
 				// LastTradeID is per-orderbook and restarts at 0 for each new
 				// market, so the raw id collides on the (id, time) primary key.
 				ID:            market + "-" + strconv.Itoa(fill.TradeID),
-				IsBuyerMaker:  fill.OtherUserID == userID,
+				IsBuyerMaker:  taker.Side == "sell",
 				Price:         fill.Price,
 				Quantity:      formatNum(fill.Qty),
-				QuoteQuantity: fmt.Sprintf("%.2f", fill.Qty*fillPrice),
+				QuoteQuantity: formatNum(fill.Qty * fillPrice),
 				// Milliseconds: the kline processor divides this by 1000.
-				Timestamp: time.Now().UnixMilli(),
+				Timestamp:    at.UnixMilli(),
+				MakerOrderID: fill.MarkerOrderID,
+				TakerOrderID: taker.OrderID,
+				MakerUserID:  fill.OtherUserID,
+				TakerUserID:  taker.UserID,
+				MakerSide:    makerSide,
+				TakerSide:    taker.Side,
 			},
+			Market: market,
 		})
 	}
 }
@@ -759,8 +1115,9 @@ func (e *Engine) UpdateDbOrders(order Order, executedQty float64, fills []Fill,
 
 	// The taker's own row: everything needed to INSERT it, with the quantity it
 	// filled on entry as the first delta.
-	pushDbMessage(DbMessage{
-		Type: ORDER_UPDATE,
+	e.persist(DbMessage{
+		EventID: e.eventID("order", order.OrderID, "create"),
+		Type:    ORDER_UPDATE,
 		Data: OrderUpdateData{
 			OrderID:     order.OrderID,
 			ExecutedQty: executedQty,
@@ -771,38 +1128,43 @@ func (e *Engine) UpdateDbOrders(order Order, executedQty float64, fills []Fill,
 			UserID:      &userID,
 			Status:      &status,
 		},
+		Market: market,
 	})
 
 	// Maker rows already exist from their own create, so these carry the delta
 	// alone. The nil identifying fields are what mark them as increments.
 	for _, fill := range fills {
-		pushDbMessage(DbMessage{
-			Type: ORDER_UPDATE,
+		e.persist(DbMessage{
+			EventID: e.eventID("order", fill.MarkerOrderID, "fill", tradeRefID(market, fill.TradeID)),
+			Type:    ORDER_UPDATE,
 			Data: OrderUpdateData{
 				OrderID:     fill.MarkerOrderID,
 				ExecutedQty: fill.Qty,
 			},
+			Market: market,
 		})
 	}
 }
 
-// markOrderCancelled records a cancellation. Without it a cancelled order sits
-// in the database as permanently open.
-func (e *Engine) markOrderCancelled(orderID string) {
+// markOrderCancelled records a cancellation on market. Without it a cancelled
+// order sits in the database as permanently open.
+func (e *Engine) markOrderCancelled(market, orderID string) {
 	status := "cancelled"
-	pushDbMessage(DbMessage{
-		Type: ORDER_UPDATE,
+	e.persist(DbMessage{
+		EventID: e.eventID("order", orderID, "cancel"),
+		Type:    ORDER_UPDATE,
 		Data: OrderUpdateData{
 			OrderID:     orderID,
 			ExecutedQty: 0,
 			Status:      &status,
 		},
+		Market: market,
 	})
 }
 
-func (e *Engine) publishWSTrades(fills []Fill, userID, market string) {
+func (e *Engine) publishWSTrades(fills []Fill, userID, market string, at time.Time) {
 	for _, fill := range fills {
-		GetRedisInstance().PublishMessage(fmt.Sprintf("trade@%s", market), WsMessage{
+		e.publish(fmt.Sprintf("trade@%s", market), WsMessage{
 			Stream: fmt.Sprintf("trade@%s", market),
 			TradeData: &TradeAddedData{
 				E:            "trade",
@@ -811,41 +1173,12 @@ func (e *Engine) publishWSTrades(fills []Fill, userID, market string) {
 				IsBuyerMaker: fill.OtherUserID == userID,
 				Price:        fill.Price,
 				Quantity:     formatNum(fill.Qty),
-				Timestamp:    time.Now().UnixMilli(),
+				Timestamp:    at.UnixMilli(),
 			},
 		})
 	}
 }
 
-func (e *Engine) publishWSDepthUpdates(fills []Fill, price, side, market string) {
-	orderbook, exists := e.Orderbooks[market]
-	if !exists {
-		log.Printf("Orderbook for market %s not found", market)
-		return
-	}
-
-	depth := orderbook.GetDepth()
-	log.Printf("Depth for market %s: %+v", market, depth)
-
-	// Initialize updated bids and asks with the full order book
-	updatedBids := make([][2]string, len(depth.Bids))
-	copy(updatedBids, depth.Bids)
-	updatedAsks := make([][2]string, len(depth.Asks))
-	copy(updatedAsks, depth.Asks)
-
-	message := WsMessage{
-		Stream: fmt.Sprintf("depth@%s", market),
-		Data: &DepthData{
-			B: updatedBids,
-			A: updatedAsks,
-			E: "depth",
-		},
-	}
-	log.Printf("Publishing WsMessage to %s: %+v", message.Stream, message)
-
-	GetRedisInstance().PublishMessage(message.Stream, message)
-}
-
 // onRamp credits a deposit of one asset. txnID is the transfers row the API
 // already wrote before sending this message; it becomes the ledger ref so a
 // credit can be traced back to the deposit that caused it.
@@ -865,6 +1198,8 @@ func (e *Engine) onRamp(userID, asset string, amount float64, txnID string) (str
 
 	e.Balances[userID][asset].Available += amount
 	e.pushLedger(userID, asset, amount, LEDGER_DEPOSIT, txnID)
+	// Under mu already: ON_RAMP is not a market command.
+	e.publish(balancesStream(userID), e.balanceMessage(userID))
 	log.Printf("OnRamp: user %s deposited %.2f %s, now holds %.2f",
 		userID, amount, asset, e.Balances[userID][asset].Available)
 
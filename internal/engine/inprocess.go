@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// RunInProcess runs engine as the only engine, consuming its command queues
+// straight off t until ctx is cancelled. There is no leader lock and no
+// journal: both exist so a second engine can take over, and an engine sharing
+// a process with everything else has nobody to hand over to. Snapshots are
+// still saved, so a restart keeps its books.
+func RunInProcess(ctx context.Context, engine *Engine, t transport.Transport) {
+	bus = t
+	if engine.seeded {
+		engine.SaveSnapshot()
+		engine.seeded = false
+	}
+
+	go heartbeat(ctx, engine)
+	go candleLoop(ctx, engine)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				engine.SaveSnapshot()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, shard := range engine.shards() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consume(ctx, engine, t, shard)
+		}()
+	}
+	wg.Wait()
+
+	log.Println("shutting down, saving snapshot")
+	engine.SaveSnapshot()
+}
+
+// consume is work without the journal. Each command is applied as the
+// journal entry it would have been, so both paths number and dead-letter
+// commands alike.
+func consume(ctx context.Context, engine *Engine, t transport.Queue, shard string) {
+	queue := shardQueue(shard)
+	for ctx.Err() == nil {
+		d, ok, err := t.Take(ctx, queue, time.Second)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error taking next %s message: %v", shard, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		seq := engine.position(shard) + 1
+		engine.applyJournaled(journalEntry{Shard: shard, Seq: seq, Payload: string(d.Payload)})
+		if err := t.Ack(ctx, queue, d); err != nil {
+			log.Printf("Error acknowledging %s message: %v", shard, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// cmd/allinone and the end-to-end tests stand on this: a command queued the
+// way the API queues it comes back as a reply on the request's channel, and
+// what the trade wrote is on the db queue for the processor.
+func TestInProcessEngineAnswersOverTheTransport(t *testing.T) {
+	useSnapshotDir(t)
+	mem := transport.NewMemory()
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	original := bus
+	go func() {
+		defer close(done)
+		RunInProcess(ctx, e, mem)
+	}()
+	t.Cleanup(func() { cancel(); <-done; bus = original })
+
+	send := func(clientID string, command MessageFromAPI) MessageToAPI {
+		t.Helper()
+		sub, err := mem.Subscribe(ctx, clientID)
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Close()
+		payload, _ := json.Marshal(queuedMessage{ClientID: clientID, Message: command})
+		mem.Push(ctx, shardQueue(testMarket), payload)
+
+		select {
+		case msg := <-sub.Messages():
+			var reply MessageToAPI
+			if err := json.Unmarshal(msg.Payload, &reply); err != nil {
+				t.Fatalf("reply: %v", err)
+			}
+			return reply
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply to %s", command.Type)
+			return MessageToAPI{}
+		}
+	}
+
+	if reply := send("maker-client", order("sell", "100", "2", "maker")); reply.Type != "ORDER_PLACED" {
+		t.Fatalf("maker reply = %s, want ORDER_PLACED", reply.Type)
+	}
+	if reply := send("taker-client", order("buy", "100", "1", "taker")); reply.Type != "ORDER_PLACED" {
+		t.Fatalf("taker reply = %s, want ORDER_PLACED", reply.Type)
+	}
+
+	trades := 0
+	for {
+		d, ok, _ := mem.Take(ctx, transport.DbPartition(testMarket), 0)
+		if !ok {
+			break
+		}
+		var message DbMessage
+		json.Unmarshal(d.Payload, &message)
+		if message.Type == TRADE_ADDED {
+			trades++
+		}
+	}
+	if trades != 1 {
+		t.Errorf("%s carried %d trades, want 1", transport.DbPartition(testMarket), trades)
+	}
+	if n, _ := mem.Len(ctx, shardQueue(testMarket)); n != 0 {
+		t.Errorf("%d commands left unacknowledged", n)
+	}
+}
@@ -0,0 +1,481 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/Althaf66/cryptoXchange/internal/streams"
+	"github.com/go-redis/redis/v8"
+)
+
+// Hot standby. Any number of engines can run against the same Redis. The one
+// holding the leader lock consumes the command streams; the rest tail the
+// leader's command journals into their own Engine and take over when the lock
+// lapses. Every shard - the account stream and one per market - has its own
+// journal and applied mark, numbered by its own position.
+//
+// A command is always in exactly one of three places: still queued, pending
+// (read through the engine consumer group but not yet journaled), or in the
+// journal. The step from pending to journaled is one Lua script that also
+// checks the caller still holds the lock, so a deposed leader cannot journal
+// anything once its successor has taken over. The leader processes a command
+// only after journaling it, which means every command that ever produced a
+// reply is in the journal for a standby to apply.
+const (
+	leaderKey = "engine:leader"
+	fenceKey  = "engine:fence"
+)
+
+// The engine reads its command streams as one consumer group with one
+// consumer, whichever engine leads. Sharing the consumer name is what hands
+// a dead leader's pending command to its successor: the new leader reads its
+// own pending entries first, and those are the old leader's. Per-engine names
+// would need an XAUTOCLAIM on every takeover, and could still strand a command
+// a fenced leader read in the moment before it noticed.
+const (
+	engineGroup    = "engine"
+	engineConsumer = "leader"
+)
+
+func journalKey(shard string) string { return "engine:journal:" + shard }
+
+// outcomesKey holds the outcome of each command on shard that has one,
+// under the command's position, written with its applied mark.
+func outcomesKey(shard string) string { return "engine:outcomes:" + shard }
+
+// fundsCheck is how an order's funds check came out. It is the one decision
+// that depends on how shards interleave: the leader runs markets at once,
+// and two orders on different markets can race for one user's funds. A
+// replay applies each shard's journal in turn, so it cannot know which of
+// the two got there first. The leader therefore journals the outcome, and a
+// replay follows it rather than checking again. Every other balance change
+// is an addition, which comes out the same in any order.
+type fundsCheck string
+
+const (
+	fundsUnchecked fundsCheck = ""
+	fundsLocked    fundsCheck = "locked"
+	fundsShort     fundsCheck = "short"
+)
+
+// outcome is what the leader decided while running a market command that a
+// replay, running it later and in another interleaving, would decide
+// differently: how its funds check came out, and when it ran. The leader
+// journals it with the applied mark and a replay follows it.
+//
+// At is stamped under the book's lock, the one closeCandles takes too, so a
+// command never runs at a time before a candle it would belong to closed.
+// Candles and the ticker are bucketed by it, where a replay bucketing by its
+// own clock would put a whole journal's trades in the minute it caught up in.
+type outcome struct {
+	Funds fundsCheck
+	At    time.Time
+}
+
+// stamp is the time a command runs at, to the millisecond the journal
+// keeps, so the leader buckets by exactly what a replay will.
+func stamp() time.Time { return clock().Truncate(time.Millisecond) }
+
+// appliedKey holds the position of the last command on shard whose replies
+// and persistence messages went out. A new leader replays the journal up to it
+// muted and anything after it live, so nothing is emitted twice.
+func appliedKey(shard string) string { return "engine:applied:" + shard }
+
+// shardQueue is the stream the API adds shard's commands to.
+func shardQueue(shard string) string {
+	if shard == accountShard {
+		return markets.AccountQueue
+	}
+	return markets.CommandQueue(shard)
+}
+
+// shards lists the account shard and one per orderbook.
+func (e *Engine) shards() []string {
+	shards := []string{accountShard}
+	for ticker := range e.Orderbooks {
+		shards = append(shards, ticker)
+	}
+	sort.Strings(shards[1:])
+	return shards
+}
+
+// errFenced means another engine holds the lock.
+var errFenced = errors.New("fenced: another engine is leader")
+
+// claimScript journals command ARGV[3] at position ARGV[2], then acknowledges
+// it and deletes it from its stream, provided ARGV[1] is still the lock's
+// fencing token. The XADD fails on its own if the position is not past the
+// journal's last id, which catches a leader that fell behind the journal.
+// Deleting rather than trimming later keeps a stream's length equal to its
+// backlog, which is what the engine stats report as queue length.
+var claimScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return redis.error_reply('FENCED')
+end
+redis.call('XADD', KEYS[3], ARGV[2] .. '-0', 'fence', ARGV[1], 'msg', ARGV[4])
+redis.call('XACK', KEYS[2], ARGV[5], ARGV[3])
+redis.call('XDEL', KEYS[2], ARGV[3])
+return 1
+`)
+
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// queuedMessage is the payload of a command stream entry as the API adds it.
+type queuedMessage struct {
+	ClientID string         `json:"clientId"`
+	Message  MessageFromAPI `json:"message"`
+}
+
+// journalEntry is one journaled command: the raw queue element and the
+// position on its shard the leader processed it at, and its outcome once the
+// leader has recorded one.
+type journalEntry struct {
+	Shard   string
+	Seq     uint64
+	Payload string
+	Outcome outcome
+}
+
+// lockTTL is how long the leader lock outlives a leader that stops renewing
+// it, and so roughly how long a crash leaves the exchange without an engine.
+func lockTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ENGINE_LOCK_TTL")); err == nil && d >= time.Second {
+		return d
+	}
+	return 5 * time.Second
+}
+
+type journal struct {
+	client *redis.Client
+	ttl    time.Duration
+	// token is the fencing token this engine was issued when it took the lock.
+	token string
+}
+
+func newJournal(client *redis.Client) *journal {
+	return &journal{client: client, ttl: lockTTL()}
+}
+
+// acquire tries once to take the leader lock. Every attempt draws a fresh
+// token, so tokens only ever grow and a stale leader's token never matches.
+func (j *journal) acquire(ctx context.Context) (bool, error) {
+	token, err := j.client.Incr(ctx, fenceKey).Result()
+	if err != nil {
+		return false, err
+	}
+	ok, err := j.client.SetNX(ctx, leaderKey, token, j.ttl).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	j.token = strconv.FormatInt(token, 10)
+	return true, nil
+}
+
+// renew extends the lock. It returns errFenced when the lock has passed to
+// someone else.
+func (j *journal) renew(ctx context.Context) error {
+	held, err := renewScript.Run(ctx, j.client, []string{leaderKey}, j.token, j.ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if held == 0 {
+		return errFenced
+	}
+	return nil
+}
+
+// release gives the lock up so a standby can take over at once, rather than
+// after the TTL. Only used on a clean shutdown.
+func (j *journal) release(ctx context.Context) error {
+	return releaseScript.Run(ctx, j.client, []string{leaderKey}, j.token).Err()
+}
+
+// ensureGroups creates the engine consumer group on every shard's stream.
+func (j *journal) ensureGroups(ctx context.Context, shards []string) error {
+	for _, shard := range shards {
+		if err := streams.EnsureGroup(ctx, j.client, shardQueue(shard), engineGroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next command for shard, journaling it at position seq on
+// the way. It blocks up to wait for one to arrive and reports false if none
+// did. A command a leader read but died before journaling is still pending,
+// and is picked up first.
+func (j *journal) next(ctx context.Context, shard string, seq uint64, wait time.Duration) (string, bool, error) {
+	m, ok, err := j.readGroup(ctx, shard, "0", -1)
+	if err == nil && !ok {
+		m, ok, err = j.readGroup(ctx, shard, ">", wait)
+	}
+	if err != nil || !ok {
+		return "", false, err
+	}
+	payload := streams.Payload(m)
+	return payload, true, j.claim(ctx, shard, seq, m.ID, payload)
+}
+
+// readGroup reads one entry of shard's stream through the engine group: the
+// oldest pending one for "0", the next undelivered one for ">". A negative
+// wait does not block.
+func (j *journal) readGroup(ctx context.Context, shard, id string, wait time.Duration) (redis.XMessage, bool, error) {
+	result, err := j.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    engineGroup,
+		Consumer: engineConsumer,
+		Streams:  []string{shardQueue(shard), id},
+		Count:    1,
+		Block:    wait,
+	}).Result()
+	if err == redis.Nil {
+		return redis.XMessage{}, false, nil
+	}
+	if err != nil {
+		return redis.XMessage{}, false, err
+	}
+	if len(result) == 0 || len(result[0].Messages) == 0 {
+		return redis.XMessage{}, false, nil
+	}
+	return result[0].Messages[0], true, nil
+}
+
+func (j *journal) claim(ctx context.Context, shard string, seq uint64, id, payload string) error {
+	err := claimScript.Run(ctx, j.client,
+		[]string{leaderKey, shardQueue(shard), journalKey(shard)}, j.token, seq, id, payload, engineGroup).Err()
+	if err != nil && strings.Contains(err.Error(), "FENCED") {
+		return errFenced
+	}
+	return err
+}
+
+// markApplied records that the command at seq on shard has had its outputs
+// sent, along with its outcome if it has one. Both go in one transaction: a
+// standby applies nothing past the mark, so the outcome is always there for
+// it to follow.
+func (j *journal) markApplied(ctx context.Context, shard string, seq uint64, o outcome) error {
+	_, err := j.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if o != (outcome{}) {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: outcomesKey(shard),
+				ID:     fmt.Sprintf("%d-0", seq),
+				Values: map[string]interface{}{"funds": string(o.Funds), "at": o.At.UnixMilli()},
+			})
+		}
+		pipe.Set(ctx, appliedKey(shard), seq, 0)
+		return nil
+	})
+	return err
+}
+
+// applied returns the applied mark of every shard.
+func (j *journal) applied(ctx context.Context, shards []string) (map[string]uint64, error) {
+	applied := make(map[string]uint64, len(shards))
+	for _, shard := range shards {
+		n, err := j.client.Get(ctx, appliedKey(shard)).Uint64()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		applied[shard] = n
+	}
+	return applied, nil
+}
+
+// read returns the entries of each shard's journal past the position after
+// gives for it, blocking up to wait for the first one. A zero wait does not
+// block. Entries of one shard come back in order; across shards they do not
+// follow any order, because the leader ran them concurrently.
+func (j *journal) read(ctx context.Context, after map[string]uint64, shards []string, wait time.Duration) ([]journalEntry, error) {
+	entries := []journalEntry{}
+	add := func(shard string, messages []redis.XMessage) error {
+		for _, m := range messages {
+			seq, err := strconv.ParseUint(strings.TrimSuffix(m.ID, "-0"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("journal entry %s/%s: %w", shard, m.ID, err)
+			}
+			payload, _ := m.Values["msg"].(string)
+			entries = append(entries, journalEntry{Shard: shard, Seq: seq, Payload: payload})
+		}
+		return nil
+	}
+
+	if wait == 0 {
+		for _, shard := range shards {
+			messages, err := j.client.XRangeN(ctx, journalKey(shard),
+				fmt.Sprintf("%d-0", after[shard]+1), "+", 1000).Result()
+			if err != nil {
+				return nil, err
+			}
+			if err := add(shard, messages); err != nil {
+				return nil, err
+			}
+		}
+		return entries, j.addOutcomes(ctx, entries)
+	}
+
+	// One XREAD over every journal, so a quiet standby blocks once rather than
+	// once per market.
+	keys := make([]string, 0, 2*len(shards))
+	byKey := make(map[string]string, len(shards))
+	for _, shard := range shards {
+		keys = append(keys, journalKey(shard))
+		byKey[journalKey(shard)] = shard
+	}
+	for _, shard := range shards {
+		keys = append(keys, fmt.Sprintf("%d-0", after[shard]))
+	}
+	streams, err := j.client.XRead(ctx, &redis.XReadArgs{Streams: keys, Count: 1000, Block: wait}).Result()
+	if err == redis.Nil {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		if err := add(byKey[stream.Stream], stream.Messages); err != nil {
+			return nil, err
+		}
+	}
+	return entries, j.addOutcomes(ctx, entries)
+}
+
+// addOutcomes fills in the outcomes recorded for entries.
+func (j *journal) addOutcomes(ctx context.Context, entries []journalEntry) error {
+	first, last := map[string]uint64{}, map[string]uint64{}
+	for _, entry := range entries {
+		if _, ok := first[entry.Shard]; !ok {
+			first[entry.Shard] = entry.Seq
+		}
+		last[entry.Shard] = entry.Seq
+	}
+	outcomes := map[string]map[uint64]outcome{}
+	for shard := range first {
+		messages, err := j.client.XRange(ctx, outcomesKey(shard),
+			fmt.Sprintf("%d-0", first[shard]), fmt.Sprintf("%d-0", last[shard])).Result()
+		if err != nil {
+			return err
+		}
+		outcomes[shard] = map[uint64]outcome{}
+		for _, m := range messages {
+			seq, err := strconv.ParseUint(strings.TrimSuffix(m.ID, "-0"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("outcome %s/%s: %w", shard, m.ID, err)
+			}
+			funds, _ := m.Values["funds"].(string)
+			at, _ := m.Values["at"].(string)
+			ms, err := strconv.ParseInt(at, 10, 64)
+			if err != nil {
+				return fmt.Errorf("outcome %s/%s: %w", shard, m.ID, err)
+			}
+			outcomes[shard][seq] = outcome{Funds: fundsCheck(funds), At: time.UnixMilli(ms).UTC()}
+		}
+	}
+	for i := range entries {
+		entries[i].Outcome = outcomes[entries[i].Shard][entries[i].Seq]
+	}
+	return nil
+}
+
+// trim drops each shard's entries up to and including the position given for
+// it. Only call it with positions some stored snapshot already covers.
+func (j *journal) trim(ctx context.Context, upTo map[string]uint64) error {
+	for shard, seq := range upTo {
+		for _, key := range []string{journalKey(shard), outcomesKey(shard)} {
+			if err := j.client.XTrimMinID(ctx, key, fmt.Sprintf("%d-0", seq+1)).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reset forgets the journals of a previous engine lineage. A freshly seeded
+// engine starts counting at 1 again and could not append to them anyway.
+func (j *journal) reset(ctx context.Context, shards []string) error {
+	keys := []string{}
+	for _, shard := range shards {
+		keys = append(keys, journalKey(shard), appliedKey(shard), outcomesKey(shard))
+	}
+	return j.client.Del(ctx, keys...).Err()
+}
+
+// applyJournaled runs one journaled command on its shard, following the
+// outcome the leader recorded for it if there is one, and returns its own.
+//
+// An entry that does not parse is dead-lettered, and still used up its
+// position on the leader, so it has to here too or every later entry would
+// look like a gap. There is no point retrying it: the same bytes will not
+// parse next time.
+func (e *Engine) applyJournaled(entry journalEntry) outcome {
+	var message queuedMessage
+	if err := json.Unmarshal([]byte(entry.Payload), &message); err != nil {
+		log.Printf("Error unmarshaling message %s/%d: %v", entry.Shard, entry.Seq, err)
+		e.deadLetter(entry.Shard, []byte(entry.Payload), err)
+		e.withBalances(func() { e.advance(entry.Shard) })
+		return outcome{}
+	}
+	return e.process(entry.Shard, message.Message, message.ClientID, entry.Outcome)
+}
+
+// catchUp applies entries, skipping any the engine already has. It stops and
+// reports false at a gap - an entry past its shard's position+1 means that
+// journal was trimmed beyond this engine, and only a newer snapshot can bridge
+// it. Entries at or below mutedThrough(shard) are applied with every output
+// muted; each one after it is passed to live with its outcome, for the
+// caller to mark applied.
+func (e *Engine) catchUp(entries []journalEntry, mutedThrough func(shard string) uint64, live func(journalEntry, outcome)) bool {
+	defer func() { e.replaying = false }()
+	for _, entry := range entries {
+		position := e.position(entry.Shard)
+		if entry.Seq <= position {
+			continue
+		}
+		if entry.Seq != position+1 {
+			return false
+		}
+		e.replaying = entry.Seq <= mutedThrough(entry.Shard)
+		o := e.applyJournaled(entry)
+		if !e.replaying && live != nil {
+			live(entry, o)
+		}
+	}
+	return true
+}
+
+// appliedOnly drops the entries past each shard's applied mark. A standby
+// leaves those for later: the leader may not have finished them, and until
+// it has, their outcomes are not there to follow.
+func appliedOnly(entries []journalEntry, applied map[string]uint64) []journalEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Seq <= applied[entry.Shard] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// allMuted is the catchUp policy of a standby, which never speaks.
+func allMuted(string) uint64 { return math.MaxUint64 }
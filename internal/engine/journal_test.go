@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/streams"
+	"github.com/go-redis/redis/v8"
+)
+
+// countOutputs replaces all three exits with counters, so a test can tell a
+// muted replay from a live one.
+func countOutputs(t *testing.T) *int {
+	t.Helper()
+	n := 0
+	origDb, origAPI, origWS := pushDbMessage, sendToAPI, publishToWS
+	pushDbMessage = func(DbMessage) error { n++; return nil }
+	sendToAPI = func(string, MessageToAPI) error { n++; return nil }
+	publishToWS = func(string, WsMessage) error { n++; return nil }
+	t.Cleanup(func() { pushDbMessage, sendToAPI, publishToWS = origDb, origAPI, origWS })
+	return &n
+}
+
+// standbyPair returns a leader and a standby in the same state, as if the
+// standby had just restored the leader's snapshot.
+func standbyPair(t *testing.T) (*Engine, *Engine) {
+	t.Helper()
+	pair := [2]*Engine{}
+	for i := range pair {
+		e := newTestEngine(t)
+		e.Epoch = "6f1c4a2e-8d3b-4c7a-9e1f-2b5d7a9c0e34"
+		fund(e, "maker", 0, 10)
+		fund(e, "taker", 10000, 0)
+		pair[i] = e
+	}
+	return pair[0], pair[1]
+}
+
+// journalOf runs commands through the leader the way work does, each on the
+// shard the API would have queued it to, and returns them as the journals it
+// would have written.
+func journalOf(t *testing.T, leader *Engine, commands ...MessageFromAPI) []journalEntry {
+	t.Helper()
+	entries := []journalEntry{}
+	for _, c := range commands {
+		shard := commandMarket(c)
+		if shard == "" {
+			shard = accountShard
+		}
+		payload, _ := json.Marshal(queuedMessage{ClientID: "client", Message: c})
+		entry := journalEntry{Shard: shard, Seq: leader.position(shard) + 1, Payload: string(payload)}
+		entry.Outcome = leader.applyJournaled(entry)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func order(side, price, qty, user string) MessageFromAPI {
+	return MessageFromAPI{Type: CREATE_ORDER, Data: CreateOrderData{
+		Market: testMarket, Price: price, Quantity: qty, Side: side, UserID: user,
+	}}
+}
+
+// A standby is only useful if, once promoted, it holds exactly the book the
+// leader had - including order ids, which clients already hold and will cancel.
+func TestStandbyReplaysToTheLeadersState(t *testing.T) {
+	outputs := countOutputs(t)
+	leader, standby := standbyPair(t)
+
+	entries := journalOf(t, leader,
+		order("sell", "100", "4", "maker"),
+		order("sell", "101", "2", "maker"),
+		order("buy", "100", "1", "taker"),
+	)
+	leaderOutputs := *outputs
+
+	if !standby.catchUp(entries, allMuted, nil) {
+		t.Fatal("catchUp reported a gap in a contiguous journal")
+	}
+	if *outputs != leaderOutputs {
+		t.Errorf("replay emitted %d outputs, want none", *outputs-leaderOutputs)
+	}
+	if standby.Sequence != leader.Sequence {
+		t.Errorf("standby sequence = %d, leader = %d", standby.Sequence, leader.Sequence)
+	}
+
+	want := leader.Orderbooks[testMarket].GetOpenOrders("maker")
+	got := standby.Orderbooks[testMarket].GetOpenOrders("maker")
+	if len(got) != len(want) {
+		t.Fatalf("standby has %d open orders, leader %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].OrderID != want[i].OrderID || got[i].Filled != want[i].Filled {
+			t.Errorf("open order %d = %+v, leader has %+v", i, got[i], want[i])
+		}
+	}
+	for _, user := range []string{"maker", "taker"} {
+		for _, asset := range []string{"USD", "SOL"} {
+			assertClose(t, user+" "+asset, bal(t, standby, user, asset).Available, bal(t, leader, user, asset).Available)
+		}
+	}
+}
+
+// On takeover, entries the old leader finished are applied silently and the
+// ones after engine:applied are applied live, since nobody has seen them yet.
+func TestTakeoverEmitsOnlyUnappliedEntries(t *testing.T) {
+	countOutputs(t)
+	replies := captureReplies(t)
+	leader, standby := standbyPair(t)
+
+	entries := journalOf(t, leader,
+		order("sell", "100", "4", "maker"),
+		order("buy", "100", "1", "taker"),
+		MessageFromAPI{Type: GET_USERS},
+	)
+	*replies = nil
+
+	// The old leader finished both orders but not the GET_USERS.
+	standby.catchUp(entries, func(shard string) uint64 {
+		if shard == testMarket {
+			return 2
+		}
+		return 0
+	}, nil)
+	if reply := onlyReply(t, replies); reply.Type != GET_USERS {
+		t.Errorf("live reply = %s, want the GET_USERS after the applied mark", reply.Type)
+	}
+	if standby.replaying {
+		t.Error("engine left muted after catchUp")
+	}
+}
+
+// An entry past position+1 means the journal was trimmed beyond this engine.
+// Applying it anyway would silently skip commands.
+func TestCatchUpStopsAtAGap(t *testing.T) {
+	countOutputs(t)
+	leader, standby := standbyPair(t)
+	entries := journalOf(t, leader,
+		order("sell", "100", "4", "maker"),
+		order("sell", "101", "4", "maker"),
+	)
+
+	if standby.catchUp(entries[1:], allMuted, nil) {
+		t.Fatal("catchUp applied an entry past a gap")
+	}
+	if got := standby.position(testMarket); got != 0 {
+		t.Errorf("standby position = %d after a gap, want 0", got)
+	}
+}
+
+// A leader that dies between emitting a command's outputs and marking it
+// applied has its successor emit them again. The db processor can only skip
+// the repeats if they carry the same event ids, and no two distinct messages
+// may share one.
+func TestTakeoverReemitsTheSameEventIDs(t *testing.T) {
+	countOutputs(t)
+	leader, standby := standbyPair(t)
+	commands := []MessageFromAPI{
+		order("sell", "100", "4", "maker"),
+		order("buy", "100", "3", "taker"),
+	}
+
+	eventIDs := func(run func()) []string {
+		t.Helper()
+		captured := captureDbMessages(t)
+		run()
+		ids := []string{}
+		for _, m := range *captured {
+			ids = append(ids, m.EventID)
+		}
+		return ids
+	}
+
+	var entries []journalEntry
+	first := eventIDs(func() { entries = journalOf(t, leader, commands...) })
+	again := eventIDs(func() { standby.catchUp(entries, func(string) uint64 { return 0 }, nil) })
+
+	if len(first) == 0 {
+		t.Fatal("no persistence messages emitted")
+	}
+	seen := map[string]bool{}
+	for _, id := range first {
+		if id == "" || seen[id] {
+			t.Errorf("event id %q is empty or repeated", id)
+		}
+		seen[id] = true
+	}
+	if strings.Join(again, ",") != strings.Join(first, ",") {
+		t.Errorf("takeover emitted event ids\n%v\nthe leader emitted\n%v", again, first)
+	}
+}
+
+// A command that does not parse is set aside once, by the leader, and still
+// takes its position on both engines so the journals line up after it.
+func TestUnreadableCommandIsDeadLetteredOnce(t *testing.T) {
+	countOutputs(t)
+	var letters []string
+	original := deadLetterCommand
+	deadLetterCommand = func(shard string, payload []byte, cause error) error {
+		letters = append(letters, shard+" "+string(payload))
+		return nil
+	}
+	t.Cleanup(func() { deadLetterCommand = original })
+
+	leader, standby := standbyPair(t)
+	garbage := journalEntry{Shard: testMarket, Seq: 1, Payload: "{not json"}
+	leader.applyJournaled(garbage)
+	if len(letters) != 1 || letters[0] != testMarket+" {not json" {
+		t.Fatalf("leader dead-lettered %q, want the one command on %s", letters, testMarket)
+	}
+
+	if !standby.catchUp([]journalEntry{garbage}, allMuted, nil) {
+		t.Fatal("catchUp reported a gap")
+	}
+	if len(letters) != 1 {
+		t.Errorf("standby dead-lettered the command again: %q", letters)
+	}
+	for _, e := range []*Engine{leader, standby} {
+		if got := e.position(testMarket); got != 1 {
+			t.Errorf("position = %d after the unreadable command, want 1", got)
+		}
+	}
+}
+
+// Fencing is what stops a paused leader that wakes up after losing the lock
+// from journaling a command its successor never sees. Needs a Redis:
+//
+//	TEST_REDIS_ADDR=localhost:6379
+//
+// It uses the real engine keys, so do not point it at a Redis an engine is
+// running against.
+func TestStaleLeaderIsFenced(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	stream := shardQueue(accountShard)
+	keys := []string{leaderKey, fenceKey, stream, journalKey(accountShard), appliedKey(accountShard)}
+	client.Del(ctx, keys...)
+	t.Cleanup(func() { client.Del(ctx, keys...); client.Close() })
+
+	old, next := newJournal(client), newJournal(client)
+	if won, err := old.acquire(ctx); err != nil || !won {
+		t.Fatalf("first acquire = %v, %v", won, err)
+	}
+	if err := old.ensureGroups(ctx, []string{accountShard}); err != nil {
+		t.Fatalf("ensureGroups: %v", err)
+	}
+	if won, _ := next.acquire(ctx); won {
+		t.Fatal("second engine acquired a held lock")
+	}
+
+	// The old leader stalls past its TTL and the standby takes over.
+	client.Del(ctx, leaderKey)
+	if won, err := next.acquire(ctx); err != nil || !won {
+		t.Fatalf("takeover acquire = %v, %v", won, err)
+	}
+
+	// The stale leader reads the command but may not journal it. It stays
+	// pending, and the new leader picks it up.
+	streams.Add(ctx, client, stream, `{"clientId":"c","message":{"type":"GET_USERS"}}`)
+	if _, _, err := old.next(ctx, accountShard, 1, 10*time.Millisecond); err != errFenced {
+		t.Fatalf("stale leader next err = %v, want errFenced", err)
+	}
+	msg, ok, err := next.next(ctx, accountShard, 1, 10*time.Millisecond)
+	if err != nil || !ok || msg == "" {
+		t.Fatalf("new leader next = %q, %v, %v", msg, ok, err)
+	}
+	entries, err := next.read(ctx, map[string]uint64{}, []string{accountShard}, 0)
+	if err != nil || len(entries) != 1 || entries[0].Seq != 1 {
+		t.Fatalf("journal = %+v, %v; want the one claimed entry", entries, err)
+	}
+	if n := client.XLen(ctx, stream).Val(); n != 0 {
+		t.Errorf("command stream holds %d entries after the claim, want 0", n)
+	}
+}
+
+// Two markets raced for one user's dollars on the leader, and the standby
+// replays the loser's market first. It must still reject the order the
+// leader rejected, not the one it would have.
+func TestStandbyFollowsTheLeadersFundsChecks(t *testing.T) {
+	countOutputs(t)
+	leader, standby := standbyPair(t)
+	for _, e := range []*Engine{leader, standby} {
+		btc := NewOrderbook("BTC", []Order{}, []Order{}, 0, 0)
+		e.Orderbooks[btc.Ticker()] = btc
+		fund(e, "buyer", 100, 0)
+	}
+	btcOrder := MessageFromAPI{Type: CREATE_ORDER, Data: CreateOrderData{
+		Market: "BTC_USD", Price: "100", Quantity: "1", Side: "buy", UserID: "buyer",
+	}}
+	entries := journalOf(t, leader, btcOrder, order("buy", "100", "1", "buyer"))
+	if entries[0].Outcome.Funds != fundsLocked || entries[1].Outcome.Funds != fundsShort {
+		t.Fatalf("journaled checks = %q, %q, want locked then short", entries[0].Outcome.Funds, entries[1].Outcome.Funds)
+	}
+
+	if !standby.catchUp([]journalEntry{entries[1], entries[0]}, allMuted, nil) {
+		t.Fatal("catchUp reported a gap")
+	}
+	for _, market := range []string{testMarket, "BTC_USD"} {
+		if got, want := len(standby.Orderbooks[market].GetOpenOrders("buyer")), len(leader.Orderbooks[market].GetOpenOrders("buyer")); got != want {
+			t.Errorf("%s: standby has %d open orders, leader %d", market, got, want)
+		}
+	}
+	assertClose(t, "standby USD locked", bal(t, standby, "buyer", "USD").Locked, 100)
+	assertClose(t, "standby USD available", bal(t, standby, "buyer", "USD").Available, 0)
+}
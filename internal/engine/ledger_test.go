@@ -1,7 +1,9 @@
-package main
+package engine
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 // captureDbMessages swaps the engine's persistence exit point for a recorder,
@@ -21,8 +23,11 @@ func captureDbMessages(t *testing.T) *[]DbMessage {
 func ledgerEntries(messages []DbMessage) []LedgerEntryData {
 	entries := []LedgerEntryData{}
 	for _, m := range messages {
-		if m.Type == LEDGER_ENTRY {
+		switch m.Type {
+		case LEDGER_ENTRY:
 			entries = append(entries, m.Data.(LedgerEntryData))
+		case LEDGER_ENTRIES:
+			entries = append(entries, m.Data.(LedgerEntriesData).Entries...)
 		}
 	}
 	return entries
@@ -106,6 +111,48 @@ func TestLedgerConservesValueAcrossATrade(t *testing.T) {
 	}
 }
 
+// A fill's legs travel as one message, so the db processor can write them in
+// one statement and the ledger never holds part of a trade.
+func TestTradeLegsTravelTogether(t *testing.T) {
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+
+	if _, _, _, err := e.CreateOrder(testMarket, "200", "1", "sell", "maker", "limit"); err != nil {
+		t.Fatalf("resting sell: %v", err)
+	}
+	if _, _, _, err := e.CreateOrder(testMarket, "201", "1", "sell", "maker", "limit"); err != nil {
+		t.Fatalf("resting sell: %v", err)
+	}
+	captured := captureDbMessages(t)
+	if _, _, _, err := e.CreateOrder(testMarket, "201", "2", "buy", "taker", "limit"); err != nil {
+		t.Fatalf("buy: %v", err)
+	}
+
+	refs := map[string]bool{}
+	for _, m := range *captured {
+		switch m.Type {
+		case LEDGER_ENTRY:
+			t.Errorf("trade leg sent on its own: %+v", m.Data)
+		case LEDGER_ENTRIES:
+			entries := m.Data.(LedgerEntriesData).Entries
+			if len(entries) != 4 {
+				t.Errorf("got %d legs in one trade's message, want 4", len(entries))
+			}
+			ref := entries[0].RefID
+			for _, entry := range entries {
+				if entry.RefID != ref {
+					t.Errorf("legs of one message name trades %q and %q", ref, entry.RefID)
+				}
+			}
+			refs[ref] = true
+		}
+	}
+	if len(refs) != 2 {
+		t.Errorf("got ledger messages for %d trades, want one per fill (2)", len(refs))
+	}
+}
+
 // Locking funds moves value between Available and Locked without changing the
 // total, so it must not produce a ledger row. An unfilled resting order is the
 // clearest case.
@@ -162,6 +209,48 @@ func TestOrderUpdateShape(t *testing.T) {
 	assertClose(t, "maker fill delta", fill.ExecutedQty, 0.5)
 }
 
+// A trade's persistence message names both orders, both users and both sides,
+// which is what the trades table is written from.
+func TestTradeNamesWhoTraded(t *testing.T) {
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+
+	_, _, makerOrder, err := e.CreateOrder(testMarket, "200", "1.5", "sell", "maker", "limit")
+	if err != nil {
+		t.Fatalf("resting sell: %v", err)
+	}
+	captured := captureDbMessages(t)
+	_, _, takerOrder, err := e.CreateOrder(testMarket, "200", "0.5", "buy", "taker", "limit")
+	if err != nil {
+		t.Fatalf("buy: %v", err)
+	}
+
+	trades := []TradeAddedData{}
+	for _, m := range *captured {
+		if m.Type == TRADE_ADDED {
+			trades = append(trades, m.Data.(TradeAddedData))
+		}
+	}
+	if len(trades) != 1 {
+		t.Fatalf("got %d trades, want 1", len(trades))
+	}
+	want := TradeAddedData{
+		MakerOrderID: makerOrder, TakerOrderID: takerOrder,
+		MakerUserID: "maker", TakerUserID: "taker",
+		MakerSide: "sell", TakerSide: "buy",
+	}
+	got := trades[0]
+	if got.MakerOrderID != want.MakerOrderID || got.TakerOrderID != want.TakerOrderID ||
+		got.MakerUserID != want.MakerUserID || got.TakerUserID != want.TakerUserID ||
+		got.MakerSide != want.MakerSide || got.TakerSide != want.TakerSide {
+		t.Errorf("trade = %+v, want the parties of %+v", got, want)
+	}
+	if got.QuoteQuantity != "100" || got.IsBuyerMaker {
+		t.Errorf("quote quantity %q, buyer maker %v; want 100 and false", got.QuoteQuantity, got.IsBuyerMaker)
+	}
+}
+
 // A market order's unfilled remainder never rests on the book, so its row has
 // to be closed out at once or it lingers in the database as open forever.
 func TestMarketOrderIsNeverLeftOpen(t *testing.T) {
@@ -222,6 +311,39 @@ func TestCancelMarksOrderCancelled(t *testing.T) {
 	}
 }
 
+// The db processor keeps messages in order only within one db queue, so
+// everything a trade, an order or its cancel emits must go out on its
+// market's, and a deposit, which belongs to no market, on the default one.
+func TestDbMessagesAreRoutedByMarket(t *testing.T) {
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	captured := captureDbMessages(t)
+
+	_, _, orderID, err := e.CreateOrder(testMarket, "200", "1.5", "sell", "maker", "limit")
+	if err != nil {
+		t.Fatalf("resting sell: %v", err)
+	}
+	if _, _, _, err := e.CreateOrder(testMarket, "200", "0.5", "buy", "taker", "limit"); err != nil {
+		t.Fatalf("buy: %v", err)
+	}
+	e.handleCancelOrder(MessageFromAPI{
+		Type: CANCEL_ORDER,
+		Data: CancelOrderData{OrderID: orderID, Market: testMarket},
+	}, "test-client")
+	for _, m := range *captured {
+		if m.Market != testMarket {
+			t.Errorf("%s %s routed to market %q, want %q", m.Type, m.EventID, m.Market, testMarket)
+		}
+	}
+
+	*captured = nil
+	e.onRamp("newuser", "", 500, "txn-abc")
+	if len(*captured) != 1 || (*captured)[0].Market != "" {
+		t.Errorf("deposit messages = %+v, want one with no market", *captured)
+	}
+}
+
 // Deposits are the one balance change that creates value, so they must leave a
 // ledger row pointing back at the transfer that authorised it.
 func TestOnRampRecordsDeposit(t *testing.T) {
@@ -264,3 +386,73 @@ func TestOnRampCreditsTheNamedAsset(t *testing.T) {
 		t.Error("a SOL deposit created a USD balance")
 	}
 }
+
+// A fill's ledger rows are pushed after the balances lock is released: the
+// push is network I/O, and under mu every other market's fills would wait on
+// it.
+func TestTradeLedgerIsPersistedOutsideTheBalancesLock(t *testing.T) {
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	e.Process(order("sell", "100", "1", "maker"), "c")
+
+	ledgerPushes, heldDuring := 0, 0
+	original := pushDbMessage
+	pushDbMessage = func(m DbMessage) error {
+		if m.Type == LEDGER_ENTRIES {
+			ledgerPushes++
+			if !e.mu.TryLock() {
+				heldDuring++
+			} else {
+				e.mu.Unlock()
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() { pushDbMessage = original })
+
+	e.Process(order("buy", "100", "1", "taker"), "c")
+	if ledgerPushes != 1 || heldDuring != 0 {
+		t.Fatalf("%d ledger pushes, %d with mu held; want 1, none held", ledgerPushes, heldDuring)
+	}
+}
+
+// A standby replaying a trade after takeover writes the row the leader did,
+// stamped when the leader made it, so the trades table agrees with the
+// candles and ticker built from the same time.
+func TestReplayedTradeKeepsTheLeadersTimestamp(t *testing.T) {
+	now := time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC)
+	setClock(t, &now)
+	countOutputs(t)
+	captured := captureDbMessages(t)
+
+	leader, standby := standbyPair(t)
+	entries := journalOf(t, leader,
+		order("sell", "100", "1", "maker"),
+		order("buy", "100", "1", "taker"),
+	)
+	leaderRows := tradeRows(*captured)
+	*captured = nil
+
+	now = now.Add(time.Hour)
+	if !standby.catchUp(entries, func(string) uint64 { return 0 }, nil) {
+		t.Fatal("catchUp reported a gap")
+	}
+	standbyRows := tradeRows(*captured)
+	if len(leaderRows) != 1 || !reflect.DeepEqual(leaderRows, standbyRows) {
+		t.Errorf("leader wrote %+v, standby %+v", leaderRows, standbyRows)
+	}
+	if len(leaderRows) == 1 && leaderRows[0].Timestamp != time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC).UnixMilli() {
+		t.Errorf("trade stamped %d, want the leader's time", leaderRows[0].Timestamp)
+	}
+}
+
+func tradeRows(messages []DbMessage) []TradeAddedData {
+	rows := []TradeAddedData{}
+	for _, m := range messages {
+		if m.Type == TRADE_ADDED {
+			rows = append(rows, m.Data.(TradeAddedData))
+		}
+	}
+	return rows
+}
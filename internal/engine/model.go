@@ -0,0 +1,298 @@
+package engine
+
+import "time"
+
+const (
+	TRADE_ADDED  = "TRADE_ADDED"
+	ORDER_UPDATE = "ORDER_UPDATE"
+	LEDGER_ENTRY = "LEDGER_ENTRY"
+	// LEDGER_ENTRIES carries every leg of one trade in one message, so the db
+	// processor writes all of them or none. A db processor from before it
+	// skips types it does not know, so deploy the API, which runs it, first.
+	LEDGER_ENTRIES = "LEDGER_ENTRIES"
+)
+
+// Ledger reasons. Locks and unlocks are deliberately absent: they move value
+// between Available and Locked within one user, leaving Available+Locked
+// unchanged, and the ledger only records changes to that total.
+const (
+	LEDGER_DEPOSIT = "deposit"
+	LEDGER_TRADE   = "trade"
+	LEDGER_SEED    = "seed"
+)
+
+const (
+	CREATE_ORDER    = "CREATE_ORDER"
+	CANCEL_ORDER    = "CANCEL_ORDER"
+	CANCEL_ALL      = "CANCEL_ALL"
+	ON_RAMP         = "ON_RAMP"
+	GET_DEPTH       = "GET_DEPTH"
+	GET_TICKER      = "GET_TICKER"
+	GET_OPEN_ORDERS = "GET_OPEN_ORDERS"
+	GET_BALANCE     = "GET_BALANCE"
+	CREATE_USER     = "CREATE_USER"
+	GET_USERS       = "GET_USERS"
+	// GET_ENGINE_STATS is operational, not user-facing; see stats.go.
+	GET_ENGINE_STATS = "GET_ENGINE_STATS"
+)
+
+const (
+	DEPTH_UPDATE  = "DEPTH_UPDATE"
+	TICKER_UPDATE = "TICKER_UPDATE"
+)
+
+type MessageFromAPI struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type CreateOrderData struct {
+	Market   string `json:"market"`
+	Price    string `json:"price"`
+	Quantity string `json:"quantity"`
+	Side     string `json:"side"`
+	UserID   string `json:"userId"`
+	Type     string `json:"type"` // "limit" (default) or "market"
+}
+
+type CancelOrderData struct {
+	OrderID string `json:"orderId"`
+	Market  string `json:"market"`
+	// UserID, when set, must own the order. The websocket service sets it
+	// from the connection's JWT.
+	UserID string `json:"userId,omitempty"`
+}
+
+type CancelAllData struct {
+	UserID string `json:"userId"`
+	Market string `json:"market"`
+}
+
+type OnRampData struct {
+	Amount string `json:"amount"`
+	UserID string `json:"userId"`
+	Asset  string `json:"asset"` // empty means the quote currency
+	TxnID  string `json:"txnId"`
+}
+
+type CreateUserData struct {
+	Name   string `json:"name"`
+	Amount string `json:"amount"` // optional; empty means create with nothing
+	TxnID  string `json:"txnId"`
+}
+
+// VirtualUser is a demo account: an engine user id and the name to show for it.
+type VirtualUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type GetDepthData struct {
+	Market string `json:"market"`
+	// Limit is how many levels a side: 0 for the default 20, below 0 for the
+	// whole book, which the websocket service's depth cache starts from.
+	Limit int `json:"limit,omitempty"`
+}
+
+type GetOpenOrdersData struct {
+	UserID string `json:"userId"`
+	Market string `json:"market"`
+}
+
+type GetBalanceData struct {
+	UserID string `json:"userId"`
+}
+
+type MessageToAPI struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// DepthPayload is the GET_DEPTH snapshot. LastUpdateID is the last depth
+// stream change it includes.
+type DepthPayload struct {
+	Bids         [][2]string `json:"bids"`
+	Asks         [][2]string `json:"asks"`
+	LastUpdateID uint64      `json:"lastUpdateId"`
+}
+
+type OrderPlacedPayload struct {
+	OrderID     string  `json:"orderId"`
+	ExecutedQty float64 `json:"executedQty"`
+	Fills       []Fill  `json:"fills"`
+}
+
+type OrderCancelledPayload struct {
+	OrderID      string  `json:"orderId"`
+	ExecutedQty  float64 `json:"executedQty"`
+	RemainingQty float64 `json:"remainingQty"`
+}
+
+// OrderRejectedPayload carries a human-readable reason back to the API so it can
+// map the failure onto a real HTTP status instead of a silent 201.
+type OrderRejectedPayload struct {
+	Reason string `json:"reason"`
+	Code   string `json:"code"` // "INSUFFICIENT_FUNDS" | "NO_ORDERBOOK" | "INVALID_ORDER" | "NO_LIQUIDITY"
+}
+
+type WsMessage struct {
+	Stream    string          `json:"stream"`
+	Data      *DepthData      `json:"data"`
+	TradeData *TradeAddedData `json:"tradeData,omitempty"`
+	KlineData *KlineData      `json:"klineData,omitempty"`
+	// Lower-case, unlike its neighbours: it is the name the frontend's
+	// SignalingManager has read tickers from all along.
+	TickerData *Ticker `json:"tickerdata,omitempty"`
+	// On the private orders:<userId> and balances:<userId> (private.go).
+	OrderData   *OrderEvent   `json:"orderData,omitempty"`
+	BalanceData *BalanceEvent `json:"balanceData,omitempty"`
+}
+
+// DepthData is one depth@<market> message: the levels one command changed,
+// numbered (see depth.go).
+type DepthData struct {
+	B             [][2]string `json:"b"`
+	A             [][2]string `json:"a"`
+	ID            int         `json:"id,omitempty"`
+	E             string      `json:"e"`
+	FirstUpdateID uint64      `json:"firstUpdateId"`
+	LastUpdateID  uint64      `json:"lastUpdateId"`
+}
+
+type TradeAddedMessage struct {
+	Stream string `json:"stream"`
+	Data   struct {
+		E string `json:"e"`
+		T int    `json:"t"`
+		M bool   `json:"m"`
+		P string `json:"p"`
+		Q string `json:"q"`
+		S string `json:"s"`
+	} `json:"data"`
+}
+
+// DbMessage is one persistence message. EventID names what it records, so the
+// db processor can tell a message it has already written - redelivered after
+// a crash, or re-emitted by a leader that took over mid-command - from a new
+// one. See (*Engine).eventID.
+type DbMessage struct {
+	EventID string      `json:"eventId,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+	// Market picks the db queue the message goes out on (see
+	// transport.DbPartition). It is routing, not content, so it is not sent.
+	Market string `json:"-"`
+}
+
+type TradeAddedData struct {
+	ID            string `json:"id"`
+	E             string `json:"e"`
+	IsBuyerMaker  bool   `json:"isBuyerMaker"`
+	Price         string `json:"price"`
+	Quantity      string `json:"quantity"`
+	QuoteQuantity string `json:"quoteQuantity"`
+	Timestamp     int64  `json:"timestamp"`
+	Market        string `json:"market"`
+	// Who traded, on the persistence message only: the same type goes out to
+	// every websocket subscriber, who must not see order or user ids, so these
+	// are left empty there and omitted.
+	MakerOrderID string `json:"makerOrderId,omitempty"`
+	TakerOrderID string `json:"takerOrderId,omitempty"`
+	MakerUserID  string `json:"makerUserId,omitempty"`
+	TakerUserID  string `json:"takerUserId,omitempty"`
+	MakerSide    string `json:"makerSide,omitempty"`
+	TakerSide    string `json:"takerSide,omitempty"`
+}
+
+// KlineData is one kline@<interval>.<market> update: the candle so far, sent
+// after every command that traded in it, and once more with IsClosed set when
+// its bucket ends. Start and End are Unix milliseconds, like a trade's
+// Timestamp.
+type KlineData struct {
+	E        string `json:"e"`
+	Market   string `json:"market"`
+	Interval string `json:"interval"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Open     string `json:"open"`
+	High     string `json:"high"`
+	Low      string `json:"low"`
+	Close    string `json:"close"`
+	Volume   string `json:"volume"`
+	Trades   int    `json:"trades"`
+	IsClosed bool   `json:"isClosed"`
+}
+
+// OrderUpdateData describes one change to an order row. ExecutedQty is a
+// DELTA, not a running total: the create message carries whatever filled on
+// entry and each maker fill carries its own quantity, so the consumer can add
+// them without knowing which kind of message it is holding.
+//
+// The pointer fields are populated only on create. A maker-fill update leaves
+// them nil, which is how the consumer tells the two apart.
+type OrderUpdateData struct {
+	OrderID     string  `json:"orderId"`
+	ExecutedQty float64 `json:"executedQty"`
+	Market      *string `json:"market,omitempty"`
+	Price       *string `json:"price,omitempty"`
+	Quantity    *string `json:"quantity,omitempty"`
+	Side        *string `json:"side,omitempty"`
+	UserID      *string `json:"userId,omitempty"`
+	Status      *string `json:"status,omitempty"`
+}
+
+type LedgerEntryData struct {
+	UserID string  `json:"userId"`
+	Asset  string  `json:"asset"`
+	Delta  float64 `json:"delta"`
+	Reason string  `json:"reason"`
+	RefID  string  `json:"refId"`
+}
+
+type LedgerEntriesData struct {
+	Entries []LedgerEntryData `json:"entries"`
+}
+
+type OnRampPayload struct {
+	UserID  string `json:"userId"`
+	Asset   string `json:"asset"`
+	Balance string `json:"balance"`
+}
+
+// EngineStats is the GET_ENGINE_STATS payload, and also what the leader writes
+// as its heartbeat.
+type EngineStats struct {
+	At       time.Time `json:"at"`
+	Sequence uint64    `json:"sequence"`
+	// Queues is the length of every command queue: how far behind the engine is.
+	Queues   map[string]int64        `json:"queues"`
+	Commands map[string]CommandStats `json:"commands"`
+	// LastSnapshotSequence and LastSnapshotAgeSeconds describe the newest
+	// snapshot this engine wrote. The age is absent until it writes one.
+	LastSnapshotSequence   uint64               `json:"lastSnapshotSequence"`
+	LastSnapshotAgeSeconds *float64             `json:"lastSnapshotAgeSeconds,omitempty"`
+	Books                  map[string]BookStats `json:"books"`
+	Users                  int                  `json:"users"`
+	Memory                 MemoryStats          `json:"memory"`
+}
+
+// CommandStats covers one command type. The percentiles are over the most
+// recent samples only (see latencySamples), in milliseconds.
+type CommandStats struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+type BookStats struct {
+	Bids int `json:"bids"`
+	Asks int `json:"asks"`
+}
+
+type MemoryStats struct {
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	SysBytes       uint64 `json:"sysBytes"`
+	Goroutines     int    `json:"goroutines"`
+}
@@ -1,9 +1,10 @@
-package main
+package engine
 
 import (
 	"fmt"
 	"sort"
 	"strconv"
+	"sync"
 
 	"github.com/google/uuid"
 )
@@ -32,6 +33,32 @@ type Orderbook struct {
 	QuoteAsset   string  `json:"quoteAsset"`
 	LastTradeID  int     `json:"lastTradeId"`
 	CurrentPrice float64 `json:"currentPrice"`
+	// OrderSeq counts the orders placed on this book; see nextOrderID.
+	OrderSeq uint64 `json:"orderSeq"`
+	// Candles are the open candle of each live interval, keyed by its name
+	// (see candle.go).
+	Candles map[string]*Candle `json:"candles,omitempty"`
+	// TickerMinutes are the last day of trades a minute at a time, oldest
+	// first, which the rolling ticker is summed from (see ticker.go). Saved
+	// with the book so a restart does not reset the 24h figures to zero.
+	TickerMinutes []TickerMinute `json:"tickerMinutes,omitempty"`
+
+	// DepthUpdateID is the number of the last change published on the depth
+	// stream (see depth.go).
+	DepthUpdateID uint64 `json:"depthUpdateId"`
+
+	// mu serialises every command on this market. See Engine.mu.
+	mu sync.Mutex
+	// publishedBids and publishedAsks are the levels as the depth stream last
+	// described them. Not saved: they are the book's own levels whenever a
+	// snapshot is taken, so restore rebuilds them from the orders.
+	publishedBids, publishedAsks map[string]string
+	// touchedBids and touchedAsks are the levels changed since the last
+	// depth diff (see touch).
+	touchedBids, touchedAsks map[string]bool
+	// follow and decided carry the outcome of the command being processed
+	// between process and its handler (see outcome).
+	follow, decided outcome
 }
 
 func NewOrderbook(baseAsset string, bids []Order, asks []Order, lastTradeID int, currentPrice float64) *Orderbook {
@@ -115,6 +142,7 @@ func (o *Orderbook) MatchBid(order Order) (float64, []Fill) {
 			if filledQty > 0 {
 				executedQty += filledQty
 				ask.Filled += filledQty
+				o.touch("sell", ask.Price)
 
 				// Update current price to the trade price
 				o.CurrentPrice = ask.Price
@@ -161,6 +189,7 @@ func (o *Orderbook) MatchAsk(order Order) (float64, []Fill) {
 			if filledQty > 0 {
 				executedQty += filledQty
 				bid.Filled += filledQty
+				o.touch("buy", bid.Price)
 
 				// Update current price to the trade price
 				o.CurrentPrice = bid.Price
@@ -215,8 +244,9 @@ func (o *Orderbook) GetDepthWithLimit(limit int) DepthPayload {
 	asks := o.sortAsksAscending(asksMap, limit)
 
 	return DepthPayload{
-		Bids: bids,
-		Asks: asks,
+		Bids:         bids,
+		Asks:         asks,
+		LastUpdateID: o.DepthUpdateID,
 	}
 }
 
@@ -243,6 +273,7 @@ func (o *Orderbook) CancelBid(order Order) *float64 {
 		if bid.OrderID == order.OrderID {
 			price := o.Bids[i].Price
 			o.Bids = append(o.Bids[:i], o.Bids[i+1:]...)
+			o.touch("buy", price)
 			return &price
 		}
 	}
@@ -254,6 +285,7 @@ func (o *Orderbook) CancelAsk(order Order) *float64 {
 		if ask.OrderID == order.OrderID {
 			price := o.Asks[i].Price
 			o.Asks = append(o.Asks[:i], o.Asks[i+1:]...)
+			o.touch("sell", price)
 			return &price
 		}
 	}
@@ -261,6 +293,7 @@ func (o *Orderbook) CancelAsk(order Order) *float64 {
 }
 
 func (o *Orderbook) insertBidInOrder(order Order) {
+	o.touch("buy", order.Price)
 	inserted := false
 	for i, bid := range o.Bids {
 		if order.Price > bid.Price {
@@ -278,6 +311,7 @@ func (o *Orderbook) insertBidInOrder(order Order) {
 
 // insertAskInOrder inserts an ask order maintaining price-time priority (lowest price first)
 func (o *Orderbook) insertAskInOrder(order Order) {
+	o.touch("sell", order.Price)
 	inserted := false
 	for i, ask := range o.Asks {
 		if order.Price < ask.Price {
@@ -303,6 +337,27 @@ func generateOrderID() string {
 	return uuid.New().String()
 }
 
+// nextOrderID names the next order placed on book. A random id would differ
+// between the leader and a standby replaying the same command, and the first
+// cancel sent to a promoted standby would then find nothing. Hashing the epoch
+// with the market and a per-book counter gives every replica the same id, and
+// is still a full UUID. The counter is per book because books run
+// concurrently, and only the order within one market is the same on replay.
+//
+// Engines without an epoch (tests build them by hand) keep random ids.
+func (e *Engine) nextOrderID(book *Orderbook) string {
+	book.OrderSeq++
+	if e.Epoch == "" {
+		return generateOrderID()
+	}
+	epoch, err := uuid.Parse(e.Epoch)
+	if err != nil {
+		return generateOrderID()
+	}
+	name := book.Ticker() + ":" + strconv.FormatUint(book.OrderSeq, 10)
+	return uuid.NewSHA1(epoch, []byte(name)).String()
+}
+
 // dustEpsilon is the quantity below which a remainder is treated as zero.
 // Filled accumulates as a sum of float64 fills, so 0.1+0.2 lands on
 // 0.30000000000000004 and the mirror case lands just under — leaving an order
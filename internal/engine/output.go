@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// bus carries everything the engine sends: persistence messages, replies and
+// market data. Run and RunInProcess set it before the first command; until
+// then it is a Memory nobody reads, which is all a test that does not capture
+// an exit needs.
+var bus transport.Transport = transport.NewMemory()
+
+// pushDbMessage is the single exit point for everything the engine wants
+// persisted, onto the db queue of the message's market. It is a variable so
+// tests can capture messages without a transport or a database.
+var pushDbMessage = func(message DbMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return bus.Push(context.Background(), transport.DbPartition(message.Market), data)
+}
+
+// sendToAPI is the single exit point for every reply to a waiting API request.
+// Same reasoning as pushDbMessage: a var lets tests assert that a handler
+// answered at all, which is the property that matters — the API blocks on a
+// pub/sub reply, so a handler that returns without calling this costs the
+// caller its full timeout.
+var sendToAPI = func(clientID string, message MessageToAPI) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	log.Printf("Sending message to API for client %s: %s", clientID, string(data))
+	return bus.Publish(context.Background(), clientID, data)
+}
+
+// publishToWS is the exit point for market data fanned out to the websocket
+// server, a var for the same reason as the two above.
+var publishToWS = func(channel string, message WsMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	log.Printf("Publishing message to channel %s: %s", channel, string(data))
+	return bus.Publish(context.Background(), channel, data)
+}
+
+// deadLetterCommand sets aside a command that shard's queue delivered but the
+// engine could not read, for an operator to inspect and replay or discard
+// through the API's /admin/deadletters. A var like the exits above.
+var deadLetterCommand = func(shard string, payload []byte, cause error) error {
+	letter := transport.NewDeadLetter(shardQueue(shard), payload, cause, 1)
+	return bus.DeadLetter(context.Background(), letter.Queue, letter)
+}
+
+// The methods below are how handlers reach the three exits. They are no-ops
+// while the engine is replaying the leader's journal: a hot standby has to
+// apply every command to stay warm, but the leader already replied, persisted
+// and published for each one.
+
+// eventID names a persistence message by what it records - a trade, an
+// order's create, fill or cancel, a ledger movement - under the engine's
+// Epoch. Those are decided by the command alone, so the leader, a standby
+// that takes over half way through it, and a restart replaying it all give a
+// message the same id; and the Epoch keeps a freshly seeded engine, whose
+// trade ids start again at 1, from colliding with the one before it.
+func (e *Engine) eventID(parts ...string) string {
+	return e.Epoch + ":" + strings.Join(parts, ":")
+}
+
+func (e *Engine) persist(message DbMessage) error {
+	if e.replaying {
+		return nil
+	}
+	return pushDbMessage(message)
+}
+
+func (e *Engine) reply(clientID string, message MessageToAPI) error {
+	if e.replaying {
+		return nil
+	}
+	return sendToAPI(clientID, message)
+}
+
+func (e *Engine) publish(channel string, message WsMessage) error {
+	if e.replaying {
+		return nil
+	}
+	return publishToWS(channel, message)
+}
+
+// deadLetter is muted like the exits: the leader already set the command
+// aside when it first read it.
+func (e *Engine) deadLetter(shard string, payload []byte, cause error) {
+	if e.replaying {
+		return
+	}
+	if err := deadLetterCommand(shard, payload, cause); err != nil {
+		log.Printf("Error dead-lettering %s message: %v", shard, err)
+	}
+}
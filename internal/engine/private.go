@@ -0,0 +1,198 @@
+package engine
+
+// Private streams. Each user has two channels, which the websocket service
+// only lets a connection holding that user's JWT subscribe to:
+//
+//   - orders:<userId> carries an OrderEvent whenever one of the user's
+//     orders changes: accepted, filled in part or in full, cancelled, or
+//     rejected outright;
+//   - balances:<userId> carries a BalanceEvent with every one of the user's
+//     balances after a change to any of them. Whole rather than a delta, so a
+//     client that missed one - or a send queue that conflated two - is right
+//     again with the next.
+
+// Order lifecycle events, OrderEvent.Event.
+const (
+	ORDER_NEW          = "new"
+	ORDER_PARTIAL_FILL = "partial_fill"
+	ORDER_FILLED       = "filled"
+	ORDER_CANCELLED    = "cancelled"
+	ORDER_REJECTED     = "rejected"
+)
+
+// OrderEvent is one change to one order, on orders:<userId>.
+type OrderEvent struct {
+	E       string `json:"e"` // "order"
+	Event   string `json:"event"`
+	OrderID string `json:"orderId,omitempty"` // empty for a rejection
+	Market  string `json:"market"`
+	Side    string `json:"side"`
+	Price   string `json:"price,omitempty"`
+	// Quantity is the order's size as placed, on new and rejected only: a
+	// resting order keeps just its remainder, so for a maker it is not known.
+	Quantity string `json:"quantity,omitempty"`
+	// LastFillQty and LastFillPrice are the fill behind a partial_fill or
+	// filled event.
+	LastFillQty   string `json:"lastFillQty,omitempty"`
+	LastFillPrice string `json:"lastFillPrice,omitempty"`
+	// RemainingQty is what is still open after the event - or, on a
+	// cancellation, what was open and is now gone.
+	RemainingQty string `json:"remainingQty"`
+	Code         string `json:"code,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// BalanceEvent is all of a user's balances, on balances:<userId>.
+type BalanceEvent struct {
+	E         string                 `json:"e"` // "balance"
+	Balances  map[string]UserBalance `json:"balances"`
+	Timestamp int64                  `json:"timestamp"`
+}
+
+func ordersStream(userID string) string   { return "orders:" + userID }
+func balancesStream(userID string) string { return "balances:" + userID }
+
+func (e *Engine) publishOrderEvent(userID string, event OrderEvent) {
+	event.E = "order"
+	event.Timestamp = clock().UnixMilli()
+	e.publish(ordersStream(userID), WsMessage{
+		Stream:    ordersStream(userID),
+		OrderData: &event,
+	})
+}
+
+// publishOrderFills publishes the lifecycle of one accepted order: new, then
+// a fill event each for it and for every maker it took from, and for a
+// market order whose remainder did not rest, its cancellation. Called under
+// book.mu, after the match.
+func (e *Engine) publishOrderFills(book *Orderbook, market string, order Order, fills []Fill, restRemainder bool) {
+	e.publishOrderEvent(order.UserID, OrderEvent{
+		Event:        ORDER_NEW,
+		OrderID:      order.OrderID,
+		Market:       market,
+		Side:         order.Side,
+		Price:        formatNum(order.Price),
+		Quantity:     formatNum(order.Quantity),
+		RemainingQty: formatNum(order.Quantity),
+	})
+
+	makerSide := "sell"
+	if order.Side == "sell" {
+		makerSide = "buy"
+	}
+	executed := 0.0
+	for _, fill := range fills {
+		executed += fill.Qty
+		remaining := max(order.Quantity-executed, 0)
+		e.publishOrderEvent(order.UserID, fillEvent(order.OrderID, market, order.Side, fill, remaining))
+
+		// A maker is matched at most once per command, so what the book
+		// holds for it now is what it has left after this fill.
+		e.publishOrderEvent(fill.OtherUserID,
+			fillEvent(fill.MarkerOrderID, market, makerSide, fill, book.restingRemaining(fill.MarkerOrderID)))
+	}
+
+	if !restRemainder && executed < order.Quantity {
+		e.publishOrderEvent(order.UserID, OrderEvent{
+			Event:        ORDER_CANCELLED,
+			OrderID:      order.OrderID,
+			Market:       market,
+			Side:         order.Side,
+			RemainingQty: formatNum(order.Quantity - executed),
+			Reason:       "a market order's remainder does not rest",
+		})
+	}
+}
+
+func fillEvent(orderID, market, side string, fill Fill, remaining float64) OrderEvent {
+	event := ORDER_PARTIAL_FILL
+	if remaining <= dustEpsilon {
+		event, remaining = ORDER_FILLED, 0
+	}
+	return OrderEvent{
+		Event:         event,
+		OrderID:       orderID,
+		Market:        market,
+		Side:          side,
+		Price:         fill.Price,
+		LastFillQty:   formatNum(fill.Qty),
+		LastFillPrice: fill.Price,
+		RemainingQty:  formatNum(remaining),
+	}
+}
+
+// restingRemaining is what is left of orderID on the book, 0 once it is gone.
+func (o *Orderbook) restingRemaining(orderID string) float64 {
+	for _, side := range [][]Order{o.Bids, o.Asks} {
+		for _, order := range side {
+			if order.OrderID == orderID {
+				return order.Quantity - order.Filled
+			}
+		}
+	}
+	return 0
+}
+
+// publishBalances publishes each user's balances as they stand. Takes mu to
+// read them, so it must not be called from inside withBalances or from a
+// command that already holds mu.
+func (e *Engine) publishBalances(userIDs ...string) {
+	if e.replaying {
+		return
+	}
+	seen := map[string]bool{}
+	messages := []WsMessage{}
+	e.withBalances(func() {
+		for _, userID := range userIDs {
+			if !seen[userID] {
+				seen[userID] = true
+				messages = append(messages, e.balanceMessage(userID))
+			}
+		}
+	})
+	for _, message := range messages {
+		e.publish(message.Stream, message)
+	}
+}
+
+// balanceMessage copies userID's balances into a message for balances:<userId>.
+// Called under mu.
+func (e *Engine) balanceMessage(userID string) WsMessage {
+	balances := map[string]UserBalance{}
+	for asset, balance := range e.Balances[userID] {
+		balances[asset] = *balance
+	}
+	return WsMessage{
+		Stream: balancesStream(userID),
+		BalanceData: &BalanceEvent{
+			E:         "balance",
+			Balances:  balances,
+			Timestamp: clock().UnixMilli(),
+		},
+	}
+}
+
+// fillUsers is the taker and every maker a command's fills touched.
+func fillUsers(userID string, fills []Fill) []string {
+	users := []string{userID}
+	for _, fill := range fills {
+		users = append(users, fill.OtherUserID)
+	}
+	return users
+}
+
+// rejectedOrder is the event for an order the engine refused, from the
+// command as sent.
+func rejectedOrder(data CreateOrderData, err error) OrderEvent {
+	return OrderEvent{
+		Event:        ORDER_REJECTED,
+		Market:       data.Market,
+		Side:         data.Side,
+		Price:        data.Price,
+		Quantity:     data.Quantity,
+		RemainingQty: "0",
+		Code:         errorCode(err),
+		Reason:       err.Error(),
+	}
+}
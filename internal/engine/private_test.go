@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+// capturePrivate records what the engine publishes on orders: and balances:
+// channels, by channel.
+func capturePrivate(t *testing.T) map[string][]WsMessage {
+	t.Helper()
+	original := publishToWS
+	got := map[string][]WsMessage{}
+	publishToWS = func(channel string, m WsMessage) error {
+		if strings.HasPrefix(channel, "orders:") || strings.HasPrefix(channel, "balances:") {
+			got[channel] = append(got[channel], m)
+		}
+		return nil
+	}
+	t.Cleanup(func() { publishToWS = original })
+	return got
+}
+
+func orderEvents(messages []WsMessage) []string {
+	events := []string{}
+	for _, m := range messages {
+		events = append(events, m.OrderData.Event+" "+m.OrderData.RemainingQty)
+	}
+	return events
+}
+
+func TestPrivateStreamsFollowEachOrder(t *testing.T) {
+	countOutputs(t)
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	got := capturePrivate(t)
+
+	e.Process(order("sell", "100", "3", "maker"), "c")
+	e.Process(order("buy", "100", "1", "taker"), "c")
+	e.Process(order("buy", "100", "5", "taker"), "c")
+	makerOrders := orderEvents(got["orders:maker"])
+	want := []string{"new 3", "partial_fill 2", "filled 0"}
+	if strings.Join(makerOrders, ",") != strings.Join(want, ",") {
+		t.Errorf("maker's events = %v, want %v", makerOrders, want)
+	}
+	takerOrders := orderEvents(got["orders:taker"])
+	want = []string{"new 1", "filled 0", "new 5", "partial_fill 3"}
+	if strings.Join(takerOrders, ",") != strings.Join(want, ",") {
+		t.Errorf("taker's events = %v, want %v", takerOrders, want)
+	}
+
+	// The resting remainder of 3 is cancelled, and the funds it held come
+	// back on the balance stream.
+	orderID := got["orders:taker"][2].OrderData.OrderID
+	e.Process(MessageFromAPI{Type: CANCEL_ORDER, Data: CancelOrderData{OrderID: orderID, Market: testMarket}}, "c")
+	last := got["orders:taker"][len(got["orders:taker"])-1].OrderData
+	if last.Event != ORDER_CANCELLED || last.RemainingQty != "3" {
+		t.Errorf("after cancel: %+v", last)
+	}
+	balances := got["balances:taker"]
+	final := balances[len(balances)-1].BalanceData.Balances
+	if final["USD"].Available != 9700 || final["USD"].Locked != 0 || final["SOL"].Available != 3 {
+		t.Errorf("taker's last balances = %+v", final)
+	}
+	// One as the sell locks its SOL, one per fill.
+	if len(got["balances:maker"]) != 3 {
+		t.Errorf("maker got %d balance updates, want 3", len(got["balances:maker"]))
+	}
+
+	e.Process(order("buy", "100", "1000", "taker"), "c")
+	last = got["orders:taker"][len(got["orders:taker"])-1].OrderData
+	if last.Event != ORDER_REJECTED || last.Code != "INSUFFICIENT_FUNDS" || last.Quantity != "1000" {
+		t.Errorf("rejection: %+v", last)
+	}
+}
+
+func TestCancelAllTakesOnlyTheUsersOwnOrders(t *testing.T) {
+	countOutputs(t)
+	replies := captureReplies(t)
+	e := newTestEngine(t)
+	fund(e, "alice", 10000, 10)
+	fund(e, "bob", 0, 10)
+	e.Process(order("sell", "110", "1", "alice"), "c")
+	e.Process(order("buy", "90", "1", "alice"), "c")
+	e.Process(order("sell", "120", "1", "bob"), "c")
+	bobs := e.Orderbooks[testMarket].GetOpenOrders("bob")[0].OrderID
+
+	// Cancelling someone else's order by id looks the same as a missing one.
+	*replies = nil
+	e.Process(MessageFromAPI{Type: CANCEL_ORDER, Data: CancelOrderData{OrderID: bobs, Market: testMarket, UserID: "alice"}}, "c")
+	if got := onlyReply(t, replies); got.Type != "ORDER_REJECTED" || got.Payload.(OrderRejectedPayload).Code != "ORDER_NOT_FOUND" {
+		t.Errorf("cancelling bob's order as alice: %+v", got)
+	}
+
+	*replies = nil
+	e.Process(MessageFromAPI{Type: CANCEL_ALL, Data: CancelAllData{UserID: "alice", Market: testMarket}}, "c")
+	if got := onlyReply(t, replies); got.Type != "ORDERS_CANCELLED" || len(got.Payload.([]OrderCancelledPayload)) != 2 {
+		t.Errorf("cancel all: %+v", got)
+	}
+	book := e.Orderbooks[testMarket]
+	if len(book.GetOpenOrders("alice")) != 0 || len(book.GetOpenOrders("bob")) != 1 {
+		t.Errorf("left alice %v and bob %v", book.GetOpenOrders("alice"), book.GetOpenOrders("bob"))
+	}
+	assertClose(t, "alice's USD", bal(t, e, "alice", "USD").Available, 10000)
+	assertClose(t, "alice's SOL", bal(t, e, "alice", "SOL").Available, 10)
+}
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// Run runs engine as one of any number of engines sharing t's Redis. It keeps
+// engine warm from the leader's journals until it wins the leader lock, then
+// leads until ctx is cancelled or the lock is lost.
+func Run(ctx context.Context, engine *Engine, t *transport.Redis) {
+	bus = t
+	j := newJournal(t.Client())
+	if !standby(ctx, engine, j) {
+		log.Println("shutting down standby")
+		return
+	}
+	lead(ctx, engine, j)
+}
+
+// standby keeps engine warm from the journal until this engine wins the lock,
+// and reports whether it did. An engine that had to seed because there was no
+// snapshot does not apply the journal: its state and order ids would not be
+// the leader's. It waits for the leader's first snapshot instead.
+func standby(ctx context.Context, engine *Engine, j *journal) bool {
+	for ctx.Err() == nil {
+		won, err := j.acquire(ctx)
+		if err != nil {
+			log.Printf("Error acquiring leader lock: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if won {
+			log.Printf("acquired leader lock with fencing token %s", j.token)
+			return true
+		}
+
+		if engine.seeded {
+			reloadSnapshot(engine)
+			time.Sleep(time.Second)
+			continue
+		}
+		entries, err := j.read(ctx, engine.positions(), engine.shards(), time.Second)
+		if err == nil {
+			var applied map[string]uint64
+			if applied, err = j.applied(ctx, engine.shards()); err == nil && len(entries) > 0 {
+				kept := appliedOnly(entries, applied)
+				if len(kept) == 0 {
+					// All of it still running on the leader: the read would
+					// return at once, so wait here instead.
+					time.Sleep(50 * time.Millisecond)
+				}
+				entries = kept
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error reading journal: %v", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if !engine.catchUp(entries, allMuted, nil) {
+			log.Printf("journal gap at sequence %d, reloading snapshot", engine.Sequence)
+			reloadSnapshot(engine)
+			time.Sleep(time.Second)
+		}
+	}
+	return false
+}
+
+// reloadSnapshot replaces the standby's state with the newest stored snapshot,
+// if there is one newer than what it has.
+func reloadSnapshot(engine *Engine) {
+	unlock := engine.lockAll()
+	defer unlock()
+
+	state, name, err := readSnapshot(engine.snapshotStore())
+	if err != nil {
+		if !errors.Is(err, errNoSnapshot) {
+			log.Printf("Error reloading snapshot: %v", err)
+		}
+		return
+	}
+	if !engine.seeded && state.Sequence <= engine.Sequence {
+		return
+	}
+	engine.restore(state)
+	engine.seeded = false
+	log.Printf("standby reloaded snapshot %s at sequence %d", name, engine.Sequence)
+}
+
+// lead takes over from the previous leader and then runs a worker per shard
+// until ctx is cancelled or the lock is lost.
+func lead(ctx context.Context, engine *Engine, j *journal) {
+	if err := j.ensureGroups(ctx, engine.shards()); err != nil {
+		log.Fatalf("creating command consumer groups: %v", err)
+	}
+	if engine.seeded {
+		// Nothing stored to follow, so nothing in the journals can be applied
+		// to this state either (see journal.reset).
+		if err := j.reset(ctx, engine.shards()); err != nil {
+			log.Fatalf("resetting journals: %v", err)
+		}
+		// Saved straight away: until the first snapshot exists a standby has
+		// nothing to start from.
+		engine.SaveSnapshot()
+		engine.seeded = false
+	} else {
+		takeOver(ctx, engine, j)
+	}
+
+	go holdLock(ctx, j)
+	go snapshotLoop(ctx, engine, j)
+	go heartbeat(ctx, engine)
+	go candleLoop(ctx, engine)
+
+	var wg sync.WaitGroup
+	for _, shard := range engine.shards() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(ctx, engine, j, shard)
+		}()
+	}
+	wg.Wait()
+
+	// Background context: ctx is already cancelled. As in snapshotLoop, a
+	// leader deposed while its workers wound down must not save: its state
+	// is behind its successor's, and would send standbys backwards.
+	if err := j.renew(context.Background()); err != nil {
+		log.Printf("shutting down without a snapshot, no longer leader: %v", err)
+		return
+	}
+	log.Println("shutting down, saving snapshot")
+	engine.SaveSnapshot()
+	if err := j.release(context.Background()); err != nil {
+		log.Printf("Error releasing leader lock: %v", err)
+	}
+}
+
+// work consumes one shard's stream. Each market has its own, so a burst of
+// orders on one book no longer delays order entry on the others; they only
+// meet briefly on the balances lock.
+func work(ctx context.Context, engine *Engine, j *journal, shard string) {
+	for ctx.Err() == nil {
+		seq := engine.position(shard) + 1
+		msg, ok, err := j.next(ctx, shard, seq, time.Second)
+		if err == errFenced {
+			log.Fatalf("lost leader lock at %s/%d, exiting so a restart rejoins as standby", shard, seq)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error taking next %s message: %v", shard, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		log.Printf("Received %s message: %s", shard, msg)
+
+		o := engine.applyJournaled(journalEntry{Shard: shard, Seq: seq, Payload: msg})
+		if err := j.markApplied(ctx, shard, seq, o); err != nil {
+			log.Printf("Error marking %s/%d applied: %v", shard, seq, err)
+		}
+	}
+}
+
+// takeOver brings a standby's state up to the end of every journal. Entries
+// the old leader already answered are applied muted; anything after that it
+// had journaled but not finished is applied live, since nobody has seen its
+// results yet.
+//
+// A leader that dies after emitting a command's outputs but before
+// markApplied gets that one command's outputs sent twice. Each consumer drops
+// the repeat by its id: the db processor by event id, the API by the reply's
+// request, which already completed, and the websocket service by trade and
+// depth update id (ws/cache.go).
+func takeOver(ctx context.Context, engine *Engine, j *journal) {
+	shards := engine.shards()
+	applied, err := j.applied(ctx, shards)
+	if err != nil {
+		log.Fatalf("reading applied positions: %v", err)
+	}
+	mutedThrough := func(shard string) uint64 { return applied[shard] }
+	// The old leader never got to these, so this engine's outcomes are the
+	// ones that count, and are journaled like any other.
+	live := func(entry journalEntry, o outcome) {
+		if err := j.markApplied(ctx, entry.Shard, entry.Seq, o); err != nil {
+			log.Printf("Error marking %s/%d applied: %v", entry.Shard, entry.Seq, err)
+		}
+	}
+	for {
+		entries, err := j.read(ctx, engine.positions(), shards, 0)
+		if err != nil {
+			log.Fatalf("reading journals during takeover: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if !engine.catchUp(entries, mutedThrough, live) {
+			reloadSnapshot(engine)
+			if !engine.catchUp(entries, mutedThrough, live) {
+				log.Fatalf("journals start past sequence %d and no snapshot covers the gap", engine.Sequence)
+			}
+		}
+	}
+	log.Printf("took over as leader at sequence %d", engine.Sequence)
+}
+
+// holdLock renews the leader lock at a third of its TTL. Losing it is fatal:
+// the next claim would be refused anyway, and exiting is the quickest way back
+// to a consistent standby.
+func holdLock(ctx context.Context, j *journal) {
+	ticker := time.NewTicker(j.ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := j.renew(ctx)
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case err == errFenced:
+			log.Fatalf("leader lock taken over by another engine")
+		case ctx.Err() != nil:
+			return
+		default:
+			log.Printf("Error renewing leader lock: %v", err)
+			if time.Since(renewed) > j.ttl {
+				log.Fatalf("could not renew leader lock for %s", j.ttl)
+			}
+		}
+	}
+}
+
+// snapshotLoop saves a snapshot every 5s and trims the journals behind it. The
+// trim lags one snapshot: a standby a few seconds behind can still catch up
+// from the journals instead of reloading.
+func snapshotLoop(ctx context.Context, engine *Engine, j *journal) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var previous map[string]uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// A deposed leader's state is only a prefix of the real one, and a
+		// stale snapshot on top of the store would send standbys backwards.
+		if j.renew(ctx) != nil {
+			continue
+		}
+		meta, ok := engine.SaveSnapshot()
+		if !ok {
+			continue
+		}
+		if previous != nil {
+			if err := j.trim(ctx, previous); err != nil {
+				log.Printf("Error trimming journals: %v", err)
+			}
+		}
+		previous = meta.Positions
+	}
+}
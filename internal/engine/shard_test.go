@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"sync"
+	"testing"
+)
+
+// Two markets' workers run at once and both spend the same users' USD. Run
+// with -race: a balance touched outside mu shows up there first. The USD
+// total across users has to come out exactly where it went in - trades move
+// value between users, locks move it between Available and Locked, and
+// neither creates any.
+func TestMarketsRunConcurrentlyOverSharedBalances(t *testing.T) {
+	countOutputs(t)
+	e := newTestEngine(t)
+	btc := NewOrderbook("BTC", []Order{}, []Order{}, 0, 0)
+	e.Orderbooks[btc.Ticker()] = btc
+	for _, user := range []string{"maker", "taker"} {
+		e.Balances[user] = map[string]*UserBalance{
+			"USD": {Available: 1_000_000},
+			"SOL": {Available: 1_000},
+			"BTC": {Available: 1_000},
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, market := range []string{testMarket, btc.Ticker()} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				e.process(market, order("sell", "10", "1", "maker"), "client", outcome{})
+				e.process(market, order("buy", "10", "1", "taker"), "client", outcome{})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			e.Process(MessageFromAPI{Type: GET_BALANCE, Data: GetBalanceData{UserID: "maker"}}, "client")
+		}
+	}()
+	wg.Wait()
+
+	usd := 0.0
+	for _, user := range []string{"maker", "taker"} {
+		b := bal(t, e, user, "USD")
+		usd += b.Available + b.Locked
+	}
+	assertClose(t, "total USD", usd, 2_000_000)
+	assertClose(t, "maker USD", bal(t, e, "maker", "USD").Available, 1_000_000+2*200*10)
+
+	if got := e.position(testMarket); got != 400 {
+		t.Errorf("%s position = %d, want 400", testMarket, got)
+	}
+	if e.Sequence != 1000 {
+		t.Errorf("sequence = %d, want 1000", e.Sequence)
+	}
+}
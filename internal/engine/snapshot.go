@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+// snapshotFormat marks a file as an engine snapshot envelope. A file without it
+// is a version 1 snapshot: the bare state JSON every release before the
+// envelope wrote.
+const snapshotFormat = "cryptoxchange-snapshot"
+
+// snapshotVersion is the schema of engineState. Bump it whenever engineState
+// changes shape, and add the step that lifts the previous version to
+// snapshotMigrations.
+const snapshotVersion = 5
+
+// engineState is everything a snapshot restores.
+type engineState struct {
+	Orderbooks map[string]*Orderbook              `json:"orderbooks"`
+	Balances   map[string]map[string]*UserBalance `json:"balances"`
+	Users      map[string]string                  `json:"users"`
+	Sequence   uint64                             `json:"sequence"`
+	Positions  map[string]uint64                  `json:"positions"`
+	Epoch      string                             `json:"epoch"`
+}
+
+// snapshotEnvelope is what is written to disk. Checksum covers Payload exactly
+// as stored - compressed, if it is - so a torn or bit-rotted file is caught
+// before anything tries to decompress it.
+type snapshotEnvelope struct {
+	Format      string       `json:"format"`
+	Version     int          `json:"version"`
+	Meta        SnapshotMeta `json:"meta"`
+	Compression string       `json:"compression"`
+	Checksum    string       `json:"checksum"`
+	Payload     []byte       `json:"payload"`
+}
+
+// snapshotMigrations lifts a payload from the version in the key to the next
+// one. Version 1 to 2 only introduced the envelope, so the state itself passes
+// through untouched. Version 3 added Sequence, which a missing field already
+// decodes to correctly: nothing before it counted commands. Version 4 added the
+// order id epoch, derived below from the state itself so that a leader and a
+// standby upgrading from the same snapshot agree on it. Version 5 sharded the
+// engine: journal positions are per shard and order counters per book. Both
+// start again from zero, which is safe - the single journal they counted
+// through is not read any more, and ids now hash the market into their name,
+// so a restarted counter cannot mint a version 4 id twice.
+var snapshotMigrations = map[int]func(json.RawMessage) (json.RawMessage, error){
+	1: func(state json.RawMessage) (json.RawMessage, error) { return state, nil },
+	2: func(state json.RawMessage) (json.RawMessage, error) { return state, nil },
+	3: func(state json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(state, &fields); err != nil {
+			return nil, err
+		}
+		epoch, _ := json.Marshal(uuid.NewSHA1(uuid.NameSpaceOID, state).String())
+		fields["epoch"] = epoch
+		return json.Marshal(fields)
+	},
+	4: func(state json.RawMessage) (json.RawMessage, error) { return state, nil },
+}
+
+// errNoSnapshot means there is nothing on disk to restore, which is the one
+// case where seeding a fresh engine is the right thing to do.
+var errNoSnapshot = errors.New("no snapshot found")
+
+// snapshotCompression reads SNAPSHOT_COMPRESSION. NewEngine refuses to start
+// on one it does not know, as newSnapshotStore does on SNAPSHOT_STORE: every
+// save would fail and only log, leaving standbys nothing to start from and
+// the journals untrimmed.
+func snapshotCompression() (string, error) {
+	switch c := strings.ToLower(os.Getenv("SNAPSHOT_COMPRESSION")); c {
+	case "":
+		return "gzip", nil
+	case "none", "gzip", "zstd":
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown SNAPSHOT_COMPRESSION %q (want none, gzip or zstd)", c)
+	}
+}
+
+// snapshotRetain is how many snapshots are kept on disk, the newest included.
+// Anything below 2 would leave nothing to fall back to when the latest is bad.
+func snapshotRetain() int {
+	n, err := strconv.Atoi(os.Getenv("SNAPSHOT_RETAIN"))
+	if err != nil || n < 2 {
+		return 3
+	}
+	return n
+}
+
+func compress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "none":
+		return data, nil
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+}
+
+func decompress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "none":
+		return data, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "zstd":
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeSnapshot wraps a marshalled engineState in an envelope.
+func encodeSnapshot(state []byte, meta SnapshotMeta, compression string) ([]byte, error) {
+	payload, err := compress(state, compression)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshotEnvelope{
+		Format:      snapshotFormat,
+		Version:     snapshotVersion,
+		Meta:        meta,
+		Compression: compression,
+		Checksum:    checksum(payload),
+		Payload:     payload,
+	})
+}
+
+// decodeSnapshot verifies one snapshot file and migrates it to the current
+// engineState. Every failure is an error, never a zero state: an empty book
+// that looks valid is exactly the silent reseed this is here to prevent.
+func decodeSnapshot(data []byte) (*engineState, error) {
+	var env snapshotEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %w", err)
+	}
+
+	var raw json.RawMessage
+	version := env.Version
+	if env.Format != snapshotFormat {
+		// Pre-envelope file. There is no checksum to verify, so it has to parse
+		// on its own merits below.
+		raw, version = data, 1
+	} else {
+		if checksum(env.Payload) != env.Checksum {
+			return nil, errors.New("checksum mismatch")
+		}
+		state, err := decompress(env.Payload, env.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing %s payload: %w", env.Compression, err)
+		}
+		raw = state
+	}
+
+	if version > snapshotVersion {
+		return nil, fmt.Errorf("written by a newer engine (version %d, this one reads up to %d)",
+			version, snapshotVersion)
+	}
+	for ; version < snapshotVersion; version++ {
+		migrate, ok := snapshotMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration from version %d", version)
+		}
+		migrated, err := migrate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %w", version, err)
+		}
+		raw = migrated
+	}
+
+	var state engineState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("state does not parse: %w", err)
+	}
+	if len(state.Orderbooks) == 0 {
+		return nil, errors.New("snapshot holds no orderbooks")
+	}
+	return &state, nil
+}
+
+// snapshotFiles lists the snapshots on disk, newest first: path itself, then
+// path.1, path.2 and so on as rotateSnapshots leaves them.
+func snapshotFiles(path string) []string {
+	files := []string{}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+
+	matches, _ := filepath.Glob(path + ".*")
+	generations := map[string]int{}
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, path+"."))
+		if err != nil || n < 1 {
+			continue // path.tmp, or something that isn't ours
+		}
+		generations[m] = n
+	}
+	older := make([]string, 0, len(generations))
+	for m := range generations {
+		older = append(older, m)
+	}
+	sort.Slice(older, func(i, j int) bool { return generations[older[i]] < generations[older[j]] })
+	return append(files, older...)
+}
+
+// readSnapshot returns the newest snapshot that verifies. It falls back one
+// generation at a time, and only reports errNoSnapshot when there is genuinely
+// nothing stored - if snapshots exist and none of them is usable, that is an
+// error the caller must not paper over by reseeding.
+func readSnapshot(store snapshotStore) (*engineState, string, error) {
+	snapshots, err := store.Load()
+	if err != nil {
+		return nil, "", fmt.Errorf("listing snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return nil, "", errNoSnapshot
+	}
+
+	failures := []string{}
+	for _, snap := range snapshots {
+		state, err := decodeSnapshot(snap.Data)
+		if err == nil {
+			return state, snap.Name, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", snap.Name, err))
+	}
+	return nil, "", fmt.Errorf("no valid snapshot among %d stored: %s",
+		len(snapshots), strings.Join(failures, "; "))
+}
+
+// writeSnapshot stores data as the newest snapshot and ages the previous ones,
+// keeping retain files in all.
+//
+// Write-then-rename, not WriteFile: WriteFile truncates first, so a crash
+// mid-write leaves valid-length garbage. The rotation runs before the final
+// rename, so a crash in between leaves path missing and path.1 intact, which
+// readSnapshot falls back to.
+func writeSnapshot(path string, data []byte, retain int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	rotateSnapshots(path, retain)
+	return os.Rename(tmp, path)
+}
+
+// rotateSnapshots shifts path.N to path.N+1 down the line, dropping whatever
+// falls off the end, and moves path to path.1.
+func rotateSnapshots(path string, retain int) {
+	generation := func(n int) string {
+		if n == 0 {
+			return path
+		}
+		return path + "." + strconv.Itoa(n)
+	}
+	os.Remove(generation(retain - 1))
+	for n := retain - 2; n >= 0; n-- {
+		os.Rename(generation(n), generation(n+1))
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent durations each command type keeps for its
+// percentiles. A ring rather than a histogram: the engine handles a handful of
+// command types, and 1024 durations each is nothing next to the book.
+const latencySamples = 1024
+
+// heartbeatChannel is where the leader publishes its stats every
+// heartbeatInterval. The API's /health listens to it, and calls the engine
+// down once it has heard nothing for a few intervals.
+const (
+	heartbeatChannel  = "engine:heartbeat"
+	heartbeatInterval = 5 * time.Second
+)
+
+// commandStats counts and times commands. It has its own lock because every
+// shard records into it, each holding a different engine lock.
+type commandStats struct {
+	mu     sync.Mutex
+	byType map[string]*commandTimings
+}
+
+type commandTimings struct {
+	count   uint64
+	samples [latencySamples]time.Duration
+	next    int
+}
+
+func (s *commandStats) record(commandType string, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byType == nil {
+		s.byType = make(map[string]*commandTimings)
+	}
+	t := s.byType[commandType]
+	if t == nil {
+		t = &commandTimings{}
+		s.byType[commandType] = t
+	}
+	t.samples[t.next%latencySamples] = took
+	t.next++
+	t.count++
+}
+
+func (s *commandStats) summary() map[string]CommandStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]CommandStats, len(s.byType))
+	for commandType, t := range s.byType {
+		n := min(t.next, latencySamples)
+		sorted := append([]time.Duration(nil), t.samples[:n]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		out[commandType] = CommandStats{
+			Count: t.count,
+			P50:   percentileMs(sorted, 0.50),
+			P90:   percentileMs(sorted, 0.90),
+			P99:   percentileMs(sorted, 0.99),
+			Max:   percentileMs(sorted, 1),
+		}
+	}
+	return out
+}
+
+// percentileMs reads the nearest-rank percentile p of sorted durations.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
+
+// queueLengths reports the length of each command queue, which is its
+// backlog: a command leaves its queue once the engine has taken it on. A variable for
+// the same reason as the output exits in output.go: tests have no transport.
+var queueLengths = func(queues []string) (map[string]int64, error) {
+	lengths := make(map[string]int64, len(queues))
+	for _, q := range queues {
+		n, err := bus.Len(context.Background(), q)
+		if err != nil {
+			return nil, err
+		}
+		lengths[q] = n
+	}
+	return lengths, nil
+}
+
+// Stats gathers EngineStats. It takes each lock only long enough to read what
+// that lock guards, and never two at once, so it neither stalls every market
+// while it walks them nor has to fit into the book-then-mu lock order.
+func (e *Engine) Stats() EngineStats {
+	stats := EngineStats{
+		At:       time.Now().UTC(),
+		Commands: e.stats.summary(),
+		Books:    make(map[string]BookStats, len(e.Orderbooks)),
+	}
+
+	queues := make([]string, 0, len(e.Orderbooks)+1)
+	for _, shard := range e.shards() {
+		queues = append(queues, shardQueue(shard))
+	}
+	lengths, err := queueLengths(queues)
+	if err != nil {
+		log.Printf("Error reading queue lengths: %v", err)
+	}
+	stats.Queues = lengths
+
+	for ticker, book := range e.Orderbooks {
+		book.mu.Lock()
+		stats.Books[ticker] = BookStats{Bids: len(book.Bids), Asks: len(book.Asks)}
+		book.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	stats.Users = len(e.Balances)
+	last := e.lastSnapshot
+	e.mu.Unlock()
+	stats.LastSnapshotSequence = last.Sequence
+	if !last.CreatedAt.IsZero() {
+		age := stats.At.Sub(last.CreatedAt).Seconds()
+		stats.LastSnapshotAgeSeconds = &age
+	}
+
+	e.seqMu.Lock()
+	stats.Sequence = e.Sequence
+	e.seqMu.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.Memory = MemoryStats{
+		HeapAllocBytes: mem.HeapAlloc,
+		SysBytes:       mem.Sys,
+		Goroutines:     runtime.NumGoroutine(),
+	}
+	return stats
+}
+
+func (e *Engine) handleGetEngineStats(clientID string) {
+	e.reply(clientID, MessageToAPI{
+		Type:    GET_ENGINE_STATS,
+		Payload: e.Stats(),
+	})
+}
+
+// heartbeat publishes the leader's stats on heartbeatChannel until ctx ends.
+// Only the leader beats: a standby answering /health would report an engine
+// that is not taking orders as alive.
+func heartbeat(ctx context.Context, engine *Engine) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(engine.Stats())
+		if err != nil {
+			log.Printf("Error marshaling heartbeat: %v", err)
+		} else if err := bus.Publish(ctx, heartbeatChannel, data); err != nil && ctx.Err() == nil {
+			log.Printf("Error publishing heartbeat: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
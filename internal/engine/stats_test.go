@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEngineStatsReportsWhatTheEngineDid(t *testing.T) {
+	countOutputs(t)
+	replies := captureReplies(t)
+	original := queueLengths
+	queueLengths = func(queues []string) (map[string]int64, error) {
+		lengths := map[string]int64{}
+		for _, q := range queues {
+			lengths[q] = 7
+		}
+		return lengths, nil
+	}
+	t.Cleanup(func() { queueLengths = original })
+
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	e.Process(order("sell", "100", "1", "maker"), "c")
+	e.Process(order("sell", "101", "1", "maker"), "c")
+	*replies = nil
+
+	e.Process(MessageFromAPI{Type: GET_ENGINE_STATS}, "c")
+	stats := onlyReply(t, replies).Payload.(EngineStats)
+
+	if got := stats.Commands[CREATE_ORDER].Count; got != 2 {
+		t.Errorf("CREATE_ORDER count = %d, want 2", got)
+	}
+	if got := stats.Books[testMarket].Asks; got != 2 {
+		t.Errorf("%s asks = %d, want 2", testMarket, got)
+	}
+	if stats.Queues["messages"] != 7 || stats.Queues["messages:"+testMarket] != 7 {
+		t.Errorf("queues = %v, want every shard's queue", stats.Queues)
+	}
+	if stats.Sequence != 3 || stats.Users != 1 {
+		t.Errorf("sequence, users = %d, %d; want 3, 1", stats.Sequence, stats.Users)
+	}
+	if stats.LastSnapshotAgeSeconds != nil {
+		t.Error("snapshot age reported before any snapshot was written")
+	}
+}
+
+func TestPercentileIsNearestRank(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	for p, want := range map[float64]float64{0.5: 50, 0.9: 90, 0.99: 99, 1: 100} {
+		if got := percentileMs(sorted, p); got != want {
+			t.Errorf("p%v = %vms, want %vms", p*100, got, want)
+		}
+	}
+	if got := percentileMs(nil, 0.5); got != 0 {
+		t.Errorf("empty p50 = %v, want 0", got)
+	}
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// tickerWindow is how far back the rolling ticker reaches.
+const tickerWindow = 24 * time.Hour
+
+// TickerMinute is one minute of a market's trades. The rolling ticker is the
+// sum of the last day of them: a minute leaves the window whole, so the window
+// is at most a minute longer than a day, and nothing has to remember each
+// trade to take it back out.
+type TickerMinute struct {
+	Start       time.Time `json:"start"`
+	Open        float64   `json:"open"`
+	High        float64   `json:"high"`
+	Low         float64   `json:"low"`
+	Close       float64   `json:"close"`
+	Volume      float64   `json:"volume"`
+	QuoteVolume float64   `json:"quoteVolume"`
+	Trades      int       `json:"trades"`
+}
+
+// Ticker is a market's rolling 24h summary, published on ticker.<market> and
+// answered to GET_TICKER. Field names are the frontend's Ticker type in
+// frontend/app/utils/types.ts.
+type Ticker struct {
+	Symbol             string `json:"symbol"`
+	LastPrice          string `json:"lastPrice"`
+	High               string `json:"high"`
+	Low                string `json:"low"`
+	Volume             string `json:"volume"`
+	QuoteVolume        string `json:"quoteVolume"`
+	PriceChange        string `json:"priceChange"`
+	PriceChangePercent string `json:"priceChangePercent"`
+	Trades             string `json:"trades"`
+	FirstPrice         string `json:"firstPrice"`
+}
+
+type GetTickerData struct {
+	Market string `json:"market"`
+}
+
+func tickerStream(market string) string {
+	return fmt.Sprintf("ticker.%s", market)
+}
+
+// recordTicker adds one command's fills to book's minutes, then publishes the
+// ticker. Minutes are by when the command ran, as candles are, so a replay
+// files the fills under the leader's minutes. Called under book.mu.
+func (e *Engine) recordTicker(book *Orderbook, market string, fills []Fill) {
+	if len(fills) == 0 {
+		return
+	}
+	at := book.now()
+	minute := at.UTC().Truncate(time.Minute)
+	n := len(book.TickerMinutes)
+	if n == 0 || !book.TickerMinutes[n-1].Start.Equal(minute) {
+		price, _ := strconv.ParseFloat(fills[0].Price, 64)
+		book.TickerMinutes = append(book.TickerMinutes, TickerMinute{Start: minute, Open: price, High: price, Low: price})
+		n++
+	}
+	m := &book.TickerMinutes[n-1]
+	for _, fill := range fills {
+		price, _ := strconv.ParseFloat(fill.Price, 64)
+		m.High = max(m.High, price)
+		m.Low = min(m.Low, price)
+		m.Close = price
+		m.Volume += fill.Qty
+		m.QuoteVolume += fill.Qty * price
+		m.Trades++
+	}
+
+	ticker := book.ticker(market, at)
+	e.publish(tickerStream(market), WsMessage{
+		Stream:     tickerStream(market),
+		TickerData: &ticker,
+	})
+}
+
+// ticker sums the minutes inside the window ending at, dropping the ones
+// before it. A market with no trades in the window gets a zeroed ticker, so
+// an unseeded market still renders a row. Called under book.mu.
+func (book *Orderbook) ticker(market string, at time.Time) Ticker {
+	from := at.UTC().Truncate(time.Minute).Add(-tickerWindow)
+	drop := 0
+	for drop < len(book.TickerMinutes) && !book.TickerMinutes[drop].Start.After(from) {
+		drop++
+	}
+	book.TickerMinutes = book.TickerMinutes[drop:]
+
+	var high, low, volume, quoteVolume, first, last float64
+	trades := 0
+	for i, m := range book.TickerMinutes {
+		if i == 0 {
+			first, high, low = m.Open, m.High, m.Low
+		}
+		high = max(high, m.High)
+		low = min(low, m.Low)
+		last = m.Close
+		volume += m.Volume
+		quoteVolume += m.QuoteVolume
+		trades += m.Trades
+	}
+
+	change := last - first
+	changePercent := 0.0
+	if first > 0 {
+		changePercent = change / first * 100
+	}
+	return Ticker{
+		Symbol:             market,
+		LastPrice:          formatNum(last),
+		High:               formatNum(high),
+		Low:                formatNum(low),
+		Volume:             formatNum(volume),
+		QuoteVolume:        formatNum(quoteVolume),
+		PriceChange:        formatNum(change),
+		PriceChangePercent: formatNum(changePercent),
+		Trades:             strconv.Itoa(trades),
+		FirstPrice:         formatNum(first),
+	}
+}
+
+func (e *Engine) handleGetTicker(message MessageFromAPI, clientID string) {
+	dataBytes, _ := json.Marshal(message.Data)
+	var data GetTickerData
+	json.Unmarshal(dataBytes, &data)
+
+	book, exists := e.Orderbooks[data.Market]
+	if !exists {
+		e.reject(clientID, &OrderError{Code: "NO_ORDERBOOK", Reason: "no orderbook for market " + data.Market})
+		return
+	}
+	e.reply(clientID, MessageToAPI{
+		Type: GET_TICKER,
+		// ticker drops the minutes that left the window, so it goes by the
+		// command's time too, or a replay would drop a different set.
+		Payload: book.ticker(data.Market, book.now()),
+	})
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTickerRollsOverTheLastDay(t *testing.T) {
+	countOutputs(t)
+	replies := captureReplies(t)
+	now := time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC)
+	setClock(t, &now)
+
+	e := newTestEngine(t)
+	fund(e, "maker", 0, 10)
+	fund(e, "taker", 10000, 0)
+	trade := func(price string) {
+		e.Process(order("sell", price, "1", "maker"), "c")
+		e.Process(order("buy", price, "1", "taker"), "c")
+	}
+	ticker := func() Ticker {
+		t.Helper()
+		*replies = nil
+		e.Process(MessageFromAPI{Type: GET_TICKER, Data: GetTickerData{Market: testMarket}}, "c")
+		return onlyReply(t, replies).Payload.(Ticker)
+	}
+
+	if got := ticker(); got.Trades != "0" || got.LastPrice != "0" {
+		t.Errorf("before any trade: %+v", got)
+	}
+
+	trade("100")
+	now = now.Add(12 * time.Hour)
+	trade("120")
+	trade("90")
+	got := ticker()
+	if got.FirstPrice != "100" || got.LastPrice != "90" || got.High != "120" || got.Low != "90" ||
+		got.Volume != "3" || got.QuoteVolume != "310" || got.Trades != "3" ||
+		got.PriceChange != "-10" || got.PriceChangePercent != "-10" {
+		t.Errorf("within the day: %+v", got)
+	}
+
+	// A day after the first trade's minute, it has left the window.
+	now = now.Add(12 * time.Hour)
+	got = ticker()
+	if got.FirstPrice != "120" || got.High != "120" || got.Volume != "2" || got.Trades != "2" {
+		t.Errorf("after the first trade's minute left: %+v", got)
+	}
+}
+
+// Replayed a day late, the leader's trades still count in the standby's
+// ticker minutes, under the minute they were made in.
+func TestReplayedTickerUsesTheLeadersTime(t *testing.T) {
+	countOutputs(t)
+	now := time.Date(2024, 3, 5, 10, 30, 15, 0, time.UTC)
+	setClock(t, &now)
+
+	leader, standby := standbyPair(t)
+	entries := journalOf(t, leader,
+		order("sell", "100", "1", "maker"),
+		order("buy", "100", "1", "taker"),
+		MessageFromAPI{Type: GET_TICKER, Data: GetTickerData{Market: testMarket}},
+	)
+
+	now = now.Add(25 * time.Hour)
+	if !standby.catchUp(entries, allMuted, nil) {
+		t.Fatal("catchUp reported a gap")
+	}
+	minutes := standby.Orderbooks[testMarket].TickerMinutes
+	want := time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+	if len(minutes) != 1 || !minutes[0].Start.Equal(want) || minutes[0].Trades != 1 {
+		t.Errorf("standby's ticker minutes = %+v, want one trade in the 10:30 minute", minutes)
+	}
+}
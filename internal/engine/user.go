@@ -1,4 +1,4 @@
-package main
+package engine
 
 import (
 	"encoding/json"
@@ -19,7 +19,7 @@ func (e *Engine) handleCreateUser(message MessageFromAPI, clientID string) {
 
 	name := strings.TrimSpace(data.Name)
 	if name == "" {
-		sendRejection(clientID, &OrderError{Code: "INVALID_USER", Reason: "name is required"})
+		e.reject(clientID, &OrderError{Code: "INVALID_USER", Reason: "name is required"})
 		return
 	}
 
@@ -28,7 +28,7 @@ func (e *Engine) handleCreateUser(message MessageFromAPI, clientID string) {
 	if data.Amount != "" {
 		parsed, err := strconv.ParseFloat(data.Amount, 64)
 		if err != nil || parsed < 0 {
-			sendRejection(clientID, &OrderError{Code: "INVALID_USER", Reason: "amount must be a non-negative number"})
+			e.reject(clientID, &OrderError{Code: "INVALID_USER", Reason: "amount must be a non-negative number"})
 			return
 		}
 		amount = parsed
@@ -42,7 +42,7 @@ func (e *Engine) handleCreateUser(message MessageFromAPI, clientID string) {
 	e.creditAllAssets(userID, amount, data.TxnID)
 	log.Printf("created virtual user %s (%s) with %.2f across %d assets", userID, name, amount, len(allAssets()))
 
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type:    CREATE_USER,
 		Payload: VirtualUser{ID: userID, Name: name},
 	})
@@ -63,7 +63,7 @@ func (e *Engine) handleGetUsers(clientID string) {
 		return users[i].ID < users[j].ID
 	})
 
-	sendToAPI(clientID, MessageToAPI{
+	e.reply(clientID, MessageToAPI{
 		Type:    GET_USERS,
 		Payload: users,
 	})
@@ -0,0 +1,447 @@
+package kline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// message is one persistence message, parsed. At most one of trade, order and
+// ledger is set; none is a message with nothing to write.
+type message struct {
+	eventID string
+
+	trade  *tradeRow
+	order  *OrderUpdateData
+	ledger []LedgerEntryData
+}
+
+// tradeRow is one trade: a point of the market's price series and, when the
+// message names who traded, a row of the trades table.
+type tradeRow struct {
+	id     string
+	time   time.Time
+	price  float64
+	volume float64
+	market string
+
+	quoteQuantity float64
+	makerOrderID  string
+	takerOrderID  string
+	makerUserID   string
+	takerUserID   string
+	makerSide     string
+	takerSide     string
+}
+
+// recorded reports whether the trade has a row in the trades table to write.
+// Trades from an engine older than it name no orders, and only go into the
+// price series.
+func (t tradeRow) recorded() bool {
+	return t.takerOrderID != ""
+}
+
+// parse decodes one message off the queue. Every error it returns wraps
+// errMalformed: nothing here has touched Postgres.
+func parse(payload []byte) (message, error) {
+	var raw struct {
+		EventID string          `json:"eventId"`
+		Type    string          `json:"type"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return message{}, fmt.Errorf("%w: parsing message: %v", errMalformed, err)
+	}
+	m, err := parseData(raw.Type, raw.Data)
+	m.eventID = raw.EventID
+	return m, err
+}
+
+// parseData decodes the data of a message of type messageType.
+func parseData(messageType string, raw json.RawMessage) (message, error) {
+	switch messageType {
+	case "TRADE_ADDED":
+		var data TradeData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return message{}, fmt.Errorf("%w: unmarshaling trade data: %v", errMalformed, err)
+		}
+		price, err := strconv.ParseFloat(data.Price, 64)
+		if err != nil {
+			return message{}, fmt.Errorf("%w: parsing price: %v", errMalformed, err)
+		}
+		volume, err := strconv.ParseFloat(data.Quantity, 64)
+		if err != nil {
+			return message{}, fmt.Errorf("%w: parsing volume: %v", errMalformed, err)
+		}
+		quoteQuantity := price * volume
+		if data.QuoteQuantity != "" {
+			if quoteQuantity, err = strconv.ParseFloat(data.QuoteQuantity, 64); err != nil {
+				return message{}, fmt.Errorf("%w: parsing quote quantity: %v", errMalformed, err)
+			}
+		}
+		return message{trade: &tradeRow{
+			id:            data.ID,
+			time:          time.UnixMilli(data.Timestamp),
+			price:         price,
+			volume:        volume,
+			market:        data.Market,
+			quoteQuantity: quoteQuantity,
+			makerOrderID:  data.MakerOrderID,
+			takerOrderID:  data.TakerOrderID,
+			makerUserID:   data.MakerUserID,
+			takerUserID:   data.TakerUserID,
+			makerSide:     data.MakerSide,
+			takerSide:     data.TakerSide,
+		}}, nil
+
+	case "ORDER_UPDATE":
+		var data OrderUpdateData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return message{}, fmt.Errorf("%w: unmarshaling order update: %v", errMalformed, err)
+		}
+		if data.OrderID == "" {
+			return message{}, nil
+		}
+		return message{order: &data}, nil
+
+	case "LEDGER_ENTRY":
+		var data LedgerEntryData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return message{}, fmt.Errorf("%w: unmarshaling ledger entry: %v", errMalformed, err)
+		}
+		return message{ledger: []LedgerEntryData{data}}, nil
+
+	case "LEDGER_ENTRIES":
+		var data LedgerEntriesData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return message{}, fmt.Errorf("%w: unmarshaling ledger entries: %v", errMalformed, err)
+		}
+		return message{ledger: data.Entries}, nil
+	}
+	// Dead-lettered rather than skipped: an engine newer than this processor
+	// sends types it does not know, and those can be replayed once it does.
+	return message{}, fmt.Errorf("%w: unknown message type %q", errMalformed, messageType)
+}
+
+// batch is messages written in one transaction, as one statement per table
+// rather than one per message.
+//
+// Trades and ledger rows are appended, and order does not matter between
+// them. Order rows do depend on order: an order's fills add to the row its
+// create inserts. So all creates are written before all increments, and a
+// batch never takes a create for an order it already holds anything for -
+// that message opens the next batch instead. Within those rules the one
+// statement per table writes what the messages would have one by one.
+type batch struct {
+	deliveries []transport.Delivery
+	messages   []message
+	// orders is the order ids the batch's messages create or update.
+	orders map[string]bool
+}
+
+func newBatch() *batch {
+	return &batch{orders: make(map[string]bool)}
+}
+
+// fits reports whether m can join b without changing what it writes.
+func (b *batch) fits(m message) bool {
+	return m.order == nil || m.order.UserID == nil || !b.orders[m.order.OrderID]
+}
+
+func (b *batch) add(d transport.Delivery, m message) {
+	b.deliveries = append(b.deliveries, d)
+	b.messages = append(b.messages, m)
+	if m.order != nil {
+		b.orders[m.order.OrderID] = true
+	}
+}
+
+// rows is what a batch writes to each table.
+type rows struct {
+	trades  []tradeRow
+	ledger  []LedgerEntryData
+	creates []OrderUpdateData
+	// increments folds every increment to one order into one row: the
+	// deltas summed and the last status set, which is the cancel.
+	increments map[string]*OrderUpdateData
+}
+
+// rows collects the rows of the messages fresh reports true for.
+func (b *batch) rows(fresh func(m message) bool) rows {
+	r := rows{increments: make(map[string]*OrderUpdateData)}
+	for _, m := range b.messages {
+		if !fresh(m) {
+			continue
+		}
+		switch {
+		case m.trade != nil:
+			r.trades = append(r.trades, *m.trade)
+		case m.order != nil && m.order.UserID != nil:
+			r.creates = append(r.creates, *m.order)
+		case m.order != nil:
+			folded, ok := r.increments[m.order.OrderID]
+			if !ok {
+				folded = &OrderUpdateData{OrderID: m.order.OrderID}
+				r.increments[m.order.OrderID] = folded
+			}
+			folded.ExecutedQty += m.order.ExecutedQty
+			if m.order.Status != nil {
+				folded.Status = m.order.Status
+			}
+		}
+		r.ledger = append(r.ledger, m.ledger...)
+	}
+	return r
+}
+
+// write writes b in one transaction: all of it or, on any error, none.
+//
+// The transaction first records the batch's event ids as applied, and writes
+// only the messages whose id it recorded just now. A message this processor -
+// or its predecessor - already committed is then a no-op, however it came
+// back: redelivered after a crash between commit and acknowledgement, or
+// re-emitted by an engine that took over half way through a command. Both
+// happen inside the one transaction, so an id is recorded exactly when its
+// message is written. Messages from an engine older than event ids carry
+// none and are written as they come.
+func (b *batch) write(db *sql.DB) error {
+	ids := []string{}
+	for _, m := range b.messages {
+		if m.eventID != "" {
+			ids = append(ids, m.eventID)
+		}
+	}
+	if b.rows(func(message) bool { return true }).empty() {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning batch: %w", err)
+	}
+	defer tx.Rollback()
+
+	claimed, err := claimEvents(tx, ids)
+	if err != nil {
+		return fmt.Errorf("recording %d events: %w", len(ids), err)
+	}
+	r := b.rows(func(m message) bool {
+		if m.eventID == "" {
+			return true
+		}
+		// Once: the same event twice in one batch is claimed once.
+		fresh := claimed[m.eventID]
+		delete(claimed, m.eventID)
+		return fresh
+	})
+
+	if err := insertTrades(tx, r.trades); err != nil {
+		return fmt.Errorf("inserting %d trades: %w", len(r.trades), err)
+	}
+	if err := insertLedger(tx, r.ledger); err != nil {
+		return fmt.Errorf("inserting %d ledger entries: %w", len(r.ledger), err)
+	}
+	if err := insertOrders(tx, r.creates); err != nil {
+		return fmt.Errorf("inserting %d orders: %w", len(r.creates), err)
+	}
+	if err := updateOrders(tx, r.increments); err != nil {
+		return fmt.Errorf("updating %d orders: %w", len(r.increments), err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing batch: %w", err)
+	}
+	return nil
+}
+
+func (r rows) empty() bool {
+	return len(r.trades)+len(r.ledger)+len(r.creates)+len(r.increments) == 0
+}
+
+// claimEvents records ids as applied and returns those that were not already.
+func claimEvents(tx *sql.Tx, ids []string) (map[string]bool, error) {
+	claimed := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return claimed, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	result, err := tx.Query(`
+		INSERT INTO processed_events (event_id)
+		VALUES `+values(len(ids), 1)+`
+		ON CONFLICT DO NOTHING
+		RETURNING event_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	for result.Next() {
+		var id string
+		if err := result.Scan(&id); err != nil {
+			return nil, err
+		}
+		claimed[id] = true
+	}
+	return claimed, result.Err()
+}
+
+// values renders the VALUES list for rows rows of cols parameters each:
+// ($1, $2), ($3, $4), ...
+func values(rows, cols int) string {
+	var sb strings.Builder
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for c := 0; c < cols; c++ {
+			if c > 0 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, "$%d", r*cols+c+1)
+		}
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// insertTrades writes each trade to the price series and, if it names who
+// traded, to the trades table. ON CONFLICT on both, because a trade delivered
+// again after a crash between the commit and its acknowledgement would
+// otherwise fail on the key and take its whole batch down with it.
+func insertTrades(tx *sql.Tx, trades []tradeRow) error {
+	if len(trades) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 5*len(trades))
+	for _, t := range trades {
+		args = append(args, t.id, t.time, t.price, t.volume, t.market)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO sol_prices (id, time, price, volume, market)
+		VALUES `+values(len(trades), 5)+`
+		ON CONFLICT DO NOTHING`, args...); err != nil {
+		return err
+	}
+
+	args = args[:0]
+	n := 0
+	for _, t := range trades {
+		if !t.recorded() {
+			continue
+		}
+		args = append(args, t.id, t.market, t.price, t.volume, t.quoteQuantity,
+			t.makerOrderID, t.takerOrderID, t.makerUserID, t.takerUserID,
+			t.makerSide, t.takerSide, t.time)
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO trades (trade_id, market, price, quantity, quote_quantity,
+			maker_order_id, taker_order_id, maker_user_id, taker_user_id,
+			maker_side, taker_side, executed_at)
+		VALUES `+values(n, 12)+`
+		ON CONFLICT DO NOTHING`, args...)
+	return err
+}
+
+// insertLedger appends movements of value. ON CONFLICT DO NOTHING is there for
+// the seed credits, which the engine re-emits on any boot without a snapshot
+// and which carry a deterministic ref_id (see ledger_seed_uniq). A trade's
+// legs arrive as one message, so they are in one batch and commit together.
+func insertLedger(tx *sql.Tx, entries []LedgerEntryData) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 5*len(entries))
+	for _, e := range entries {
+		args = append(args, e.UserID, e.Asset, e.Delta, e.Reason, e.RefID)
+	}
+	_, err := tx.Exec(`
+		INSERT INTO ledger (user_id, asset, delta, reason, ref_id)
+		VALUES `+values(len(entries), 5)+`
+		ON CONFLICT DO NOTHING`, args...)
+	return err
+}
+
+// insertOrders inserts each create's row. ON CONFLICT rather than a plain
+// INSERT: the engine can be restarted from a snapshot that still holds an
+// order id already written here.
+func insertOrders(tx *sql.Tx, creates []OrderUpdateData) error {
+	if len(creates) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 8*len(creates))
+	for _, data := range creates {
+		price, quantity := 0.0, 0.0
+		if data.Price != nil {
+			price, _ = strconv.ParseFloat(*data.Price, 64)
+		}
+		if data.Quantity != nil {
+			quantity, _ = strconv.ParseFloat(*data.Quantity, 64)
+		}
+		status := "open"
+		if data.Status != nil {
+			status = *data.Status
+		}
+		args = append(args, data.OrderID, *data.UserID, derefOr(data.Market), derefOr(data.Side),
+			price, quantity, data.ExecutedQty, status)
+	}
+	_, err := tx.Exec(`
+		INSERT INTO orders (order_id, user_id, market, side, price, quantity, executed_qty, status)
+		VALUES `+values(len(creates), 8)+`
+		ON CONFLICT (order_id) DO UPDATE SET
+			executed_qty = orders.executed_qty + EXCLUDED.executed_qty,
+			status = CASE
+				WHEN orders.executed_qty + EXCLUDED.executed_qty >= orders.quantity THEN 'filled'
+				-- The engine's own verdict wins when it is terminal. Without
+				-- this branch EXCLUDED.status was never consulted at all, so a
+				-- market order replayed after a snapshot restore came back as
+				-- 'open' and showed in open orders despite not being on the book.
+				WHEN EXCLUDED.status IN ('filled', 'partially_filled', 'cancelled') THEN EXCLUDED.status
+				ELSE orders.status
+			END,
+			updated_at = now()`, args...)
+	return err
+}
+
+// updateOrders adds each folded increment to its row. A status forces itself
+// (a cancel) while a plain fill leaves the derivation to the CASE.
+func updateOrders(tx *sql.Tx, increments map[string]*OrderUpdateData) error {
+	if len(increments) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 3*len(increments))
+	for _, data := range increments {
+		args = append(args, data.OrderID, data.ExecutedQty, data.Status)
+	}
+	// The casts type the VALUES columns, which Postgres cannot infer from
+	// parameters alone.
+	var rows strings.Builder
+	for r := 0; r < len(increments); r++ {
+		if r > 0 {
+			rows.WriteString(", ")
+		}
+		fmt.Fprintf(&rows, "($%d::text, $%d::numeric, $%d::text)", 3*r+1, 3*r+2, 3*r+3)
+	}
+	_, err := tx.Exec(`
+		UPDATE orders SET
+			executed_qty = orders.executed_qty + v.delta,
+			status = CASE
+				WHEN v.status IS NOT NULL THEN v.status
+				WHEN orders.executed_qty + v.delta >= orders.quantity THEN 'filled'
+				ELSE orders.status
+			END,
+			updated_at = now()
+		FROM (VALUES `+rows.String()+`) AS v(order_id, delta, status)
+		WHERE orders.order_id = v.order_id`, args...)
+	return err
+}
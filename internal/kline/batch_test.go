@@ -0,0 +1,203 @@
+package kline
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// One statement per table only writes what the messages would have one by
+// one if an order's increments fold into a single row behind its create, and
+// a second create of the same order waits for the next batch.
+func TestBatchFoldsOrderUpdates(t *testing.T) {
+	str := func(s string) *string { return &s }
+	b := newBatch()
+	add := func(data OrderUpdateData) bool {
+		m := message{order: &data}
+		if !b.fits(m) {
+			return false
+		}
+		b.add(transport.Delivery{}, m)
+		return true
+	}
+
+	create := OrderUpdateData{OrderID: "o1", UserID: str("u"), Quantity: str("10"), Status: str("open")}
+	add(create)
+	add(OrderUpdateData{OrderID: "o1", ExecutedQty: 4})
+	add(OrderUpdateData{OrderID: "o1", ExecutedQty: 2})
+	add(OrderUpdateData{OrderID: "o1", Status: str("cancelled")})
+
+	r := b.rows(func(message) bool { return true })
+	if len(r.creates) != 1 || len(r.increments) != 1 {
+		t.Fatalf("got %d creates and %d increments, want 1 and 1", len(r.creates), len(r.increments))
+	}
+	folded := r.increments["o1"]
+	if folded.ExecutedQty != 6 || folded.Status == nil || *folded.Status != "cancelled" {
+		t.Errorf("folded increment = %v/%v, want 6/cancelled", folded.ExecutedQty, folded.Status)
+	}
+	if add(create) {
+		t.Error("a second create of o1 joined the batch holding its first")
+	}
+	if !add(OrderUpdateData{OrderID: "o2", UserID: str("u")}) {
+		t.Error("another order's create did not fit")
+	}
+}
+
+// A batch commits whole or not at all, so a trade's ledger legs never land
+// without the rest of their batch. Needs a real Postgres; set TEST_DB_ADDR.
+func TestBatchWritesAllOrNothing(t *testing.T) {
+	addr := os.Getenv("TEST_DB_ADDR")
+	if addr == "" {
+		t.Skip("TEST_DB_ADDR not set")
+	}
+
+	db, err := dbase.New(addr, 5, 5, "1m")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer db.Close()
+
+	if err := dbase.InitializeExchangeTables(db); err != nil {
+		t.Fatalf("init tables: %v", err)
+	}
+
+	ref := "test-trade-" + t.Name()
+	t.Cleanup(func() { db.Exec(`DELETE FROM ledger WHERE ref_id = $1`, ref) })
+	db.Exec(`DELETE FROM ledger WHERE ref_id = $1`, ref)
+
+	b := newBatch()
+	for _, payload := range [][]byte{
+		encode(t, "LEDGER_ENTRIES", LedgerEntriesData{Entries: []LedgerEntryData{
+			{UserID: "a", Asset: "USD", Delta: 100, Reason: "trade", RefID: ref},
+			{UserID: "b", Asset: "USD", Delta: -100, Reason: "trade", RefID: ref},
+		}}),
+		// sol_prices.id is VARCHAR(50): Postgres rejects this one outright.
+		encode(t, "TRADE_ADDED", TradeData{ID: strings.Repeat("x", 60), Price: "1", Quantity: "1"}),
+	} {
+		m, err := parse(payload)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		b.add(transport.Delivery{Payload: payload}, m)
+	}
+
+	err = b.write(db)
+	if err == nil || transient(err) {
+		t.Fatalf("write = %v, want a permanent error", err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ledger WHERE ref_id = $1`, ref).Scan(&count); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("got %d ledger rows from a batch that failed, want 0", count)
+	}
+}
+
+// A message already written - the batch redelivered after a crash between its
+// commit and acknowledgement - writes nothing the second time, and one event
+// twice in a batch is written once. Needs a real Postgres; set TEST_DB_ADDR.
+func TestRedeliveredEventsAreSkipped(t *testing.T) {
+	addr := os.Getenv("TEST_DB_ADDR")
+	if addr == "" {
+		t.Skip("TEST_DB_ADDR not set")
+	}
+
+	db, err := dbase.New(addr, 5, 5, "1m")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer db.Close()
+
+	if err := dbase.InitializeExchangeTables(db); err != nil {
+		t.Fatalf("init tables: %v", err)
+	}
+
+	ref := "test-trade-" + t.Name()
+	orderID := "test-order-" + t.Name()
+	events := []string{ref + ":ledger", orderID + ":create", orderID + ":fill"}
+	cleanup := func() {
+		db.Exec(`DELETE FROM ledger WHERE ref_id = $1`, ref)
+		db.Exec(`DELETE FROM orders WHERE order_id = $1`, orderID)
+		for _, id := range events {
+			db.Exec(`DELETE FROM processed_events WHERE event_id = $1`, id)
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	str := func(s string) *string { return &s }
+	payloads := [][]byte{}
+	for _, m := range []DbMessage{
+		{EventID: events[0], Type: "LEDGER_ENTRIES", Data: LedgerEntriesData{Entries: []LedgerEntryData{
+			{UserID: "a", Asset: "USD", Delta: 100, Reason: "trade", RefID: ref},
+			{UserID: "b", Asset: "USD", Delta: -100, Reason: "trade", RefID: ref},
+		}}},
+		{EventID: events[1], Type: "ORDER_UPDATE", Data: OrderUpdateData{
+			OrderID: orderID, Market: str("SOL_USD"), Price: str("200"), Quantity: str("10"),
+			Side: str("sell"), UserID: str("test-user"), Status: str("open"),
+		}},
+		{EventID: events[2], Type: "ORDER_UPDATE", Data: OrderUpdateData{OrderID: orderID, ExecutedQty: 4}},
+	} {
+		raw, _ := json.Marshal(m)
+		payloads = append(payloads, raw)
+	}
+	// The fill twice in one batch, then the whole batch again.
+	payloads = append(payloads, payloads[2])
+	for i := 0; i < 2; i++ {
+		b := newBatch()
+		for _, payload := range payloads {
+			m, err := parse(payload)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			b.add(transport.Delivery{Payload: payload}, m)
+		}
+		if err := b.write(db); err != nil {
+			t.Fatalf("write #%d: %v", i+1, err)
+		}
+	}
+
+	var legs int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ledger WHERE ref_id = $1`, ref).Scan(&legs); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if legs != 2 {
+		t.Errorf("got %d ledger legs, want 2", legs)
+	}
+	var executed float64
+	if err := db.QueryRow(`SELECT executed_qty FROM orders WHERE order_id = $1`, orderID).Scan(&executed); err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if executed != 4 {
+		t.Errorf("executed_qty = %v, want 4", executed)
+	}
+}
+
+// A trade naming who traded goes into the trades table as well as the price
+// series; one from an engine older than that table goes into the series only.
+func TestTradesFromOlderEnginesAreSeriesOnly(t *testing.T) {
+	full, err := parse(encode(t, "TRADE_ADDED", TradeData{
+		ID: "SOL_USD-1", Price: "200", Quantity: "0.5", QuoteQuantity: "100", Market: "SOL_USD",
+		MakerOrderID: "m", TakerOrderID: "t", MakerUserID: "mu", TakerUserID: "tu",
+		MakerSide: "sell", TakerSide: "buy",
+	}))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !full.trade.recorded() || full.trade.quoteQuantity != 100 {
+		t.Errorf("full trade = %+v, want it recorded with quote quantity 100", *full.trade)
+	}
+
+	old, err := parse(encode(t, "TRADE_ADDED", TradeData{ID: "SOL_USD-2", Price: "200", Quantity: "0.5"}))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if old.trade.recorded() || old.trade.quoteQuantity != 100 {
+		t.Errorf("old trade = %+v, want it unrecorded, quote quantity derived as 100", *old.trade)
+	}
+}
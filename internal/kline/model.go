@@ -1,20 +1,29 @@
 package kline
 
 type DbMessage struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
+	EventID string      `json:"eventId,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
 }
 
+// TradeData mirrors the engine's TradeAddedData. The order, user and side
+// fields are missing from what an engine older than the trades table sent.
 type TradeData struct {
-	ID           string `json:"id"`
-	IsBuyerMaker bool   `json:"isBuyerMaker"`
-	Price        string `json:"price"`
-	Quantity     string `json:"quantity"`
-	Timestamp    int64  `json:"timestamp"`
-	Market       string `json:"market"`
+	ID            string `json:"id"`
+	Price         string `json:"price"`
+	Quantity      string `json:"quantity"`
+	QuoteQuantity string `json:"quoteQuantity"`
+	Timestamp     int64  `json:"timestamp"`
+	Market        string `json:"market"`
+	MakerOrderID  string `json:"makerOrderId"`
+	TakerOrderID  string `json:"takerOrderId"`
+	MakerUserID   string `json:"makerUserId"`
+	TakerUserID   string `json:"takerUserId"`
+	MakerSide     string `json:"makerSide"`
+	TakerSide     string `json:"takerSide"`
 }
 
-// OrderUpdateData mirrors the engine's type in cmd/engine/model.go. ExecutedQty
+// OrderUpdateData mirrors the engine's type in internal/engine/model.go. ExecutedQty
 // is a delta to add, not a total to set. Market/Price/Quantity/Side/UserID are
 // present only on the create message; a nil UserID means this is an increment
 // against a row that already exists.
@@ -36,3 +45,8 @@ type LedgerEntryData struct {
 	Reason string  `json:"reason"`
 	RefID  string  `json:"refId"`
 }
+
+// LedgerEntriesData is every leg of one trade, written together.
+type LedgerEntriesData struct {
+	Entries []LedgerEntryData `json:"entries"`
+}
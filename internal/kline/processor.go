@@ -3,184 +3,268 @@ package kline
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"log"
-	"strconv"
+	"sync/atomic"
 	"time"
 
-	"github.com/Althaf66/cryptoXchange/internal/rediscfg"
-	"github.com/go-redis/redis/v8"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/lib/pq"
 )
 
-func StartDataProcessor(db *sql.DB) {
-	rdb := redis.NewClient(rediscfg.Options())
+const (
+	// retryDelay is the first wait before writing a batch again after a
+	// transient error. It doubles on every retry up to maxRetryDelay.
+	retryDelay    = time.Second
+	maxRetryDelay = 30 * time.Second
+)
 
-	ctx := context.Background()
+// batchSize caps how many messages one transaction writes. A trade is a
+// handful of messages, so this is a few hundred trades a commit, and it keeps
+// the largest multi-row insert well under Postgres's 65535 parameters.
+const batchSize = 500
 
-	// Test Redis connection
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Fatal("Failed to connect to Redis:", err)
-	}
-	log.Println("Connected to Redis")
+// errMalformed marks a message no retry can write.
+var errMalformed = errors.New("malformed message")
 
-	for {
-		// Block and wait for messages from Redis list
-		result, err := rdb.BRPop(ctx, 0, "db_processor").Result()
-		if err != nil {
-			log.Printf("Error reading from Redis: %v", err)
-			time.Sleep(time.Second)
-			continue
+// Metrics counts what StartDataProcessor has done, for cmd/dbprocessor's
+// /metrics. Every field is safe to read while it runs.
+type Metrics struct {
+	// Batches counts batches finished, Messages the messages they committed
+	// and DeadLettered those set aside instead.
+	Batches      atomic.Int64
+	Messages     atomic.Int64
+	DeadLettered atomic.Int64
+	// Retries counts batch writes retried after a transient error. One that
+	// keeps climbing while Batches stands still is a database that is down.
+	Retries atomic.Int64
+	// LastBatch is when the last batch committed, in Unix milliseconds.
+	LastBatch atomic.Int64
+}
+
+// StartDataProcessor writes the engine's persistence messages from queue, one
+// of transport.DbPartitions, to Postgres. It takes whatever has queued up, up
+// to batchSize messages, and writes them in one transaction, so a busy queue
+// costs one commit per batch rather than one round trip per row. A message is
+// acknowledged only once its batch has committed or it was dead-lettered, so
+// one this process was killed in the middle of is delivered again when it, or
+// its replacement, comes back.
+//
+// Batches are written strictly in order, and one that fails for a reason that
+// may pass - the connection, a deadlock, Postgres shutting down - is retried
+// with backoff until it succeeds rather than set aside: an order's fills are
+// increments against the row its create inserts, so letting a later message
+// overtake an earlier one loses the fill. A batch Postgres rejects outright is
+// written again one message at a time, to find the message at fault; that one
+// would fail the same way forever, so it is dead-lettered and the queue moves
+// on. GET /v1/admin/deadletters lists it for replay once whatever was wrong
+// is fixed.
+//
+// A process killed between committing a batch and acknowledging it gets the
+// batch again, and writes nothing the second time: every message carries the
+// engine's event id, and the commit recorded those (see batch.write).
+//
+// Cancelling ctx stops it taking messages, not writing them: it returns once
+// everything it took is written and acknowledged, so a deploy that waits for
+// it leaves nothing half done. Whoever cancels decides how long to wait.
+//
+// ponytail: a dead-lettered order create leaves that order's later fills
+// updating a row that does not exist, and replaying the create afterwards
+// inserts it without them. A dead-lettered ledger row shows up as drift in
+// /admin/reconcile until it is replayed.
+func StartDataProcessor(ctx context.Context, db *sql.DB, t transport.Transport, queue string, metrics *Metrics) {
+	c := &consumer{db: db, t: t, queue: queue, metrics: metrics}
+	// drain outlives ctx, so the batch in hand is finished after a SIGTERM.
+	drain := context.WithoutCancel(ctx)
+	var carried *pending
+	for ctx.Err() == nil {
+		b, taken, next := c.collect(ctx, carried)
+		carried = next
+		if len(taken) > 0 {
+			c.finish(drain, b, taken)
 		}
+	}
+	// Taken while the last batch was being filled; left unacknowledged it
+	// would be skipped by this process's Take if it were to consume queue
+	// again before restarting.
+	if carried != nil {
+		b := newBatch()
+		b.add(carried.d, carried.m)
+		c.finish(drain, b, []transport.Delivery{carried.d})
+	}
+}
 
-		if len(result) < 2 {
-			continue
+// consumer is StartDataProcessor's state for one queue.
+type consumer struct {
+	db      *sql.DB
+	t       transport.Transport
+	queue   string
+	metrics *Metrics
+}
+
+// finish writes b and acknowledges everything taken for it.
+func (c *consumer) finish(ctx context.Context, b *batch, taken []transport.Delivery) {
+	c.write(ctx, b)
+	if len(b.messages) > 0 {
+		c.metrics.Batches.Add(1)
+		c.metrics.LastBatch.Store(time.Now().UnixMilli())
+	}
+	// Retried in place rather than left for redelivery: event ids make a
+	// second write a no-op, but messages from an engine older than them
+	// carry none, and a fill increment written twice counts twice.
+	for _, d := range taken {
+		for ctx.Err() == nil {
+			err := c.t.Ack(ctx, c.queue, d)
+			if err == nil {
+				break
+			}
+			log.Printf("Error acknowledging %s message %s: %v", c.queue, d.ID, err)
+			sleep(ctx, retryDelay)
 		}
+	}
+}
 
-		message := result[1] // BRPop returns [key, value]
+// pending is a message taken off the queue that did not fit the batch it was
+// taken for, and opens the next one.
+type pending struct {
+	d transport.Delivery
+	m message
+}
 
-		var dbMessage DbMessage
-		if err := json.Unmarshal([]byte(message), &dbMessage); err != nil {
-			log.Printf("Error parsing message: %v", err)
-			continue
+// collect takes messages into a batch until the queue is empty, the batch is
+// full or a message does not fit it, which it returns to open the next batch.
+// It waits for the first message only. taken is every delivery to acknowledge
+// once the batch is written, including malformed ones it dead-lettered along
+// the way.
+func (c *consumer) collect(ctx context.Context, carried *pending) (*batch, []transport.Delivery, *pending) {
+	b := newBatch()
+	taken := []transport.Delivery{}
+	if carried != nil {
+		b.add(carried.d, carried.m)
+		taken = append(taken, carried.d)
+	}
+	for len(taken) < batchSize && ctx.Err() == nil {
+		wait := time.Duration(0)
+		if len(taken) == 0 {
+			wait = 30 * time.Second
+		}
+		d, ok, err := c.t.Take(ctx, c.queue, wait)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error reading %s messages: %v", c.queue, err)
+				if len(taken) == 0 {
+					sleep(ctx, time.Second)
+				}
+			}
+			break
+		}
+		if !ok {
+			break
 		}
 
-		// Re-marshal once: every branch below decodes dbMessage.Data, which
-		// arrived as a generic map.
-		dataBytes, err := json.Marshal(dbMessage.Data)
+		m, err := parse(d.Payload)
 		if err != nil {
-			log.Printf("Error marshaling message data: %v", err)
+			c.deadLetter(context.WithoutCancel(ctx), d, err, 1)
+			taken = append(taken, d)
 			continue
 		}
-
-		switch dbMessage.Type {
-		case "TRADE_ADDED":
-			handleTradeAdded(db, dataBytes)
-		case "ORDER_UPDATE":
-			handleOrderUpdate(db, dataBytes)
-		case "LEDGER_ENTRY":
-			handleLedgerEntry(db, dataBytes)
+		if !b.fits(m) {
+			return b, taken, &pending{d: d, m: m}
 		}
+		b.add(d, m)
+		taken = append(taken, d)
 	}
+	return b, taken, nil
 }
 
-func handleTradeAdded(db *sql.DB, dataBytes []byte) {
-	log.Println("Adding trade data")
-
-	var tradeData TradeData
-	if err := json.Unmarshal(dataBytes, &tradeData); err != nil {
-		log.Printf("Error unmarshaling trade data: %v", err)
-		return
-	}
-
-	price, err := strconv.ParseFloat(tradeData.Price, 64)
-	if err != nil {
-		log.Printf("Error parsing price: %v", err)
-		return
-	}
-
-	volume, err := strconv.ParseFloat(tradeData.Quantity, 64)
-	if err != nil {
-		log.Printf("Error parsing volume: %v", err)
-		return
-	}
-
-	timestamp := time.Unix(tradeData.Timestamp/1000, (tradeData.Timestamp%1000)*1000000)
-
-	if err := insertTrade(db, tradeData, price, volume); err != nil {
-		log.Printf("Error inserting trade: %v", err)
-	} else {
-		log.Printf("Inserted trade: price=%.2f, volume=%.2f, time=%s",
-			price, volume, timestamp.Format(time.RFC3339))
+// write writes b, retrying transient errors. On any other it writes b's
+// messages one at a time, and dead-letters a message written alone that
+// fails the same way. It returns early only when ctx is done.
+func (c *consumer) write(ctx context.Context, b *batch) {
+	delay := retryDelay
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		err := b.write(c.db)
+		if err == nil {
+			c.metrics.Messages.Add(int64(len(b.messages)))
+			return
+		}
+		if !transient(err) {
+			if len(b.messages) == 1 {
+				c.deadLetter(ctx, b.deliveries[0], err, attempt)
+				return
+			}
+			log.Printf("Error writing a batch of %d %s messages, writing them one at a time: %v", len(b.messages), c.queue, err)
+			for i := range b.messages {
+				one := newBatch()
+				one.add(b.deliveries[i], b.messages[i])
+				c.write(ctx, one)
+			}
+			return
+		}
+		log.Printf("Error writing %d %s messages, retrying in %v: %v", len(b.messages), c.queue, delay, err)
+		c.metrics.Retries.Add(1)
+		sleep(ctx, delay)
+		delay = min(2*delay, maxRetryDelay)
 	}
 }
 
-// handleOrderUpdate applies one delta to an order row. A message carrying
-// UserID is the order's create and inserts the row; one without it is an
-// increment (a maker fill, or a cancellation carrying only a status).
-func handleOrderUpdate(db *sql.DB, dataBytes []byte) {
-	var data OrderUpdateData
-	if err := json.Unmarshal(dataBytes, &data); err != nil {
-		log.Printf("Error unmarshaling order update: %v", err)
-		return
-	}
-	if data.OrderID == "" {
-		return
-	}
-
-	if data.UserID == nil {
-		// Increment against an existing row. $3 lets a cancel force the status
-		// while a plain fill leaves the derivation to the CASE.
-		const q = `
-			UPDATE orders SET
-				executed_qty = executed_qty + $2,
-				status = CASE
-					WHEN $3::text IS NOT NULL THEN $3::text
-					WHEN executed_qty + $2 >= quantity THEN 'filled'
-					ELSE status
-				END,
-				updated_at = now()
-			WHERE order_id = $1`
-		if _, err := db.Exec(q, data.OrderID, data.ExecutedQty, data.Status); err != nil {
-			log.Printf("Error updating order %s: %v", data.OrderID, err)
+// deadLetter sets d aside. Retried in place: acknowledging a message that
+// never made it to the dead letters loses it.
+func (c *consumer) deadLetter(ctx context.Context, d transport.Delivery, cause error, attempts int) {
+	log.Printf("Dead-lettering %s message %s after %d attempts: %v", c.queue, d.ID, attempts, cause)
+	letter := transport.NewDeadLetter(c.queue, d.Payload, cause, attempts)
+	for ctx.Err() == nil {
+		err := c.t.DeadLetter(ctx, c.queue, letter)
+		if err == nil {
+			c.metrics.DeadLettered.Add(1)
+			return
 		}
-		return
+		log.Printf("Error dead-lettering %s message %s: %v", c.queue, d.ID, err)
+		sleep(ctx, retryDelay)
 	}
+}
 
-	price, quantity := 0.0, 0.0
-	if data.Price != nil {
-		price, _ = strconv.ParseFloat(*data.Price, 64)
-	}
-	if data.Quantity != nil {
-		quantity, _ = strconv.ParseFloat(*data.Quantity, 64)
+// transient reports whether err may go away on its own. Anything Postgres did
+// not answer with an error code - a dropped connection, a timeout - may; of
+// its codes, only the connection, transaction rollback (serialization
+// failures, deadlocks), resource, operator intervention and system error
+// classes do. The rest are about the statement or the data, and a retry sends
+// the same statement with the same data.
+func transient(err error) bool {
+	if errors.Is(err, errMalformed) {
+		return false
 	}
-
-	status := "open"
-	if data.Status != nil {
-		status = *data.Status
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return true
 	}
-
-	// ON CONFLICT rather than a plain INSERT: the engine can be restarted from a
-	// snapshot that still holds an order id already written here.
-	const q = `
-		INSERT INTO orders (order_id, user_id, market, side, price, quantity, executed_qty, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		ON CONFLICT (order_id) DO UPDATE SET
-			executed_qty = orders.executed_qty + EXCLUDED.executed_qty,
-			status = CASE
-				WHEN orders.executed_qty + EXCLUDED.executed_qty >= orders.quantity THEN 'filled'
-				-- The engine's own verdict wins when it is terminal. Without
-				-- this branch EXCLUDED.status was never consulted at all, so a
-				-- market order replayed after a snapshot restore came back as
-				-- 'open' and showed in open orders despite not being on the book.
-				WHEN EXCLUDED.status IN ('filled', 'partially_filled', 'cancelled') THEN EXCLUDED.status
-				ELSE orders.status
-			END,
-			updated_at = now()`
-	_, err := db.Exec(q, data.OrderID, *data.UserID, derefOr(data.Market), derefOr(data.Side),
-		price, quantity, data.ExecutedQty, status)
-	if err != nil {
-		log.Printf("Error inserting order %s: %v", data.OrderID, err)
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57", "58":
+		return true
 	}
+	return false
 }
 
-// handleLedgerEntry appends one movement of value. ON CONFLICT DO NOTHING is
-// there for the seed credits, which the engine re-emits on any boot without a
-// snapshot and which carry a deterministic ref_id (see ledger_seed_uniq).
-func handleLedgerEntry(db *sql.DB, dataBytes []byte) {
-	var data LedgerEntryData
-	if err := json.Unmarshal(dataBytes, &data); err != nil {
-		log.Printf("Error unmarshaling ledger entry: %v", err)
-		return
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
 	}
+}
 
-	const q = `
-		INSERT INTO ledger (user_id, asset, delta, reason, ref_id)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT DO NOTHING`
-	if _, err := db.Exec(q, data.UserID, data.Asset, data.Delta, data.Reason, data.RefID); err != nil {
-		log.Printf("Error inserting ledger entry for %s/%s: %v", data.UserID, data.Asset, err)
+// processMessage writes one persistence message on its own, with no retry.
+// Errors wrapping errMalformed are about the message itself; any other is
+// Postgres.
+func processMessage(db *sql.DB, payload []byte) error {
+	m, err := parse(payload)
+	if err != nil {
+		return err
 	}
+	b := newBatch()
+	b.add(transport.Delivery{Payload: payload}, m)
+	return b.write(db)
 }
 
 func derefOr(s *string) string {
@@ -189,13 +273,3 @@ func derefOr(s *string) string {
 	}
 	return *s
 }
-
-func insertTrade(db *sql.DB, tradeData TradeData, price float64, volume float64) error {
-	timestamp := time.Unix(tradeData.Timestamp/1000, (tradeData.Timestamp%1000)*1000000)
-
-	query := `INSERT INTO sol_prices (id, time, price, volume, market, is_buyer_maker) 
-			  VALUES ($1, $2, $3, $4, $5, $6)`
-
-	_, err := db.Exec(query, tradeData.ID, timestamp, price, volume, tradeData.Market, tradeData.IsBuyerMaker)
-	return err
-}
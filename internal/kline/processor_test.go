@@ -1,13 +1,29 @@
 package kline
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/Althaf66/cryptoXchange/internal/dbase"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/lib/pq"
 )
 
+// encode wraps data the way the engine sends it.
+func encode(t *testing.T, messageType string, data interface{}) []byte {
+	t.Helper()
+	raw, err := json.Marshal(DbMessage{Type: messageType, Data: data})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return raw
+}
+
 // The order upsert's whole correctness rests on ExecutedQty being a delta that
 // accumulates, and on status deriving from the running total. Both are SQL, so
 // this needs a real Postgres. Set TEST_DB_ADDR to run it.
@@ -34,11 +50,9 @@ func TestOrderUpdateAccumulatesDeltas(t *testing.T) {
 	str := func(s string) *string { return &s }
 	apply := func(data OrderUpdateData) {
 		t.Helper()
-		raw, err := json.Marshal(data)
-		if err != nil {
-			t.Fatalf("marshal: %v", err)
+		if err := processMessage(db, encode(t, "ORDER_UPDATE", data)); err != nil {
+			t.Fatalf("write: %v", err)
 		}
-		handleOrderUpdate(db, raw)
 	}
 
 	readOrder := func() (float64, string) {
@@ -104,8 +118,9 @@ func TestCancelSetsStatus(t *testing.T) {
 	str := func(s string) *string { return &s }
 	apply := func(data OrderUpdateData) {
 		t.Helper()
-		raw, _ := json.Marshal(data)
-		handleOrderUpdate(db, raw)
+		if err := processMessage(db, encode(t, "ORDER_UPDATE", data)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
 	}
 
 	apply(OrderUpdateData{
@@ -146,12 +161,12 @@ func TestSeedLedgerEntriesAreIdempotent(t *testing.T) {
 	t.Cleanup(func() { db.Exec(`DELETE FROM ledger WHERE ref_id = $1`, ref) })
 	db.Exec(`DELETE FROM ledger WHERE ref_id = $1`, ref)
 
-	entry, _ := json.Marshal(LedgerEntryData{
+	entry := encode(t, "LEDGER_ENTRY", LedgerEntryData{
 		UserID: "test-user", Asset: "USD", Delta: 10000000,
 		Reason: "seed", RefID: ref,
 	})
-	handleLedgerEntry(db, entry)
-	handleLedgerEntry(db, entry)
+	processMessage(db, entry)
+	processMessage(db, entry)
 
 	var count int
 	if err := db.QueryRow(`SELECT COUNT(*) FROM ledger WHERE ref_id = $1`, ref).Scan(&count); err != nil {
@@ -190,9 +205,8 @@ func TestTradeLedgerEntriesShareARef(t *testing.T) {
 		{UserID: "a", Asset: "SOL", Delta: -0.5, Reason: "trade", RefID: ref},
 		{UserID: "b", Asset: "SOL", Delta: 0.5, Reason: "trade", RefID: ref},
 	}
-	for _, leg := range legs {
-		raw, _ := json.Marshal(leg)
-		handleLedgerEntry(db, raw)
+	if err := processMessage(db, encode(t, "LEDGER_ENTRIES", LedgerEntriesData{Entries: legs})); err != nil {
+		t.Fatalf("write: %v", err)
 	}
 
 	var count int
@@ -209,3 +223,58 @@ func TestTradeLedgerEntriesShareARef(t *testing.T) {
 		t.Errorf("trade legs sum to %v, want 0", sum)
 	}
 }
+
+// A message no retry can write is dead-lettered and acknowledged, and the
+// processor moves on instead of stopping the queue behind it. Malformed
+// messages fail before reaching Postgres, so this needs none.
+func TestMalformedMessageIsDeadLettered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bus := transport.NewMemory()
+	bus.Push(ctx, transport.DbQueue, []byte("{not json"))
+
+	metrics := &Metrics{}
+	done := make(chan struct{})
+	go func() { StartDataProcessor(ctx, nil, bus, transport.DbQueue, metrics); close(done) }()
+	t.Cleanup(func() { cancel(); <-done })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, _ := bus.Len(ctx, transport.DbQueue)
+		letters, _ := bus.DeadLetters(ctx, transport.DbQueue)
+		if n == 0 && len(letters) == 1 {
+			if letters[0].Payload != "{not json" || letters[0].Attempts != 1 || letters[0].Error == "" {
+				t.Errorf("dead letter = %+v", letters[0])
+			}
+			if got := metrics.DeadLettered.Load(); got != 1 {
+				t.Errorf("DeadLettered = %d, want 1", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue length %d, %d dead letters; want 0 and 1", n, len(letters))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Only errors that can pass on their own are retried; retrying the rest
+// blocks the queue behind a message that fails the same way every time.
+func TestTransientErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("dial tcp: connection refused"), true},
+		{fmt.Errorf("inserting trade: %w", &pq.Error{Code: "40P01"}), true},  // deadlock
+		{fmt.Errorf("inserting trade: %w", &pq.Error{Code: "57P01"}), true},  // admin shutdown
+		{fmt.Errorf("inserting trade: %w", &pq.Error{Code: "08006"}), true},  // connection failure
+		{fmt.Errorf("inserting trade: %w", &pq.Error{Code: "23502"}), false}, // not null violation
+		{fmt.Errorf("inserting trade: %w", &pq.Error{Code: "22P02"}), false}, // invalid text
+		{fmt.Errorf("%w: parsing price", errMalformed), false},
+	}
+	for _, c := range cases {
+		if got := transient(c.err); got != c.want {
+			t.Errorf("transient(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -31,3 +31,25 @@ func Symbols() []string {
 	}
 	return symbols
 }
+
+// AccountQueue is the engine command stream for everything that is not about one
+// market: deposits, balances, users. It is also where every command went before
+// the engine was sharded, and the engine still accepts market commands on it.
+const AccountQueue = "messages"
+
+// CommandQueue is the engine command stream for one market. Each market's book
+// has its own worker, so a burst of orders on one market no longer queues up
+// behind another.
+func CommandQueue(ticker string) string {
+	return AccountQueue + ":" + ticker
+}
+
+// Listed reports whether ticker is one of All.
+func Listed(ticker string) bool {
+	for _, m := range All {
+		if m.Ticker() == ticker {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+type FillStore struct {
+	db *sql.DB
+}
+
+// Fill is one execution of one of a user's orders: a trades row seen from the
+// side that user was on. A user who traded against themselves has two fills
+// for the one trade, one per role.
+type Fill struct {
+	TradeID            string    `json:"tradeId"`
+	OrderID            string    `json:"orderId"`
+	CounterpartOrderID string    `json:"counterpartOrderId"`
+	Market             string    `json:"market"`
+	Side               string    `json:"side"`
+	Role               string    `json:"role"`
+	Price              float64   `json:"price"`
+	Quantity           float64   `json:"quantity"`
+	QuoteQuantity      float64   `json:"quoteQuantity"`
+	Fee                float64   `json:"fee"`
+	ExecutedAt         time.Time `json:"executedAt"`
+}
+
+// FillFilter selects a page of a user's fills. Market and OrderID are
+// optional. Before is the cursor of the last fill of the previous page, empty
+// for the first.
+type FillFilter struct {
+	UserID  string
+	Market  string
+	OrderID string
+	Before  string
+	Limit   int
+}
+
+// ErrBadCursor is a Before that Cursor did not make.
+var ErrBadCursor = errors.New("store: bad fill cursor")
+
+// Cursor is where the page after f starts. Fills are ordered newest first by
+// when they executed, then trade id and role: one taker order sweeping a book
+// fills several makers in the same instant, so the time alone would split or
+// repeat them across a page boundary.
+func (f Fill) Cursor() string {
+	raw := f.ExecutedAt.UTC().Format(time.RFC3339Nano) + "|" + f.TradeID + "|" + f.Role
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(cursor string) (time.Time, string, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", "", ErrBadCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return time.Time{}, "", "", ErrBadCursor
+	}
+	at, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", "", ErrBadCursor
+	}
+	return at, parts[1], parts[2], nil
+}
+
+// ListByUser returns a page of the user's fills, newest first. They come from
+// the trades table, each trade once for its maker and once for its taker.
+func (s *FillStore) ListByUser(filter FillFilter) ([]Fill, error) {
+	args := []interface{}{filter.UserID}
+	conditions := []string{}
+	if filter.Market != "" {
+		args = append(args, filter.Market)
+		conditions = append(conditions, fmt.Sprintf("market = $%d", len(args)))
+	}
+	if filter.OrderID != "" {
+		args = append(args, filter.OrderID)
+		conditions = append(conditions, fmt.Sprintf("order_id = $%d", len(args)))
+	}
+	if filter.Before != "" {
+		at, tradeID, role, err := parseCursor(filter.Before)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, at, tradeID, role)
+		conditions = append(conditions, fmt.Sprintf("(executed_at, trade_id, role) < ($%d, $%d, $%d)",
+			len(args)-2, len(args)-1, len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+
+	query := `
+		SELECT trade_id, order_id, counterpart_order_id, market, side, role,
+			price, quantity, quote_quantity, fee, executed_at
+		FROM (
+			SELECT trade_id, maker_order_id AS order_id, taker_order_id AS counterpart_order_id,
+				market, maker_side AS side, 'maker' AS role,
+				price, quantity, quote_quantity, maker_fee AS fee, executed_at
+			FROM trades
+			WHERE maker_user_id = $1
+			UNION ALL
+			SELECT trade_id, taker_order_id, maker_order_id,
+				market, taker_side, 'taker',
+				price, quantity, quote_quantity, taker_fee, executed_at
+			FROM trades
+			WHERE taker_user_id = $1
+		) fills
+		` + where + `
+		ORDER BY executed_at DESC, trade_id DESC, role DESC
+		LIMIT $` + fmt.Sprint(len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fills := []Fill{}
+	for rows.Next() {
+		var f Fill
+		if err := rows.Scan(&f.TradeID, &f.OrderID, &f.CounterpartOrderID, &f.Market, &f.Side, &f.Role,
+			&f.Price, &f.Quantity, &f.QuoteQuantity, &f.Fee, &f.ExecutedAt); err != nil {
+			return nil, err
+		}
+		fills = append(fills, f)
+	}
+	return fills, rows.Err()
+}
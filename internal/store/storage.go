@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
 type Storage struct {
@@ -17,13 +18,15 @@ type Storage struct {
 	// how they got that way, and what a reconcile compares them against.
 	Trades interface {
 		GetRecentTrades(limit int, market string) ([]Trade, error)
-		GetTicker(market string) (*Ticker, error)
-		GetKlines(interval, market string) ([]Kline, error)
+		GetKlines(interval, market string, startTime, endTime time.Time, limit int) ([]Kline, error)
 		GetLatestPrice() (float64, error)
 	}
 	Orders interface {
 		ListByUser(userID, market string, limit int) ([]Order, error)
 	}
+	Fills interface {
+		ListByUser(filter FillFilter) ([]Fill, error)
+	}
 	Transfers interface {
 		Create(transfer *Transfer) (bool, error)
 		MarkStatus(id, status string) error
@@ -39,6 +42,7 @@ func NewPostgresStorage(db *sql.DB) Storage {
 		Users:     &UserStore{db},
 		Trades:    &TradeStore{db},
 		Orders:    &OrderStore{db},
+		Fills:     &FillStore{db},
 		Transfers: &TransferStore{db},
 		Ledger:    &LedgerStore{db},
 	}
@@ -3,10 +3,10 @@ package store
 import (
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
 	_ "github.com/lib/pq"
 )
 
@@ -32,96 +32,30 @@ type Trade struct {
 	Volume       float64   `json:"volume" db:"volume"`
 	Timestamp    time.Time `json:"timestamp" db:"time"`
 	Market       string    `json:"market" db:"market"`
-	IsBuyerMaker bool      `json:"is_buyer_maker" db:"is_buyer_maker"`
+	IsBuyerMaker bool      `json:"is_buyer_maker"`
 	// QuoteQuantity float64   `json:"quote_quantity" db:"quote_quantity"`
 }
 
-// Ticker is the 24h rollup the markets page and market bar render. Field names
-// match the frontend's Ticker type in frontend/app/utils/types.ts.
-type Ticker struct {
-	Symbol             string `json:"symbol"`
-	LastPrice          string `json:"lastPrice"`
-	High               string `json:"high"`
-	Low                string `json:"low"`
-	Volume             string `json:"volume"`
-	QuoteVolume        string `json:"quoteVolume"`
-	PriceChange        string `json:"priceChange"`
-	PriceChangePercent string `json:"priceChangePercent"`
-	Trades             string `json:"trades"`
-	FirstPrice         string `json:"firstPrice"`
-}
-
-// GetTicker rolls up the last 24h of trades for a market. Returns a zeroed
-// ticker (not an error) when there are no trades yet, so an empty demo database
-// still renders a row instead of a crash.
-func (t *TradeStore) GetTicker(market string) (*Ticker, error) {
-	query := `
-		SELECT
-			COALESCE(MAX(high.price), 0),
-			COALESCE(MIN(high.price), 0),
-			COALESCE(SUM(high.volume), 0),
-			COALESCE(SUM(high.price * high.volume), 0),
-			COUNT(*),
-			COALESCE((SELECT price FROM sol_prices WHERE market = $1 AND time > NOW() - INTERVAL '24 hours' ORDER BY time DESC LIMIT 1), 0),
-			COALESCE((SELECT price FROM sol_prices WHERE market = $1 AND time > NOW() - INTERVAL '24 hours' ORDER BY time ASC  LIMIT 1), 0)
-		FROM sol_prices high
-		WHERE high.market = $1 AND high.time > NOW() - INTERVAL '24 hours'`
-
-	var high, low, volume, quoteVolume, last, first float64
-	var trades int64
-	err := t.db.QueryRow(query, market).Scan(
-		&high, &low, &volume, &quoteVolume, &trades, &last, &first)
-	if err != nil {
-		return nil, err
-	}
-
-	change := last - first
-	changePercent := 0.0
-	if first > 0 {
-		changePercent = change / first * 100
-	}
-
-	// Round at 8 decimals and trim: summing quantities in SQL accumulates float
-	// noise, and a DOGE volume reads as 4000.0001999999995 without this.
-	f := func(v float64) string {
-		s := strconv.FormatFloat(v, 'f', 8, 64)
-		if strings.Contains(s, ".") {
-			s = strings.TrimRight(s, "0")
-			s = strings.TrimSuffix(s, ".")
-		}
-		return s
-	}
-	return &Ticker{
-		Symbol:             market,
-		LastPrice:          f(last),
-		High:               f(high),
-		Low:                f(low),
-		Volume:             f(volume),
-		QuoteVolume:        f(quoteVolume),
-		PriceChange:        f(change),
-		PriceChangePercent: f(changePercent),
-		Trades:             strconv.FormatInt(trades, 10),
-		FirstPrice:         f(first),
-	}, nil
-}
-
+// GetRecentTrades reads the trades table rather than the price series, which
+// no longer says which side took. The buyer was the maker when the taker
+// sold. Order and user ids stay out: this is the public trade tape.
 func (t *TradeStore) GetRecentTrades(limit int, market string) ([]Trade, error) {
 	var query string
 	var args []interface{}
 
 	if market != "" {
 		query = `
-			SELECT id, price, volume, time, market, is_buyer_maker
-			FROM sol_prices 
+			SELECT trade_id, price, quantity, executed_at, market, taker_side = 'sell'
+			FROM trades
 			WHERE market = $1
-			ORDER BY time DESC 
+			ORDER BY executed_at DESC
 			LIMIT $2`
 		args = []interface{}{market, limit}
 	} else {
 		query = `
-			SELECT id, price, volume, time, market, is_buyer_maker
-			FROM sol_prices 
-			ORDER BY time DESC 
+			SELECT trade_id, price, quantity, executed_at, market, taker_side = 'sell'
+			FROM trades
+			ORDER BY executed_at DESC
 			LIMIT $1`
 		args = []interface{}{limit}
 	}
@@ -146,26 +80,74 @@ func (t *TradeStore) GetRecentTrades(limit int, market string) ([]Trade, error)
 	return trades, nil
 }
 
-func (t *TradeStore) GetKlines(interval, market string) ([]Kline, error) {
-	var tableName string
-	var bucketSize time.Duration
-	switch interval {
-	case "1m":
-		tableName, bucketSize = "klines_1m", time.Minute
-	case "1h":
-		tableName, bucketSize = "klines_1h", time.Hour
-	default:
+// GetKlines returns up to limit of market's candles at interval, newest
+// first. startTime and endTime bound the buckets' starts, inclusive; a zero
+// one is unbounded. Given a start and no end, the limit counts forward from
+// the start, which is how a client pages through history; otherwise it
+// counts back from the end, or from now.
+func (t *TradeStore) GetKlines(interval, market string, startTime, endTime time.Time, limit int) ([]Kline, error) {
+	series, ok := dbase.KlineIntervalByName(interval)
+	if !ok {
 		return nil, fmt.Errorf("invalid interval: %s", interval)
 	}
 
+	args := []interface{}{market}
+	conditions := []string{"market = $1"}
+	if !startTime.IsZero() {
+		args = append(args, startTime)
+		conditions = append(conditions, fmt.Sprintf("bucket >= $%d", len(args)))
+	}
+	if !endTime.IsZero() {
+		args = append(args, endTime)
+		conditions = append(conditions, fmt.Sprintf("bucket <= $%d", len(args)))
+	}
+	order := "DESC"
+	if !startTime.IsZero() && endTime.IsZero() {
+		order = "ASC"
+	}
+	args = append(args, limit)
+
+	// Table and view names, and the width, come from dbase.KlineIntervals,
+	// never from the request.
+	source := series.View
+	if h := series.History; h != nil {
+		// The history table up to its last bucket, then the view for the
+		// hours (or the day) the cron has not copied yet, grouped into the
+		// series' width. Rolling 4h up from hours lands on the same buckets
+		// time_bucket('4 hours') would, since both start at the same origin.
+		source = fmt.Sprintf(`(
+			SELECT time_bucket(INTERVAL '%[3]s', bucket) AS bucket, market,
+				first(open, bucket) AS open,
+				max(high) AS high,
+				min(low) AS low,
+				last(close, bucket) AS close,
+				sum(volume) AS volume
+			FROM (
+				SELECT bucket, market, open, high, low, close, volume
+				FROM %[1]s
+				WHERE market = $1
+				UNION ALL
+				SELECT bucket, market, open, high, low, close, volume
+				FROM %[2]s
+				WHERE market = $1 AND bucket > COALESCE(
+					(SELECT max(bucket) FROM %[1]s WHERE market = $1), '-infinity')
+			) base
+			GROUP BY 1, 2
+		) stitched`, h.Table, h.View, series.Width)
+	}
+
 	query := fmt.Sprintf(`
 		SELECT bucket, open, high, low, close, volume
-		FROM %s
-		WHERE market = $1
-		ORDER BY bucket DESC
-		LIMIT 100`, tableName)
+		FROM (
+			SELECT bucket, open, high, low, close, volume
+			FROM %s
+			WHERE %s
+			ORDER BY bucket %s
+			LIMIT $%d
+		) k
+		ORDER BY bucket DESC`, source, strings.Join(conditions, " AND "), order, len(args))
 
-	rows, err := t.db.Query(query, market)
+	rows, err := t.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -178,7 +160,7 @@ func (t *TradeStore) GetKlines(interval, market string) ([]Kline, error) {
 		if err != nil {
 			return nil, err
 		}
-		k.End = k.Start.Add(bucketSize)
+		k.End = series.End(k.Start)
 		klines = append(klines, k)
 	}
 
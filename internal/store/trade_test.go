@@ -0,0 +1,127 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
+)
+
+// Candles come from continuous aggregates with real-time aggregation, so
+// trades written a moment ago are already in them, with no refresh. A start
+// with no end pages forward from the start. Needs a real TimescaleDB; set
+// TEST_DB_ADDR.
+func TestKlinesPageFromStartTime(t *testing.T) {
+	addr := os.Getenv("TEST_DB_ADDR")
+	if addr == "" {
+		t.Skip("TEST_DB_ADDR not set")
+	}
+
+	db, err := dbase.New(addr, 5, 5, "1m")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := dbase.InitializeKlineDB(db); err != nil {
+		t.Fatalf("init kline tables: %v", err)
+	}
+
+	const market = "TEST_KLINES"
+	clear := func() { db.Exec(`DELETE FROM sol_prices WHERE market = $1`, market) }
+	clear()
+	t.Cleanup(clear)
+
+	first := time.Now().UTC().Truncate(time.Minute).Add(-10 * time.Minute)
+	for i := 0; i < 5; i++ {
+		at := first.Add(time.Duration(i) * time.Minute)
+		if _, err := db.Exec(`INSERT INTO sol_prices (id, time, price, volume, market) VALUES ($1, $2, $3, 1, $4)`,
+			"test-kline-"+at.Format(time.RFC3339), at, 100+i, market); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	trades := &TradeStore{db}
+	klines, err := trades.GetKlines("1m", market, first.Add(time.Minute), time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("GetKlines: %v", err)
+	}
+	if len(klines) != 2 {
+		t.Fatalf("got %d candles, want 2", len(klines))
+	}
+	// Newest first: the second and third minutes.
+	if !klines[1].Start.Equal(first.Add(time.Minute)) || klines[0].Close != 102 {
+		t.Errorf("candles = %+v, want minutes 2 and 3", klines)
+	}
+
+	if _, err := trades.GetKlines("1y", market, time.Time{}, time.Time{}, 10); err == nil {
+		t.Error("GetKlines(1y) succeeded, want an invalid interval")
+	}
+}
+
+// The long series read the durable history and, past its last bucket, the
+// live view. A week is rolled up from days, and a day the cron never copied
+// still shows. Needs a real TimescaleDB; set TEST_DB_ADDR.
+func TestKlinesStitchHistoryAndRecent(t *testing.T) {
+	addr := os.Getenv("TEST_DB_ADDR")
+	if addr == "" {
+		t.Skip("TEST_DB_ADDR not set")
+	}
+
+	db, err := dbase.New(addr, 5, 5, "1m")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := dbase.InitializeKlineDB(db); err != nil {
+		t.Fatalf("init kline tables: %v", err)
+	}
+
+	const market = "TEST_KLINES_HISTORY"
+	clear := func() {
+		db.Exec(`DELETE FROM sol_prices WHERE market = $1`, market)
+		db.Exec(`DELETE FROM kline_history_1d WHERE market = $1`, market)
+	}
+	clear()
+	t.Cleanup(clear)
+
+	// Monday to Wednesday of a week long gone from sol_prices.
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, c := range [][4]float64{{10, 14, 9, 12}, {12, 20, 11, 18}, {18, 19, 5, 6}} {
+		if _, err := db.Exec(`INSERT INTO kline_history_1d (bucket, market, open, high, low, close, volume)
+			VALUES ($1, $2, $3, $4, $5, $6, 1)`,
+			monday.AddDate(0, 0, i), market, c[0], c[1], c[2], c[3]); err != nil {
+			t.Fatalf("insert history: %v", err)
+		}
+	}
+	now := time.Now().UTC()
+	if _, err := db.Exec(`INSERT INTO sol_prices (id, time, price, volume, market) VALUES ('test-history-now', $1, 50, 2, $2)`,
+		now, market); err != nil {
+		t.Fatalf("insert trade: %v", err)
+	}
+
+	trades := &TradeStore{db}
+	weeks, err := trades.GetKlines("1w", market, time.Time{}, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("GetKlines(1w): %v", err)
+	}
+	if len(weeks) != 2 {
+		t.Fatalf("got %d weeks, want this one and the old one: %+v", len(weeks), weeks)
+	}
+	old := weeks[1]
+	if !old.Start.Equal(monday) || !old.End.Equal(monday.AddDate(0, 0, 7)) ||
+		old.Open != 10 || old.High != 20 || old.Low != 5 || old.Close != 6 || old.Volume != 3 {
+		t.Errorf("old week = %+v", old)
+	}
+	if weeks[0].Close != 50 || weeks[0].Volume != 2 {
+		t.Errorf("this week = %+v, want the recent trade", weeks[0])
+	}
+
+	months, err := trades.GetKlines("1M", market, monday, monday, 10)
+	if err != nil {
+		t.Fatalf("GetKlines(1M): %v", err)
+	}
+	if len(months) != 1 || !months[0].End.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("January = %+v", months)
+	}
+}
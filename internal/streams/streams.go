@@ -0,0 +1,80 @@
+// Package streams is the Redis Streams plumbing the API, the engine and the db
+// processor share. Both hand-offs between them used to be lists drained with
+// BRPOP, which removes a message the moment it is read: a consumer that died
+// between the pop and finishing its work lost that order or ledger row for
+// good. On a stream a read message stays in the consumer group's pending list
+// until it is acknowledged, so a consumer that dies mid-message leaves it for
+// the next one to reclaim.
+//
+// ponytail: a Redis that still holds the old lists under these names answers
+// every stream command with WRONGTYPE. Drain and delete them before deploying;
+// EnsureGroup says so rather than letting a consumer spin on the error.
+package streams
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Field is the one field every entry carries, holding the JSON message. The
+// engine's journal uses the same name.
+const Field = "msg"
+
+// Add appends payload to stream.
+func Add(ctx context.Context, c redis.Cmdable, stream, payload string) error {
+	return c.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]interface{}{Field: payload},
+	}).Err()
+}
+
+// Payload returns the message an entry carries, or "" if it has none.
+func Payload(m redis.XMessage) string {
+	payload, _ := m.Values[Field].(string)
+	return payload
+}
+
+// EnsureGroup creates group on stream, and the stream with it, if it does not
+// exist yet. A new group starts at the beginning of the stream, so whatever
+// producers added before the first consumer ever ran is still delivered.
+func EnsureGroup(ctx context.Context, c redis.Cmdable, stream, group string) error {
+	err := c.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	switch {
+	case err == nil, err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP"):
+		return nil
+	case strings.HasPrefix(err.Error(), "WRONGTYPE"):
+		return fmt.Errorf("%s is not a stream; it is probably the list an older release pushed to - drain it and delete the key: %w", stream, err)
+	default:
+		return err
+	}
+}
+
+// Trim drops the entries of stream that group has acknowledged. It assumes
+// group is the stream's only consumer group, as it is for the db queue. Everything
+// below the oldest pending entry is acknowledged; with nothing pending,
+// everything up to the last delivered one is.
+func Trim(ctx context.Context, c redis.Cmdable, stream, group string) error {
+	pending, err := c.XPending(ctx, stream, group).Result()
+	if err != nil {
+		return err
+	}
+	floor := pending.Lower
+	if pending.Count == 0 {
+		groups, err := c.XInfoGroups(ctx, stream).Result()
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			if g.Name == group {
+				floor = g.LastDeliveredID
+			}
+		}
+	}
+	if floor == "" {
+		return nil
+	}
+	return c.XTrimMinID(ctx, stream, floor).Err()
+}
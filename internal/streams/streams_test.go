@@ -0,0 +1,78 @@
+package streams
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Trim is the only thing that ever removes db messages, so it must never take
+// one that is still pending - that is the row a crashed processor left for
+// its successor. Needs a Redis:
+//
+//	TEST_REDIS_ADDR=localhost:6379
+func TestTrimKeepsPendingEntries(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	stream, group := "test:streams:"+t.Name(), "test"
+	client.Del(ctx, stream)
+	t.Cleanup(func() { client.Del(ctx, stream); client.Close() })
+
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := Add(ctx, client, stream, payload); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	// Twice: every consumer calls it on every start.
+	for i := 0; i < 2; i++ {
+		if err := EnsureGroup(ctx, client, stream, group); err != nil {
+			t.Fatalf("EnsureGroup #%d: %v", i+1, err)
+		}
+	}
+
+	read, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: group, Consumer: "c", Streams: []string{stream, ">"}, Count: 2, Block: -1,
+	}).Result()
+	if err != nil || len(read[0].Messages) != 2 {
+		t.Fatalf("read = %+v, %v; want the first two entries, added before the group", read, err)
+	}
+	first, second := read[0].Messages[0], read[0].Messages[1]
+	client.XAck(ctx, stream, group, first.ID)
+
+	if err := Trim(ctx, client, stream, group); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	left, _ := client.XRange(ctx, stream, "-", "+").Result()
+	if len(left) != 2 || left[0].ID != second.ID || Payload(left[0]) != "b" {
+		t.Fatalf("after trim = %+v, want the pending %q and the unread %q", left, "b", "c")
+	}
+}
+
+// A Redis still holding an older release's list must fail loudly, not leave
+// the consumer retrying WRONGTYPE forever.
+func TestEnsureGroupRejectsAList(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	key := "test:streams:" + t.Name()
+	client.Del(ctx, key)
+	t.Cleanup(func() { client.Del(context.Background(), key); client.Close() })
+
+	client.LPush(ctx, key, "old")
+	err := EnsureGroup(ctx, client, key, "test")
+	if err == nil || !strings.Contains(err.Error(), "not a stream") {
+		t.Fatalf("EnsureGroup on a list = %v, want a not-a-stream error", err)
+	}
+}
@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory carries everything inside one process. A message taken and never
+// acknowledged is not delivered again: redelivery exists for a consumer that
+// crashed, and here a crash takes every queue down with it.
+type Memory struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	subs   map[string]map[*memorySubscription]bool
+	nextID uint64
+	// dead holds each queue's dead letters, newest first.
+	dead map[string][]DeadLetter
+}
+
+type memoryQueue struct {
+	ready   []Delivery
+	unacked map[string]bool
+	// wake is closed and replaced on every push, waking every waiting Take.
+	wake chan struct{}
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		queues: make(map[string]*memoryQueue),
+		subs:   make(map[string]map[*memorySubscription]bool),
+		dead:   make(map[string][]DeadLetter),
+	}
+}
+
+func (m *Memory) Close() error { return nil }
+
+// queue must be called with mu held.
+func (m *Memory) queue(name string) *memoryQueue {
+	q := m.queues[name]
+	if q == nil {
+		q = &memoryQueue{unacked: make(map[string]bool), wake: make(chan struct{})}
+		m.queues[name] = q
+	}
+	return q
+}
+
+func (m *Memory) Push(ctx context.Context, queue string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	q := m.queue(queue)
+	q.ready = append(q.ready, Delivery{ID: strconv.FormatUint(m.nextID, 10), Payload: payload})
+	close(q.wake)
+	q.wake = make(chan struct{})
+	return nil
+}
+
+func (m *Memory) Take(ctx context.Context, queue string, wait time.Duration) (Delivery, bool, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		m.mu.Lock()
+		q := m.queue(queue)
+		if len(q.ready) > 0 {
+			d := q.ready[0]
+			q.ready = q.ready[1:]
+			q.unacked[d.ID] = true
+			m.mu.Unlock()
+			return d, true, nil
+		}
+		wake := q.wake
+		m.mu.Unlock()
+
+		if wait <= 0 {
+			return Delivery{}, false, nil
+		}
+		select {
+		case <-wake:
+		case <-timeout:
+			return Delivery{}, false, nil
+		case <-ctx.Done():
+			return Delivery{}, false, ctx.Err()
+		}
+	}
+}
+
+func (m *Memory) Ack(ctx context.Context, queue string, d Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.queue(queue).unacked, d.ID)
+	return nil
+}
+
+func (m *Memory) Len(ctx context.Context, queue string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	return int64(len(q.ready) + len(q.unacked)), nil
+}
+
+// Publish never blocks on a subscriber. One that has fallen a full buffer
+// behind loses the message, as a slow Redis pub/sub client eventually would;
+// blocking instead would stall the engine behind a websocket client.
+func (m *Memory) Publish(ctx context.Context, channel string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for s := range m.subs[channel] {
+		select {
+		case s.out <- Message{Channel: channel, Payload: payload}:
+		default:
+			log.Printf("Dropping message on %s for a subscriber that is not reading", channel)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, channels ...string) (Subscription, error) {
+	s := &memorySubscription{m: m, out: make(chan Message, 100), channels: make(map[string]bool)}
+	s.Subscribe(ctx, channels...)
+	return s, nil
+}
+
+type memorySubscription struct {
+	m        *Memory
+	out      chan Message
+	channels map[string]bool // guarded by m.mu
+	closed   bool            // guarded by m.mu
+}
+
+func (s *memorySubscription) Subscribe(ctx context.Context, channels ...string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for _, channel := range channels {
+		if s.m.subs[channel] == nil {
+			s.m.subs[channel] = make(map[*memorySubscription]bool)
+		}
+		s.m.subs[channel][s] = true
+		s.channels[channel] = true
+	}
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, channel := range channels {
+		s.remove(channel)
+	}
+	return nil
+}
+
+// remove must be called with m.mu held.
+func (s *memorySubscription) remove(channel string) {
+	delete(s.m.subs[channel], s)
+	if len(s.m.subs[channel]) == 0 {
+		delete(s.m.subs, channel)
+	}
+	delete(s.channels, channel)
+}
+
+func (s *memorySubscription) Messages() <-chan Message { return s.out }
+
+// Close unsubscribes everything and closes Messages. Publish sends under the
+// same lock, so it can never send on the closed channel.
+func (s *memorySubscription) Close() error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for channel := range s.channels {
+		s.remove(channel)
+	}
+	s.closed = true
+	close(s.out)
+	return nil
+}
+
+func (m *Memory) DeadLetter(ctx context.Context, queue string, letter DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dead[queue] = append([]DeadLetter{letter}, m.dead[queue]...)
+	return nil
+}
+
+func (m *Memory) DeadLetters(ctx context.Context, queue string) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DeadLetter{}, m.dead[queue]...), nil
+}
+
+func (m *Memory) TakeDeadLetter(ctx context.Context, queue, id string) (DeadLetter, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, letter := range m.dead[queue] {
+		if letter.ID == id {
+			m.dead[queue] = append(m.dead[queue][:i:i], m.dead[queue][i+1:]...)
+			return letter, true, nil
+		}
+	}
+	return DeadLetter{}, false, nil
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Take has to wake for a push that lands while it waits - the engine's
+// workers spend their lives in that wait - and hand messages out in order.
+func TestMemoryQueueWakesWaitingTake(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	if _, ok, _ := m.Take(ctx, "q", 0); ok {
+		t.Fatal("Take on an empty queue returned a message")
+	}
+
+	got := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			d, ok, err := m.Take(ctx, "q", 5*time.Second)
+			if err != nil || !ok {
+				got <- "none"
+				return
+			}
+			got <- string(d.Payload)
+			m.Ack(ctx, "q", d)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Push(ctx, "q", []byte("first"))
+	m.Push(ctx, "q", []byte("second"))
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case g := <-got:
+			if g != want {
+				t.Fatalf("took %q, want %q", g, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Take did not wake for a push")
+		}
+	}
+	// Acked in the goroutine after the last send; give it the moment.
+	time.Sleep(10 * time.Millisecond)
+	if n, _ := m.Len(ctx, "q"); n != 0 {
+		t.Errorf("Len = %d after both were acknowledged, want 0", n)
+	}
+}
+
+// Len counts a taken message until it is acknowledged: it is the engine's
+// backlog figure, and a command in hand is still backlog.
+func TestMemoryLenCountsUnacknowledged(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	m.Push(ctx, "q", []byte("a"))
+	d, _, _ := m.Take(ctx, "q", 0)
+	if n, _ := m.Len(ctx, "q"); n != 1 {
+		t.Errorf("Len with one taken = %d, want 1", n)
+	}
+	m.Ack(ctx, "q", d)
+	if n, _ := m.Len(ctx, "q"); n != 0 {
+		t.Errorf("Len after Ack = %d, want 0", n)
+	}
+}
+
+// A reply goes only to the channel it was published on, and a closed
+// subscription neither receives nor panics the publisher.
+func TestMemoryPubSubDeliversPerChannel(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	a, _ := m.Subscribe(ctx, "a")
+	b, _ := m.Subscribe(ctx, "b")
+
+	m.Publish(ctx, "a", []byte("for a"))
+	select {
+	case msg := <-a.Messages():
+		if msg.Channel != "a" || string(msg.Payload) != "for a" {
+			t.Errorf("a got %+v", msg)
+		}
+	default:
+		t.Fatal("a got nothing")
+	}
+	select {
+	case msg := <-b.Messages():
+		t.Fatalf("b got %+v, published on a", msg)
+	default:
+	}
+
+	b.Close()
+	m.Publish(ctx, "b", []byte("after close"))
+	if _, open := <-b.Messages(); open {
+		t.Error("closed subscription still delivering")
+	}
+
+	a.Unsubscribe(ctx, "a")
+	m.Publish(ctx, "a", []byte("after unsubscribe"))
+	select {
+	case msg := <-a.Messages():
+		t.Errorf("unsubscribed a got %+v", msg)
+	default:
+	}
+}
+
+// Dead letters list newest first, and each one can be taken exactly once -
+// a replay clicked twice must not push the message twice.
+func TestMemoryDeadLettersTakeOnce(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	first := NewDeadLetter("q", []byte("first"), errors.New("boom"), 1)
+	second := NewDeadLetter("q", []byte("second"), errors.New("boom"), 3)
+	m.DeadLetter(ctx, "q", first)
+	m.DeadLetter(ctx, "q", second)
+
+	letters, _ := m.DeadLetters(ctx, "q")
+	if len(letters) != 2 || letters[0].ID != second.ID || letters[1].ID != first.ID {
+		t.Fatalf("DeadLetters = %+v, want second then first", letters)
+	}
+
+	if got, ok, _ := m.TakeDeadLetter(ctx, "q", first.ID); !ok || got.Payload != "first" {
+		t.Fatalf("TakeDeadLetter = %+v, %v", got, ok)
+	}
+	if _, ok, _ := m.TakeDeadLetter(ctx, "q", first.ID); ok {
+		t.Error("took the same dead letter twice")
+	}
+	if letters, _ := m.DeadLetters(ctx, "q"); len(letters) != 1 || letters[0].ID != second.ID {
+		t.Errorf("DeadLetters after a take = %+v, want only second", letters)
+	}
+}
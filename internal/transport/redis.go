@@ -0,0 +1,319 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/streams"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// reclaimIdle is how long a message sits pending with another consumer
+	// before Take hands it to this one. Consumers are named after their host,
+	// and a redeployed container comes back under a new name, so whatever the
+	// old one had taken and not acknowledged would otherwise never be seen.
+	reclaimIdle = time.Minute
+	// maintainEvery is how often Take reclaims and trims a queue.
+	maintainEvery = 30 * time.Second
+)
+
+// Redis carries queues as streams read through a consumer group, and pub/sub
+// as Redis pub/sub.
+//
+// The engine's own command queues are the exception: the leader reads them
+// through its journal (internal/engine), which needs to journal and
+// acknowledge in one fenced script. Take is for the other consumers.
+type Redis struct {
+	client *redis.Client
+	// group and consumer name this process to the consumer groups Take reads
+	// through. A process that only pushes and publishes leaves them empty.
+	group    string
+	consumer string
+
+	mu         sync.Mutex
+	ready      map[string]bool
+	maintained map[string]time.Time
+	// cursor is, per queue, the id Take reads this consumer's pending
+	// messages after: the last one it handed out. held is what it handed out
+	// and has not seen acknowledged.
+	cursor map[string]string
+	held   map[string]map[string]bool
+}
+
+func NewRedis(client *redis.Client, group, consumer string) *Redis {
+	return &Redis{
+		client:     client,
+		group:      group,
+		consumer:   consumer,
+		ready:      make(map[string]bool),
+		maintained: make(map[string]time.Time),
+		cursor:     make(map[string]string),
+		held:       make(map[string]map[string]bool),
+	}
+}
+
+// Client is the underlying connection, for the Redis-only parts of the
+// engine: the leader lock, the journal and the snapshot store.
+func (r *Redis) Client() *redis.Client { return r.client }
+
+func (r *Redis) Close() error { return r.client.Close() }
+
+func (r *Redis) Push(ctx context.Context, queue string, payload []byte) error {
+	return streams.Add(ctx, r.client, queue, string(payload))
+}
+
+// Take reads the consumer's own pending messages before new ones: those are
+// what it took before a restart, or reclaimed from a dead consumer, and they
+// come first to keep the queue's order. Pending also holds what this process
+// took and has not acknowledged yet, which Take steps over.
+func (r *Redis) Take(ctx context.Context, queue string, wait time.Duration) (Delivery, bool, error) {
+	if r.group == "" {
+		return Delivery{}, false, errors.New("transport: Take needs a consumer group")
+	}
+	if err := r.prepare(ctx, queue); err != nil {
+		return Delivery{}, false, err
+	}
+	for {
+		m, ok, err := r.read(ctx, queue, r.after(queue), -1)
+		if err != nil {
+			return Delivery{}, false, err
+		}
+		if !ok {
+			break
+		}
+		if r.hand(queue, m.ID) {
+			return Delivery{ID: m.ID, Payload: []byte(streams.Payload(m))}, true, nil
+		}
+	}
+	if wait <= 0 {
+		wait = -1
+	}
+	m, ok, err := r.read(ctx, queue, ">", wait)
+	if err != nil || !ok {
+		return Delivery{}, false, err
+	}
+	r.hand(queue, m.ID)
+	return Delivery{ID: m.ID, Payload: []byte(streams.Payload(m))}, true, nil
+}
+
+// after is the id to read queue's pending messages after.
+func (r *Redis) after(queue string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cursor, ok := r.cursor[queue]; ok {
+		return cursor
+	}
+	return "0"
+}
+
+// hand moves queue's cursor past id and reports whether id is free to hand
+// out, which it is unless Take already handed it out and it awaits its ack.
+func (r *Redis) hand(queue, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cursor[queue] = id
+	if r.held[queue] == nil {
+		r.held[queue] = make(map[string]bool)
+	}
+	if r.held[queue][id] {
+		return false
+	}
+	r.held[queue][id] = true
+	return true
+}
+
+func (r *Redis) read(ctx context.Context, queue, id string, wait time.Duration) (redis.XMessage, bool, error) {
+	result, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  []string{queue, id},
+		Count:    1,
+		Block:    wait,
+	}).Result()
+	if err == redis.Nil {
+		return redis.XMessage{}, false, nil
+	}
+	if err != nil || len(result) == 0 || len(result[0].Messages) == 0 {
+		return redis.XMessage{}, false, err
+	}
+	return result[0].Messages[0], true, nil
+}
+
+func (r *Redis) Ack(ctx context.Context, queue string, d Delivery) error {
+	if err := r.client.XAck(ctx, queue, r.group, d.ID).Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.held[queue], d.ID)
+	r.mu.Unlock()
+	return nil
+}
+
+// Len is the stream's length, which counts acknowledged messages until the
+// next trim as well.
+func (r *Redis) Len(ctx context.Context, queue string) (int64, error) {
+	return r.client.XLen(ctx, queue).Result()
+}
+
+// prepare creates the consumer group on first use and, every maintainEvery,
+// takes over messages other consumers left pending and trims what the group
+// has acknowledged.
+func (r *Redis) prepare(ctx context.Context, queue string) error {
+	r.mu.Lock()
+	ready, due := r.ready[queue], time.Since(r.maintained[queue]) > maintainEvery
+	if due {
+		r.maintained[queue] = time.Now()
+	}
+	r.mu.Unlock()
+
+	if !ready {
+		if err := streams.EnsureGroup(ctx, r.client, queue, r.group); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.ready[queue] = true
+		r.mu.Unlock()
+	}
+	if due {
+		r.maintain(ctx, queue)
+	}
+	return nil
+}
+
+func (r *Redis) maintain(ctx context.Context, queue string) {
+	start := "0-0"
+	for {
+		claimed, next, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   queue,
+			Group:    r.group,
+			Consumer: r.consumer,
+			MinIdle:  reclaimIdle,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			log.Printf("Error reclaiming pending %s messages: %v", queue, err)
+			break
+		}
+		if len(claimed) > 0 {
+			log.Printf("Reclaimed %d pending %s messages", len(claimed), queue)
+			// They can sort before the cursor; read pending from the start.
+			r.mu.Lock()
+			delete(r.cursor, queue)
+			r.mu.Unlock()
+		}
+		if next == "0-0" {
+			break
+		}
+		start = next
+	}
+	if err := streams.Trim(ctx, r.client, queue, r.group); err != nil {
+		log.Printf("Error trimming %s: %v", queue, err)
+	}
+}
+
+func (r *Redis) Publish(ctx context.Context, channel string, payload []byte) error {
+	return r.client.Publish(ctx, channel, string(payload)).Err()
+}
+
+func (r *Redis) Subscribe(ctx context.Context, channels ...string) (Subscription, error) {
+	ps := r.client.Subscribe(ctx, channels...)
+	// Redis confirms every channel of one SUBSCRIBE before it can deliver a
+	// message on any of them, so these are all confirmations.
+	for range channels {
+		if _, err := ps.Receive(ctx); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	s := &redisSubscription{ps: ps, out: make(chan Message, 100), done: make(chan struct{})}
+	go s.forward()
+	return s, nil
+}
+
+type redisSubscription struct {
+	ps   *redis.PubSub
+	out  chan Message
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *redisSubscription) forward() {
+	defer close(s.out)
+	for m := range s.ps.Channel() {
+		select {
+		case s.out <- Message{Channel: m.Channel, Payload: []byte(m.Payload)}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *redisSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	return s.ps.Subscribe(ctx, channels...)
+}
+
+func (s *redisSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	return s.ps.Unsubscribe(ctx, channels...)
+}
+
+func (s *redisSubscription) Messages() <-chan Message { return s.out }
+
+func (s *redisSubscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.ps.Close()
+}
+
+// deadLetterKey is the list holding queue's dead letters.
+func deadLetterKey(queue string) string { return "dlq:" + queue }
+
+func (r *Redis) DeadLetter(ctx context.Context, queue string, letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return r.client.LPush(ctx, deadLetterKey(queue), data).Err()
+}
+
+func (r *Redis) DeadLetters(ctx context.Context, queue string) ([]DeadLetter, error) {
+	raw, err := r.client.LRange(ctx, deadLetterKey(queue), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(raw))
+	for _, item := range raw {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(item), &letter); err != nil {
+			return nil, fmt.Errorf("dead letter on %s: %w", queue, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// TakeDeadLetter removes the letter by its stored value. LREM is what makes
+// two concurrent takes safe: only one of them removes anything.
+func (r *Redis) TakeDeadLetter(ctx context.Context, queue, id string) (DeadLetter, bool, error) {
+	raw, err := r.client.LRange(ctx, deadLetterKey(queue), 0, -1).Result()
+	if err != nil {
+		return DeadLetter{}, false, err
+	}
+	for _, item := range raw {
+		var letter DeadLetter
+		if json.Unmarshal([]byte(item), &letter) != nil || letter.ID != id {
+			continue
+		}
+		removed, err := r.client.LRem(ctx, deadLetterKey(queue), 1, item).Result()
+		if err != nil || removed == 0 {
+			return DeadLetter{}, false, err
+		}
+		return letter, true, nil
+	}
+	return DeadLetter{}, false, nil
+}
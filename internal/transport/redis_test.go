@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The db processor takes a whole batch before acknowledging any of it, so
+// Take must step over what it already handed out - and a restarted consumer,
+// which holds nothing, must get its predecessor's pending messages back in
+// order. Needs a Redis:
+//
+//	TEST_REDIS_ADDR=localhost:6379
+func TestRedisTakeStepsOverWhatItHolds(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	queue := "test:transport:" + t.Name()
+	client.Del(ctx, queue)
+	t.Cleanup(func() { client.Del(ctx, queue); client.Close() })
+
+	r := NewRedis(client, "test", "c")
+	for _, payload := range []string{"a", "b", "c"} {
+		r.Push(ctx, queue, []byte(payload))
+	}
+	take := func(r *Redis) string {
+		t.Helper()
+		d, ok, err := r.Take(ctx, queue, 0)
+		if err != nil {
+			t.Fatalf("Take: %v", err)
+		}
+		if !ok {
+			return ""
+		}
+		return string(d.Payload)
+	}
+
+	first, _, _ := r.Take(ctx, queue, 0)
+	if got := take(r); got != "b" {
+		t.Fatalf("second Take = %q with a unacknowledged, want b", got)
+	}
+	r.Ack(ctx, queue, first)
+
+	// A new process under the same consumer name: b is pending and comes
+	// back before c.
+	restarted := NewRedis(client, "test", "c")
+	for _, want := range []string{"b", "c", ""} {
+		if got := take(restarted); got != want {
+			t.Fatalf("Take after restart = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package transport is how the API, the engine, the db processor and the
+// websocket server talk to each other. Three conversations run over it:
+//
+//   - commands: the API pushes a command onto an engine queue and subscribes
+//     to a channel named after the request, which the engine publishes its
+//     reply to;
+//   - persistence: the engine pushes onto the db queues, one per market and
+//     DbQueue for the rest, and the db processor takes from them,
+//     acknowledging each message once it is written;
+//   - market data: the engine publishes depth, trades and tickers, and the
+//     websocket server subscribes to the channels its clients asked for.
+//
+// Redis carries all three when the services run apart. Memory carries them
+// inside one process, which is what cmd/allinone and the end-to-end tests use,
+// so running the whole exchange needs no Redis server.
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/google/uuid"
+)
+
+// DbQueue carries the engine's persistence messages that belong to no market
+// - deposits and seed credits - to the db processor. It used to carry all of
+// them, and is also where whatever an older engine left queued drains from.
+const DbQueue = "db_processor"
+
+// DbPartition is the db queue for market's persistence messages. Every
+// message about an order or a trade belongs to its market, so one queue per
+// market keeps each order's create, fills and cancel in order while the db
+// processor writes the markets side by side. No market is DbQueue.
+func DbPartition(market string) string {
+	if market == "" {
+		return DbQueue
+	}
+	return DbQueue + ":" + market
+}
+
+// DbPartitions lists every db queue, DbQueue first.
+func DbPartitions() []string {
+	queues := []string{DbQueue}
+	for _, ticker := range markets.Symbols() {
+		queues = append(queues, DbPartition(ticker))
+	}
+	return queues
+}
+
+// Transport is a Queue, a PubSub and the queues' dead letters over the same
+// connection.
+type Transport interface {
+	Queue
+	PubSub
+	DeadLetters
+	Close() error
+}
+
+// Queue delivers each message to one consumer, at least once. A message that
+// was taken but not acknowledged is delivered again; how soon depends on the
+// implementation.
+type Queue interface {
+	Push(ctx context.Context, queue string, payload []byte) error
+	// Take returns the next message on queue, waiting up to wait for one, and
+	// reports false if none came. A wait of zero or less does not wait. It
+	// never returns a message the caller holds unacknowledged, so a consumer
+	// can take several before acknowledging any.
+	Take(ctx context.Context, queue string, wait time.Duration) (Delivery, bool, error)
+	Ack(ctx context.Context, queue string, d Delivery) error
+	// Len counts the messages on queue not yet acknowledged.
+	Len(ctx context.Context, queue string) (int64, error)
+}
+
+// DeadLetters keeps the messages a queue's consumer gave up on, one list per
+// queue, until someone replays or discards them. A consumer dead-letters a
+// message and then acknowledges it, so it is never lost in between.
+type DeadLetters interface {
+	DeadLetter(ctx context.Context, queue string, letter DeadLetter) error
+	// DeadLetters lists queue's dead letters, newest first.
+	DeadLetters(ctx context.Context, queue string) ([]DeadLetter, error)
+	// TakeDeadLetter removes and returns one dead letter. It reports false if
+	// there is no such letter, including when a concurrent take got it first.
+	TakeDeadLetter(ctx context.Context, queue, id string) (DeadLetter, bool, error)
+}
+
+// DeadLetter is a message with why and when its consumer gave up on it.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Queue    string    `json:"queue"`
+	Payload  string    `json:"payload"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+	Attempts int       `json:"attempts"`
+}
+
+// NewDeadLetter describes payload, taken off queue, failing with cause after
+// attempts tries.
+func NewDeadLetter(queue string, payload []byte, cause error, attempts int) DeadLetter {
+	return DeadLetter{
+		ID:       uuid.New().String(),
+		Queue:    queue,
+		Payload:  string(payload),
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+		Attempts: attempts,
+	}
+}
+
+// Delivery is one message taken off a queue.
+type Delivery struct {
+	ID      string
+	Payload []byte
+}
+
+// PubSub delivers each message to every current subscriber of its channel,
+// at most once: nobody subscribed, nobody gets it.
+type PubSub interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe returns once the subscription is in place, so a message
+	// published after it returns is not missed.
+	Subscribe(ctx context.Context, channels ...string) (Subscription, error)
+}
+
+// Subscription is one subscriber's set of channels.
+type Subscription interface {
+	Subscribe(ctx context.Context, channels ...string) error
+	Unsubscribe(ctx context.Context, channels ...string) error
+	// Messages is closed by Close.
+	Messages() <-chan Message
+	Close() error
+}
+
+// Message is one published message.
+type Message struct {
+	Channel string
+	Payload []byte
+}
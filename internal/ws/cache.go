@@ -0,0 +1,351 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/google/uuid"
+)
+
+// A new subscriber to depth@, ticker. or trade@ used to see nothing until the
+// market next moved. This service now keeps each listed market's state and
+// sends it the moment a stream is subscribed to, ahead of anything live:
+//
+//   - depth@<market>: the whole book as one message flagged "snapshot",
+//     carrying the lastUpdateId it is at, so the diffs after it apply in the
+//     usual way (engine/depth.go);
+//   - ticker.<market>: the latest ticker;
+//   - trade@<market>: the last recentTrades trades, oldest first, as they
+//     were published.
+//
+// The book is kept the way a client keeps one: from a GET_DEPTH of the whole
+// book plus every diff after it, fetched again on a gap. The ticker starts
+// from a GET_TICKER. Trades start empty: the engine keeps no history, so
+// the ring only has what was traded since this service started.
+
+// recentTrades is how many trades a trade@ subscriber starts with.
+const recentTrades = 50
+
+// marketCache is one market's state. mu also covers publishing the market's
+// messages to subscribers, so a subscriber added under it gets the snapshot
+// and then exactly the messages after it: none missed, none twice.
+type marketCache struct {
+	market string
+
+	mu sync.Mutex
+	// bids and asks are the book, price to quantity, valid once synced.
+	bids, asks   map[string]string
+	lastUpdateID uint64
+	synced       bool
+	// fetching is set while a GET_DEPTH is out; buffered holds the diffs
+	// that arrive meanwhile.
+	fetching bool
+	buffered []DepthData
+
+	ticker []byte
+	trades [][]byte
+	// lastDiff and lastTrade are the newest depth update and trade id passed
+	// on, for telling a repeat from news (see replayed).
+	lastDiff, lastTrade uint64
+
+	// views are the derived depth streams (depthstreams.go), which emit
+	// publishes to subscribers.
+	views map[string]*depthView
+	emit  func(payload []byte, channel string)
+
+	// fetch reaches the engine, sendToEngine outside tests.
+	fetch func(ctx context.Context, queue string, command engineCommand) (*engineReply, error)
+}
+
+func newMarketCache(market string) *marketCache {
+	return &marketCache{
+		market: market,
+		fetch: func(ctx context.Context, queue string, command engineCommand) (*engineReply, error) {
+			return sendToEngine(ctx, queue, command)
+		},
+	}
+}
+
+// cachedStream reports the market and kind of a stream the caches keep,
+// the derived depth streams included.
+func cachedStream(channel string) (market, kind string, ok bool) {
+	if m, _, _, depth := parseDepthStream(channel); depth {
+		return m, "depth", true
+	}
+	for _, prefix := range []string{"depth@", "trade@", "ticker."} {
+		if m, found := strings.CutPrefix(channel, prefix); found && markets.Listed(m) {
+			return m, strings.TrimRight(prefix, "@."), true
+		}
+	}
+	return "", "", false
+}
+
+// cachedChannels are the streams kept subscribed upstream for as long as the
+// service runs, whether or not a client wants them, so the caches never go
+// stale.
+func cachedChannels() []string {
+	channels := []string{}
+	for _, ticker := range markets.Symbols() {
+		channels = append(channels, "depth@"+ticker, "trade@"+ticker, "ticker."+ticker)
+	}
+	return channels
+}
+
+// replayWindow is how far below the newest id a repeat can be. A new engine
+// leader sends again the outputs of the one command per market its
+// predecessor died in (engine/run.go takeOver), a handful of ids at most. An
+// id further back is an engine that started over from a fresh seed, whose
+// messages are news.
+const replayWindow = 1000
+
+// replayed reports whether id, from a stream whose ids only grow, was already
+// passed on.
+func replayed(id, last uint64) bool {
+	return id <= last && last-id < replayWindow
+}
+
+// observe folds one published message into the cache, and reports false for
+// a trade or depth diff it has already seen, which is not to be passed on.
+// Called under c.mu.
+func (c *marketCache) observe(kind string, payload []byte) bool {
+	switch kind {
+	case "ticker":
+		c.ticker = payload
+	case "trade":
+		var message struct {
+			Trade struct {
+				ID string `json:"id"`
+			} `json:"tradeData"`
+		}
+		if err := json.Unmarshal(payload, &message); err == nil {
+			if id, err := strconv.ParseUint(message.Trade.ID, 10, 64); err == nil {
+				if replayed(id, c.lastTrade) {
+					return false
+				}
+				c.lastTrade = id
+			}
+		}
+		c.trades = append(c.trades, payload)
+		if len(c.trades) > recentTrades {
+			c.trades = c.trades[len(c.trades)-recentTrades:]
+		}
+	case "depth":
+		var message struct {
+			Data DepthData `json:"data"`
+		}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			log.Printf("Ignoring unreadable depth message for %s: %v", c.market, err)
+			return true
+		}
+		if replayed(message.Data.LastUpdateID, c.lastDiff) {
+			return false
+		}
+		c.lastDiff = message.Data.LastUpdateID
+		c.applyDiff(message.Data)
+		c.updateViews(message.Data)
+	}
+	return true
+}
+
+// applyDiff applies one diff if it follows on from the book, and otherwise
+// buffers it and fetches the book again. Called under c.mu.
+func (c *marketCache) applyDiff(diff DepthData) {
+	if !c.synced {
+		c.buffered = append(c.buffered, diff)
+		c.resync()
+		return
+	}
+	if diff.FirstUpdateID != c.lastUpdateID+1 {
+		log.Printf("Depth cache for %s at %d got %d-%d, fetching the book again",
+			c.market, c.lastUpdateID, diff.FirstUpdateID, diff.LastUpdateID)
+		c.synced = false
+		c.buffered = []DepthData{diff}
+		c.resync()
+		return
+	}
+	applyLevels(c.bids, diff.B)
+	applyLevels(c.asks, diff.A)
+	c.lastUpdateID = diff.LastUpdateID
+}
+
+func applyLevels(side map[string]string, levels [][2]string) {
+	for _, level := range levels {
+		if qty, err := strconv.ParseFloat(level[1], 64); err == nil && qty == 0 {
+			delete(side, level[0])
+		} else {
+			side[level[0]] = level[1]
+		}
+	}
+}
+
+// resync fetches the book unless a fetch is already out. Called under c.mu;
+// the fetch itself runs without it.
+func (c *marketCache) resync() {
+	if c.fetching {
+		return
+	}
+	c.fetching = true
+	go c.fetchDepth()
+}
+
+func (c *marketCache) fetchDepth() {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(min(time.Duration(attempt)*time.Second, 10*time.Second))
+		}
+		payload, err := c.ask("GET_DEPTH", map[string]interface{}{"market": c.market, "limit": -1})
+		if err != nil {
+			log.Printf("Fetching the %s book for the depth cache: %v", c.market, err)
+			continue
+		}
+		var book struct {
+			Bids         [][2]string `json:"bids"`
+			Asks         [][2]string `json:"asks"`
+			LastUpdateID uint64      `json:"lastUpdateId"`
+		}
+		if err := json.Unmarshal(payload, &book); err != nil {
+			log.Printf("Reading the %s book for the depth cache: %v", c.market, err)
+			continue
+		}
+		if c.load(book.Bids, book.Asks, book.LastUpdateID) {
+			return
+		}
+	}
+}
+
+// load replaces the book with a fetched one and applies what was buffered
+// since. It reports false if the buffer does not follow on from it - a diff
+// went missing even so - in which case the caller fetches again.
+func (c *marketCache) load(bids, asks [][2]string, lastUpdateID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.bids, c.asks = map[string]string{}, map[string]string{}
+	applyLevels(c.bids, bids)
+	applyLevels(c.asks, asks)
+	c.lastUpdateID = lastUpdateID
+
+	pending := c.buffered
+	c.buffered = nil
+	for i, diff := range pending {
+		if diff.LastUpdateID <= c.lastUpdateID {
+			continue
+		}
+		if diff.FirstUpdateID > c.lastUpdateID+1 {
+			c.buffered = pending[i:]
+			return false
+		}
+		applyLevels(c.bids, diff.B)
+		applyLevels(c.asks, diff.A)
+		c.lastUpdateID = diff.LastUpdateID
+	}
+	c.synced, c.fetching = true, false
+	c.refreshViews()
+	return true
+}
+
+// loadTicker seeds the ticker, unless one was published while it was asked
+// for.
+func (c *marketCache) loadTicker() {
+	payload, err := c.ask("GET_TICKER", map[string]string{"market": c.market})
+	if err != nil {
+		log.Printf("Fetching the %s ticker for the cache: %v", c.market, err)
+		return
+	}
+	message, err := json.Marshal(map[string]json.RawMessage{
+		"stream":     json.RawMessage(strconv.Quote("ticker." + c.market)),
+		"tickerdata": payload,
+	})
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ticker == nil {
+		c.ticker = message
+	}
+}
+
+// ask sends the engine one read about the market and returns its payload.
+func (c *marketCache) ask(msgType string, data interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), engineReplyTimeout)
+	defer cancel()
+	var command engineCommand
+	command.ClientID = uuid.New().String()
+	command.Message.Type, command.Message.Data = msgType, data
+	reply, err := c.fetch(ctx, markets.CommandQueue(c.market), command)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != msgType {
+		return nil, fmt.Errorf("engine answered %s with %s: %s", msgType, reply.Type, reply.Payload)
+	}
+	return reply.Payload, nil
+}
+
+// snapshotFor is what a new subscriber to channel is sent first. Called
+// under c.mu.
+func (c *marketCache) snapshotFor(channel string) [][]byte {
+	if _, levels, interval, ok := parseDepthStream(channel); ok && (levels > 0 || interval > 0) {
+		return c.viewSnapshot(c.view(channel, levels, interval))
+	}
+	_, kind, _ := cachedStream(channel)
+	return c.snapshot(kind)
+}
+
+// snapshot is what a new subscriber to kind is sent first, oldest first.
+// Called under c.mu.
+func (c *marketCache) snapshot(kind string) [][]byte {
+	switch kind {
+	case "ticker":
+		if c.ticker != nil {
+			return [][]byte{c.ticker}
+		}
+	case "trade":
+		return append([][]byte(nil), c.trades...)
+	case "depth":
+		if !c.synced {
+			// The subscriber syncs from a REST snapshot instead.
+			return nil
+		}
+		message, err := json.Marshal(OutgoingMessage{
+			Stream: "depth@" + c.market,
+			DepthData: &DepthData{
+				B:            sortedLevels(c.bids, true),
+				A:            sortedLevels(c.asks, false),
+				E:            "depth",
+				Snapshot:     true,
+				LastUpdateID: c.lastUpdateID,
+			},
+		})
+		if err != nil {
+			return nil
+		}
+		return [][]byte{message}
+	}
+	return nil
+}
+
+func sortedLevels(side map[string]string, descending bool) [][2]string {
+	levels := make([][2]string, 0, len(side))
+	for price, qty := range side {
+		levels = append(levels, [2]string{price, qty})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(levels[i][0], 64)
+		b, _ := strconv.ParseFloat(levels[j][0], 64)
+		if descending {
+			return a > b
+		}
+		return a < b
+	})
+	return levels
+}
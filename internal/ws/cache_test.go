@@ -0,0 +1,232 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+// fakeBooks answers each GET_DEPTH with the next of books, the last one over
+// and over, and counts the calls.
+type fakeBooks struct {
+	mu    sync.Mutex
+	books []string
+	calls int
+}
+
+func (f *fakeBooks) fetch(ctx context.Context, queue string, command engineCommand) (*engineReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	book := f.books[min(f.calls, len(f.books)-1)]
+	f.calls++
+	return &engineReply{Type: command.Message.Type, Payload: json.RawMessage(book)}, nil
+}
+
+func (f *fakeBooks) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func observeDiff(t *testing.T, c *marketCache, first, last uint64, bids [][2]string) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe("depth", depthMessage(t, first, last, bids))
+}
+
+func waitSynced(t *testing.T, c *marketCache) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		synced := c.synced
+		c.mu.Unlock()
+		if synced {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("cache never synced")
+}
+
+// The cache is a client of the engine's depth like any other: diffs before
+// the book are buffered and the ones it already holds dropped, and a gap
+// costs a fresh fetch rather than a wrong book.
+func TestDepthCacheSyncsAndResyncsOnGap(t *testing.T) {
+	books := &fakeBooks{books: []string{
+		`{"bids":[["100","1"]],"asks":[["110","1"]],"lastUpdateId":2}`,
+		`{"bids":[["99","4"]],"asks":[],"lastUpdateId":7}`,
+	}}
+	c := newMarketCache("SOL_USD")
+	c.fetch = books.fetch
+
+	observeDiff(t, c, 2, 2, [][2]string{{"100", "1"}})
+	waitSynced(t, c)
+	observeDiff(t, c, 3, 3, [][2]string{{"101", "2"}})
+	observeDiff(t, c, 4, 4, [][2]string{{"100", "0"}})
+
+	c.mu.Lock()
+	if want := map[string]string{"101": "2"}; !reflect.DeepEqual(c.bids, want) || c.lastUpdateID != 4 {
+		t.Errorf("after diffs: bids %v at %d, want %v at 4", c.bids, c.lastUpdateID, want)
+	}
+	c.mu.Unlock()
+
+	// 5 and 6 went missing.
+	observeDiff(t, c, 7, 7, [][2]string{{"99", "4"}})
+	observeDiff(t, c, 8, 8, [][2]string{{"98", "1"}})
+	waitSynced(t, c)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if want := map[string]string{"99": "4", "98": "1"}; !reflect.DeepEqual(c.bids, want) || c.lastUpdateID != 8 {
+		t.Errorf("after the gap: bids %v at %d, want %v at 8", c.bids, c.lastUpdateID, want)
+	}
+	if n := books.callCount(); n != 2 {
+		t.Errorf("fetched the book %d times, want 2", n)
+	}
+}
+
+func TestTradeRingKeepsTheLatest(t *testing.T) {
+	c := newMarketCache("SOL_USD")
+	for i := 0; i < recentTrades+5; i++ {
+		c.observe("trade", []byte{byte(i)})
+	}
+	got := c.snapshot("trade")
+	if len(got) != recentTrades || got[0][0] != 5 || got[len(got)-1][0] != recentTrades+4 {
+		t.Fatalf("ring holds %d trades from %d to %d, want %d from 5", len(got), got[0][0], got[len(got)-1][0], recentTrades)
+	}
+}
+
+// A snapshot conflated with the diffs after it is still a whole book, and
+// one queued behind a stale diff replaces it.
+func TestConflatedSnapshotStaysWhole(t *testing.T) {
+	snapshot, err := json.Marshal(OutgoingMessage{Stream: "depth@SOL_USD", DepthData: &DepthData{
+		B: [][2]string{{"100", "1"}, {"99", "2"}}, A: [][2]string{}, E: "depth", Snapshot: true, LastUpdateID: 4,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := mergeDepth(snapshot, depthMessage(t, 5, 5, [][2]string{{"100", "0"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got OutgoingMessage
+	if err := json.Unmarshal(merged, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.DepthData.Snapshot || got.DepthData.LastUpdateID != 5 ||
+		!reflect.DeepEqual(got.DepthData.B, [][2]string{{"99", "2"}}) {
+		t.Errorf("merged snapshot = %+v", got.DepthData)
+	}
+
+	replaced, err := mergeDepth(depthMessage(t, 1, 1, [][2]string{{"50", "1"}}), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(replaced) != string(snapshot) {
+		t.Errorf("diff then snapshot = %s, want the snapshot", replaced)
+	}
+}
+
+// A new subscriber is sent the book first and then every diff after it, so
+// it never waits on the market moving to see it.
+func TestSubscriberGetsSnapshotFirst(t *testing.T) {
+	initSubscriptions.Do(func() {
+		if err := SubscriptionManager.Init(transport.NewMemory()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	sm := SubscriptionManager
+	c := newMarketCache("SOL_USD")
+	c.bids, c.asks = map[string]string{"100": "1"}, map[string]string{"110": "3"}
+	c.lastUpdateID, c.synced = 4, true
+	sm.mutex.Lock()
+	sm.caches["SOL_USD"] = c
+	sm.mutex.Unlock()
+
+	u := testUser(false)
+	u.ID = "cache-test"
+	UserManager.mutex.Lock()
+	UserManager.users[u.ID] = u
+	UserManager.mutex.Unlock()
+	t.Cleanup(func() {
+		SubscriptionManager.UserLeft(u.ID)
+		UserManager.removeUser(u.ID)
+		sm.mutex.Lock()
+		delete(sm.caches, "SOL_USD")
+		sm.mutex.Unlock()
+	})
+
+	sm.Subscribe(u.ID, "depth@SOL_USD")
+	if err := sm.bus.Publish(context.Background(), "depth@SOL_USD", depthMessage(t, 5, 5, [][2]string{{"101", "2"}})); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []DepthData
+	deadline := time.After(time.Second)
+	for len(got) < 2 {
+		batch := make(chan []outbound, 1)
+		go func() { batch <- u.queue.take() }()
+		select {
+		case messages := <-batch:
+			for _, m := range messages {
+				var message OutgoingMessage
+				if err := json.Unmarshal(m.payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, *message.DepthData)
+			}
+		case <-deadline:
+			t.Fatalf("got %d messages, want 2", len(got))
+		}
+	}
+
+	want := []DepthData{
+		{B: [][2]string{{"100", "1"}}, A: [][2]string{{"110", "3"}}, E: "depth", Snapshot: true, LastUpdateID: 4},
+		{B: [][2]string{{"101", "2"}}, A: [][2]string{}, E: "depth", FirstUpdateID: 5, LastUpdateID: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func tradeMessage(id string) []byte {
+	return []byte(`{"stream":"trade@SOL_USD","tradeData":{"id":"` + id + `","e":"trade","price":"100","quantity":"1"}}`)
+}
+
+// A new engine leader sends the outputs of the command its predecessor died
+// in a second time. The cache passes each trade and diff on once, and still
+// takes a fresh seed's ids, starting again from 1, for news.
+func TestCacheDropsReplayedTradesAndDiffs(t *testing.T) {
+	c := newMarketCache("SOL_USD")
+	c.fetch = (&fakeBooks{books: []string{`{"bids":[],"asks":[],"lastUpdateId":0}`}}).fetch
+
+	if !c.observe("trade", tradeMessage("7")) || c.observe("trade", tradeMessage("7")) {
+		t.Error("trade 7 passed on other than once")
+	}
+	if !c.observe("trade", tradeMessage("8")) {
+		t.Error("trade 8 dropped")
+	}
+	if got := len(c.snapshot("trade")); got != 2 {
+		t.Errorf("ring holds %d trades, want 2", got)
+	}
+	c.lastTrade = 5000
+	if !c.observe("trade", tradeMessage("1")) {
+		t.Error("a reseeded engine's first trade was dropped")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.observe("depth", depthMessage(t, 1, 1, [][2]string{{"100", "1"}})) {
+		t.Error("first diff dropped")
+	}
+	if c.observe("depth", depthMessage(t, 1, 1, [][2]string{{"100", "1"}})) {
+		t.Error("repeated diff passed on")
+	}
+}
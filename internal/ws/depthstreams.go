@@ -0,0 +1,234 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+)
+
+// depth@<market> carries every diff the engine publishes, as it publishes it.
+// A dashboard showing the top five levels does not need most of them, so
+// there are variants the depth cache derives from its book (cache.go):
+//
+//   - depth<N>@<market>, N one of depthLevels: the top N levels a side,
+//     whole, in the depth snapshot shape, sent whenever they change. A client
+//     replaces what it shows with each one; there is nothing to keep in sync;
+//   - @100ms or @1s on the end of either: at most one message per window.
+//     For diffs, everything within the window merged into one, spanning
+//     its first firstUpdateId to its last lastUpdateId, which applies like
+//     any other diff; for the top N, how they stand at the end of it.
+//
+// depth@<market> itself stays what the engine publishes, untouched.
+
+// depthLevels are the level counts a partial depth stream can ask for.
+var depthLevels = map[string]int{"5": 5, "20": 20, "100": 100}
+
+// depthSpeeds are the windows a depth stream can be throttled to.
+var depthSpeeds = map[string]time.Duration{"100ms": 100 * time.Millisecond, "1s": time.Second}
+
+// depthTick is how often throttled views are looked at: the shortest speed.
+const depthTick = 100 * time.Millisecond
+
+// parseDepthStream picks a depth stream name apart. levels is 0 for diffs,
+// and interval 0 for as they happen; both 0 is depth@<market> itself.
+func parseDepthStream(name string) (market string, levels int, interval time.Duration, ok bool) {
+	kind, rest, found := strings.Cut(name, "@")
+	if !found {
+		return "", 0, 0, false
+	}
+	if count, partial := strings.CutPrefix(kind, "depth"); !partial {
+		return "", 0, 0, false
+	} else if count != "" {
+		if levels, ok = depthLevels[count]; !ok {
+			return "", 0, 0, false
+		}
+	}
+	market, speed, throttled := strings.Cut(rest, "@")
+	if throttled {
+		if interval, ok = depthSpeeds[speed]; !ok {
+			return "", 0, 0, false
+		}
+	}
+	if !markets.Listed(market) {
+		return "", 0, 0, false
+	}
+	return market, levels, interval, true
+}
+
+// derivedDepth reports whether channel is one of the variants, which nothing
+// publishes upstream.
+func derivedDepth(channel string) bool {
+	_, levels, interval, ok := parseDepthStream(channel)
+	return ok && (levels > 0 || interval > 0)
+}
+
+// depthView is one derived depth stream of a market. Made on its first
+// subscriber and kept after the last: there are only so many.
+type depthView struct {
+	channel  string
+	levels   int
+	interval time.Duration
+
+	// pending is the diffs merged since the last flush, for a diff view.
+	pending *DepthData
+	// changed is set when the book moved since the last flush, for a top-N
+	// view; sentB and sentA are what that flush sent.
+	changed      bool
+	sentB, sentA [][2]string
+}
+
+// view is channel's view, made if this is its first subscriber. Called
+// under c.mu.
+func (c *marketCache) view(channel string, levels int, interval time.Duration) *depthView {
+	if v, ok := c.views[channel]; ok {
+		return v
+	}
+	if c.views == nil {
+		c.views = map[string]*depthView{}
+	}
+	v := &depthView{channel: channel, levels: levels, interval: interval}
+	if levels > 0 && c.synced {
+		// As the subscriber's snapshot has them, so the first flush does
+		// not send them again.
+		v.sentB, v.sentA = c.top(levels)
+	}
+	c.views[channel] = v
+	return v
+}
+
+// updateViews passes a diff on to the views, flushing the ones that are not
+// throttled. Diff views take every diff, applied to the book or not; top-N
+// views only move with a synced book. Called under c.mu, after applyDiff.
+func (c *marketCache) updateViews(diff DepthData) {
+	for _, v := range c.views {
+		if v.levels == 0 {
+			// Merged across a gap, the diff would span it and hide it from
+			// the client, so what came before goes out on its own.
+			if v.pending != nil && diff.FirstUpdateID != v.pending.LastUpdateID+1 {
+				c.flushView(v)
+			}
+			v.pending = mergeDiffs(v.pending, diff)
+		} else if c.synced {
+			v.changed = true
+		}
+		if v.interval == 0 {
+			c.flushView(v)
+		}
+	}
+}
+
+// refreshViews brings the top-N views up to a book just fetched again.
+// Diff views carry on: their subscribers see the gap the fetch was for
+// themselves, and resync the way they would on depth@. Called under c.mu.
+func (c *marketCache) refreshViews() {
+	for _, v := range c.views {
+		if v.levels > 0 {
+			v.changed = true
+			if v.interval == 0 {
+				c.flushView(v)
+			}
+		}
+	}
+}
+
+// flushView sends what the view has to send, if anything. Called under c.mu.
+func (c *marketCache) flushView(v *depthView) {
+	var data *DepthData
+	if v.levels == 0 {
+		data, v.pending = v.pending, nil
+	} else if v.changed {
+		v.changed = false
+		b, a := c.top(v.levels)
+		if reflect.DeepEqual(b, v.sentB) && reflect.DeepEqual(a, v.sentA) {
+			return
+		}
+		v.sentB, v.sentA = b, a
+		data = &DepthData{B: b, A: a, E: "depth", Snapshot: true, LastUpdateID: c.lastUpdateID}
+	}
+	if data == nil {
+		return
+	}
+	message, err := json.Marshal(OutgoingMessage{Stream: v.channel, DepthData: data})
+	if err != nil {
+		log.Printf("Encoding %s: %v", v.channel, err)
+		return
+	}
+	if c.emit != nil {
+		c.emit(message, v.channel)
+	}
+}
+
+// viewSnapshot is what a new subscriber to v is sent first: the top N as
+// they stand, or for a diff view the whole book its diffs apply to. Called
+// under c.mu.
+func (c *marketCache) viewSnapshot(v *depthView) [][]byte {
+	if !c.synced {
+		return nil
+	}
+	data := &DepthData{E: "depth", Snapshot: true, LastUpdateID: c.lastUpdateID}
+	if v.levels > 0 {
+		data.B, data.A = c.top(v.levels)
+	} else {
+		data.B, data.A = sortedLevels(c.bids, true), sortedLevels(c.asks, false)
+	}
+	message, err := json.Marshal(OutgoingMessage{Stream: v.channel, DepthData: data})
+	if err != nil {
+		return nil
+	}
+	return [][]byte{message}
+}
+
+// top is the best n levels a side. Called under c.mu.
+func (c *marketCache) top(n int) (bids, asks [][2]string) {
+	bids, asks = sortedLevels(c.bids, true), sortedLevels(c.asks, false)
+	return bids[:min(n, len(bids))], asks[:min(n, len(asks))]
+}
+
+// throttle flushes the throttled views, each once per its interval. It runs
+// for as long as the service does.
+func (c *marketCache) throttle() {
+	ticker := time.NewTicker(depthTick)
+	defer ticker.Stop()
+	for ticks := 1; ; ticks++ {
+		<-ticker.C
+		c.mu.Lock()
+		for _, v := range c.views {
+			if v.interval > 0 && ticks%int(v.interval/depthTick) == 0 {
+				c.flushView(v)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// mergeDiffs folds newer into older as mergeDepth does, for diffs already
+// decoded.
+func mergeDiffs(older *DepthData, newer DepthData) *DepthData {
+	if older == nil {
+		merged := newer
+		return &merged
+	}
+	return &DepthData{
+		B:             mergeLevels(older.B, newer.B, true),
+		A:             mergeLevels(older.A, newer.A, false),
+		E:             newer.E,
+		FirstUpdateID: older.FirstUpdateID,
+		LastUpdateID:  newer.LastUpdateID,
+	}
+}
+
+// depthStreamKind is the send queue kind of any depth stream: they all
+// conflate alike.
+func depthStreamKind(kind string) string {
+	if count, ok := strings.CutPrefix(kind, "depth"); ok {
+		if _, err := strconv.Atoi(count); err == nil {
+			return "depth"
+		}
+	}
+	return kind
+}
@@ -0,0 +1,95 @@
+package ws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type emitted struct {
+	channel string
+	data    DepthData
+}
+
+func capturingCache(t *testing.T, bids map[string]string, lastUpdateID uint64) (*marketCache, *[]emitted) {
+	t.Helper()
+	sent := &[]emitted{}
+	c := newMarketCache("SOL_USD")
+	c.bids, c.asks = bids, map[string]string{}
+	c.lastUpdateID, c.synced = lastUpdateID, true
+	c.emit = func(payload []byte, channel string) {
+		var message OutgoingMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatal(err)
+		}
+		*sent = append(*sent, emitted{channel, *message.DepthData})
+	}
+	return c, sent
+}
+
+// A top-of-book stream is sent the top levels whole, and only when they
+// change: a diff deeper in the book costs its subscribers nothing.
+func TestTopLevelsStreamSendsOnlyChanges(t *testing.T) {
+	bids := map[string]string{}
+	for _, price := range []string{"100", "99", "98", "97", "96", "95"} {
+		bids[price] = "1"
+	}
+	c, sent := capturingCache(t, bids, 1)
+	c.view("depth5@SOL_USD", 5, 0)
+
+	observeDiff(t, c, 2, 2, [][2]string{{"95", "3"}})
+	if len(*sent) != 0 {
+		t.Fatalf("a change below the top 5 sent %+v", *sent)
+	}
+	observeDiff(t, c, 3, 3, [][2]string{{"100", "0"}})
+	want := []emitted{{"depth5@SOL_USD", DepthData{
+		B: [][2]string{{"99", "1"}, {"98", "1"}, {"97", "1"}, {"96", "1"}, {"95", "3"}}, A: [][2]string{},
+		E: "depth", Snapshot: true, LastUpdateID: 3,
+	}}}
+	if !reflect.DeepEqual(*sent, want) {
+		t.Errorf("sent %+v, want %+v", *sent, want)
+	}
+}
+
+// A throttled diff stream sends one diff per window, spanning every update
+// in it - but never across a gap, which the client has to see to resync.
+func TestThrottledDiffsMergeWithinTheWindow(t *testing.T) {
+	c, sent := capturingCache(t, map[string]string{}, 1)
+	v := c.view("depth@SOL_USD@100ms", 0, depthSpeeds["100ms"])
+
+	observeDiff(t, c, 2, 2, [][2]string{{"100", "1"}})
+	observeDiff(t, c, 3, 3, [][2]string{{"101", "2"}})
+	observeDiff(t, c, 4, 4, [][2]string{{"100", "0"}})
+	if len(*sent) != 0 {
+		t.Fatalf("sent before the window closed: %+v", *sent)
+	}
+	c.mu.Lock()
+	c.flushView(v)
+	c.mu.Unlock()
+
+	// 7 follows a gap: what came before goes out first, unmerged with it.
+	observeDiff(t, c, 5, 5, [][2]string{{"90", "1"}})
+	observeDiff(t, c, 7, 7, [][2]string{{"91", "1"}})
+	c.mu.Lock()
+	c.flushView(v)
+	c.mu.Unlock()
+
+	var spans [][2]uint64
+	for _, m := range *sent {
+		spans = append(spans, [2]uint64{m.data.FirstUpdateID, m.data.LastUpdateID})
+	}
+	if want := [][2]uint64{{2, 4}, {5, 5}, {7, 7}}; !reflect.DeepEqual(spans, want) {
+		t.Fatalf("sent spans %v, want %v", spans, want)
+	}
+	if want := [][2]string{{"101", "2"}, {"100", "0"}}; !reflect.DeepEqual((*sent)[0].data.B, want) {
+		t.Errorf("merged bids %v, want %v", (*sent)[0].data.B, want)
+	}
+}
+
+func TestEveryDepthStreamConflatesLikeDepth(t *testing.T) {
+	for _, channel := range []string{"depth@SOL_USD", "depth5@SOL_USD", "depth100@SOL_USD@1s"} {
+		if kind := streamKind(channel); kind != "depth" {
+			t.Errorf("%s is kind %q, want depth", channel, kind)
+		}
+	}
+}
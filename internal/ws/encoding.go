@@ -0,0 +1,102 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoding is how a connection wants its frames, chosen with ?encoding= when
+// it connects. Everything inside the exchange stays JSON; a frame is
+// re-encoded on its way out.
+type Encoding string
+
+const (
+	// JSONEncoding sends the engine's payload as it is, in text frames.
+	JSONEncoding Encoding = "json"
+	// MsgpackEncoding sends the same document as MessagePack, in binary
+	// frames, and accepts requests the same way. Field names are unchanged;
+	// what shrinks is everything around them, which for a depth diff of
+	// price/quantity string pairs is most of it.
+	MsgpackEncoding Encoding = "msgpack"
+)
+
+func parseEncoding(value string) (Encoding, error) {
+	switch Encoding(value) {
+	case "", JSONEncoding:
+		return JSONEncoding, nil
+	case MsgpackEncoding:
+		return MsgpackEncoding, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q: use json or msgpack", value)
+}
+
+// encodeFrame turns a JSON payload into the frame enc sends.
+func encodeFrame(enc Encoding, payload []byte) (int, []byte, error) {
+	if enc != MsgpackEncoding {
+		return websocket.TextMessage, payload, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	// Numbers decode as json.Number so an integer stays one: a float64 would
+	// arrive in the client as 1.792378416111e+12 typed as a double.
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return 0, nil, err
+	}
+	data, err := msgpack.Marshal(toMsgpack(document))
+	return websocket.BinaryMessage, data, err
+}
+
+// toMsgpack replaces each json.Number with the integer or float it holds.
+func toMsgpack(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = toMsgpack(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = toMsgpack(value)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// decodeFrame turns a frame a client sent into the JSON the request handlers
+// read. A binary frame is MessagePack whatever the connection's encoding, so
+// a client can send either.
+func decodeFrame(messageType int, data []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	var document interface{}
+	if err := msgpack.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// prepareFrame encodes payload for enc once, as a frame any number of
+// connections can write. The PreparedMessage also keeps the deflated frame
+// after the first connection that negotiated permessage-deflate asks for it,
+// so a thousand subscribers cost one encode and one compression, not a
+// thousand.
+func prepareFrame(enc Encoding, payload []byte) (*websocket.PreparedMessage, error) {
+	messageType, data, err := encodeFrame(enc, payload)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NewPreparedMessage(messageType, data)
+}
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// A msgpack client speaks and hears MessagePack end to end, over a deflated
+// connection, while the engine's side stays JSON.
+func TestMsgpackConnectionOverDeflate(t *testing.T) {
+	initSubscriptions.Do(func() {
+		if err := SubscriptionManager.Init(transport.NewMemory()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?encoding=msgpack"
+	conn, response, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if !strings.Contains(response.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Error("permessage-deflate was not negotiated")
+	}
+
+	read := func() map[string]interface{} {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("got frame type %d, want binary", messageType)
+		}
+		var frame map[string]interface{}
+		if err := msgpack.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("decoding %x: %v", data, err)
+		}
+		return frame
+	}
+
+	request, _ := msgpack.Marshal(map[string]interface{}{
+		"method": SUBSCRIBE, "params": []string{"trade@SOL_USD"}, "id": 7,
+	})
+	if err := conn.WriteMessage(websocket.BinaryMessage, request); err != nil {
+		t.Fatal(err)
+	}
+	if ack := read(); fmt.Sprint(ack["id"]) != "7" || ack["error"] != nil {
+		t.Fatalf("subscribe answered %v", ack)
+	}
+
+	SubscriptionManager.bus.Publish(context.Background(), "trade@SOL_USD",
+		[]byte(`{"stream":"trade@SOL_USD","data":null,"tradeData":{"e":"trade","price":"101.5","timestamp":1792378416111}}`))
+	message := read()
+	trade, _ := message["tradeData"].(map[string]interface{})
+	if message["stream"] != "trade@SOL_USD" || trade["price"] != "101.5" || fmt.Sprint(trade["timestamp"]) != "1792378416111" {
+		t.Errorf("got %v", message)
+	}
+}
+
+func TestUnknownEncodingIsRefused(t *testing.T) {
+	if _, err := parseEncoding("protobuf"); err == nil {
+		t.Error("protobuf accepted")
+	}
+}
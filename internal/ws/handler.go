@@ -0,0 +1,32 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow connections from any origin
+	},
+	// Accept permessage-deflate when the client offers it, which every
+	// browser does. Depth and trade frames are repetitive JSON and compress
+	// several times over; prepared frames (encoding.go) keep the cost to one
+	// compression per message rather than one per subscriber. WS_COMPRESSION=off
+	// declines it for everyone.
+	EnableCompression: os.Getenv("WS_COMPRESSION") != "off",
+}
+
+// HandleWebSocket upgrades the connection and registers its user.
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+
+	UserManager.AddUser(conn, r)
+}
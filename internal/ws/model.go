@@ -1,5 +1,7 @@
 package ws
 
+import "encoding/json"
+
 // Message types
 const (
 	SUBSCRIBE   = "SUBSCRIBE"
@@ -17,37 +19,52 @@ type UnsubscribeMessage struct {
 	Params []string `json:"params"`
 }
 
+// IncomingMessage is any frame a client sends. Params stays raw until the
+// method says what it holds: a list of streams for SUBSCRIBE and UNSUBSCRIBE,
+// an object for an order request (orders.go), whose ID comes back on the
+// reply.
 type IncomingMessage struct {
-	Method string   `json:"method"`
-	Params []string `json:"params"`
+	Method string `json:"method"`
+	// ID is echoed back as sent: the frontend numbers its frames, a bot may
+	// use strings.
+	ID     json.RawMessage `json:"id,omitempty"`
+	Params json.RawMessage `json:"params"`
 }
 
 // OutgoingMessage types.
 //
 // NOTE: the server forwards engine payloads verbatim and no longer serializes
 // through these structs. They describe the wire format for reference only -
-// the authoritative definitions live in cmd/engine/model.go.
+// the authoritative definitions live in internal/engine/model.go. The one
+// exception is DepthData, which a slow client's send queue decodes to merge
+// diffs (sendqueue.go).
+// TickerData is what ticker.<market> carries under "tickerdata": the engine's
+// rolling 24h summary (engine.Ticker).
 type TickerData struct {
-	C  *string `json:"c,omitempty"`
-	H  *string `json:"h,omitempty"`
-	L  *string `json:"l,omitempty"`
-	V  *string `json:"v,omitempty"`
-	VV *string `json:"V,omitempty"`
-	S  *string `json:"s,omitempty"`
-	ID int     `json:"id"`
-	E  string  `json:"e"`
-}
-
-type TickerUpdateMessage struct {
-	Type string     `json:"type"`
-	Data TickerData `json:"data"`
+	Symbol             string `json:"symbol"`
+	LastPrice          string `json:"lastPrice"`
+	High               string `json:"high"`
+	Low                string `json:"low"`
+	Volume             string `json:"volume"`
+	QuoteVolume        string `json:"quoteVolume"`
+	PriceChange        string `json:"priceChange"`
+	PriceChangePercent string `json:"priceChangePercent"`
+	Trades             string `json:"trades"`
+	FirstPrice         string `json:"firstPrice"`
 }
 
+// DepthData is a depth@<market> diff: changed levels only, "0" for a level
+// that emptied, numbered firstUpdateId to lastUpdateId (engine/depth.go).
 type DepthData struct {
 	B  [][2]string `json:"b"`
 	A  [][2]string `json:"a"`
-	ID int         `json:"id"`
+	ID int         `json:"id,omitempty"`
 	E  string      `json:"e"`
+	// Snapshot marks the whole book a subscriber is sent first (cache.go):
+	// it replaces the client's book rather than applying to it.
+	Snapshot      bool   `json:"snapshot,omitempty"`
+	FirstUpdateID uint64 `json:"firstUpdateId"`
+	LastUpdateID  uint64 `json:"lastUpdateId"`
 }
 
 type DepthUpdateMessage struct {
@@ -0,0 +1,233 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/google/uuid"
+)
+
+// Order entry over the socket. A signed-in connection can send
+//
+//	{"method": "placeOrder", "id": "1", "params": {"market": "SOL_USD", "side": "buy", "price": "100", "quantity": "1", "type": "limit"}}
+//	{"method": "cancelOrder", "id": "2", "params": {"market": "SOL_USD", "orderId": "..."}}
+//	{"method": "cancelAll", "id": "3", "params": {"market": "SOL_USD"}}
+//
+// and gets the engine's reply back with the same id, as the HTTP API would
+// have returned it:
+//
+//	{"id": "1", "type": "ORDER_PLACED", "payload": {...}}
+//
+// The user is always the connection's, never a field of the request. Replies
+// can arrive in a different order from the requests; the id is what ties
+// them together.
+const (
+	PLACE_ORDER  = "placeOrder"
+	CANCEL_ORDER = "cancelOrder"
+	CANCEL_ALL   = "cancelAll"
+)
+
+// repliesChannel is the send queue channel replies go out on, so they get
+// their own slow-consumer policy: a bot that is not reading its replies is
+// disconnected rather than left guessing which orders went through.
+const repliesChannel = "replies"
+
+// maxInFlight caps the requests one connection can have waiting on the
+// engine. Each holds a goroutine and a pub/sub subscription until it is
+// answered.
+const maxInFlight = 32
+
+// engineReplyTimeout matches the HTTP API's. An order command is never
+// retried on timeout: it may only be queued, and a second copy would be a
+// second order.
+const engineReplyTimeout = 30 * time.Second
+
+type PlaceOrderParams struct {
+	Market   string `json:"market"`
+	Side     string `json:"side"`
+	Price    string `json:"price"`
+	Quantity string `json:"quantity"`
+	Type     string `json:"type"` // "limit" (default) or "market"
+}
+
+type CancelOrderParams struct {
+	Market  string `json:"market"`
+	OrderID string `json:"orderId"`
+}
+
+type CancelAllParams struct {
+	Market string `json:"market"`
+}
+
+// ResponseFrame answers one request frame.
+type ResponseFrame struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload interface{}     `json:"payload"`
+}
+
+// engineCommand is what the engine reads off its queues (engine.QueuedCommand).
+// ClientID is the correlation id: the engine publishes its reply to the
+// channel of that name.
+type engineCommand struct {
+	ClientID string `json:"clientId"`
+	Message  struct {
+		Type string      `json:"type"`
+		Data interface{} `json:"data"`
+	} `json:"message"`
+}
+
+type engineReply struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// sendToEngine pushes command onto queue and waits for the engine's reply.
+// A var so tests can stand in for the engine.
+var sendToEngine = func(ctx context.Context, queue string, command engineCommand) (*engineReply, error) {
+	bus := SubscriptionManager.bus
+	// Subscribe before pushing, so a fast engine cannot answer into the void.
+	sub, err := bus.Subscribe(ctx, command.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("subscribing for the reply: %w", err)
+	}
+	defer sub.Close()
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	if err := bus.Push(ctx, queue, data); err != nil {
+		return nil, fmt.Errorf("sending to the engine: %w", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("awaiting engine reply on %s: %w", command.ClientID, ctx.Err())
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return nil, fmt.Errorf("awaiting engine reply on %s: subscription closed", command.ClientID)
+			}
+			var reply engineReply
+			if err := json.Unmarshal(msg.Payload, &reply); err != nil {
+				log.Printf("Discarding unparseable engine reply on %s: %v", command.ClientID, err)
+				continue
+			}
+			return &reply, nil
+		}
+	}
+}
+
+// handleRequest answers one order request frame. The engine round trip runs
+// on its own goroutine: the read loop has pings and subscriptions to get on
+// with meanwhile.
+func (u *User) handleRequest(frame IncomingMessage) {
+	if !u.authenticated {
+		u.rejectRequest(frame.ID, "UNAUTHENTICATED", "order entry needs a signed-in connection")
+		return
+	}
+
+	var command engineCommand
+	var market string
+	switch frame.Method {
+	case PLACE_ORDER:
+		var params PlaceOrderParams
+		if err := json.Unmarshal(frame.Params, &params); err != nil {
+			u.rejectRequest(frame.ID, "INVALID_ORDER", "params: "+err.Error())
+			return
+		}
+		if params.Type == "" {
+			params.Type = "limit"
+		}
+		market = params.Market
+		command.Message.Type = "CREATE_ORDER"
+		command.Message.Data = map[string]string{
+			"market":   params.Market,
+			"side":     params.Side,
+			"price":    params.Price,
+			"quantity": params.Quantity,
+			"type":     params.Type,
+			"userId":   u.ID,
+		}
+	case CANCEL_ORDER:
+		var params CancelOrderParams
+		if err := json.Unmarshal(frame.Params, &params); err != nil {
+			u.rejectRequest(frame.ID, "INVALID_ORDER", "params: "+err.Error())
+			return
+		}
+		market = params.Market
+		command.Message.Type = "CANCEL_ORDER"
+		command.Message.Data = map[string]string{
+			"market":  params.Market,
+			"orderId": params.OrderID,
+			"userId":  u.ID,
+		}
+	case CANCEL_ALL:
+		var params CancelAllParams
+		if err := json.Unmarshal(frame.Params, &params); err != nil {
+			u.rejectRequest(frame.ID, "INVALID_ORDER", "params: "+err.Error())
+			return
+		}
+		market = params.Market
+		command.Message.Type = "CANCEL_ALL"
+		command.Message.Data = map[string]string{
+			"market": params.Market,
+			"userId": u.ID,
+		}
+	}
+
+	// Order commands go to their market's queue, and the engine only reads
+	// the listed ones: anything else would wait out the full timeout.
+	if !markets.Listed(market) {
+		u.rejectRequest(frame.ID, "NO_ORDERBOOK", "no orderbook for market "+market)
+		return
+	}
+
+	select {
+	case u.inFlight <- struct{}{}:
+	default:
+		u.rejectRequest(frame.ID, "TOO_MANY_REQUESTS",
+			fmt.Sprintf("%d requests already waiting on the engine", maxInFlight))
+		return
+	}
+	command.ClientID = uuid.New().String()
+
+	go func() {
+		defer func() { <-u.inFlight }()
+		ctx, cancel := context.WithTimeout(context.Background(), engineReplyTimeout)
+		defer cancel()
+
+		reply, err := sendToEngine(ctx, markets.CommandQueue(market), command)
+		if err != nil {
+			log.Printf("User %s request %s: %v", u.ID, string(frame.ID), err)
+			u.rejectRequest(frame.ID, "INTERNAL", err.Error())
+			return
+		}
+		u.respond(ResponseFrame{ID: frame.ID, Type: reply.Type, Payload: reply.Payload})
+	}()
+}
+
+// rejectRequest answers a request in the engine's own rejection shape, so a
+// client handles one whether the engine or this service refused it.
+func (u *User) rejectRequest(id json.RawMessage, code, reason string) {
+	u.respond(ResponseFrame{
+		ID:      id,
+		Type:    "ORDER_REJECTED",
+		Payload: map[string]string{"reason": reason, "code": code},
+	})
+}
+
+func (u *User) respond(frame ResponseFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("User %s: encoding reply to %s: %v", u.ID, string(frame.ID), err)
+		return
+	}
+	if err := u.Emit(repliesChannel, data); err != nil {
+		log.Printf("User %s: sending reply to %s: %v", u.ID, string(frame.ID), err)
+	}
+}
@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// fakeEngine answers every command with reply and hands back what it was sent.
+func fakeEngine(t *testing.T, reply string) chan engineCommand {
+	t.Helper()
+	original := sendToEngine
+	sent := make(chan engineCommand, 1)
+	sendToEngine = func(_ context.Context, queue string, command engineCommand) (*engineReply, error) {
+		if queue != "messages:SOL_USD" {
+			t.Errorf("sent to queue %s", queue)
+		}
+		sent <- command
+		var r engineReply
+		json.Unmarshal([]byte(reply), &r)
+		return &r, nil
+	}
+	t.Cleanup(func() { sendToEngine = original })
+	return sent
+}
+
+func testUser(authenticated bool) *User {
+	return &User{ID: "alice", authenticated: authenticated, queue: newSendQueue(), inFlight: make(chan struct{}, maxInFlight)}
+}
+
+func nextResponse(t *testing.T, u *User) ResponseFrame {
+	t.Helper()
+	done := make(chan []outbound, 1)
+	go func() { done <- u.queue.take() }()
+	select {
+	case batch := <-done:
+		var frame ResponseFrame
+		if err := json.Unmarshal(batch[0].payload, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+		return ResponseFrame{}
+	}
+}
+
+func TestPlaceOrderForwardsTheConnectionsUserAndAnswersWithTheRequestID(t *testing.T) {
+	sent := fakeEngine(t, `{"type":"ORDER_PLACED","payload":{"orderId":"7"}}`)
+	u := testUser(true)
+
+	u.handleRequest(IncomingMessage{
+		Method: PLACE_ORDER,
+		ID:     json.RawMessage(`"req-1"`),
+		Params: json.RawMessage(`{"market":"SOL_USD","side":"buy","price":"100","quantity":"1","userId":"mallory"}`),
+	})
+
+	command := <-sent
+	data := command.Message.Data.(map[string]string)
+	if command.Message.Type != "CREATE_ORDER" || data["userId"] != "alice" || data["type"] != "limit" {
+		t.Errorf("engine got %+v", command)
+	}
+	if command.ClientID == "" {
+		t.Error("no correlation id")
+	}
+	frame := nextResponse(t, u)
+	if string(frame.ID) != `"req-1"` || frame.Type != "ORDER_PLACED" {
+		t.Errorf("response = %+v", frame)
+	}
+}
+
+func TestOrderRequestsNeedASignedInConnection(t *testing.T) {
+	fakeEngine(t, `{}`)
+	u := testUser(false)
+	u.handleRequest(IncomingMessage{Method: CANCEL_ALL, ID: json.RawMessage(`2`), Params: json.RawMessage(`{"market":"SOL_USD"}`)})
+
+	frame := nextResponse(t, u)
+	payload, _ := frame.Payload.(map[string]interface{})
+	if string(frame.ID) != "2" || frame.Type != "ORDER_REJECTED" || payload["code"] != "UNAUTHENTICATED" {
+		t.Errorf("response = %+v", frame)
+	}
+}
@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Althaf66/cryptoXchange/internal/dbase"
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+)
+
+// LIST_SUBSCRIPTIONS asks for the streams the connection is subscribed to.
+const LIST_SUBSCRIPTIONS = "LIST_SUBSCRIPTIONS"
+
+// maxSubscriptions caps the streams one connection holds, the private ones
+// it was given on connecting included. Each is a channel this service keeps
+// subscribed upstream for as long as anyone wants it.
+const maxSubscriptions = 50
+
+// Every SUBSCRIBE, UNSUBSCRIBE and LIST_SUBSCRIPTIONS gets one frame back with
+// the request's id: the streams the connection now holds, or why nothing
+// changed.
+//
+//	{"id": 1, "result": ["depth@SOL_USD", "orders:42"]}
+//	{"id": 2, "result": null, "error": {"code": "INVALID_STREAM", "msg": "..."}}
+//
+// A request naming several streams is applied whole or not at all.
+type ResultFrame struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result []string        `json:"result"`
+	Error  *FrameError     `json:"error,omitempty"`
+}
+
+type FrameError struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// validateStream checks name is a stream something publishes to and that
+// this connection may read it. Anything else used to become an upstream
+// channel nobody would ever publish on.
+func (u *User) validateStream(name string) *FrameError {
+	for _, prefix := range privatePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			if !u.mayRead(name) {
+				return &FrameError{Code: "FORBIDDEN", Msg: name + " is another user's stream, or needs a signed-in connection"}
+			}
+			return nil
+		}
+	}
+
+	invalid := &FrameError{Code: "INVALID_STREAM", Msg: "unknown stream " + name}
+	var market string
+	switch {
+	case strings.HasPrefix(name, "depth"):
+		if _, _, _, ok := parseDepthStream(name); !ok {
+			return invalid
+		}
+		return nil
+	case strings.HasPrefix(name, "trade@"):
+		market = strings.TrimPrefix(name, "trade@")
+	case strings.HasPrefix(name, "ticker."):
+		market = strings.TrimPrefix(name, "ticker.")
+	case strings.HasPrefix(name, "kline@"):
+		interval, rest, ok := strings.Cut(strings.TrimPrefix(name, "kline@"), ".")
+		if _, known := dbase.KlineIntervalByName(interval); !ok || !known {
+			return invalid
+		}
+		market = rest
+	default:
+		return invalid
+	}
+	if !markets.Listed(market) {
+		return &FrameError{Code: "INVALID_STREAM", Msg: "no market " + market + " in " + name}
+	}
+	return nil
+}
+
+// handleFrame answers one frame from the client.
+func (u *User) handleFrame(data []byte) {
+	var frame IncomingMessage
+	if err := json.Unmarshal(data, &frame); err != nil {
+		u.respondResult(ResultFrame{Error: &FrameError{Code: "INVALID_REQUEST", Msg: err.Error()}})
+		return
+	}
+
+	switch frame.Method {
+	case SUBSCRIBE, UNSUBSCRIBE:
+		var streams []string
+		if err := json.Unmarshal(frame.Params, &streams); err != nil {
+			u.respondResult(ResultFrame{ID: frame.ID, Error: &FrameError{
+				Code: "INVALID_REQUEST", Msg: "params must be a list of streams: " + err.Error()}})
+			return
+		}
+		if frame.Method == SUBSCRIBE {
+			u.subscribe(frame.ID, streams)
+		} else {
+			for _, s := range streams {
+				SubscriptionManager.GetInstance().Unsubscribe(u.ID, s)
+			}
+			u.respondResult(ResultFrame{ID: frame.ID, Result: SubscriptionManager.GetInstance().GetSubscriptions(u.ID)})
+		}
+	case LIST_SUBSCRIPTIONS:
+		u.respondResult(ResultFrame{ID: frame.ID, Result: SubscriptionManager.GetInstance().GetSubscriptions(u.ID)})
+	case PLACE_ORDER, CANCEL_ORDER, CANCEL_ALL:
+		u.handleRequest(frame)
+	default:
+		u.respondResult(ResultFrame{ID: frame.ID, Error: &FrameError{
+			Code: "UNKNOWN_METHOD", Msg: fmt.Sprintf("unknown method %q", frame.Method)}})
+	}
+}
+
+func (u *User) subscribe(id json.RawMessage, streams []string) {
+	sm := SubscriptionManager.GetInstance()
+	held := sm.GetSubscriptions(u.ID)
+	isHeld := map[string]bool{}
+	for _, s := range held {
+		isHeld[s] = true
+	}
+
+	added := 0
+	for _, s := range streams {
+		if err := u.validateStream(s); err != nil {
+			u.respondResult(ResultFrame{ID: id, Error: err})
+			return
+		}
+		if !isHeld[s] {
+			isHeld[s] = true
+			added++
+		}
+	}
+	if len(held)+added > maxSubscriptions {
+		u.respondResult(ResultFrame{ID: id, Error: &FrameError{
+			Code: "TOO_MANY_SUBSCRIPTIONS",
+			Msg:  fmt.Sprintf("a connection can hold %d streams; this one has %d", maxSubscriptions, len(held)),
+		}})
+		return
+	}
+
+	for _, s := range streams {
+		sm.Subscribe(u.ID, s)
+	}
+	u.respondResult(ResultFrame{ID: id, Result: sm.GetSubscriptions(u.ID)})
+}
+
+// respondResult sends frame on the replies channel, behind the same
+// slow-consumer policy as order replies.
+func (u *User) respondResult(frame ResultFrame) {
+	if frame.Error == nil && frame.Result == nil {
+		frame.Result = []string{}
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("User %s: encoding reply to %s: %v", u.ID, string(frame.ID), err)
+		return
+	}
+	if err := u.Emit(repliesChannel, data); err != nil {
+		log.Printf("User %s: sending reply to %s: %v", u.ID, string(frame.ID), err)
+	}
+}
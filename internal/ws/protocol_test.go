@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+)
+
+var initSubscriptions sync.Once
+
+func nextResult(t *testing.T, u *User) ResultFrame {
+	t.Helper()
+	batch := u.queue.take()
+	var frame ResultFrame
+	if err := json.Unmarshal(batch[len(batch)-1].payload, &frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestStreamNamesAreCheckedBeforeSubscribing(t *testing.T) {
+	alice := testUser(true)
+	for name, want := range map[string]string{
+		"depth@SOL_USD":         "",
+		"trade@SOL_USD":         "",
+		"ticker.SOL_USD":        "",
+		"kline@1h.SOL_USD":      "",
+		"orders:alice":          "",
+		"depth@NOPE_USD":        "INVALID_STREAM",
+		"kline@7m.SOL_USD":      "INVALID_STREAM",
+		"kline@1h":              "INVALID_STREAM",
+		"engine:heartbeat":      "INVALID_STREAM",
+		"balances:bob":          "FORBIDDEN",
+		"messages:SOL_USD":      "INVALID_STREAM",
+		"depth@SOL_USD@bad":     "INVALID_STREAM",
+		"depth5@SOL_USD":        "",
+		"depth100@SOL_USD@1s":   "",
+		"depth@SOL_USD@100ms":   "",
+		"depth7@SOL_USD":        "INVALID_STREAM",
+		"depth5@NOPE_USD@100ms": "INVALID_STREAM",
+		"depth5@SOL_USD@250ms":  "INVALID_STREAM",
+	} {
+		got := ""
+		if err := alice.validateStream(name); err != nil {
+			got = err.Code
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestEverySubscriptionRequestIsAnswered(t *testing.T) {
+	initSubscriptions.Do(func() {
+		if err := SubscriptionManager.Init(transport.NewMemory()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	u := testUser(false)
+	u.ID = "protocol-test"
+	t.Cleanup(func() { SubscriptionManager.UserLeft(u.ID) })
+
+	u.handleFrame([]byte(`{"method":"SUBSCRIBE","params":["depth@SOL_USD","trade@SOL_USD"],"id":1}`))
+	if got := nextResult(t, u); string(got.ID) != "1" || got.Error != nil || len(got.Result) != 2 {
+		t.Errorf("subscribe: %+v", got)
+	}
+
+	// One bad stream refuses the whole request.
+	u.handleFrame([]byte(`{"method":"SUBSCRIBE","params":["ticker.SOL_USD","orders:someone"],"id":2}`))
+	if got := nextResult(t, u); string(got.ID) != "2" || got.Error == nil || got.Error.Code != "FORBIDDEN" {
+		t.Errorf("forbidden subscribe: %+v", got)
+	}
+
+	u.handleFrame([]byte(`{"method":"UNSUBSCRIBE","params":["trade@SOL_USD"],"id":3}`))
+	u.handleFrame([]byte(`{"method":"LIST_SUBSCRIPTIONS","id":4}`))
+	if got := nextResult(t, u); string(got.ID) != "4" || len(got.Result) != 1 || got.Result[0] != "depth@SOL_USD" {
+		t.Errorf("list: %+v", got)
+	}
+
+	u.handleFrame([]byte(`{"method":"PING","id":5}`))
+	if got := nextResult(t, u); got.Error == nil || got.Error.Code != "UNKNOWN_METHOD" {
+		t.Errorf("unknown method: %+v", got)
+	}
+}
+
+func TestSubscriptionsAreCappedPerConnection(t *testing.T) {
+	initSubscriptions.Do(func() {
+		if err := SubscriptionManager.Init(transport.NewMemory()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	u := testUser(false)
+	u.ID = "cap-test"
+	t.Cleanup(func() { SubscriptionManager.UserLeft(u.ID) })
+	for i := 0; i < maxSubscriptions; i++ {
+		SubscriptionManager.Subscribe(u.ID, "held-"+string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+
+	u.handleFrame([]byte(`{"method":"SUBSCRIBE","params":["depth@SOL_USD"],"id":1}`))
+	if got := nextResult(t, u); got.Error == nil || got.Error.Code != "TOO_MANY_SUBSCRIPTIONS" {
+		t.Errorf("over the cap: %+v", got)
+	}
+}
@@ -0,0 +1,349 @@
+package ws
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowPolicy is what a connection's send queue does with a message once the
+// queue is full, i.e. once the browser has stopped keeping up.
+type SlowPolicy string
+
+const (
+	// DropOldest makes room by discarding the message queued longest. Fine for
+	// streams where each message stands alone, like public trades.
+	DropOldest SlowPolicy = "drop_oldest"
+	// Conflate folds a message into the one already queued for the same
+	// stream, so a slow client gets fewer, fresher messages instead of a
+	// backlog. A ticker is replaced outright; depth diffs are merged level by
+	// level, keeping the first diff's firstUpdateId so the client's gap check
+	// still holds.
+	Conflate SlowPolicy = "conflate"
+	// Disconnect closes the connection. For streams where a lost message
+	// leaves the client wrong with no way to tell, like the user's own fills,
+	// a reconnect and a fresh fetch beats carrying on.
+	Disconnect SlowPolicy = "disconnect"
+)
+
+// sendPolicies is the policy per stream kind, the channel name up to its
+// first '@', '.' or ':'. WS_SLOW_CONSUMER overrides entries as a comma
+// separated list, e.g. "trade=conflate,kline=disconnect". A kind not listed
+// drops oldest.
+//
+// Kline is not conflated by default: replacing a queued candle with the next
+// bucket's would lose the update that closed it. Balances conflate safely
+// because each message carries all of them.
+var sendPolicies = parseSlowPolicies(os.Getenv("WS_SLOW_CONSUMER"), map[string]SlowPolicy{
+	"depth":    Conflate,
+	"ticker":   Conflate,
+	"trade":    DropOldest,
+	"kline":    DropOldest,
+	"trades":   Disconnect,
+	"orders":   Disconnect,
+	"balances": Conflate,
+	"replies":  Disconnect,
+})
+
+// sendQueueSize is how many messages a connection may have waiting before its
+// policy kicks in. WS_SEND_QUEUE overrides it.
+var sendQueueSize = func() int {
+	n, err := strconv.Atoi(os.Getenv("WS_SEND_QUEUE"))
+	if err != nil || n < 1 {
+		return 256
+	}
+	return n
+}()
+
+// writeWait caps a single write. A client that cannot take one message in this
+// long is gone, whatever its queue looks like.
+const writeWait = 10 * time.Second
+
+// Counters by stream kind, served on /debug/vars: messages discarded to make
+// room, messages folded into a queued one, and connections closed for being
+// slow.
+var (
+	droppedMessages    = expvar.NewMap("ws_dropped_messages")
+	conflatedMessages  = expvar.NewMap("ws_conflated_messages")
+	slowDisconnections = expvar.NewMap("ws_slow_disconnects")
+)
+
+func parseSlowPolicies(spec string, defaults map[string]SlowPolicy) map[string]SlowPolicy {
+	policies := make(map[string]SlowPolicy, len(defaults))
+	for kind, policy := range defaults {
+		policies[kind] = policy
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		kind, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		switch policy := SlowPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+		case DropOldest, Conflate, Disconnect:
+			policies[strings.TrimSpace(kind)] = policy
+		default:
+			log.Printf("WS_SLOW_CONSUMER: unknown policy %q for %s, ignored", value, kind)
+		}
+	}
+	return policies
+}
+
+func streamKind(channel string) string {
+	if i := strings.IndexAny(channel, "@.:"); i >= 0 {
+		return depthStreamKind(channel[:i])
+	}
+	return channel
+}
+
+type outbound struct {
+	channel string
+	// payload is the message as JSON, which conflation works on.
+	payload []byte
+	// frame is payload already encoded for the connection, shared with every
+	// other subscriber that uses the same encoding. Nil means the writer
+	// encodes payload itself: a reply, or a message conflation rewrote.
+	frame *websocket.PreparedMessage
+}
+
+// sendQueue holds one connection's outgoing messages for its writer goroutine,
+// so the pub/sub dispatch loop only ever appends to a slice and a stalled
+// browser stalls nobody but itself.
+type sendQueue struct {
+	mu      sync.Mutex
+	pending []outbound
+	closed  bool
+	// wake has room for one signal: the writer drains everything pending each
+	// time round, so a second signal would say nothing new.
+	wake    chan struct{}
+	dropped int
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{wake: make(chan struct{}, 1)}
+}
+
+// push queues payload for channel, applying the stream's policy if the queue
+// is full. It reports false when the policy is to disconnect; the caller
+// closes the connection.
+func (q *sendQueue) push(channel string, payload []byte, frame *websocket.PreparedMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return true
+	}
+	kind := streamKind(channel)
+	policy := sendPolicies[kind]
+
+	// Conflating only pays once the client is behind; while there is room
+	// every message goes out as it came.
+	if len(q.pending) >= sendQueueSize {
+		switch policy {
+		case Disconnect:
+			slowDisconnections.Add(kind, 1)
+			q.closed = true
+			return false
+		case Conflate:
+			if q.conflate(kind, channel, payload, frame) {
+				conflatedMessages.Add(kind, 1)
+				return true
+			}
+		}
+		// Nothing queued to fold it into, or the policy is to drop: the
+		// oldest message that may be dropped goes. For a depth diff that
+		// opens a gap, which the client notices and resyncs from a
+		// snapshot. A fill, order event, balance or reply is never dropped
+		// to make room for market data: with one at the head, or nothing
+		// else queued, the client is behind on a stream it must not miss
+		// and is disconnected as if that stream had overflowed.
+		victim := -1
+		if sendPolicies[streamKind(q.pending[0].channel)] != Disconnect {
+			for i, queued := range q.pending {
+				if droppable(queued.channel) {
+					victim = i
+					break
+				}
+			}
+		}
+		if victim < 0 {
+			slowDisconnections.Add(streamKind(q.pending[0].channel), 1)
+			q.closed = true
+			return false
+		}
+		droppedMessages.Add(streamKind(q.pending[victim].channel), 1)
+		q.dropped++
+		q.pending = append(q.pending[:victim], q.pending[victim+1:]...)
+	}
+	q.pending = append(q.pending, outbound{channel, payload, frame})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// droppable reports whether a queued message on channel may be dropped to
+// make room. Balances conflate, each carrying all of them, but dropping the
+// last one outright would leave the client on stale funds; private streams
+// and replies are therefore never dropped, whatever their policy.
+func droppable(channel string) bool {
+	if channel == repliesChannel || sendPolicies[streamKind(channel)] == Disconnect {
+		return false
+	}
+	for _, prefix := range privatePrefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// conflate folds payload into the message already queued for channel, if
+// there is one. Called with q.mu held.
+func (q *sendQueue) conflate(kind, channel string, payload []byte, frame *websocket.PreparedMessage) bool {
+	for i := len(q.pending) - 1; i >= 0; i-- {
+		if q.pending[i].channel != channel {
+			continue
+		}
+		if kind == "depth" {
+			merged, err := mergeDepth(q.pending[i].payload, payload)
+			if err != nil {
+				log.Printf("conflating %s: %v", channel, err)
+				return false
+			}
+			payload, frame = merged, nil
+		}
+		q.pending[i].payload, q.pending[i].frame = payload, frame
+		return true
+	}
+	return false
+}
+
+// take hands the writer everything queued, waiting for something if the
+// queue is empty. It returns nil once the queue is closed.
+func (q *sendQueue) take() []outbound {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+		if len(q.pending) > 0 {
+			batch := q.pending
+			q.pending = nil
+			q.mu.Unlock()
+			return batch
+		}
+		q.mu.Unlock()
+		<-q.wake
+	}
+}
+
+// droppedCount is how many messages this connection has lost to DropOldest.
+func (q *sendQueue) droppedCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop sends what the queue hands it, in enc, until the queue closes or a
+// write fails. A failed write closes the connection, which ends the read loop
+// and with it the user.
+func writeLoop(conn *websocket.Conn, q *sendQueue, enc Encoding) {
+	for {
+		batch := q.take()
+		if batch == nil {
+			return
+		}
+		for _, m := range batch {
+			if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				conn.Close()
+				return
+			}
+			if err := writeOutbound(conn, m, enc); err != nil {
+				log.Printf("writing %s: %v", m.channel, err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func writeOutbound(conn *websocket.Conn, m outbound, enc Encoding) error {
+	if m.frame != nil {
+		return conn.WritePreparedMessage(m.frame)
+	}
+	messageType, data, err := encodeFrame(enc, m.payload)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+// mergeDepth folds the depth diff newer into older: the later quantity wins
+// at each price, and the result spans older's firstUpdateId to newer's
+// lastUpdateId. Every other field comes from newer. A snapshot folded into
+// stays one, without the levels the diffs emptied; a snapshot replaces
+// whatever was queued before it.
+func mergeDepth(older, newer []byte) ([]byte, error) {
+	type message struct {
+		Stream string    `json:"stream"`
+		Data   DepthData `json:"data"`
+	}
+	var a, b message
+	if err := json.Unmarshal(older, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(newer, &b); err != nil {
+		return nil, err
+	}
+	if b.Data.Snapshot {
+		return newer, nil
+	}
+	b.Data.B = mergeLevels(a.Data.B, b.Data.B, true)
+	b.Data.A = mergeLevels(a.Data.A, b.Data.A, false)
+	b.Data.FirstUpdateID = a.Data.FirstUpdateID
+	if a.Data.Snapshot {
+		b.Data.Snapshot = true
+		b.Data.B, b.Data.A = withoutEmpty(b.Data.B), withoutEmpty(b.Data.A)
+	}
+	return json.Marshal(b)
+}
+
+func mergeLevels(older, newer [][2]string, descending bool) [][2]string {
+	levels := map[string]string{}
+	for _, level := range older {
+		levels[level[0]] = level[1]
+	}
+	for _, level := range newer {
+		levels[level[0]] = level[1]
+	}
+	return sortedLevels(levels, descending)
+}
+
+// withoutEmpty drops the levels a diff marked removed.
+func withoutEmpty(levels [][2]string) [][2]string {
+	kept := make([][2]string, 0, len(levels))
+	for _, level := range levels {
+		if qty, err := strconv.ParseFloat(level[1], 64); err != nil || qty != 0 {
+			kept = append(kept, level)
+		}
+	}
+	return kept
+}
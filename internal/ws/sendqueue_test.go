@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func setQueueSize(t *testing.T, n int) {
+	t.Helper()
+	original := sendQueueSize
+	sendQueueSize = n
+	t.Cleanup(func() { sendQueueSize = original })
+}
+
+func depthMessage(t *testing.T, first, last uint64, bids [][2]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(OutgoingMessage{
+		Stream:    "depth@SOL_USD",
+		DepthData: &DepthData{B: bids, A: [][2]string{}, E: "depth", FirstUpdateID: first, LastUpdateID: last},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// A client that fell behind has to get one diff it can still apply, not a
+// gap: the merged message spans both ids and holds the later quantity.
+func TestFullQueueConflatesDepthDiffs(t *testing.T) {
+	setQueueSize(t, 2)
+	q := newSendQueue()
+	q.push("depth@SOL_USD", depthMessage(t, 1, 2, [][2]string{{"100", "1"}, {"99", "2"}}), nil)
+	q.push("trade@SOL_USD", []byte(`{"stream":"trade@SOL_USD"}`), nil)
+	if !q.push("depth@SOL_USD", depthMessage(t, 3, 3, [][2]string{{"100", "0"}}), nil) {
+		t.Fatal("depth asked for a disconnect")
+	}
+
+	batch := q.take()
+	if len(batch) != 2 || batch[1].channel != "trade@SOL_USD" {
+		t.Fatalf("queued %+v", batch)
+	}
+	var got struct {
+		Data DepthData `json:"data"`
+	}
+	if err := json.Unmarshal(batch[0].payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"100", "0"}, {"99", "2"}}
+	if got.Data.FirstUpdateID != 1 || got.Data.LastUpdateID != 3 || !reflect.DeepEqual(got.Data.B, want) {
+		t.Errorf("merged = %+v, want ids 1-3 and bids %v", got.Data, want)
+	}
+}
+
+func TestFullQueueAppliesEachStreamsPolicy(t *testing.T) {
+	setQueueSize(t, 1)
+
+	q := newSendQueue()
+	q.push("trade@SOL_USD", []byte("1"), nil)
+	q.push("trade@SOL_USD", []byte("2"), nil)
+	if batch := q.take(); len(batch) != 1 || string(batch[0].payload) != "2" || q.droppedCount() != 1 {
+		t.Errorf("drop oldest: kept %+v, dropped %d", batch, q.droppedCount())
+	}
+
+	q = newSendQueue()
+	q.push("trade@SOL_USD", []byte("1"), nil)
+	if q.push("trades:alice", []byte("fill"), nil) {
+		t.Error("a full queue kept a private fill instead of disconnecting")
+	}
+	if q.take() != nil {
+		t.Error("queue still hands out messages after a disconnect")
+	}
+}
+
+// Market data never pushes a private message out of a full queue: the
+// oldest droppable message goes, and with a private one at the head the
+// connection is closed instead.
+func TestFullQueueNeverDropsPrivateMessages(t *testing.T) {
+	setQueueSize(t, 2)
+
+	q := newSendQueue()
+	q.push("trade@SOL_USD", []byte("1"), nil)
+	q.push("orders:alice", []byte("order"), nil)
+	if !q.push("trade@SOL_USD", []byte("2"), nil) {
+		t.Fatal("disconnected with a droppable trade at the head")
+	}
+	batch := q.take()
+	if len(batch) != 2 || batch[0].channel != "orders:alice" || string(batch[1].payload) != "2" {
+		t.Errorf("kept %+v, want the order and the newer trade", batch)
+	}
+
+	q = newSendQueue()
+	q.push("balances:alice", []byte("balances"), nil)
+	q.push("kline@1m.SOL_USD", []byte("1"), nil)
+	q.push("kline@1m.SOL_USD", []byte("2"), nil)
+	if batch := q.take(); len(batch) != 2 || batch[0].channel != "balances:alice" || string(batch[1].payload) != "2" {
+		t.Errorf("kept %+v, want the balances and the newer kline", batch)
+	}
+
+	for _, channel := range []string{"orders:alice", "trades:alice", repliesChannel} {
+		q = newSendQueue()
+		q.push(channel, []byte("private"), nil)
+		q.push("kline@1m.SOL_USD", []byte("1"), nil)
+		if q.push("kline@1m.SOL_USD", []byte("2"), nil) {
+			t.Errorf("%s: a full queue dropped it for a kline instead of disconnecting", channel)
+		}
+	}
+}
+
+func TestSlowPolicyOverrides(t *testing.T) {
+	got := parseSlowPolicies("trade=conflate, kline = DISCONNECT,depth=bogus", map[string]SlowPolicy{
+		"depth": Conflate,
+		"trade": DropOldest,
+	})
+	want := map[string]SlowPolicy{"depth": Conflate, "trade": Conflate, "kline": Disconnect}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("policies = %v, want %v", got, want)
+	}
+}
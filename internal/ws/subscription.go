@@ -5,37 +5,124 @@ import (
 	"log"
 	"sync"
 
-	"github.com/Althaf66/cryptoXchange/internal/rediscfg"
-	"github.com/go-redis/redis/v8"
+	"github.com/Althaf66/cryptoXchange/internal/markets"
+	"github.com/Althaf66/cryptoXchange/internal/transport"
+	"github.com/gorilla/websocket"
 )
 
 type SubscriptionManagerStruct struct {
 	subscriptions        map[string][]string
 	reverseSubscriptions map[string][]string
-	redisClient          *redis.Client
-	pubsub               *redis.PubSub
+	bus                  transport.Transport
+	pubsub               transport.Subscription
 	mutex                sync.RWMutex
 	subscribedChannels   map[string]bool
+	// caches hold each listed market's state for new subscribers, once
+	// WarmCaches has run (cache.go). Their channels are pinned: subscribed
+	// upstream for good, whoever is listening.
+	caches map[string]*marketCache
+	pinned map[string]bool
 }
 
 var SubscriptionManager = &SubscriptionManagerStruct{
 	subscriptions:        make(map[string][]string),
 	reverseSubscriptions: make(map[string][]string),
 	subscribedChannels:   make(map[string]bool),
+	caches:               make(map[string]*marketCache),
+	pinned:               make(map[string]bool),
 }
 
 func (sm *SubscriptionManagerStruct) GetInstance() *SubscriptionManagerStruct {
 	return sm
 }
 
-func (sm *SubscriptionManagerStruct) Init() {
-	sm.redisClient = redis.NewClient(rediscfg.Options())
+// Init starts listening on bus. Channels are added as clients subscribe to
+// them, so it starts with none. The queues are for order requests sent over
+// the socket, which go to the engine like the API's do.
+func (sm *SubscriptionManagerStruct) Init(bus transport.Transport) error {
+	pubsub, err := bus.Subscribe(context.Background())
+	if err != nil {
+		return err
+	}
+	sm.bus, sm.pubsub = bus, pubsub
+	go sm.listen()
+	return nil
+}
 
-	sm.pubsub = sm.redisClient.Subscribe(context.Background())
-	go sm.listenToRedis()
+// WarmCaches starts keeping every listed market's depth, ticker and recent
+// trades, so a client subscribing to one is sent it straight away. Call it
+// after Init. It returns without waiting for the engine: until a market's
+// book arrives, its depth subscribers sync from REST as before.
+func (sm *SubscriptionManagerStruct) WarmCaches() {
+	sm.mutex.Lock()
+	for _, ticker := range markets.Symbols() {
+		cache := newMarketCache(ticker)
+		cache.emit = sm.emit
+		sm.caches[ticker] = cache
+	}
+	for _, channel := range cachedChannels() {
+		sm.pinned[channel] = true
+		if !sm.subscribedChannels[channel] {
+			sm.pubsub.Subscribe(context.Background(), channel)
+			sm.subscribedChannels[channel] = true
+		}
+	}
+	caches := make([]*marketCache, 0, len(sm.caches))
+	for _, cache := range sm.caches {
+		caches = append(caches, cache)
+	}
+	sm.mutex.Unlock()
+
+	// Subscribed first, fetched second: a diff published in between is
+	// buffered rather than lost.
+	for _, cache := range caches {
+		cache.mu.Lock()
+		cache.resync()
+		cache.mu.Unlock()
+		go cache.loadTicker()
+		go cache.throttle()
+	}
+}
+
+// cacheFor is the cache keeping channel, if any.
+func (sm *SubscriptionManagerStruct) cacheFor(channel string) (*marketCache, string) {
+	market, kind, ok := cachedStream(channel)
+	if !ok {
+		return nil, ""
+	}
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.caches[market], kind
 }
 
+// Subscribe adds userID to subscription. For a cached stream, the user is
+// sent the cache's snapshot first, under the cache's lock so that no
+// message is published between the two.
 func (sm *SubscriptionManagerStruct) Subscribe(userID, subscription string) {
+	cache, _ := sm.cacheFor(subscription)
+	if cache == nil {
+		sm.subscribe(userID, subscription)
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !sm.subscribe(userID, subscription) {
+		return
+	}
+	user := UserManager.GetUser(userID)
+	if user == nil {
+		return
+	}
+	for _, payload := range cache.snapshotFor(subscription) {
+		if err := user.Emit(subscription, payload); err != nil {
+			log.Printf("Error sending %s snapshot to user %s: %v", subscription, userID, err)
+			return
+		}
+	}
+}
+
+// subscribe reports whether userID was newly added.
+func (sm *SubscriptionManagerStruct) subscribe(userID, subscription string) bool {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
@@ -44,7 +131,7 @@ func (sm *SubscriptionManagerStruct) Subscribe(userID, subscription string) {
 	log.Printf("User %s current subscriptions: %v", userID, userSubs)
 	for _, s := range userSubs {
 		if s == subscription {
-			return
+			return false
 		}
 	}
 
@@ -52,12 +139,14 @@ func (sm *SubscriptionManagerStruct) Subscribe(userID, subscription string) {
 	sm.subscriptions[userID] = append(sm.subscriptions[userID], subscription)
 	sm.reverseSubscriptions[subscription] = append(sm.reverseSubscriptions[subscription], userID)
 
-	// Subscribe to Redis channel if this is the first subscription
-	if len(sm.reverseSubscriptions[subscription]) == 1 && !sm.subscribedChannels[subscription] {
+	// Subscribe to the channel if this is the first subscription. A derived
+	// depth stream is fed from the cache, not published upstream.
+	if len(sm.reverseSubscriptions[subscription]) == 1 && !sm.subscribedChannels[subscription] && !derivedDepth(subscription) {
 		sm.pubsub.Subscribe(context.Background(), subscription)
 		sm.subscribedChannels[subscription] = true
 	}
 	log.Println("User", userID, "subscribed to", subscription)
+	return true
 }
 
 func (sm *SubscriptionManagerStruct) Unsubscribe(userID, subscription string) {
@@ -83,9 +172,14 @@ func (sm *SubscriptionManagerStruct) Unsubscribe(userID, subscription string) {
 			}
 		}
 
-		// Unsubscribe from Redis if no more users
+		// Unsubscribe from the channel if no more users, unless a cache
+		// needs it regardless.
 		if len(sm.reverseSubscriptions[subscription]) == 0 {
 			delete(sm.reverseSubscriptions, subscription)
+			if sm.pinned[subscription] || !sm.subscribedChannels[subscription] {
+				log.Println("User", userID, "unsubscribed from", subscription)
+				return
+			}
 			sm.pubsub.Unsubscribe(context.Background(), subscription)
 			delete(sm.subscribedChannels, subscription)
 		}
@@ -125,17 +219,23 @@ func (sm *SubscriptionManagerStruct) GetSubscriptions(userID string) []string {
 	return []string{}
 }
 
-func (sm *SubscriptionManagerStruct) listenToRedis() {
-	ch := sm.pubsub.Channel()
-	for msg := range ch {
+func (sm *SubscriptionManagerStruct) listen() {
+	for msg := range sm.pubsub.Messages() {
 		log.Printf("Received message on channel %s: %s", msg.Channel, msg.Payload)
-		sm.redisCallbackHandler(msg.Payload, msg.Channel)
+		if cache, kind := sm.cacheFor(msg.Channel); cache != nil {
+			cache.mu.Lock()
+			if cache.observe(kind, msg.Payload) {
+				sm.emit(msg.Payload, msg.Channel)
+			}
+			cache.mu.Unlock()
+			continue
+		}
+		sm.emit(msg.Payload, msg.Channel)
 	}
-	log.Println("Redis pubsub channel closed, stopping listener")
+	log.Println("pubsub channel closed, stopping listener")
 }
 
-func (sm *SubscriptionManagerStruct) redisCallbackHandler(message, channel string) {
-	payload := []byte(message)
+func (sm *SubscriptionManagerStruct) emit(payload []byte, channel string) {
 
 	sm.mutex.RLock()
 	userIDs := make([]string, len(sm.reverseSubscriptions[channel]))
@@ -143,11 +243,23 @@ func (sm *SubscriptionManagerStruct) redisCallbackHandler(message, channel strin
 	sm.mutex.RUnlock()
 
 	log.Printf("Emitting message to %d users on channel %s", len(userIDs), channel)
+	// Encoded once per encoding in use, not once per subscriber.
+	frames := map[Encoding]*websocket.PreparedMessage{}
 	for _, userID := range userIDs {
-		if user := UserManager.GetUser(userID); user != nil {
-			if err := user.Emit(payload); err != nil {
-				log.Printf("Error emitting to user %s: %v", userID, err)
+		user := UserManager.GetUser(userID)
+		if user == nil {
+			continue
+		}
+		frame, ok := frames[user.encoding]
+		if !ok {
+			var err error
+			if frame, err = prepareFrame(user.encoding, payload); err != nil {
+				log.Printf("Error encoding %s as %s: %v", channel, user.encoding, err)
 			}
+			frames[user.encoding] = frame
+		}
+		if err := user.EmitPrepared(channel, payload, frame); err != nil {
+			log.Printf("Error emitting to user %s: %v", userID, err)
 		}
 	}
 }
@@ -29,10 +29,10 @@ func SimulateTradeFill(userID, symbol, side string, quantity, price float64) {
 		},
 	}
 
-	// Publish to Redis on the user's trade channel
+	// Publish on the user's trade channel
 	channel := "trades:" + userID
 	messageBytes, _ := json.Marshal(tradeUpdate)
-	SubscriptionManager.redisClient.Publish(context.Background(), channel, string(messageBytes))
+	SubscriptionManager.bus.Publish(context.Background(), channel, messageBytes)
 }
 
 func generateTradeID() string {
@@ -1,8 +1,8 @@
 package ws
 
 import (
-	"encoding/json"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,7 +10,11 @@ import (
 )
 
 type User struct {
-	ID            string
+	ID string
+	// authenticated is set when ID came from a validated JWT rather than
+	// being made up for an anonymous connection. Only then may the
+	// connection read ID's private streams.
+	authenticated bool
 	Conn          *websocket.Conn
 	subscriptions []string
 	mutex         sync.RWMutex
@@ -18,17 +22,32 @@ type User struct {
 	// concurrent reader, so cleanup has to hang off this loop rather than a
 	// second goroutine of its own.
 	onClose func()
+	// queue feeds the connection's writer goroutine; see sendqueue.go.
+	queue *sendQueue
+	// inFlight holds a token per order request waiting on the engine.
+	inFlight chan struct{}
+	// encoding is what the connection asked for with ?encoding=.
+	encoding Encoding
 }
 
-func NewUser(id string, conn *websocket.Conn, onClose func()) *User {
+func NewUser(id string, conn *websocket.Conn, authenticated bool, encoding Encoding, onClose func()) *User {
 	user := &User{
 		ID:            id,
+		encoding:      encoding,
+		authenticated: authenticated,
 		Conn:          conn,
 		subscriptions: make([]string, 0),
 		onClose:       onClose,
+		queue:         newSendQueue(),
+		inFlight:      make(chan struct{}, maxInFlight),
+	}
+	// A signed-in connection gets its own order and balance events without
+	// asking. An anonymous one has nothing private to follow.
+	if authenticated {
+		for _, prefix := range []string{"orders:", "balances:"} {
+			SubscriptionManager.GetInstance().Subscribe(user.ID, prefix+user.ID)
+		}
 	}
-	// Automatically subscribe user to their own trades channel
-	SubscriptionManager.GetInstance().Subscribe(user.ID, "trades:"+user.ID)
 	log.Println("New user connected:", user.ID)
 	return user
 }
@@ -38,6 +57,7 @@ func NewUser(id string, conn *websocket.Conn, onClose func()) *User {
 // the user, the cleanup deletes nothing and the entry is then inserted dead —
 // leaking the connection and its subscriptions permanently.
 func (u *User) Start() {
+	go writeLoop(u.Conn, u.queue, u.encoding)
 	u.addListeners()
 }
 
@@ -58,19 +78,43 @@ func (u *User) Unsubscribe(subscription string) {
 	}
 }
 
-// Emit forwards a payload to the browser byte for byte. The engine owns the
-// stream schema; re-serializing it here through a local struct silently dropped
-// every field the two definitions did not share.
-func (u *User) Emit(data []byte) error {
-	// Every subscriber's write happens inline on the single Redis dispatch
-	// goroutine, so an unbounded write blocks market data for everyone. The
-	// deadline caps that at 10s and drops the stalled client instead.
-	// ponytail: a per-user send channel and writer goroutine is the real fix;
-	// add it when a slow client is actually observed stalling the fan-out.
-	if err := u.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
-		return err
+// privatePrefixes name the per-user channels: the engine's order and balance
+// events (engine/private.go) and the trades: fills SimulateTradeFill sends.
+var privatePrefixes = []string{"orders:", "balances:", "trades:"}
+
+// mayRead reports whether the connection may subscribe to channel. Public
+// market data is open to anyone; a private channel only to the user it
+// names, and only once a JWT has shown that is who this is. Otherwise any
+// page could follow any user's orders by guessing an id.
+func (u *User) mayRead(channel string) bool {
+	for _, prefix := range privatePrefixes {
+		if owner, ok := strings.CutPrefix(channel, prefix); ok {
+			return u.authenticated && owner == u.ID
+		}
 	}
-	return u.Conn.WriteMessage(websocket.TextMessage, data)
+	return true
+}
+
+// Emit queues a payload from channel for the browser, byte for byte. The
+// engine owns the stream schema; re-serializing it here through a local struct
+// silently dropped every field the two definitions did not share.
+//
+// It never blocks: it runs on the single pub/sub dispatch goroutine, where one
+// stalled write used to hold up market data for every other subscriber. A
+// client that falls sendQueueSize messages behind gets the stream's
+// SlowPolicy instead.
+func (u *User) Emit(channel string, data []byte) error {
+	return u.EmitPrepared(channel, data, nil)
+}
+
+// EmitPrepared is Emit with data already encoded as frame, for a message
+// many connections receive alike.
+func (u *User) EmitPrepared(channel string, data []byte, frame *websocket.PreparedMessage) error {
+	if !u.queue.push(channel, data, frame) {
+		log.Printf("User %s fell behind on %s, disconnecting", u.ID, channel)
+		return u.Conn.Close()
+	}
+	return nil
 }
 
 // Keepalive timings. A proxy in front of this service will drop an idle
@@ -85,7 +129,7 @@ const (
 
 func (u *User) addListeners() {
 	// WriteControl is safe to call concurrently with WriteMessage, so the ping
-	// ticker needs no lock against the broadcast goroutine's Emit.
+	// ticker needs no lock against the writer goroutine.
 	go func() {
 		ticker := time.NewTicker(pingPeriod)
 		defer ticker.Stop()
@@ -99,7 +143,11 @@ func (u *User) addListeners() {
 
 	go func() {
 		defer func() {
+			u.queue.close()
 			u.Conn.Close()
+			if n := u.queue.droppedCount(); n > 0 {
+				log.Printf("User %s had %d messages dropped for being slow", u.ID, n)
+			}
 			if u.onClose != nil {
 				u.onClose()
 			}
@@ -111,7 +159,7 @@ func (u *User) addListeners() {
 		})
 
 		for {
-			_, messageBytes, err := u.Conn.ReadMessage()
+			messageType, messageBytes, err := u.Conn.ReadMessage()
 			if err != nil {
 				log.Printf("User %s disconnected: %v", u.ID, err)
 				break
@@ -120,23 +168,12 @@ func (u *User) addListeners() {
 			u.Conn.SetReadDeadline(time.Now().Add(pongWait))
 			log.Printf("Received message from user %s: %s", u.ID, string(messageBytes))
 
-			var parsedMessage IncomingMessage
-			if err := json.Unmarshal(messageBytes, &parsedMessage); err != nil {
-				log.Printf("Error parsing message: %v", err)
+			request, err := decodeFrame(messageType, messageBytes)
+			if err != nil {
+				u.respondResult(ResultFrame{Error: &FrameError{Code: "INVALID_REQUEST", Msg: err.Error()}})
 				continue
 			}
-
-			switch parsedMessage.Method {
-			case SUBSCRIBE:
-				for _, s := range parsedMessage.Params {
-					SubscriptionManager.GetInstance().Subscribe(u.ID, s)
-				}
-			case UNSUBSCRIBE:
-				for _, s := range parsedMessage.Params {
-					SubscriptionManager.GetInstance().Unsubscribe(u.ID, s)
-				}
-			}
-			log.Printf("User %s sent message: %s", u.ID, parsedMessage.Method)
+			u.handleFrame(request)
 		}
 	}()
 }
@@ -0,0 +1,25 @@
+package ws
+
+import "testing"
+
+func TestOnlyTheSignedInUserReadsTheirPrivateStreams(t *testing.T) {
+	alice := &User{ID: "alice", authenticated: true}
+	anonymous := &User{ID: "alice"} // a made-up id that happens to match
+	for _, tc := range []struct {
+		user    *User
+		channel string
+		want    bool
+	}{
+		{alice, "depth@SOL_USD", true},
+		{alice, "orders:alice", true},
+		{alice, "balances:alice", true},
+		{alice, "orders:bob", false},
+		{anonymous, "orders:alice", false},
+		{anonymous, "ticker.SOL_USD", true},
+	} {
+		if got := tc.user.mayRead(tc.channel); got != tc.want {
+			t.Errorf("%s (signed in: %v) reading %s = %v, want %v",
+				tc.user.ID, tc.user.authenticated, tc.channel, got, tc.want)
+		}
+	}
+}
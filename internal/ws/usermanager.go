@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
@@ -36,10 +37,24 @@ func (um *UserManagerStruct) AddUser(conn *websocket.Conn, r *http.Request) *Use
 	} else {
 		id = um.getRandomID()
 	}
+	encoding, err := parseEncoding(r.URL.Query().Get("encoding"))
+	if err != nil {
+		log.Println("Refusing connection:", err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(time.Second))
+		conn.Close()
+		return nil
+	}
+	// A client that negotiated permessage-deflate can still turn it off for
+	// this connection, e.g. one on a fast link that would rather save CPU.
+	if r.URL.Query().Get("compress") == "false" {
+		conn.EnableWriteCompression(false)
+	}
+
 	// Cleanup is driven by the user's own read loop. A second goroutine reading
 	// the same connection races it for every frame, which tore the socket down
 	// and swallowed SUBSCRIBE messages.
-	user := NewUser(id, conn, func() { um.removeUser(id) })
+	user := NewUser(id, conn, tokenString != "", encoding, func() { um.removeUser(id) })
 
 	um.mutex.Lock()
 	um.users[id] = user